@@ -2,104 +2,108 @@
 A golang client implementation of a basic chat client
 Allows for users to send/recieve messages in different rooms
 
-Planned for the future:
-	-Message encryption
-	-Basic GUI
+Rooms created with /encrypt are end-to-end encrypted
 */
 
 package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"os/signal"
+	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/austin-mc/GoChat/Client/client"
 )
 
-//address for http requests
-const url = "http://localhost:8080"
-const socketURL = "ws://localhost:8080/chat/sockets/connect"
+// Time allowed for a single request to the server
+const requestTimeout = 10 * time.Second
 
-//Keeps track of userName/ID and last room the user was active in
-var userInfo User
-var lastActiveRoom string
+// Time allowed for uploading or downloading an attachment
+const transferTimeout = 5 * time.Minute
 
-type User struct {
-	Name   *string `json:"name"`
-	UserID *int    `json:"userID"`
-}
+// Connection to the chat server
+var chat *client.Client
 
-// Holds the data for a message
-type Message struct {
-	Sender      *string `json:"sender"`
-	Epoch       *int64  `json:"epoch"`
-	MessageText *string `json:"messageText"`
-	RoomName    *string `json:"roomName"`
-}
-
-// HTTP Response struct containing a slice of Message
-type Response struct {
-	Messages []Message `json:"messages"`
-}
-
-var done chan interface{}
-var interrupt chan os.Signal
-var wsconn *websocket.Conn
+//Keeps track of the last room the user was active in
+var lastActiveRoom string
 
-//Keeps track of the websocket connection status
-var isConnected bool
+// Called for every message received from the server, prints to the console unless the TUI is running
+var messageHandler = printMessage
 
-var activeRooms []Room
+func main() {
+	p, err := loadProfile(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	profile = p
 
-type Room struct {
-	roomName   string
-	lastUpdate int64 // Epoch of last update
-}
+	tlsConfig, err := clientTLSConfig(profile.TLS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chat, err = client.New(profile.URL, client.WithTLSConfig(tlsConfig), client.WithEncryption(profile.KeyDir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer chat.Close()
 
-func main() {
-	activeRooms = make([]Room, 0)
 	scanner := bufio.NewScanner(os.Stdin)
 
 	fmt.Println("Welcome to the golang chat app!")
+	fmt.Println("Connecting to", profile.URL)
 	printMenu()
-	fmt.Print("Please enter desired username: ")
-	scanner.Scan()
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+	name := profile.Username
+	if name == "" {
+		fmt.Print("Please enter desired username: ")
+		scanner.Scan()
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+		name = scanner.Text()
+	}
+	login(name, scanner)
+
+	// Connect for live messages, over a websocket if the network allows it. The client package
+	// falls back to server-sent events or long-polling, and reconnects if the connection drops.
+	chat.OnEvent(handleEvent)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	connectErr := chat.Connect(ctx)
+	cancel()
+	if connectErr != nil {
+		log.Println("Unable to connect for live messages, polling for them instead: ", connectErr)
 	}
-	name := scanner.Text()
-	postName(name, scanner)
 
-	// Upgrade to websocket connection
-	done = make(chan interface{})
-	interrupt = make(chan os.Signal)
-	signal.Notify(interrupt, os.Interrupt)
-	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s?user-id=%d", socketURL, *userInfo.UserID), nil)
-	wsconn = conn
-	if err != nil {
-		isConnected = false
-	} else {
-		isConnected = true
+	// Join the rooms listed in the profile
+	for _, room := range profile.Rooms {
+		cliJoinRoom(room)
 	}
 
-	defer conn.Close()
-	go recieveHandler()
+	if profile.TUI {
+		if err := runTUI(); err != nil {
+			log.Fatal(err)
+		}
+		quit()
+	}
+
+	// The TUI polls for itself
+	if connectErr != nil {
+		go updateMessages()
+	}
 
 	scanner.Scan()
 
 	for scanner.Text() != "/quit" {
-		if !isConnected {
-			updateMessages(&activeRooms)
-		}
 		cmd, msg := sanitizeInput(scanner.Text())
 		if err := scanner.Err(); err != nil {
 			log.Fatal(err)
@@ -108,9 +112,27 @@ func main() {
 		switch cmd {
 		case "err":
 		case "join":
-			joinRoom(msg)
+			cliJoinRoom(msg)
+		case "encrypt":
+			if err := encryptRoom(msg); err != nil {
+				fmt.Println("Error creating encrypted room:", err)
+			} else {
+				fmt.Println("Created and joined end-to-end encrypted room: ", msg)
+			}
+		case "trust":
+			if fingerprint, err := trustKey(msg); err != nil {
+				fmt.Println("Error trusting key:", err)
+			} else if msg == "" {
+				fmt.Println("Your key fingerprint: ", fingerprint)
+			} else {
+				fmt.Println("Now trusting the key of", msg, "with fingerprint: ", fingerprint)
+			}
 		case "leave":
-			leaveRoom(msg)
+			if err := leaveRoom(msg); err != nil {
+				fmt.Println("Error leaving room:", err)
+			} else {
+				fmt.Println("Successfully left room: ", msg)
+			}
 		case "help":
 			printMenu()
 		case "quit":
@@ -121,34 +143,149 @@ func main() {
 			printStatus()
 		case "active":
 			lastActiveRoom = msg
+		case "upload":
+			if err := uploadFile(lastActiveRoom, msg); err != nil {
+				fmt.Println("Error uploading file:", err)
+			}
+		case "download":
+			if path, err := downloadAttachment(msg); err != nil {
+				fmt.Println("Error downloading attachment:", err)
+			} else {
+				fmt.Println("Saved attachment to", path)
+			}
 		default:
-			postMessage(cmd, msg)
+			if err := postMessage(cmd, msg); err != nil {
+				fmt.Println("Error sending message:", err)
+			}
 		}
 		scanner.Scan()
 	}
 }
 
+// Returns a context for a single request to the server
+func requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), requestTimeout)
+}
+
+// Handles events from the connection to the server
+func handleEvent(ev client.Event) {
+	switch ev := ev.(type) {
+	case client.MessageEvent:
+		messageHandler(ev.Message)
+	case client.DisconnectedEvent:
+		log.Println("Lost connection to the server, reconnecting: ", ev.Err)
+	case client.ConnectedEvent:
+		if ev.Reconnect {
+			log.Println("Reconnected to the server over", ev.Transport)
+		} else if ev.Transport != client.TransportWebsocket {
+			log.Println("Websockets are unavailable, receiving messages over", ev.Transport)
+		}
+	}
+}
+
+// Joins a room and prints the result to the console
+func cliJoinRoom(roomName string) {
+	if err := joinRoom(roomName); err != nil {
+		fmt.Println("Error joining room:", err)
+		return
+	}
+	fmt.Println("Successfully joined room: ", roomName)
+}
+
 // Leaves all active rooms before quitting
 func quit() {
-	for _, v := range activeRooms {
-		leaveRoom(v.roomName)
+	for _, room := range chat.JoinedRooms() {
+		leaveRoom(room)
 	}
+	chat.Close()
 	os.Exit(0)
 }
 
-// Handles incomoing messages over the websocket connection
-func recieveHandler() {
-	defer close(done)
-	var msg Message
-	var err error
-	for {
-		err = wsconn.ReadJSON(&msg)
-		if err != nil {
-			log.Println("Error reading json: ", err)
+// Prints a message to the user's console
+func printMessage(msg client.Message) {
+	fmt.Println(formatMessage(msg))
+}
+
+// Formats a message as "[room] sender (time): text"
+func formatMessage(msg client.Message) string {
+	sent := msg.Time()
+	if sent.IsZero() {
+		sent = time.Now()
+	}
+	line := fmt.Sprintf("[%s] %s (%s): %s", msg.Room(), msg.SenderName(), sent.Format(time.RFC822), msg.Text())
+	if msg.Attachment != nil {
+		line += " " + describeAttachment(msg.Attachment)
+	}
+	return line
+}
+
+// Describes an attachment with the id needed to /download it
+func describeAttachment(att *client.Attachment) string {
+	return fmt.Sprintf("[attachment %s, %s, /download %s]", att.Name, formatSize(att.Size), att.ID)
+}
+
+// Formats a byte count as B, KB or MB
+func formatSize(n int64) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// Uploads a file and posts it to the room with its name as the text
+func uploadFile(room, path string) error {
+	if path == "" {
+		return errors.New("usage: /upload <path>")
+	}
+	if room == "" {
+		return errors.New("join a room before uploading")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+	att, err := chat.UploadFile(ctx, path)
+	if err != nil {
+		return err
+	}
+	return chat.PostAttachment(ctx, room, att.Name, att)
+}
+
+// Saves an attachment in the current directory under the name it was uploaded with, without
+// overwriting existing files. Returns the path it was saved to.
+func downloadAttachment(id string) (string, error) {
+	if id == "" {
+		return "", errors.New("usage: /download <id>")
+	}
+	tmp, err := os.CreateTemp(".", ".gochat-download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+	name, err := chat.Download(ctx, id, tmp)
+	if err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if name == "" || name == "." || name == "/" {
+		name = id
+	}
+	path := name
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
 		}
-		// Print the message to the user's console
-		fmt.Printf("[%s] %s (%s): %s\n", *msg.RoomName, *msg.Sender, time.Now().Format(time.RFC822), *msg.MessageText)
+		ext := filepath.Ext(name)
+		path = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
 	}
+	return path, os.Rename(tmp.Name(), path)
 }
 
 // Takes user input and splits it into a command and the text after the command
@@ -171,169 +308,164 @@ func sanitizeInput(userIn string) (string, string) {
 }
 
 // Posts a new message to the server using websockets if available, otherwise http
-func postMessage(room string, message string) {
+func postMessage(room string, message string) error {
 	if room == "" {
 		room = lastActiveRoom
 	}
-	postURL := url + "/chat/postmsg/"
+	ctx, cancel := requestContext()
+	defer cancel()
+	return chat.PostMessage(ctx, room, message)
+}
 
-	msg := Message{
-		Sender:      userInfo.Name,
-		MessageText: &message,
-		RoomName:    &room,
+// Joins a room and makes it the active room
+func joinRoom(roomName string) error {
+	ctx, cancel := requestContext()
+	defer cancel()
+	if err := chat.JoinRoom(ctx, roomName); err != nil {
+		return err
 	}
-	err := wsconn.WriteJSON(msg)
-	if err == nil {
-		//Sent over WS, don't need to send over HTTP
-		return
-	}
-	json, err := json.Marshal(msg)
-	if err != nil {
-		log.Fatal(err)
+	lastActiveRoom = roomName
+	return nil
+}
+
+// Creates an end-to-end encrypted room and joins it
+func encryptRoom(roomName string) error {
+	if roomName == "" {
+		return errors.New("usage: /encrypt <room>")
 	}
-	_, err = http.Post(postURL, "application/json", bytes.NewBuffer(json))
+	ctx, cancel := requestContext()
+	err := chat.CreateEncryptedRoom(ctx, roomName)
+	cancel()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return joinRoom(roomName)
 }
 
-// Sends an HTTP POST request for the user to join a room
-func joinRoom(roomName string) {
-	postURL := url + "/chat/room/join"
-	client := http.Client{}
-	req, err := http.NewRequest("POST", postURL, nil)
-	if err != nil {
-		log.Println("Error joining room: ", roomName)
-		return
-	}
-	req.Header.Set("User-Name", *userInfo.Name)
-	req.Header.Set("Room-Name", roomName)
-	res, err := client.Do(req)
-	if err != nil || res.StatusCode == http.StatusBadRequest {
-		log.Println("Error joining room: ", roomName)
-		return
-	} else {
-		fmt.Println("Successfully joined room: ", roomName)
+// Pins the keys a user publishes now, after they changed, and returns their fingerprint to check
+// with the user. With no user, returns the fingerprint of this user's own keys.
+func trustKey(user string) (string, error) {
+	if user == "" {
+		return chat.Fingerprint()
 	}
-	lastActiveRoom = roomName
-	room := Room{
-		roomName:   roomName,
-		lastUpdate: time.Now().Unix() - 3600,
-	}
-	activeRooms = append(activeRooms, room)
+	ctx, cancel := requestContext()
+	defer cancel()
+	return chat.TrustKey(ctx, user)
 }
 
-// Sends an HTTP DELETE request to remove the user from the room
-func leaveRoom(roomName string) {
-	postURL := url + "/chat/room/leave"
-	client := http.Client{}
-	req, err := http.NewRequest("DELETE", postURL, nil)
-	if err != nil {
-		log.Println("Error joining room: ", roomName)
-	}
-	req.Header.Set("User-Name", *userInfo.Name)
-	req.Header.Set("Room-Name", roomName)
-	res, err := client.Do(req)
-	if err != nil || res.StatusCode == http.StatusBadRequest {
-		log.Println("Error leaving room: ", roomName)
-	} else {
-		fmt.Println("Successfully left room: ", roomName)
-	}
-	lastActiveRoom = roomName
+// Removes the user from the room
+func leaveRoom(roomName string) error {
+	ctx, cancel := requestContext()
+	defer cancel()
+	return chat.LeaveRoom(ctx, roomName)
 }
 
-// Goroutine to get and print messages from all active rooms
-func updateMessages(activeRooms *[]Room) {
-	//Loop indefinitely through the rooms to get updates
+// Goroutine to get and print messages from all active rooms when the client couldn't connect
+// for live messages. The first poll of a room starts an hour back.
+func updateMessages() {
+	// Epoch of the last poll for each room
+	lastUpdate := make(map[string]int64)
 	for {
-		for i := 0; i < len(*activeRooms); i++ {
-			room := (*activeRooms)[i]
-			requestURL := url + "/chat/room/" + room.roomName + "?message-start-time=" + fmt.Sprintf("%d", room.lastUpdate)
-			room.lastUpdate = time.Now().Unix()
-			getMessages(requestURL)
+		for _, room := range chat.JoinedRooms() {
+			since, ok := lastUpdate[room]
+			if !ok {
+				since = time.Now().Unix() - 3600
+			}
+			lastUpdate[room] = time.Now().Unix()
+			getMessages(room, since)
 		}
-		// Wait 10 seconds between requests
 		time.Sleep(5 * time.Second)
 	}
 }
 
-// Get messages in a room and print to console
-// Format url as /chat/room/{roomName} with optional query param ?message-start-time={epoch}
-func getMessages(url string) {
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Fatal(err)
-	}
-	body, err := ioutil.ReadAll(resp.Body)
+// Get messages in a room sent at or after the given epoch and print to console
+func getMessages(room string, since int64) {
+	ctx, cancel := requestContext()
+	defer cancel()
+	messages, err := chat.Messages(ctx, room, time.Unix(since, 0))
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("Error getting messages:", err)
+		return
 	}
-
-	var res Response
-	// Make empty slice to unmarshall the JSON into
-	json.Unmarshal(body, &res)
-	messages := res.Messages
-
 	for _, msg := range messages {
-		fmt.Printf("[%s] %s (%s): %s\n", *msg.RoomName, *msg.Sender, time.Unix(*msg.Epoch, 0).Format(time.RFC822), *msg.MessageText)
+		printMessage(msg)
 	}
 }
 
-// Makes a GET request on /status and prints the result
+// Prints the server's liveness and readiness checks
 func printStatus() {
-	resp, err := http.Get(url + "/status")
+	ctx, cancel := requestContext()
+	defer cancel()
+	lines, err := serverStatus(ctx)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("Error getting server status:", err)
+		return
 	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	for _, line := range lines {
+		fmt.Println(line)
 	}
-
-	fmt.Println(string(body))
 }
 
-//Creates a new user in the database and the json response with name and userID is stored in the userInfo struct
-func postName(name string, scanner *bufio.Scanner) {
-	if name == "" {
-		name = "default"
+// Fetches the server's liveness and readiness and formats them for /status. Servers without the
+// health endpoints only have the /status text.
+func serverStatus(ctx context.Context) ([]string, error) {
+	live, err := chat.Live(ctx)
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		status, err := chat.Status(ctx)
+		return []string{status}, err
 	}
-
-	user := User{
-		Name: &name,
-	}
-
-	jsonMsg, err := json.Marshal(user)
 	if err != nil {
-		log.Println("Error creating username: ", err)
-		fmt.Print("Please enter a new username: ")
-		scanner.Scan()
-		postName(scanner.Text(), scanner)
+		return nil, err
 	}
-	postURL := url + "/chat/user/new"
-	client := http.Client{}
-	req, err := http.NewRequest("POST", postURL, bytes.NewBuffer(jsonMsg))
+	ready, err := chat.Ready(ctx)
 	if err != nil {
-		log.Println("Error creating username: ", err)
-		fmt.Print("Please enter a new username: ")
-		scanner.Scan()
-		postName(scanner.Text(), scanner)
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Error creating username: ", err)
-		fmt.Print("Please enter a new username: ")
-		scanner.Scan()
-		postName(scanner.Text(), scanner)
+
+	state := func(h *client.Health, ok, fail string) string {
+		if h.OK() {
+			return ok
+		}
+		return strings.ToUpper(fail)
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	lines := []string{fmt.Sprintf("Server is %s and %s (up %s, schema version %d)",
+		state(live, "live", "not live"), state(ready, "ready", "not ready"), ready.Uptime, ready.SchemaVersion)}
+	// Readiness runs the liveness checks too
+	for _, check := range ready.Checks {
+		status := "ok"
+		if check.Status != "ok" {
+			status = "FAIL"
+		}
+		lines = append(lines, fmt.Sprintf("  %-4s  %-16s %s (%s)", status, check.Name, check.Detail, check.Duration))
+	}
+	if hub := ready.Hub; hub != nil {
+		lines = append(lines, fmt.Sprintf("  %d connections, %d members in %d rooms, %d queued messages, %d webhook workers, %d goroutines",
+			hub.Connections, hub.RoomMembers, hub.ActiveRooms, hub.QueuedMessages, hub.WebhookWorkers, hub.Goroutines))
+	}
+	return lines, nil
+}
+
+// Logs in as the given user, creating it if it doesn't exist, and asks for another name on failure
+func login(name string, scanner *bufio.Scanner) {
+	for {
+		if name == "" {
+			name = "default"
+		}
+		ctx, cancel := requestContext()
+		user, err := chat.Login(ctx, name)
+		cancel()
+		if err == nil {
+			fmt.Printf("Logged in as user: %s\n", *user.Name)
+			return
+		}
+		fmt.Println("Error logging in:", err)
+		fmt.Print("Please enter a new username: ")
+		if !scanner.Scan() {
+			os.Exit(1)
+		}
+		name = scanner.Text()
 	}
-	json.Unmarshal(body, &userInfo)
-	fmt.Printf("Successfully created user: %s\n", *userInfo.Name)
 }
 
 // Prints the instructiosn for the user
@@ -345,4 +477,8 @@ func printMenu() {
 	fmt.Println(">5. Type \"/help\" at any time to view these instructions.")
 	fmt.Println(">6. Type \"/status\" to see the server status.")
 	fmt.Println(">6. Type \"/active\" to change the active room.")
+	fmt.Println(">7. Type \"/upload\" and a file path to send a file to the active room, and \"/download\" and an attachment id to save one.")
+	fmt.Println(">8. Type \"/encrypt\" and a room name to create and join an end-to-end encrypted room.")
+	fmt.Println(">9. Type \"/trust\" to see your key fingerprint, or \"/trust\" and a user name to accept their new key once you have checked its fingerprint with them.")
+	fmt.Println(">10. Start with \"--tui\" for the full-screen interface.")
 }
@@ -0,0 +1,60 @@
+package bot
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// Returned by ParseArgs when a quote is opened but never closed
+var ErrUnterminatedQuote = errors.New("bot: unterminated quote")
+
+// Splits a command line into arguments the way a shell would: arguments are separated by
+// whitespace, "double" or 'single' quotes group words, and a backslash escapes the next character
+// outside single quotes.
+func ParseArgs(line string) ([]string, error) {
+	args := make([]string, 0)
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, ErrUnterminatedQuote
+	}
+	if escaped {
+		current.WriteRune('\\')
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,41 @@
+package bot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"   ", []string{}},
+		{"one two  three", []string{"one", "two", "three"}},
+		{`"one two" three`, []string{"one two", "three"}},
+		{`'it''s' x`, []string{"its", "x"}},
+		{`"say \"hi\""`, []string{`say "hi"`}},
+		{`'no \escape'`, []string{`no \escape`}},
+		{`one\ two`, []string{"one two"}},
+		{`a""b`, []string{"ab"}},
+		{`""`, []string{""}},
+		{`trailing\`, []string{`trailing\`}},
+		{"tab\tand\nnewline", []string{"tab", "and", "newline"}},
+	} {
+		got, err := ParseArgs(tc.line)
+		if err != nil {
+			t.Errorf("ParseArgs(%q): %v", tc.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseArgs(%q) = %q, want %q", tc.line, got, tc.want)
+		}
+	}
+
+	for _, line := range []string{`"open`, `'open`, `one "two`} {
+		if _, err := ParseArgs(line); err != ErrUnterminatedQuote {
+			t.Errorf("ParseArgs(%q) error = %v, want ErrUnterminatedQuote", line, err)
+		}
+	}
+}
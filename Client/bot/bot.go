@@ -0,0 +1,343 @@
+/*
+Package bot is a runtime for GoChat bots built on the client package.
+
+Bots register handlers for "!command" messages. The bot parses the arguments, checks the room,
+permissions and rate limit for the command, then runs the handler in its own goroutine:
+
+	b := bot.New(c, "echobot", bot.WithRooms("lobby"))
+	b.Handle("echo", func(ctx *bot.Context) error {
+		return ctx.Reply(strings.Join(ctx.Args, " "))
+	}, bot.Description("Repeats the arguments"), bot.Args(1, -1), bot.RateLimit(5, time.Minute))
+	err := b.Run(ctx)
+
+Run logs in, connects and joins the rooms, retrying until the server is reachable, and the client
+reconnects and rejoins the rooms if the connection drops later.
+*/
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/austin-mc/GoChat/Client/client"
+)
+
+// Reported to the error handler when the sender fails a permission check
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Reported to the error handler when the sender has used a command too often
+var ErrRateLimited = errors.New("rate limited")
+
+// A chat bot that answers commands in the rooms it has joined
+type Bot struct {
+	client         *client.Client
+	name           string
+	prefix         string
+	rooms          []string
+	logger         *log.Logger
+	errorHandler   func(*Context, error)
+	handlerTimeout time.Duration
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+
+	mu       sync.RWMutex
+	commands map[string]*Command
+	ready    chan struct{}
+	handlers sync.WaitGroup
+}
+
+// Configures a Bot
+type Option func(*Bot)
+
+// Sets the prefix commands start with. The default is "!".
+func WithPrefix(prefix string) Option {
+	return func(b *Bot) {
+		b.prefix = prefix
+	}
+}
+
+// Sets the rooms the bot joins when it starts
+func WithRooms(rooms ...string) Option {
+	return func(b *Bot) {
+		b.rooms = append(b.rooms, rooms...)
+	}
+}
+
+// Sets the logger for connection changes and handler failures. The default is log.Default().
+func WithLogger(l *log.Logger) Option {
+	return func(b *Bot) {
+		b.logger = l
+	}
+}
+
+// Sets the function called when a command fails, including permission and rate limit failures.
+// The default replies to the room with the error.
+func WithErrorHandler(h func(ctx *Context, err error)) Option {
+	return func(b *Bot) {
+		b.errorHandler = h
+	}
+}
+
+// Sets how long a handler's context lasts. The default is 30 seconds.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(b *Bot) {
+		b.handlerTimeout = d
+	}
+}
+
+// Sets the delays between attempts to reach the server when the bot starts
+func WithStartBackoff(min, max time.Duration) Option {
+	return func(b *Bot) {
+		b.minBackoff = min
+		b.maxBackoff = max
+	}
+}
+
+// Creates a bot that logs in as name using the client. The bot owns the client and closes it when
+// Run returns. A "help" command listing the other commands is registered by default and can be
+// replaced with Handle.
+func New(c *client.Client, name string, opts ...Option) *Bot {
+	b := &Bot{
+		client:         c,
+		name:           name,
+		prefix:         "!",
+		logger:         log.Default(),
+		handlerTimeout: 30 * time.Second,
+		minBackoff:     time.Second,
+		maxBackoff:     30 * time.Second,
+		commands:       make(map[string]*Command),
+		ready:          make(chan struct{}),
+	}
+	b.errorHandler = replyError
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.Handle("help", helpHandler, Description("Lists the commands"), Args(0, 0))
+	return b
+}
+
+// Registers a handler for a command, replacing any existing command with the same name.
+// Command names are case insensitive.
+func (b *Bot) Handle(name string, handler HandlerFunc, opts ...CommandOption) {
+	cmd := &Command{
+		Name:    strings.ToLower(name),
+		Handler: handler,
+		prefix:  b.prefix,
+		maxArgs: -1,
+	}
+	for _, opt := range opts {
+		opt(cmd)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.commands[cmd.Name] = cmd
+}
+
+// Returns the registered commands sorted by name
+func (b *Bot) Commands() []*Command {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	cmds := make([]*Command, 0, len(b.commands))
+	for _, cmd := range b.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// Returns the bot's user name
+func (b *Bot) Name() string {
+	return b.name
+}
+
+// Returns the client the bot uses
+func (b *Bot) Client() *client.Client {
+	return b.client
+}
+
+// Returns a channel that is closed once the bot has connected and joined its rooms
+func (b *Bot) Ready() <-chan struct{} {
+	return b.ready
+}
+
+// Posts a message to a room
+func (b *Bot) Say(ctx context.Context, room, text string) error {
+	return b.client.PostMessage(ctx, room, text)
+}
+
+// Logs in, connects, joins the rooms and answers commands until ctx is cancelled. Running handlers
+// are waited for and the client is closed before it returns. Returns nil when ctx is cancelled.
+func (b *Bot) Run(ctx context.Context) error {
+	defer b.client.Close()
+	events := b.client.Events()
+
+	err := b.retry(ctx, "log in", func(ctx context.Context) error {
+		_, err := b.client.Login(ctx, b.name)
+		return err
+	})
+	if err == nil {
+		err = b.retry(ctx, "connect", b.client.Connect)
+	}
+	for _, room := range b.rooms {
+		if err != nil {
+			break
+		}
+		room := room
+		err = b.retry(ctx, "join "+room, func(ctx context.Context) error {
+			return b.client.JoinRoom(ctx, room)
+		})
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	close(b.ready)
+
+	defer b.handlers.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-events:
+			if !ok {
+				return client.ErrClosed
+			}
+			b.handleEvent(ctx, ev)
+		}
+	}
+}
+
+// Calls fn until it succeeds, backing off between attempts. Errors returned by the server are not
+// retried since trying again won't change the answer.
+func (b *Bot) retry(ctx context.Context, what string, fn func(context.Context) error) error {
+	delay := b.minBackoff
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		err := fn(attemptCtx)
+		cancel()
+		var apiErr *client.APIError
+		if err == nil || errors.As(err, &apiErr) {
+			return err
+		}
+		b.logger.Printf("bot %s: unable to %s, retrying in %v: %v", b.name, what, delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > b.maxBackoff {
+			delay = b.maxBackoff
+		}
+	}
+}
+
+// Handles an event from the client
+func (b *Bot) handleEvent(ctx context.Context, ev client.Event) {
+	switch ev := ev.(type) {
+	case client.MessageEvent:
+		b.dispatch(ctx, ev.Message)
+	case client.DisconnectedEvent:
+		b.logger.Printf("bot %s: lost connection to the server: %v", b.name, ev.Err)
+	case client.ConnectedEvent:
+		if ev.Reconnect {
+			b.logger.Printf("bot %s: reconnected to the server", b.name)
+		}
+	}
+}
+
+// Runs the command in the message, if there is one
+func (b *Bot) dispatch(ctx context.Context, msg client.Message) {
+	if msg.SenderName() == b.name {
+		return
+	}
+	text := strings.TrimSpace(msg.Text())
+	if !strings.HasPrefix(text, b.prefix) {
+		return
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(text, b.prefix), " ")
+	b.mu.RLock()
+	cmd, ok := b.commands[strings.ToLower(name)]
+	b.mu.RUnlock()
+	// Unknown commands are ignored since other bots in the room may share the prefix
+	if !ok || !cmd.inRoom(msg.Room()) {
+		return
+	}
+
+	b.handlers.Add(1)
+	go func() {
+		defer b.handlers.Done()
+		handlerCtx, cancel := context.WithTimeout(ctx, b.handlerTimeout)
+		defer cancel()
+		c := &Context{
+			Context: handlerCtx,
+			Bot:     b,
+			Message: msg,
+			Command: cmd,
+			RawArgs: strings.TrimSpace(rest),
+		}
+		if err := b.run(c); err != nil {
+			b.errorHandler(c, err)
+		}
+	}()
+}
+
+// Checks the command's restrictions and runs its handler
+func (b *Bot) run(c *Context) (err error) {
+	cmd := c.Command
+	if !cmd.permitted(c) {
+		return fmt.Errorf("%w: %s may not use %s%s", ErrPermissionDenied, c.Sender(), cmd.prefix, cmd.Name)
+	}
+	args, err := ParseArgs(c.RawArgs)
+	if err != nil {
+		return err
+	}
+	if err := cmd.checkArgs(args); err != nil {
+		return err
+	}
+	c.Args = args
+	if cmd.limiter != nil {
+		if ok, wait := cmd.limiter.allow(c.Sender()); !ok {
+			return fmt.Errorf("%w: try %s%s again in %v", ErrRateLimited, cmd.prefix, cmd.Name, wait.Round(time.Second))
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			b.logger.Printf("bot %s: %s%s panicked: %v", b.name, cmd.prefix, cmd.Name, r)
+			err = fmt.Errorf("%s%s failed", cmd.prefix, cmd.Name)
+		}
+	}()
+	return cmd.Handler(c)
+}
+
+// The default error handler, replies to the room with the error
+func replyError(c *Context, err error) {
+	if replyErr := c.Reply("Error: " + err.Error()); replyErr != nil {
+		c.Bot.logger.Printf("bot %s: unable to report error %q: %v", c.Bot.name, err, replyErr)
+	}
+}
+
+// Lists the commands the sender can use in the room
+func helpHandler(c *Context) error {
+	lines := []string{"Commands:"}
+	for _, cmd := range c.Bot.Commands() {
+		if !cmd.inRoom(c.Room()) || !cmd.permitted(c) {
+			continue
+		}
+		line := cmd.synopsis()
+		if cmd.Description != "" {
+			line += " - " + cmd.Description
+		}
+		lines = append(lines, line)
+	}
+	return c.Reply(strings.Join(lines, "\n"))
+}
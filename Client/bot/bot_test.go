@@ -0,0 +1,244 @@
+package bot_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/austin-mc/GoChat/Client/bot"
+	"github.com/austin-mc/GoChat/Client/bot/bottest"
+	"github.com/austin-mc/GoChat/Client/client"
+)
+
+const botName = "testbot"
+
+// Starts a bot in lobby and ops against a fresh in-memory server, stopping both when the test ends
+func startBot(t *testing.T, register func(b *bot.Bot), opts ...client.Option) *bottest.Server {
+	t.Helper()
+	srv := bottest.NewServer()
+	t.Cleanup(srv.Close)
+	b := bot.New(srv.NewClient(opts...), botName,
+		bot.WithRooms("lobby", "ops"),
+		bot.WithLogger(log.New(io.Discard, "", 0)),
+		bot.WithStartBackoff(10*time.Millisecond, 100*time.Millisecond))
+	b.Handle("echo", func(ctx *bot.Context) error {
+		return ctx.Reply(strings.Join(ctx.Args, " "))
+	}, bot.Usage("<text>"), bot.Args(1, -1))
+	if register != nil {
+		register(b)
+	}
+	stop, err := srv.Start(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := stop(); err != nil {
+			t.Errorf("Run: %v", err)
+		}
+	})
+	return srv
+}
+
+// Says text in the room as the sender and returns the bot's next reply there
+func ask(t *testing.T, srv *bottest.Server, room, sender, text string) string {
+	t.Helper()
+	fromBot := bottest.FromIn(botName, room)
+	before := 0
+	for _, msg := range srv.Messages(room) {
+		if fromBot(msg) {
+			before++
+		}
+	}
+	srv.Say(room, sender, text)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// WaitFor goes through every message posted, so skip the replies already there
+	replies := 0
+	msg, err := srv.WaitFor(ctx, func(msg client.Message) bool {
+		if !fromBot(msg) {
+			return false
+		}
+		replies++
+		return replies > before
+	})
+	if err != nil {
+		t.Fatalf("no reply to %q in %s: %v", text, room, err)
+	}
+	return msg.Text()
+}
+
+func TestRouting(t *testing.T) {
+	srv := startBot(t, nil)
+	if got := ask(t, srv, "lobby", "alice", "!echo hello world"); got != "hello world" {
+		t.Errorf("!echo reply = %q, want %q", got, "hello world")
+	}
+	if got := ask(t, srv, "lobby", "alice", "  !ECHO shouting  "); got != "shouting" {
+		t.Errorf("!ECHO reply = %q, want %q", got, "shouting")
+	}
+
+	// Plain text, unknown commands and the wrong prefix get no reply, so the next reply is to !echo
+	srv.Say("lobby", "alice", "just chatting")
+	srv.Say("lobby", "alice", "!unknown")
+	srv.Say("lobby", "alice", "?echo wrong prefix")
+	if got := ask(t, srv, "lobby", "alice", "!echo after"); got != "after" {
+		t.Errorf("reply after ignored messages = %q, want %q", got, "after")
+	}
+}
+
+func TestArgs(t *testing.T) {
+	srv := startBot(t, func(b *bot.Bot) {
+		b.Handle("pair", func(ctx *bot.Context) error {
+			return ctx.Replyf("%s|%s", ctx.Args[0], ctx.Args[1])
+		}, bot.Usage("<a> <b>"), bot.Args(2, 2))
+	})
+	for _, tc := range []struct {
+		text, want string
+	}{
+		{`!pair one two`, "one|two"},
+		{`!pair "one two" 'three four'`, "one two|three four"},
+		{`!pair one\ two three`, "one two|three"},
+		{`!pair one`, "Error: usage: !pair <a> <b>"},
+		{`!pair one two three`, "Error: usage: !pair <a> <b>"},
+		{`!pair "one two`, "Error: " + bot.ErrUnterminatedQuote.Error()},
+		{`!echo`, "Error: usage: !echo <text>"},
+	} {
+		if got := ask(t, srv, "lobby", "alice", tc.text); got != tc.want {
+			t.Errorf("%s: reply = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	srv := startBot(t, func(b *bot.Bot) {
+		b.Handle("admin", func(ctx *bot.Context) error {
+			return ctx.Reply("done")
+		}, bot.Description("Admins only"), bot.Require(bot.AllowUsers("alice")))
+		b.Handle("mute", func(ctx *bot.Context) error {
+			return ctx.Reply("muted")
+		}, bot.Require(bot.DenyUsers("mallory")))
+	})
+	if got := ask(t, srv, "lobby", "alice", "!admin"); got != "done" {
+		t.Errorf("alice !admin = %q, want %q", got, "done")
+	}
+	if got := ask(t, srv, "lobby", "bob", "!admin"); got != "Error: permission denied: bob may not use !admin" {
+		t.Errorf("bob !admin = %q", got)
+	}
+	if got := ask(t, srv, "lobby", "bob", "!mute"); got != "muted" {
+		t.Errorf("bob !mute = %q, want %q", got, "muted")
+	}
+	if got := ask(t, srv, "lobby", "mallory", "!mute"); !strings.HasPrefix(got, "Error: permission denied") {
+		t.Errorf("mallory !mute = %q, want a permission error", got)
+	}
+
+	// Help only lists what the sender may run
+	if got := ask(t, srv, "lobby", "alice", "!help"); !strings.Contains(got, "!admin - Admins only") {
+		t.Errorf("alice !help = %q, want it to list !admin", got)
+	}
+	if got := ask(t, srv, "lobby", "bob", "!help"); strings.Contains(got, "!admin") {
+		t.Errorf("bob !help = %q, want it to leave out !admin", got)
+	}
+}
+
+func TestRoomScoping(t *testing.T) {
+	srv := startBot(t, func(b *bot.Bot) {
+		b.Handle("deploy", func(ctx *bot.Context) error {
+			return ctx.Reply("deploying from " + ctx.Room())
+		}, bot.InRooms("ops"))
+	})
+	if got := ask(t, srv, "ops", "alice", "!deploy"); got != "deploying from ops" {
+		t.Errorf("!deploy in ops = %q", got)
+	}
+	// Ignored outside ops, so the next reply in lobby is to !echo
+	srv.Say("lobby", "alice", "!deploy")
+	if got := ask(t, srv, "lobby", "alice", "!echo still here"); got != "still here" {
+		t.Errorf("reply in lobby = %q, want %q", got, "still here")
+	}
+	if got := ask(t, srv, "lobby", "alice", "!help"); strings.Contains(got, "!deploy") {
+		t.Errorf("!help in lobby = %q, want it to leave out !deploy", got)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	srv := startBot(t, func(b *bot.Bot) {
+		b.Handle("ping", func(ctx *bot.Context) error {
+			return ctx.Reply("pong")
+		}, bot.RateLimit(2, time.Hour))
+	})
+	for i := 0; i < 2; i++ {
+		if got := ask(t, srv, "lobby", "alice", "!ping"); got != "pong" {
+			t.Fatalf("!ping %d = %q, want pong", i+1, got)
+		}
+	}
+	if got := ask(t, srv, "lobby", "alice", "!ping"); !strings.HasPrefix(got, "Error: rate limited: try !ping again in") {
+		t.Errorf("third !ping = %q, want a rate limit error", got)
+	}
+	// Each sender has their own limit
+	if got := ask(t, srv, "lobby", "bob", "!ping"); got != "pong" {
+		t.Errorf("bob !ping = %q, want pong", got)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	srv := startBot(t, func(b *bot.Bot) {
+		b.Handle("fail", func(ctx *bot.Context) error {
+			return errors.New("it broke")
+		})
+		b.Handle("boom", func(ctx *bot.Context) error {
+			panic("boom")
+		})
+	})
+	if got := ask(t, srv, "lobby", "alice", "!fail"); got != "Error: it broke" {
+		t.Errorf("!fail = %q", got)
+	}
+	if got := ask(t, srv, "lobby", "alice", "!boom"); got != "Error: !boom failed" {
+		t.Errorf("!boom = %q", got)
+	}
+	// The bot keeps answering after a panic
+	if got := ask(t, srv, "lobby", "alice", "!echo ok"); got != "ok" {
+		t.Errorf("!echo after a panic = %q", got)
+	}
+}
+
+// The bot answers over every transport and encoding, and again after the server drops the
+// connection
+func TestReconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		transport client.Transport
+		encoding  client.Encoding
+	}{
+		{"websocket json", client.TransportWebsocket, client.EncodingJSON},
+		{"websocket msgpack", client.TransportWebsocket, client.EncodingMsgpack},
+		{"websocket protobuf", client.TransportWebsocket, client.EncodingProtobuf},
+		{"sse", client.TransportSSE, client.EncodingJSON},
+		{"longpoll", client.TransportLongPoll, client.EncodingJSON},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := startBot(t, nil, client.WithTransports(tc.transport), client.WithEncoding(tc.encoding))
+			if got := srv.Transport(botName); got != tc.transport {
+				t.Fatalf("connected over %q, want %q", got, tc.transport)
+			}
+			if got := ask(t, srv, "lobby", "alice", "!echo before"); got != "before" {
+				t.Fatalf("reply before the drop = %q", got)
+			}
+
+			for i := 0; i < 2; i++ {
+				srv.DisconnectAll()
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				err := srv.WaitConnected(ctx, botName)
+				cancel()
+				if err != nil {
+					t.Fatalf("bot didn't reconnect: %v", err)
+				}
+				if got := ask(t, srv, "ops", "alice", "!echo after"); got != "after" {
+					t.Fatalf("reply after drop %d = %q", i+1, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,874 @@
+/*
+Package bottest runs bots against an in-process GoChat server.
+
+The server implements the same REST API and event transports as the real one, keeping users,
+rooms and messages in memory, so bots can be exercised without a database or network. Events are
+delivered over websockets in any of the encodings, server-sent event streams or long-polls:
+
+	srv := bottest.NewServer()
+	defer srv.Close()
+	b := bot.New(srv.NewClient(), "echobot", bot.WithRooms("lobby"))
+	stop, err := srv.Start(b)
+	...
+	srv.Say("lobby", "alice", "!echo hi")
+	msg, err := srv.WaitFor(ctx, bottest.From("echobot"))
+*/
+package bottest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/austin-mc/GoChat/Client/bot"
+	"github.com/austin-mc/GoChat/Client/client"
+	"github.com/gorilla/websocket"
+)
+
+// An in-memory chat server listening on a local port
+type Server struct {
+	// Base URL of the server, e.g. "http://127.0.0.1:54321"
+	URL string
+
+	srv      *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	users    map[string]int
+	names    map[int]string
+	rooms    map[string]*room
+	conns    map[string]subscriber
+	sessions map[string]*pollSession
+	messages []client.Message
+	// Closed and replaced whenever a message is posted, to wake up WaitFor
+	posted chan struct{}
+}
+
+type room struct {
+	members  []string
+	messages []client.Message
+}
+
+// Websocket subprotocols selecting a binary encoding, as offered by the real server
+var subprotocols = map[string]client.Encoding{
+	"gochat.v1.protobuf": client.EncodingProtobuf,
+	"gochat.v1.msgpack":  client.EncodingMsgpack,
+}
+
+// Error codes of the real server that the client package has no constant for
+const (
+	codeNotFound = "not_found"
+	codeInternal = "internal_error"
+)
+
+// How long a long-poll waits for messages when the client doesn't say
+const defaultPollWait = 25 * time.Second
+
+// A connection receiving a user's room events, over any transport
+type subscriber interface {
+	// Name of the transport, as Transport reports it
+	transport() client.Transport
+	send(msg client.Message) error
+	// Drops the connection without a close event, as a server restart would
+	drop()
+}
+
+// A websocket connection with its writes serialised
+type socket struct {
+	conn     *websocket.Conn
+	encoding client.Encoding
+	mu       sync.Mutex
+}
+
+func (s *socket) transport() client.Transport {
+	return client.TransportWebsocket
+}
+
+func (s *socket) send(msg client.Message) error {
+	data, err := s.encoding.Encode(msg)
+	if err != nil {
+		return err
+	}
+	frameType := websocket.TextMessage
+	if s.encoding != client.EncodingJSON {
+		frameType = websocket.BinaryMessage
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return s.conn.WriteMessage(frameType, data)
+}
+
+func (s *socket) drop() {
+	s.conn.Close()
+}
+
+// Reads the next message posted over the websocket. Text frames are always JSON.
+func (s *socket) read() (client.Message, error) {
+	frameType, data, err := s.conn.ReadMessage()
+	if err != nil {
+		return client.Message{}, err
+	}
+	if frameType == websocket.TextMessage {
+		return client.EncodingJSON.Decode(data)
+	}
+	return s.encoding.Decode(data)
+}
+
+// A server-sent event stream. Messages are queued for the handler writing the stream.
+type eventStream struct {
+	queue    chan client.Message
+	done     chan struct{}
+	dropOnce sync.Once
+}
+
+func (s *eventStream) transport() client.Transport {
+	return client.TransportSSE
+}
+
+func (s *eventStream) send(msg client.Message) error {
+	select {
+	case s.queue <- msg:
+		return nil
+	default:
+		// Too slow to keep up
+		s.drop()
+		return fmt.Errorf("bottest: event stream queue full")
+	}
+}
+
+func (s *eventStream) drop() {
+	s.dropOnce.Do(func() { close(s.done) })
+}
+
+// A long-poll session, holding the messages queued between polls
+type pollSession struct {
+	id     string
+	userID int
+
+	mu     sync.Mutex
+	queue  []client.Message
+	ended  bool
+	notify chan struct{}
+	// The last batch sent and its cursor. Polls get the batch again until one acknowledges it.
+	cursor  int64
+	unacked []client.Message
+}
+
+func (s *pollSession) transport() client.Transport {
+	return client.TransportLongPoll
+}
+
+func (s *pollSession) send(msg client.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return fmt.Errorf("bottest: long-poll session ended")
+	}
+	s.queue = append(s.queue, msg)
+	s.wakeLocked()
+	return nil
+}
+
+// Ends the session, so the client's next poll fails and it opens a new one
+func (s *pollSession) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ended = true
+	s.wakeLocked()
+}
+
+// Wakes a poll waiting for messages. Must hold s.mu.
+func (s *pollSession) wakeLocked() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// Starts a server
+func NewServer() *Server {
+	s := &Server{
+		users:    make(map[string]int),
+		names:    make(map[int]string),
+		rooms:    make(map[string]*room),
+		conns:    make(map[string]subscriber),
+		sessions: make(map[string]*pollSession),
+		posted:   make(chan struct{}),
+	}
+	s.upgrader.Subprotocols = []string{"gochat.v1.protobuf", "gochat.v1.msgpack"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Server is running")
+	})
+	mux.HandleFunc("POST /chat/user/new", s.newUserHandler)
+	mux.HandleFunc("GET /chat/user/{name}", s.getUserHandler)
+	mux.HandleFunc("POST /chat/room/new", s.newRoomHandler)
+	mux.HandleFunc("POST /chat/room/join", s.joinRoomHandler)
+	mux.HandleFunc("DELETE /chat/room/leave", s.leaveRoomHandler)
+	mux.HandleFunc("POST /chat/postmsg", s.postMessageHandler)
+	mux.HandleFunc("GET /chat/rooms", s.roomsHandler)
+	mux.HandleFunc("GET /chat/room/{room}/members", s.membersHandler)
+	mux.HandleFunc("GET /chat/room/{room}", s.chatHandler)
+	mux.HandleFunc("GET /chat/sockets/connect", s.socketHandler)
+	mux.HandleFunc("GET /chat/events/stream", s.streamHandler)
+	mux.HandleFunc("GET /chat/events/poll", s.pollHandler)
+	mux.HandleFunc("DELETE /chat/events/poll", s.closePollHandler)
+
+	s.srv = httptest.NewServer(mux)
+	s.URL = s.srv.URL
+	return s
+}
+
+// Closes all connections and stops the server
+func (s *Server) Close() {
+	s.DisconnectAll()
+	s.srv.Close()
+}
+
+// Returns a client for the server that reconnects quickly, for passing to bot.New
+func (s *Server) NewClient(opts ...client.Option) *client.Client {
+	opts = append([]client.Option{client.WithReconnectBackoff(10*time.Millisecond, 100*time.Millisecond)}, opts...)
+	c, err := client.New(s.URL, opts...)
+	if err != nil {
+		// The URL comes from httptest so it is always valid
+		panic(err)
+	}
+	return c
+}
+
+// Runs the bot until the returned stop function is called, which waits for Run to return and
+// passes on its error. Start returns once the bot has joined its rooms.
+func (s *Server) Start(b *bot.Bot) (stop func() error, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- b.Run(ctx)
+	}()
+	stop = func() error {
+		cancel()
+		return <-done
+	}
+
+	select {
+	case <-b.Ready():
+		return stop, nil
+	case err := <-done:
+		cancel()
+		if err == nil {
+			err = fmt.Errorf("bottest: bot %s stopped before it was ready", b.Name())
+		}
+		return nil, err
+	case <-time.After(10 * time.Second):
+		stop()
+		return nil, fmt.Errorf("bottest: bot %s wasn't ready after 10s", b.Name())
+	}
+}
+
+// Posts a message as the sender, creating the user and joining the room first if needed
+func (s *Server) Say(roomName, sender, text string) {
+	s.mu.Lock()
+	s.createUserLocked(sender)
+	s.joinLocked(roomName, sender)
+	s.mu.Unlock()
+	s.post(client.Message{Sender: &sender, RoomName: &roomName, MessageText: &text})
+}
+
+// Returns the messages posted to a room, oldest first
+func (s *Server) Messages(roomName string) []client.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[roomName]
+	if !ok {
+		return nil
+	}
+	return append([]client.Message(nil), r.messages...)
+}
+
+// Returns the users in a room, sorted by name
+func (s *Server) Members(roomName string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rooms[roomName]
+	if !ok {
+		return nil
+	}
+	members := append([]string(nil), r.members...)
+	sort.Strings(members)
+	return members
+}
+
+// Returns the first message posted to any room that matches, waiting for one if there isn't one yet.
+// Messages posted before the call are included.
+func (s *Server) WaitFor(ctx context.Context, match func(client.Message) bool) (client.Message, error) {
+	seen := 0
+	for {
+		s.mu.Lock()
+		messages := s.messages[seen:]
+		posted := s.posted
+		s.mu.Unlock()
+		for _, msg := range messages {
+			if match(msg) {
+				return msg, nil
+			}
+		}
+		seen += len(messages)
+
+		select {
+		case <-ctx.Done():
+			return client.Message{}, ctx.Err()
+		case <-posted:
+		}
+	}
+}
+
+// Drops every connection over any transport, as a server restart would, so reconnection can be
+// exercised
+func (s *Server) DisconnectAll() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = make(map[string]subscriber)
+	s.sessions = make(map[string]*pollSession)
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.drop()
+	}
+}
+
+// Returns the transport the user is connected over, or "" if they aren't connected
+func (s *Server) Transport(user string) client.Transport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.conns[user]; ok {
+		return c.transport()
+	}
+	return ""
+}
+
+// Waits until the user is connected over any transport
+func (s *Server) WaitConnected(ctx context.Context, user string) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		_, ok := s.conns[user]
+		s.mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Matches messages sent by the user
+func From(sender string) func(client.Message) bool {
+	return func(msg client.Message) bool {
+		return msg.SenderName() == sender
+	}
+}
+
+// Matches messages sent by the user to the room
+func FromIn(sender, roomName string) func(client.Message) bool {
+	return func(msg client.Message) bool {
+		return msg.SenderName() == sender && msg.Room() == roomName
+	}
+}
+
+// Stores a message and sends it to the connected members of its room
+func (s *Server) post(msg client.Message) {
+	epoch := time.Now().Unix()
+	msg.Epoch = &epoch
+
+	s.mu.Lock()
+	r := s.rooms[*msg.RoomName]
+	r.messages = append(r.messages, msg)
+	s.messages = append(s.messages, msg)
+	close(s.posted)
+	s.posted = make(chan struct{})
+	var targets []subscriber
+	for _, member := range r.members {
+		if c, ok := s.conns[member]; ok {
+			targets = append(targets, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range targets {
+		c.send(msg)
+	}
+}
+
+// Creates a user if it doesn't exist and returns its ID. Must hold s.mu.
+func (s *Server) createUserLocked(name string) int {
+	if id, ok := s.users[name]; ok {
+		return id
+	}
+	id := len(s.users) + 1
+	s.users[name] = id
+	s.names[id] = name
+	return id
+}
+
+// Adds the user to the room, creating the room if needed. Must hold s.mu.
+func (s *Server) joinLocked(roomName, user string) {
+	r, ok := s.rooms[roomName]
+	if !ok {
+		r = &room{}
+		s.rooms[roomName] = r
+	}
+	for _, member := range r.members {
+		if member == user {
+			return
+		}
+	}
+	r.members = append(r.members, user)
+}
+
+func (s *Server) newUserHandler(w http.ResponseWriter, r *http.Request) {
+	var user client.User
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		writeError(w, http.StatusBadRequest, client.ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	if user.Name == nil || *user.Name == "" {
+		writeError(w, http.StatusBadRequest, client.ErrCodeMissingField, "A user name is required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[*user.Name]; ok {
+		writeError(w, http.StatusConflict, client.ErrCodeUserExists, "Error creating user with name \"%s\": A user with this name already exists", *user.Name)
+		return
+	}
+	id := s.createUserLocked(*user.Name)
+	user.UserID = &id
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	s.mu.Lock()
+	id, ok := s.users[name]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, client.ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", name)
+		return
+	}
+	writeJSON(w, http.StatusOK, client.User{Name: &name, UserID: &id})
+}
+
+func (s *Server) newRoomHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("room-name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, client.ErrCodeMissingField, "The room-name query parameter is required")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.rooms[name]; ok {
+		writeError(w, http.StatusConflict, client.ErrCodeRoomExists, "Error creating room with name \"%s\": A room with this name already exists", name)
+		return
+	}
+	s.rooms[name] = &room{}
+}
+
+func (s *Server) joinRoomHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("User-Name")
+	roomName := r.Header.Get("Room-Name")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user]; !ok {
+		writeError(w, http.StatusBadRequest, client.ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", user)
+		return
+	}
+	if roomName == "" {
+		writeError(w, http.StatusBadRequest, client.ErrCodeMissingField, "The Room-Name header is required")
+		return
+	}
+	s.joinLocked(roomName, user)
+}
+
+func (s *Server) leaveRoomHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("User-Name")
+	roomName := r.Header.Get("Room-Name")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[user]; !ok {
+		writeError(w, http.StatusBadRequest, client.ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", user)
+		return
+	}
+	rm, ok := s.rooms[roomName]
+	if !ok {
+		writeError(w, http.StatusBadRequest, client.ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", roomName)
+		return
+	}
+	for i, member := range rm.members {
+		if member == user {
+			rm.members = append(rm.members[:i], rm.members[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *Server) postMessageHandler(w http.ResponseWriter, r *http.Request) {
+	var msg client.Message
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		writeError(w, http.StatusBadRequest, client.ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	if err := s.validate(msg); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: *err})
+		return
+	}
+	s.post(msg)
+}
+
+// Checks that a posted message has a known sender and room
+func (s *Server) validate(msg client.Message) *client.APIError {
+	if msg.Sender == nil || msg.RoomName == nil || msg.MessageText == nil {
+		return &client.APIError{Code: client.ErrCodeMissingField, Message: "A message requires a sender, roomName and messageText"}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[*msg.Sender]; !ok {
+		return &client.APIError{Code: client.ErrCodeUserNotFound, Message: fmt.Sprintf("Invalid sender supplied \"%s\": A user with this name does not exist", *msg.Sender)}
+	}
+	if _, ok := s.rooms[*msg.RoomName]; !ok {
+		return &client.APIError{Code: client.ErrCodeRoomNotFound, Message: fmt.Sprintf("Invalid room name supplied \"%s\": A room with this name does not exist", *msg.RoomName)}
+	}
+	return nil
+}
+
+func (s *Server) roomsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	rooms := make([]string, 0, len(s.rooms))
+	for name := range s.rooms {
+		rooms = append(rooms, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(rooms)
+	writeJSON(w, http.StatusOK, map[string][]string{"rooms": rooms})
+}
+
+func (s *Server) membersHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("room")
+	s.mu.Lock()
+	_, ok := s.rooms[name]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, client.ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", name)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"room": name, "members": s.Members(name)})
+}
+
+func (s *Server) chatHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("room")
+	s.mu.Lock()
+	_, ok := s.rooms[name]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, client.ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", name)
+		return
+	}
+
+	query := r.URL.Query()
+	after := int64(0)
+	before := time.Now().Unix() + 1
+	limit := 0
+	var err error
+	if v := query.Get("message-start-time"); v != "" {
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, client.ErrCodeInvalidParam, "Invalid message-start-time supplied \"%s\": must be an epoch in seconds", v)
+			return
+		}
+	}
+	if v := query.Get("before"); v != "" {
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, client.ErrCodeInvalidParam, "Invalid before supplied \"%s\": must be an epoch in seconds", v)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, client.ErrCodeInvalidParam, "Invalid limit supplied \"%s\": must be a positive integer", v)
+			return
+		}
+	}
+
+	messages := make([]client.Message, 0)
+	for _, msg := range s.Messages(name) {
+		if *msg.Epoch >= after && *msg.Epoch < before {
+			messages = append(messages, msg)
+		}
+	}
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	writeJSON(w, http.StatusOK, map[string][]client.Message{"messages": messages})
+}
+
+// Returns the ID and name of the user in the user-id query parameter, writing an error response
+// and returning false if there isn't one
+func (s *Server) connectingUser(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	idString := r.URL.Query().Get("user-id")
+	id, err := strconv.Atoi(idString)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, client.ErrCodeInvalidParam, "Invalid user-id supplied \"%s\": must be an integer", idString)
+		return 0, "", false
+	}
+	s.mu.Lock()
+	name, ok := s.names[id]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, client.ErrCodeUserNotFound, "Invalid user-id supplied \"%d\": A user with this ID does not exist", id)
+		return 0, "", false
+	}
+	return id, name, true
+}
+
+// Makes c the user's connection, dropping any connection they had before
+func (s *Server) register(name string, c subscriber) {
+	s.mu.Lock()
+	old := s.conns[name]
+	s.conns[name] = c
+	s.mu.Unlock()
+	if old != nil {
+		old.drop()
+	}
+}
+
+// Removes c if it is still the user's connection
+func (s *Server) unregister(name string, c subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[name] == c {
+		delete(s.conns, name)
+	}
+}
+
+func (s *Server) socketHandler(w http.ResponseWriter, r *http.Request) {
+	_, name, ok := s.connectingUser(w, r)
+	if !ok {
+		return
+	}
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &socket{conn: conn, encoding: client.EncodingJSON}
+	if encoding, ok := subprotocols[conn.Subprotocol()]; ok {
+		c.encoding = encoding
+	}
+	s.register(name, c)
+
+	go func() {
+		defer func() {
+			s.unregister(name, c)
+			conn.Close()
+		}()
+		for {
+			msg, err := c.read()
+			if err != nil {
+				return
+			}
+			if s.validate(msg) == nil {
+				s.post(msg)
+			}
+		}
+	}()
+}
+
+func (s *Server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	_, name, ok := s.connectingUser(w, r)
+	if !ok {
+		return
+	}
+	rc := http.NewResponseController(w)
+	c := &eventStream{queue: make(chan client.Message, 256), done: make(chan struct{})}
+	s.register(name, c)
+	defer s.unregister(name, c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	for {
+		select {
+		case msg := <-c.queue:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Body of a long-poll response, matching the real server
+type pollResponse struct {
+	Session  string           `json:"session"`
+	Cursor   int64            `json:"cursor"`
+	Messages []client.Message `json:"messages"`
+}
+
+func (s *Server) pollHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	wait := defaultPollWait
+	if v := query.Get("wait"); v != "" {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			writeError(w, http.StatusBadRequest, client.ErrCodeInvalidParam, "Invalid wait supplied \"%s\": must be a number of seconds", v)
+			return
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	// Without ack, each batch is acknowledged as soon as it is sent
+	ack, acked := int64(0), false
+	if v := query.Get("ack"); v != "" {
+		var err error
+		if ack, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, client.ErrCodeInvalidParam, "Invalid ack supplied \"%s\": must be the cursor of a response", v)
+			return
+		}
+		acked = true
+	}
+	id := query.Get("session")
+	if id == "" {
+		s.openPollSession(w, r)
+		return
+	}
+	sess := s.findPollSession(w, r, id)
+	if sess == nil {
+		return
+	}
+
+	sess.mu.Lock()
+	switch {
+	case !acked || ack == sess.cursor:
+		sess.unacked = nil
+	case ack != sess.cursor-1 || len(sess.unacked) == 0:
+		cursor := sess.cursor
+		sess.mu.Unlock()
+		writeError(w, http.StatusBadRequest, client.ErrCodeInvalidParam, "Invalid ack supplied \"%d\": the last response's cursor was %d", ack, cursor)
+		return
+	}
+	sess.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		sess.mu.Lock()
+		ended, notify, cursor := sess.ended, sess.notify, sess.cursor
+		messages := sess.unacked
+		if len(messages) == 0 && len(sess.queue) > 0 {
+			messages, sess.queue = sess.queue, nil
+			sess.cursor++
+			cursor = sess.cursor
+			sess.unacked = messages
+		}
+		sess.mu.Unlock()
+		if ended {
+			writeError(w, http.StatusNotFound, codeNotFound, "Long-poll session \"%s\" does not exist or has expired", id)
+			return
+		}
+		if len(messages) > 0 {
+			writeJSON(w, http.StatusOK, pollResponse{Session: id, Cursor: cursor, Messages: messages})
+			return
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			writeJSON(w, http.StatusOK, pollResponse{Session: id, Cursor: cursor, Messages: make([]client.Message, 0)})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Opens a session for the requesting user and returns its ID
+func (s *Server) openPollSession(w http.ResponseWriter, r *http.Request) {
+	userID, name, ok := s.connectingUser(w, r)
+	if !ok {
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		writeError(w, http.StatusInternalServerError, codeInternal, "%v", err)
+		return
+	}
+	sess := &pollSession{id: hex.EncodeToString(b), userID: userID, notify: make(chan struct{})}
+	s.mu.Lock()
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+	s.register(name, sess)
+	writeJSON(w, http.StatusOK, pollResponse{Session: sess.id, Messages: make([]client.Message, 0)})
+}
+
+func (s *Server) closePollHandler(w http.ResponseWriter, r *http.Request) {
+	sess := s.findPollSession(w, r, r.URL.Query().Get("session"))
+	if sess == nil {
+		return
+	}
+	sess.drop()
+	s.mu.Lock()
+	delete(s.sessions, sess.id)
+	for name, c := range s.conns {
+		if c == sess {
+			delete(s.conns, name)
+		}
+	}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns the open session with the given ID if it belongs to the request's user-id. Writes a 404
+// and returns nil otherwise.
+func (s *Server) findPollSession(w http.ResponseWriter, r *http.Request, id string) *pollSession {
+	s.mu.Lock()
+	sess := s.sessions[id]
+	s.mu.Unlock()
+	if sess == nil || strconv.Itoa(sess.userID) != r.URL.Query().Get("user-id") {
+		writeError(w, http.StatusNotFound, codeNotFound, "Long-poll session \"%s\" does not exist or has expired", id)
+		return nil
+	}
+	return sess
+}
+
+// Body of an error response, matching the real server
+type errorResponse struct {
+	Error client.APIError `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, format string, args ...interface{}) {
+	writeJSON(w, status, errorResponse{Error: client.APIError{Code: code, Message: fmt.Sprintf(format, args...)}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
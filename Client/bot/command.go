@@ -0,0 +1,129 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Handles a command. A returned error is reported to the room by the bot's error handler.
+type HandlerFunc func(ctx *Context) error
+
+// Decides whether the sender of a command may run it
+type Permission func(ctx *Context) bool
+
+// A registered command
+type Command struct {
+	Name        string
+	Description string
+	Usage       string
+	Handler     HandlerFunc
+
+	prefix      string
+	rooms       map[string]bool
+	permissions []Permission
+	minArgs     int
+	maxArgs     int
+	limiter     *rateLimiter
+}
+
+// Configures a command when it is registered with Bot.Handle
+type CommandOption func(*Command)
+
+// Sets the one line description shown by !help
+func Description(text string) CommandOption {
+	return func(c *Command) {
+		c.Description = text
+	}
+}
+
+// Sets the argument synopsis shown by !help and when the arguments are invalid, e.g. "<room> [message]"
+func Usage(text string) CommandOption {
+	return func(c *Command) {
+		c.Usage = text
+	}
+}
+
+// Only answers the command in the given rooms. By default a command works in every room the bot is in.
+func InRooms(rooms ...string) CommandOption {
+	return func(c *Command) {
+		if c.rooms == nil {
+			c.rooms = make(map[string]bool)
+		}
+		for _, room := range rooms {
+			c.rooms[room] = true
+		}
+	}
+}
+
+// Requires the permission check to pass before the handler runs. Multiple checks must all pass.
+func Require(p Permission) CommandOption {
+	return func(c *Command) {
+		c.permissions = append(c.permissions, p)
+	}
+}
+
+// Requires between min and max arguments. A negative max means there is no upper limit.
+func Args(min, max int) CommandOption {
+	return func(c *Command) {
+		c.minArgs = min
+		c.maxArgs = max
+	}
+}
+
+// Lets each user run the command at most burst times per period
+func RateLimit(burst int, per time.Duration) CommandOption {
+	return func(c *Command) {
+		c.limiter = newRateLimiter(burst, per)
+	}
+}
+
+// Allows only the named users
+func AllowUsers(names ...string) Permission {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return func(ctx *Context) bool {
+		return allowed[ctx.Sender()]
+	}
+}
+
+// Denies the named users and allows everyone else
+func DenyUsers(names ...string) Permission {
+	denied := make(map[string]bool, len(names))
+	for _, name := range names {
+		denied[name] = true
+	}
+	return func(ctx *Context) bool {
+		return !denied[ctx.Sender()]
+	}
+}
+
+// Reports whether the command answers in the room
+func (c *Command) inRoom(room string) bool {
+	return c.rooms == nil || c.rooms[room]
+}
+
+// Reports whether the sender passes every permission check
+func (c *Command) permitted(ctx *Context) bool {
+	for _, p := range c.permissions {
+		if !p(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the number of arguments against Args
+func (c *Command) checkArgs(args []string) error {
+	if len(args) < c.minArgs || (c.maxArgs >= 0 && len(args) > c.maxArgs) {
+		return fmt.Errorf("usage: %s", c.synopsis())
+	}
+	return nil
+}
+
+// Returns the command with its usage, e.g. "!echo <text>"
+func (c *Command) synopsis() string {
+	return strings.TrimSpace(c.prefix + c.Name + " " + c.Usage)
+}
@@ -0,0 +1,40 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/austin-mc/GoChat/Client/client"
+)
+
+// The command being handled. It is cancelled when the handler timeout passes or the bot stops.
+type Context struct {
+	context.Context
+	Bot     *Bot
+	Message client.Message
+	Command *Command
+	// The parsed arguments after the command name
+	Args []string
+	// The text after the command name, before it was split into arguments
+	RawArgs string
+}
+
+// Returns the room the command was sent in
+func (c *Context) Room() string {
+	return c.Message.Room()
+}
+
+// Returns the name of the user who sent the command
+func (c *Context) Sender() string {
+	return c.Message.SenderName()
+}
+
+// Posts a message to the room the command was sent in
+func (c *Context) Reply(text string) error {
+	return c.Bot.Say(c, c.Room(), text)
+}
+
+// Formats and posts a message to the room the command was sent in
+func (c *Context) Replyf(format string, args ...interface{}) error {
+	return c.Reply(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,147 @@
+/*
+An example bot that repeats what it is told.
+
+	echobot -server http://localhost:8080 -name echobot -rooms lobby,dev -admins alice
+
+Commands: !echo <text>, !ping, !shout <text> (admins only) and !help.
+Run with -selftest to try the bot against an in-process server instead of a real one.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/austin-mc/GoChat/Client/bot"
+	"github.com/austin-mc/GoChat/Client/bot/bottest"
+	"github.com/austin-mc/GoChat/Client/client"
+)
+
+func main() {
+	server := flag.String("server", "http://localhost:8080", "URL of the chat server")
+	name := flag.String("name", "echobot", "user name of the bot")
+	rooms := flag.String("rooms", "lobby", "comma separated rooms to join")
+	admins := flag.String("admins", "", "comma separated users allowed to use !shout")
+	selftest := flag.Bool("selftest", false, "run the bot against an in-process server and check its replies")
+	flag.Parse()
+
+	if *selftest {
+		if err := selfTest(); err != nil {
+			log.Fatal("Self test failed: ", err)
+		}
+		fmt.Println("Self test passed")
+		return
+	}
+
+	c, err := client.New(*server)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := newEchoBot(c, *name, splitList(*rooms), splitList(*admins))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := b.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Creates the bot and registers its commands
+func newEchoBot(c *client.Client, name string, rooms, admins []string) *bot.Bot {
+	b := bot.New(c, name, bot.WithRooms(rooms...))
+	b.Handle("echo", func(ctx *bot.Context) error {
+		return ctx.Reply(strings.Join(ctx.Args, " "))
+	}, bot.Description("Repeats the text"), bot.Usage("<text>"), bot.Args(1, -1), bot.RateLimit(5, time.Minute))
+	b.Handle("ping", func(ctx *bot.Context) error {
+		return ctx.Replyf("pong, %s", ctx.Sender())
+	}, bot.Description("Checks the bot is alive"), bot.Args(0, 0))
+	b.Handle("shout", func(ctx *bot.Context) error {
+		return ctx.Reply(strings.ToUpper(ctx.RawArgs))
+	}, bot.Description("Repeats the text loudly"), bot.Usage("<text>"), bot.Args(1, -1), bot.Require(bot.AllowUsers(admins...)))
+	return b
+}
+
+// Splits a comma separated flag, ignoring empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Runs the bot against an in-process server and checks the replies to a few commands
+func selfTest() error {
+	srv := bottest.NewServer()
+	defer srv.Close()
+
+	b := newEchoBot(srv.NewClient(), "echobot", []string{"lobby"}, []string{"alice"})
+	stop, err := srv.Start(b)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	checks := []struct {
+		sender, text, reply string
+	}{
+		{"alice", `!echo "hello world" again`, "hello world again"},
+		{"bob", "!ping", "pong, bob"},
+		{"bob", "!shout hi", "Error: permission denied: bob may not use !shout"},
+		{"alice", "!shout hi", "HI"},
+		{"alice", "!echo", "Error: usage: !echo <text>"},
+	}
+	for i, check := range checks {
+		srv.Say("lobby", check.sender, check.text)
+		if err := expectReply(srv, i+1, check.reply); err != nil {
+			return fmt.Errorf("%s: %w", check.text, err)
+		}
+	}
+
+	// Drop the connection and check the bot comes back
+	srv.DisconnectAll()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.WaitConnected(ctx, "echobot"); err != nil {
+		return fmt.Errorf("bot didn't reconnect: %w", err)
+	}
+	srv.Say("lobby", "alice", "!ping")
+	if err := expectReply(srv, len(checks)+1, "pong, alice"); err != nil {
+		return fmt.Errorf("after reconnecting: %w", err)
+	}
+	return nil
+}
+
+// Waits for the nth reply from the bot and compares its text
+func expectReply(srv *bottest.Server, n int, want string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	seen := 0
+	msg, err := srv.WaitFor(ctx, func(msg client.Message) bool {
+		if msg.SenderName() != "echobot" {
+			return false
+		}
+		seen++
+		return seen == n
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("no reply, want %q", want)
+	}
+	if err != nil {
+		return err
+	}
+	if msg.Text() != want {
+		return fmt.Errorf("got reply %q, want %q", msg.Text(), want)
+	}
+	return nil
+}
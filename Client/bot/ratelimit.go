@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"sync"
+	"time"
+)
+
+// A token bucket per key, e.g. per user. Each key may spend burst tokens at once, and tokens refill
+// evenly so that burst calls are allowed every period.
+type rateLimiter struct {
+	burst  float64
+	per    time.Duration
+	mu     sync.Mutex
+	now    func() time.Time
+	bucket map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(burst int, per time.Duration) *rateLimiter {
+	return &rateLimiter{
+		burst:  float64(burst),
+		per:    per,
+		now:    time.Now,
+		bucket: make(map[string]*tokenBucket),
+	}
+}
+
+// Takes a token for the key. If none are left it returns false and how long until one is.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	rate := l.burst / float64(l.per)
+	b, ok := l.bucket[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.bucket[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) * rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate)
+}
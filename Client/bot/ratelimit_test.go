@@ -0,0 +1,49 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("alice"); !ok {
+			t.Fatalf("call %d refused within the burst", i+1)
+		}
+	}
+	ok, wait := l.allow("alice")
+	if ok {
+		t.Fatal("call past the burst allowed")
+	}
+	// Two tokens a minute, so one every 30 seconds
+	if wait != 30*time.Second {
+		t.Errorf("wait = %v, want 30s", wait)
+	}
+	if ok, _ := l.allow("bob"); !ok {
+		t.Error("bob refused because of alice's calls")
+	}
+
+	now = now.Add(15 * time.Second)
+	if ok, wait := l.allow("alice"); ok || wait != 15*time.Second {
+		t.Errorf("after 15s allow = %v, %v, want false, 15s", ok, wait)
+	}
+	now = now.Add(15 * time.Second)
+	if ok, _ := l.allow("alice"); !ok {
+		t.Error("refused once a token refilled")
+	}
+
+	// Tokens stop refilling at the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("alice"); !ok {
+			t.Fatalf("call %d after an hour refused", i+1)
+		}
+	}
+	if ok, _ := l.allow("alice"); ok {
+		t.Error("idle time let the bucket grow past the burst")
+	}
+}
@@ -0,0 +1,309 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+)
+
+// A user as seen by an admin
+type AdminUser struct {
+	Name        string   `json:"name"`
+	UserID      int      `json:"userID"`
+	Integration bool     `json:"integration"`
+	Disabled    bool     `json:"disabled"`
+	Messages    int64    `json:"messages"`
+	LastMessage int64    `json:"lastMessage,omitempty"`
+	Connected   bool     `json:"connected"`
+	Rooms       []string `json:"rooms"`
+}
+
+// A room as seen by an admin
+type AdminRoom struct {
+	Name        string   `json:"name"`
+	RoomID      int      `json:"roomID"`
+	Owner       string   `json:"owner,omitempty"`
+	Encrypted   bool     `json:"encrypted"`
+	Disabled    bool     `json:"disabled"`
+	Messages    int64    `json:"messages"`
+	LastMessage int64    `json:"lastMessage,omitempty"`
+	Members     []string `json:"members"`
+}
+
+// Changes made by UpdateUser and UpdateRoom. Nil fields are left unchanged.
+type AdminUpdate struct {
+	Name     *string `json:"name,omitempty"`
+	Disabled *bool   `json:"disabled,omitempty"`
+	// Rooms only. An empty owner leaves the room without one.
+	Owner *string `json:"owner,omitempty"`
+}
+
+// An open websocket connection on the server
+type Connection struct {
+	UserID     int      `json:"userID"`
+	User       string   `json:"user"`
+	RemoteAddr string   `json:"remoteAddr"`
+	Transport  string   `json:"transport"`
+	Encoding   string   `json:"encoding"`
+	Connected  int64    `json:"connected"`
+	Queued     int      `json:"queued"`
+	Rooms      []string `json:"rooms"`
+}
+
+// Server wide counts
+type Stats struct {
+	Started         int64  `json:"started"`
+	Uptime          string `json:"uptime"`
+	SchemaVersion   int    `json:"schemaVersion"`
+	DatabaseBytes   int64  `json:"databaseBytes"`
+	Users           int64  `json:"users"`
+	Rooms           int64  `json:"rooms"`
+	Messages        int64  `json:"messages"`
+	Attachments     int64  `json:"attachments"`
+	AttachmentBytes int64  `json:"attachmentBytes"`
+	Connections     int    `json:"connections"`
+	RoomMembers     int    `json:"roomMembers"`
+	Goroutines      int    `json:"goroutines"`
+}
+
+// The server's retention settings and its most recent prune runs
+type RetentionStatus struct {
+	MaxAge     string     `json:"maxAge"`
+	MaxCount   int        `json:"maxCount"`
+	Interval   string     `json:"interval"`
+	ArchiveDir string     `json:"archiveDir,omitempty"`
+	Runs       []PruneRun `json:"runs"`
+}
+
+// One run of the message pruner
+type PruneRun struct {
+	ID       int          `json:"id"`
+	Started  int64        `json:"started"`
+	Finished int64        `json:"finished"`
+	Deleted  int64        `json:"deleted"`
+	Rooms    []RoomPruned `json:"rooms"`
+	Archive  string       `json:"archive,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// Messages deleted from one room in a prune run
+type RoomPruned struct {
+	Room    string `json:"room"`
+	Deleted int64  `json:"deleted"`
+}
+
+// A copy of the database written by the server
+type Backup struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Created  int64  `json:"created"`
+	Duration string `json:"duration,omitempty"`
+
+	// Older backups the server deleted to stay within its backup.keep setting
+	Removed []string `json:"removed,omitempty"`
+}
+
+// The backups in the server's backup directory, newest first
+type Backups struct {
+	Dir     string   `json:"dir"`
+	Keep    int      `json:"keep"`
+	Backups []Backup `json:"backups"`
+}
+
+// How ImportRoom imports an export
+type ImportOptions struct {
+	// Name of the room to create, the exported name if empty
+	Room string
+	// Maps exported user names to names on the server
+	Users map[string]string
+	// Add the messages to an existing room instead of failing
+	Merge bool
+	// The export is gzipped
+	Gzip bool
+}
+
+// What an import did
+type ImportResult struct {
+	Room               string   `json:"room"`
+	Messages           int      `json:"messages"`
+	UsersCreated       []string `json:"usersCreated"`
+	AttachmentsMissing int      `json:"attachmentsMissing"`
+}
+
+// Returns every user on the server. Like the other admin methods, this needs a Client created with
+// WithAuth(BearerToken(token)) using the server's admin.token.
+func (c *Client) AdminUsers(ctx context.Context) ([]AdminUser, error) {
+	var resp struct {
+		Users []AdminUser `json:"users"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/users", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Users, nil
+}
+
+// Creates a user through the admin API. Fails with ErrCodeUserExists if the name is taken.
+func (c *Client) AdminCreateUser(ctx context.Context, name string) (*User, error) {
+	var user User
+	body := struct {
+		Name string `json:"name"`
+	}{name}
+	if err := c.do(ctx, http.MethodPost, "/admin/users", nil, body, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Renames, disables or enables a user. Disabling a user disconnects them and removes them from their rooms.
+func (c *Client) UpdateUser(ctx context.Context, name string, update AdminUpdate) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodPatch, "/admin/users/"+neturl.PathEscape(name), nil, update, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Deletes a user along with their messages and keys
+func (c *Client) DeleteUser(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/users/"+neturl.PathEscape(name), nil, nil, nil)
+}
+
+// Removes the keys a user published, so they can publish new ones after losing their key
+// directory. Members who pinned the old keys must TrustKey the new ones.
+func (c *Client) ResetKey(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/users/"+neturl.PathEscape(name)+"/key", nil, nil, nil)
+}
+
+// Returns every room on the server
+func (c *Client) AdminRooms(ctx context.Context) ([]AdminRoom, error) {
+	var resp struct {
+		Rooms []AdminRoom `json:"rooms"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/rooms", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Rooms, nil
+}
+
+// Creates a room through the admin API. An empty owner leaves the room without one.
+func (c *Client) AdminCreateRoom(ctx context.Context, name, owner string, encrypted bool) error {
+	body := struct {
+		Name      string `json:"name"`
+		Owner     string `json:"owner,omitempty"`
+		Encrypted bool   `json:"encrypted"`
+	}{name, owner, encrypted}
+	return c.do(ctx, http.MethodPost, "/admin/rooms", nil, body, nil)
+}
+
+// Renames, disables or enables a room. Disabling a room removes its members and stops new messages.
+func (c *Client) UpdateRoom(ctx context.Context, room string, update AdminUpdate) error {
+	return c.do(ctx, http.MethodPatch, "/admin/rooms/"+neturl.PathEscape(room), nil, update, nil)
+}
+
+// Deletes a room along with its messages, webhooks and keys
+func (c *Client) DeleteRoom(ctx context.Context, room string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/rooms/"+neturl.PathEscape(room), nil, nil, nil)
+}
+
+// Returns the open websocket connections
+func (c *Client) Connections(ctx context.Context) ([]Connection, error) {
+	var resp struct {
+		Connections []Connection `json:"connections"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/admin/connections", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Connections, nil
+}
+
+// Closes the user's websocket
+func (c *Client) DropConnection(ctx context.Context, user string) error {
+	return c.do(ctx, http.MethodDelete, "/admin/connections/"+neturl.PathEscape(user), nil, nil, nil)
+}
+
+// Returns server wide counts
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	var stats Stats
+	if err := c.do(ctx, http.MethodGet, "/admin/stats", nil, nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Returns the retention settings and up to limit of the most recent prune runs
+func (c *Client) RetentionStatus(ctx context.Context, limit int) (*RetentionStatus, error) {
+	var status RetentionStatus
+	if err := c.do(ctx, http.MethodGet, "/admin/retention?limit="+strconv.Itoa(limit), nil, nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Runs the message pruner now and returns what it did
+func (c *Client) RunRetention(ctx context.Context) (*PruneRun, error) {
+	var run PruneRun
+	if err := c.do(ctx, http.MethodPost, "/admin/retention/run", nil, nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// Takes a backup of the server's database
+func (c *Client) Backup(ctx context.Context) (*Backup, error) {
+	var backup Backup
+	if err := c.do(ctx, http.MethodPost, "/admin/backup", nil, nil, &backup); err != nil {
+		return nil, err
+	}
+	return &backup, nil
+}
+
+// Lists the backups of the server's database
+func (c *Client) Backups(ctx context.Context) (*Backups, error) {
+	var backups Backups
+	if err := c.do(ctx, http.MethodGet, "/admin/backups", nil, nil, &backups); err != nil {
+		return nil, err
+	}
+	return &backups, nil
+}
+
+// Writes an export of the room to w
+func (c *Client) ExportRoom(ctx context.Context, room string, w io.Writer) error {
+	resp, err := c.send(ctx, http.MethodGet, "/admin/rooms/"+neturl.PathEscape(room)+"/export", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Imports a room export read from r
+func (c *Client) ImportRoom(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	query := neturl.Values{}
+	if opts.Room != "" {
+		query.Set("room", opts.Room)
+	}
+	for from, to := range opts.Users {
+		query.Add("user", from+":"+to)
+	}
+	if opts.Merge {
+		query.Set("merge", "true")
+	}
+	headers := map[string]string{"Content-Type": "application/x-ndjson"}
+	if opts.Gzip {
+		headers["Content-Encoding"] = "gzip"
+	}
+	resp, err := c.send(ctx, http.MethodPost, "/admin/rooms/import?"+query.Encode(), headers, r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result ImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
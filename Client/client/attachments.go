@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+)
+
+// Uploads content as an attachment named name. Post it with PostAttachment.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader) (*Attachment, error) {
+	user := c.UserName()
+	if user == "" {
+		return nil, ErrNotLoggedIn
+	}
+
+	// Stream the form instead of buffering the whole file
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, err := form.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	headers := map[string]string{"User-Name": user, "Content-Type": form.FormDataContentType()}
+	resp, err := c.send(ctx, http.MethodPost, "/chat/attachments", headers, pr)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var att Attachment
+	if err := json.NewDecoder(resp.Body).Decode(&att); err != nil {
+		return nil, err
+	}
+	return &att, nil
+}
+
+// Uploads the file at path as an attachment
+func (c *Client) UploadFile(ctx context.Context, path string) (*Attachment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return c.Upload(ctx, filepath.Base(path), f)
+}
+
+// Writes the attachment's content to w and returns the file name it was uploaded with
+func (c *Client) Download(ctx context.Context, id string, w io.Writer) (string, error) {
+	return c.download(ctx, "/chat/attachments/"+neturl.PathEscape(id), w)
+}
+
+// Writes a PNG thumbnail of an image attachment to w
+func (c *Client) DownloadThumbnail(ctx context.Context, id string, w io.Writer) error {
+	_, err := c.download(ctx, "/chat/attachments/"+neturl.PathEscape(id)+"/thumbnail", w)
+	return err
+}
+
+func (c *Client) download(ctx context.Context, path string, w io.Writer) (string, error) {
+	resp, err := c.send(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var name string
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = filepath.Base(params["filename"])
+	}
+	_, err = io.Copy(w, resp.Body)
+	return name, err
+}
@@ -0,0 +1,39 @@
+package client
+
+import "net/http"
+
+// Adds credentials to every HTTP request and websocket handshake the client makes
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// Adapts a function to the Authenticator interface
+type AuthFunc func(req *http.Request) error
+
+func (f AuthFunc) Authenticate(req *http.Request) error {
+	return f(req)
+}
+
+// Sends the token as an "Authorization: Bearer" header
+func BearerToken(token string) Authenticator {
+	return AuthFunc(func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	})
+}
+
+// Sends HTTP basic auth credentials
+func BasicAuth(user, password string) Authenticator {
+	return AuthFunc(func(req *http.Request) error {
+		req.SetBasicAuth(user, password)
+		return nil
+	})
+}
+
+// Sends a fixed header, e.g. an API key
+func StaticHeader(name, value string) Authenticator {
+	return AuthFunc(func(req *http.Request) error {
+		req.Header.Set(name, value)
+		return nil
+	})
+}
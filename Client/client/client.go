@@ -0,0 +1,718 @@
+// Package client is a Go SDK for the GoChat REST and websocket API.
+//
+// A Client logs in as a user, joins rooms and posts messages. After Connect, messages for the joined
+// rooms are delivered as typed events through Events or handlers registered with OnEvent, and the
+// connection is reopened automatically if it drops. Events arrive over a websocket where the
+// network allows it, and otherwise over server-sent events or long-polling.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Path of the websocket endpoint on the server
+const socketPath = "/chat/sockets/connect"
+
+// Close code the server gives a connection too slow to keep up with its messages. The client
+// reconnects, and Messages returns what was missed.
+const CloseSlowConsumer = 4000
+
+// A connection to a GoChat server. A Client is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	socketURL  string
+	httpClient *http.Client
+	dialer     *websocket.Dialer
+	auth       Authenticator
+
+	e2e *keyring
+
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	eventBuffer int
+	transports  []Transport
+	encoding    Encoding
+	compression bool
+
+	mu     sync.Mutex
+	user   *User
+	rooms  []string
+	stream stream
+	// The stream's websocket, which messages are posted over, if it is one
+	ws       *websocketStream
+	events   chan Event
+	handlers []func(Event)
+	closed   bool
+	done     chan struct{}
+
+	// Serializes writes to the websocket
+	writeMu sync.Mutex
+
+	// Held for reading while sending on events so Close can't close the channel mid send
+	emitMu sync.RWMutex
+}
+
+// Configures a Client
+type Option func(*Client)
+
+// Uses the given HTTP client for REST requests, and for event streams and long-polls when
+// websockets are unavailable. Its Timeout must be zero for event streams to stay open.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cl *Client) { cl.httpClient = c }
+}
+
+// Uses the given dialer for the websocket
+func WithDialer(d *websocket.Dialer) Option {
+	return func(cl *Client) { cl.dialer = d }
+}
+
+// Uses the TLS config for both REST requests and the websocket, e.g. for a custom CA or client certificates
+func WithTLSConfig(c *tls.Config) Option {
+	return func(cl *Client) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c
+		cl.httpClient = &http.Client{Transport: transport}
+
+		// The transport adds h2 to its config's NextProtos, so the dialer needs its own copy
+		d := *websocket.DefaultDialer
+		d.TLSClientConfig = c.Clone()
+		cl.dialer = &d
+	}
+}
+
+// Adds credentials to every request
+func WithAuth(a Authenticator) Option {
+	return func(cl *Client) { cl.auth = a }
+}
+
+// Sets the delay before the first reconnect attempt and the maximum delay between attempts
+func WithReconnectBackoff(min, max time.Duration) Option {
+	return func(cl *Client) {
+		cl.minBackoff = min
+		cl.maxBackoff = max
+	}
+}
+
+// Sets how many events the Events channel buffers before the websocket reader waits
+func WithEventBuffer(n int) Option {
+	return func(cl *Client) { cl.eventBuffer = n }
+}
+
+// Sets the transports Connect tries, in order. By default it tries a websocket, then a server-sent
+// event stream, then long-polling, and uses the first the network allows.
+func WithTransports(transports ...Transport) Option {
+	return func(cl *Client) { cl.transports = transports }
+}
+
+// Asks the server to encode websocket events in e, e.g. EncodingProtobuf to save bandwidth with
+// many rooms. The default is EncodingJSON, and Encoding reports what the server agreed to.
+func WithEncoding(e Encoding) Option {
+	return func(cl *Client) { cl.encoding = e }
+}
+
+// Sets whether to offer the server permessage-deflate compression on the websocket. It is offered
+// by default.
+func WithCompression(enabled bool) Option {
+	return func(cl *Client) { cl.compression = enabled }
+}
+
+// Creates a client for the server at baseURL, e.g. "https://chat.example.com"
+func New(baseURL string, opts ...Option) (*Client, error) {
+	baseURL = strings.TrimRight(baseURL, "/")
+	u, err := neturl.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid server url: %v", err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("client: server url %q must start with http:// or https://", baseURL)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + socketPath
+
+	c := &Client{
+		baseURL:     baseURL,
+		socketURL:   u.String(),
+		httpClient:  http.DefaultClient,
+		dialer:      websocket.DefaultDialer,
+		minBackoff:  time.Second,
+		maxBackoff:  30 * time.Second,
+		eventBuffer: 100,
+		transports:  defaultTransports,
+		encoding:    EncodingJSON,
+		compression: true,
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Returns the server's base URL
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// Returns the logged in user, or nil before Login
+func (c *Client) User() *User {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+// Returns the logged in user's name, or "" before Login
+func (c *Client) UserName() string {
+	if u := c.User(); u != nil && u.Name != nil {
+		return *u.Name
+	}
+	return ""
+}
+
+// Returns the names of the rooms joined through this client
+func (c *Client) JoinedRooms() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.rooms...)
+}
+
+// Reports whether the client is currently connected for events, over any transport
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stream != nil
+}
+
+// Returns the transport events are currently received over, or "" while disconnected
+func (c *Client) Transport() Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream == nil {
+		return ""
+	}
+	return c.stream.transport()
+}
+
+// Returns the encoding events are currently received in, or "" while disconnected. Only a
+// websocket can use anything but JSON.
+func (c *Client) Encoding() Encoding {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream == nil {
+		return ""
+	}
+	if c.ws == nil {
+		return EncodingJSON
+	}
+	return c.ws.encoding
+}
+
+// Sends a request to the API and decodes a JSON response into out if it isn't nil
+func (c *Client) do(ctx context.Context, method, path string, headers map[string]string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	if body != nil {
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers["Content-Type"] = "application/json"
+	}
+	resp, err := c.send(ctx, method, path, headers, reader)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Sends a request with the authenticator applied. On success the caller must close the body;
+// an error status is returned as an *APIError.
+func (c *Client) send(ctx context.Context, method, path string, headers map[string]string, body io.Reader) (*http.Response, error) {
+	resp, err := c.request(ctx, method, path, headers, body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Makes a request with the authenticator applied but doesn't check the response status
+func (c *Client) request(ctx context.Context, method, path string, headers map[string]string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if c.auth != nil {
+		if err := c.auth.Authenticate(req); err != nil {
+			return nil, err
+		}
+	}
+	return c.httpClient.Do(req)
+}
+
+// Returns the existing user with the given name
+func (c *Client) GetUser(ctx context.Context, name string) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodGet, "/chat/user/"+neturl.PathEscape(name), nil, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Creates a new user. Fails with ErrCodeUserExists if the name is taken.
+func (c *Client) CreateUser(ctx context.Context, name string) (*User, error) {
+	var user User
+	if err := c.do(ctx, http.MethodPost, "/chat/user/new", nil, User{Name: &name}, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Logs in as the named user, creating the user if it doesn't exist yet
+func (c *Client) Login(ctx context.Context, name string) (*User, error) {
+	user, err := c.GetUser(ctx, name)
+	if IsCode(err, ErrCodeUserNotFound) {
+		user, err = c.CreateUser(ctx, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Name == nil || user.UserID == nil {
+		return nil, fmt.Errorf("client: invalid user returned by server")
+	}
+	if c.e2e != nil {
+		if err := c.e2e.load(*user.Name); err != nil {
+			return nil, err
+		}
+		if err := c.publishKey(ctx, *user.Name); err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	c.user = user
+	c.mu.Unlock()
+	return user, nil
+}
+
+// Creates a room. Fails with ErrCodeRoomExists if it already exists.
+func (c *Client) CreateRoom(ctx context.Context, room string) error {
+	return c.do(ctx, http.MethodPost, "/chat/room/new?room-name="+neturl.QueryEscape(room), nil, nil, nil)
+}
+
+// Joins a room, creating it if it doesn't exist
+func (c *Client) JoinRoom(ctx context.Context, room string) error {
+	name := c.UserName()
+	if name == "" {
+		return ErrNotLoggedIn
+	}
+	headers := map[string]string{"User-Name": name, "Room-Name": room}
+	if err := c.do(ctx, http.MethodPost, "/chat/room/join", headers, nil, nil); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	joined := false
+	for _, r := range c.rooms {
+		if r == room {
+			joined = true
+			break
+		}
+	}
+	if !joined {
+		c.rooms = append(c.rooms, room)
+	}
+	c.mu.Unlock()
+
+	if c.e2e != nil {
+		// Joining invalidates an encrypted room's key, so make one that includes us
+		if _, err := c.currentRoomKey(ctx, room, true); err != nil {
+			return fmt.Errorf("client: joined %s but couldn't get its key: %w", room, err)
+		}
+	}
+	return nil
+}
+
+// Leaves a room
+func (c *Client) LeaveRoom(ctx context.Context, room string) error {
+	name := c.UserName()
+	if name == "" {
+		return ErrNotLoggedIn
+	}
+	headers := map[string]string{"User-Name": name, "Room-Name": room}
+	if err := c.do(ctx, http.MethodDelete, "/chat/room/leave", headers, nil, nil); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, r := range c.rooms {
+		if r == room {
+			c.rooms = append(c.rooms[:i], c.rooms[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Returns the names of all rooms on the server
+func (c *Client) Rooms(ctx context.Context) ([]string, error) {
+	var res roomsResponse
+	if err := c.do(ctx, http.MethodGet, "/chat/rooms", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Rooms, nil
+}
+
+// Returns the names of the users active in a room
+func (c *Client) Members(ctx context.Context, room string) ([]string, error) {
+	var res membersResponse
+	if err := c.do(ctx, http.MethodGet, "/chat/room/"+neturl.PathEscape(room)+"/members", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Members, nil
+}
+
+// Returns the messages in a room sent at or after since. The zero time returns the whole history.
+func (c *Client) Messages(ctx context.Context, room string, since time.Time) ([]Message, error) {
+	path := "/chat/room/" + neturl.PathEscape(room)
+	if !since.IsZero() {
+		path += "?message-start-time=" + strconv.FormatInt(since.Unix(), 10)
+	}
+	var res messagesResponse
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	for i := range res.Messages {
+		c.decrypt(ctx, &res.Messages[i])
+	}
+	return res.Messages, nil
+}
+
+// Returns up to limit of the newest messages in a room sent before the given time, oldest first.
+// The zero time starts from the newest message.
+func (c *Client) History(ctx context.Context, room string, before time.Time, limit int) ([]Message, error) {
+	path := "/chat/room/" + neturl.PathEscape(room) + "?limit=" + strconv.Itoa(limit)
+	if !before.IsZero() {
+		path += "&before=" + strconv.FormatInt(before.Unix(), 10)
+	}
+	var res messagesResponse
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, &res); err != nil {
+		return nil, err
+	}
+	for i := range res.Messages {
+		c.decrypt(ctx, &res.Messages[i])
+	}
+	return res.Messages, nil
+}
+
+// Posts a message to a room, over the websocket when connected and otherwise over HTTP. Messages
+// to end-to-end encrypted rooms are encrypted and always sent over HTTP, so a stale room key can
+// be noticed and replaced.
+func (c *Client) PostMessage(ctx context.Context, room, text string) error {
+	return c.post(ctx, room, text, nil)
+}
+
+// Posts a message with an attachment returned by Upload
+func (c *Client) PostAttachment(ctx context.Context, room, text string, att *Attachment) error {
+	return c.post(ctx, room, text, &Attachment{ID: att.ID})
+}
+
+func (c *Client) post(ctx context.Context, room, text string, att *Attachment) error {
+	name := c.UserName()
+	if name == "" {
+		return ErrNotLoggedIn
+	}
+	if c.e2e != nil {
+		sent, err := c.postEncrypted(ctx, room, name, text, att)
+		if sent || err != nil {
+			return err
+		}
+	}
+	msg := Message{
+		Sender:      &name,
+		MessageText: &text,
+		RoomName:    &room,
+		Attachment:  att,
+	}
+
+	c.mu.Lock()
+	ws := c.ws
+	c.mu.Unlock()
+	if ws != nil {
+		if err := ws.write(ctx, msg); err == nil {
+			//Sent over WS, don't need to send over HTTP
+			return nil
+		}
+	}
+	return c.do(ctx, http.MethodPost, "/chat/postmsg", nil, msg, nil)
+}
+
+// Posts to an encrypted room, retrying once with a new key if the server says the key is stale.
+// Returns false without sending if the room isn't encrypted.
+func (c *Client) postEncrypted(ctx context.Context, room, name, text string, att *Attachment) (bool, error) {
+	for refresh := false; ; refresh = true {
+		sealed, encrypted, err := c.encrypt(ctx, room, name, text, refresh)
+		if err != nil || !encrypted {
+			return false, err
+		}
+		msg := Message{
+			Sender:      &name,
+			MessageText: &sealed,
+			RoomName:    &room,
+			Attachment:  att,
+		}
+		err = c.do(ctx, http.MethodPost, "/chat/postmsg", nil, msg, nil)
+		if !IsCode(err, ErrCodeStaleKey) || refresh {
+			return true, err
+		}
+	}
+}
+
+// Returns the server's status text
+func (c *Client) Status(ctx context.Context) (string, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/status", nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// Returns the server's liveness, which only fails when the server process needs restarting
+func (c *Client) Live(ctx context.Context) (*Health, error) {
+	return c.health(ctx, "/health/live")
+}
+
+// Returns the server's readiness, which also checks the database and its schema version
+func (c *Client) Ready(ctx context.Context) (*Health, error) {
+	return c.health(ctx, "/health/ready")
+}
+
+// Fetches a health probe. Failed checks come back as a 503 with the same body, so that isn't an
+// error.
+func (c *Client) health(ctx context.Context, path string) (*Health, error) {
+	resp, err := c.request(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		if err := checkResponse(resp); err != nil {
+			return nil, err
+		}
+	}
+	var health Health
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// Returns the channel events are delivered on. The channel is created on the first call and
+// closed by Close; once it exists the websocket reader waits for it to be drained.
+func (c *Client) Events() <-chan Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.events == nil {
+		c.events = make(chan Event, c.eventBuffer)
+		if c.closed {
+			close(c.events)
+		}
+	}
+	return c.events
+}
+
+// Registers a callback for every event. Callbacks run on the websocket reader goroutine, in
+// registration order, so they should return quickly.
+func (c *Client) OnEvent(handler func(Event)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, handler)
+}
+
+// Delivers an event to the callbacks and the events channel
+func (c *Client) emit(ev Event) {
+	c.mu.Lock()
+	handlers := append([]func(Event){}, c.handlers...)
+	events := c.events
+	c.mu.Unlock()
+
+	for _, h := range handlers {
+		h(ev)
+	}
+	if events == nil {
+		return
+	}
+	c.emitMu.RLock()
+	defer c.emitMu.RUnlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	select {
+	case events <- ev:
+	case <-c.done:
+	}
+}
+
+// Connects for events and starts delivering them, over the first transport that works. It returns
+// once the first connection succeeds or fails; after that the connection is kept open, reconnecting
+// with backoff, until Close.
+func (c *Client) Connect(ctx context.Context) error {
+	if c.User() == nil {
+		return ErrNotLoggedIn
+	}
+	s, err := c.openStream(ctx)
+	if err != nil {
+		return err
+	}
+	if !c.setStream(s) {
+		s.close()
+		return ErrClosed
+	}
+	c.emit(ConnectedEvent{Transport: s.transport()})
+	go c.readLoop(s)
+	return nil
+}
+
+// Stores the current connection. Returns false if the client has been closed.
+func (c *Client) setStream(s stream) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.stream = s
+	c.ws, _ = s.(*websocketStream)
+	return true
+}
+
+// Reads messages until the connection drops, then reconnects
+func (c *Client) readLoop(s stream) {
+	for {
+		msg, err := s.next()
+		if err != nil {
+			c.mu.Lock()
+			closed := c.closed
+			if !closed {
+				c.stream = nil
+				c.ws = nil
+			}
+			c.mu.Unlock()
+			if closed {
+				// Close has already closed the stream
+				return
+			}
+			s.close()
+			c.emit(DisconnectedEvent{Err: err})
+			if s = c.reconnect(); s == nil {
+				return
+			}
+			continue
+		}
+		if msg.RoomName == nil || msg.Sender == nil || msg.MessageText == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		c.decrypt(ctx, &msg)
+		cancel()
+		c.emit(MessageEvent{Message: msg})
+	}
+}
+
+// Reconnects with exponential backoff until it succeeds or the client is closed, then rejoins
+// the rooms in case the server restarted and forgot them. Each attempt starts again from the best
+// transport, in case the network now allows it.
+func (c *Client) reconnect() stream {
+	delay := c.minBackoff
+	for attempt := 1; ; attempt++ {
+		c.emit(ReconnectingEvent{Attempt: attempt, Delay: delay})
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(delay):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		s, err := c.openStream(ctx)
+		cancel()
+		if err == nil {
+			if !c.setStream(s) {
+				s.close()
+				return nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			for _, room := range c.JoinedRooms() {
+				c.JoinRoom(ctx, room)
+			}
+			cancel()
+			c.emit(ConnectedEvent{Reconnect: true, Transport: s.transport()})
+			return s
+		}
+
+		delay *= 2
+		if delay > c.maxBackoff {
+			delay = c.maxBackoff
+		}
+	}
+}
+
+// Closes the connection, stops reconnecting and closes the events channel. It does not leave
+// rooms; call LeaveRoom first to do that.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	s := c.stream
+	c.stream = nil
+	c.ws = nil
+	events := c.events
+	c.mu.Unlock()
+
+	var err error
+	if s != nil {
+		err = s.close()
+	}
+	if events != nil {
+		// Senders give up once done is closed, so this doesn't wait long
+		c.emitMu.Lock()
+		close(events)
+		c.emitMu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,690 @@
+package client
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encrypted messages are sent as "e2e:1:<key version>:<base64 nonce and ciphertext>"
+const encryptedPrefix = "e2e:1:"
+
+// Text of a message that couldn't be decrypted, e.g. one sent before the user joined
+const undecryptableText = "[unable to decrypt message]"
+
+// Room keys are AES-256 keys
+const roomKeySize = 32
+
+// How many times a rotation is retried when another member rotates or joins at the same time
+const rotateAttempts = 3
+
+// Returned when encryption is needed but the client was created without WithEncryption
+var ErrEncryptionDisabled = errors.New("client: end-to-end encryption is not enabled")
+
+// Returned when the keys a user publishes differ from the ones this client saw the first time it
+// used them, which is what someone trying to read the user's rooms would have to do. Once the new
+// keys have been checked with the user, TrustKey accepts them.
+type KeyChangedError struct {
+	User string
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("client: the published key of %s has changed since it was first used", e.User)
+}
+
+// Identity key, the keys pinned for other users and room keys for end-to-end encrypted rooms
+type keyring struct {
+	dir string
+
+	mu       sync.Mutex
+	user     string
+	identity *ecdh.PrivateKey
+	signing  ed25519.PrivateKey
+	known    map[string]publishedKey
+	rooms    map[string]*roomKeys
+}
+
+// What the client knows about one room's encryption
+type roomKeys struct {
+	encrypted bool
+	version   int
+	rekey     bool
+	members   []string
+	keys      map[int][]byte
+}
+
+// Enables end-to-end encrypted rooms. Each user's X25519 identity key is kept in keyDir and
+// published to the server's key directory at Login, along with an Ed25519 signing key derived from
+// it. The keys other users published are pinned in keyDir the first time they are used. With an
+// empty keyDir a new key is made and nothing is pinned past the session, and since the server
+// won't replace a published key, only the first Login of each user succeeds.
+func WithEncryption(keyDir string) Option {
+	return func(cl *Client) {
+		cl.e2e = &keyring{dir: keyDir, rooms: make(map[string]*roomKeys)}
+	}
+}
+
+// Wire format of the server's encryption endpoints, also how keys are pinned in keyDir
+type publishedKey struct {
+	PublicKey  string `json:"publicKey"`
+	SigningKey string `json:"signingKey"`
+}
+
+type roomEncryptionResponse struct {
+	Encrypted bool     `json:"encrypted"`
+	Version   int      `json:"version"`
+	Rekey     bool     `json:"rekey"`
+	Members   []string `json:"members"`
+	Keys      []struct {
+		Version    int    `json:"version"`
+		WrappedKey string `json:"wrappedKey"`
+		Sender     string `json:"sender"`
+	} `json:"keys"`
+}
+
+type rotateRoomKeyRequest struct {
+	Version int               `json:"version"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// Loads the user's identity key and pinned keys from the key directory, creating the identity key
+// if needed, and forgets any room keys from a previous login
+func (k *keyring) load(user string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.user = user
+	k.rooms = make(map[string]*roomKeys)
+	k.known = make(map[string]publishedKey)
+	identity, err := k.loadIdentity(user)
+	if err != nil {
+		return err
+	}
+	k.identity = identity
+	// Derived rather than stored, so the identity key is the only secret in the key directory
+	seed, err := hkdf.Key(sha256.New, identity.Bytes(), nil, "gochat signing key", ed25519.SeedSize)
+	if err != nil {
+		return err
+	}
+	k.signing = ed25519.NewKeyFromSeed(seed)
+	if k.dir == "" {
+		return nil
+	}
+
+	path := k.knownPath()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &k.known); err != nil {
+		return fmt.Errorf("client: reading pinned keys %s: %v", path, err)
+	}
+	return nil
+}
+
+func (k *keyring) loadIdentity(user string) (*ecdh.PrivateKey, error) {
+	if k.dir == "" {
+		return ecdh.X25519().GenerateKey(rand.Reader)
+	}
+
+	path := filepath.Join(k.dir, neturl.PathEscape(user)+".key")
+	data, err := os.ReadFile(path)
+	if err == nil {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("client: reading identity key %s: %v", path, err)
+		}
+		key, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("client: reading identity key %s: %v", path, err)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key.Bytes())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Returns the file the logged in user's pinned keys are kept in
+func (k *keyring) knownPath() string {
+	return filepath.Join(k.dir, neturl.PathEscape(k.user)+".known")
+}
+
+// Pins a user's keys, saving them to the key directory. Called with k.mu held.
+func (k *keyring) pin(user string, key publishedKey) error {
+	k.known[user] = key
+	if k.dir == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(k.known, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(k.knownPath(), append(data, '\n'), 0600)
+}
+
+// Returns the logged in user's own keys as published
+func (k *keyring) published() publishedKey {
+	return publishedKey{
+		PublicKey:  base64.StdEncoding.EncodeToString(k.identity.PublicKey().Bytes()),
+		SigningKey: base64.StdEncoding.EncodeToString(k.signing.Public().(ed25519.PublicKey)),
+	}
+}
+
+// Publishes the identity and signing keys for the logged in user. The server refuses keys that
+// differ from ones the user already published.
+func (c *Client) publishKey(ctx context.Context, name string) error {
+	c.e2e.mu.Lock()
+	body := c.e2e.published()
+	c.e2e.mu.Unlock()
+	headers := map[string]string{"User-Name": name}
+	return c.do(ctx, http.MethodPut, "/chat/keys/"+neturl.PathEscape(name), headers, body, nil)
+}
+
+// Returns the keys a user has published, checked against the keys pinned for them. Keys are
+// pinned the first time they are used, and a KeyChangedError is returned if they change after.
+func (c *Client) userKeys(ctx context.Context, user string) (*ecdh.PublicKey, ed25519.PublicKey, error) {
+	var res publishedKey
+	if err := c.do(ctx, http.MethodGet, "/chat/keys/"+neturl.PathEscape(user), nil, nil, &res); err != nil {
+		return nil, nil, err
+	}
+	c.e2e.mu.Lock()
+	defer c.e2e.mu.Unlock()
+	if user == c.e2e.user {
+		if res != c.e2e.published() {
+			return nil, nil, &KeyChangedError{User: user}
+		}
+	} else if pinned, ok := c.e2e.known[user]; !ok {
+		if err := c.e2e.pin(user, res); err != nil {
+			return nil, nil, err
+		}
+	} else if pinned != res {
+		return nil, nil, &KeyChangedError{User: user}
+	}
+	return res.decode(user)
+}
+
+// Returns the key a user signs the room keys they wrap with. Keys pinned for the user are used
+// without asking the server, so a sender's key that changed is never trusted.
+func (c *Client) signingKey(ctx context.Context, user string) (ed25519.PublicKey, error) {
+	c.e2e.mu.Lock()
+	pinned, ok := c.e2e.known[user]
+	if user == c.e2e.user {
+		pinned, ok = c.e2e.published(), true
+	}
+	c.e2e.mu.Unlock()
+	if ok {
+		_, signing, err := pinned.decode(user)
+		return signing, err
+	}
+	_, signing, err := c.userKeys(ctx, user)
+	return signing, err
+}
+
+func (k publishedKey) decode(user string) (*ecdh.PublicKey, ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(k.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("client: invalid public key for %s: %v", user, err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("client: invalid public key for %s: %v", user, err)
+	}
+	signing, err := base64.StdEncoding.DecodeString(k.SigningKey)
+	if err != nil || len(signing) != ed25519.PublicKeySize {
+		return nil, nil, fmt.Errorf("client: invalid signing key for %s", user)
+	}
+	return pub, ed25519.PublicKey(signing), nil
+}
+
+// Returns the fingerprint of a user's keys, for checking with them that the keys are really theirs
+func (k publishedKey) fingerprint() string {
+	sum := sha256.Sum256([]byte(k.PublicKey + ":" + k.SigningKey))
+	hexSum := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(hexSum)/4)
+	for i := 0; i < len(hexSum); i += 4 {
+		groups = append(groups, hexSum[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+// Returns the public key a user has published, once it has been checked against the key pinned
+// for them
+func (c *Client) PublicKey(ctx context.Context, user string) (*ecdh.PublicKey, error) {
+	if c.e2e == nil {
+		return nil, ErrEncryptionDisabled
+	}
+	pub, _, err := c.userKeys(ctx, user)
+	return pub, err
+}
+
+// Returns the fingerprint of the logged in user's keys, which others compare against the one
+// TrustKey shows them
+func (c *Client) Fingerprint() (string, error) {
+	if c.e2e == nil {
+		return "", ErrEncryptionDisabled
+	}
+	c.e2e.mu.Lock()
+	defer c.e2e.mu.Unlock()
+	if c.e2e.identity == nil {
+		return "", ErrNotLoggedIn
+	}
+	return c.e2e.published().fingerprint(), nil
+}
+
+// Pins the keys a user currently publishes, replacing any pinned before, and returns their
+// fingerprint. Used after a KeyChangedError once the fingerprint has been checked with the user.
+func (c *Client) TrustKey(ctx context.Context, user string) (string, error) {
+	if c.e2e == nil {
+		return "", ErrEncryptionDisabled
+	}
+	var res publishedKey
+	if err := c.do(ctx, http.MethodGet, "/chat/keys/"+neturl.PathEscape(user), nil, nil, &res); err != nil {
+		return "", err
+	}
+	if _, _, err := res.decode(user); err != nil {
+		return "", err
+	}
+	c.e2e.mu.Lock()
+	defer c.e2e.mu.Unlock()
+	if err := c.e2e.pin(user, res); err != nil {
+		return "", err
+	}
+	return res.fingerprint(), nil
+}
+
+// Creates a room that only accepts end-to-end encrypted messages, owned by the logged in user
+func (c *Client) CreateEncryptedRoom(ctx context.Context, room string) error {
+	name := c.UserName()
+	if name == "" {
+		return ErrNotLoggedIn
+	}
+	headers := map[string]string{"User-Name": name}
+	return c.do(ctx, http.MethodPost, "/chat/room/new?encrypted=true&room-name="+neturl.QueryEscape(room), headers, nil, nil)
+}
+
+// Reports whether a room is end-to-end encrypted
+func (c *Client) RoomEncrypted(ctx context.Context, room string) (bool, error) {
+	if c.e2e == nil {
+		return false, ErrEncryptionDisabled
+	}
+	keys, err := c.roomKeys(ctx, room, false)
+	if err != nil {
+		return false, err
+	}
+	return keys.encrypted, nil
+}
+
+// Returns what is known about a room's encryption, fetching it from the server if it isn't cached
+// or refresh is set. Room keys wrapped for this user are unwrapped and cached.
+func (c *Client) roomKeys(ctx context.Context, room string, refresh bool) (*roomKeys, error) {
+	c.e2e.mu.Lock()
+	keys, ok := c.e2e.rooms[room]
+	c.e2e.mu.Unlock()
+	if ok && !refresh {
+		return keys, nil
+	}
+
+	name := c.UserName()
+	if name == "" {
+		return nil, ErrNotLoggedIn
+	}
+	var res roomEncryptionResponse
+	headers := map[string]string{"User-Name": name}
+	if err := c.do(ctx, http.MethodGet, "/chat/room/"+neturl.PathEscape(room)+"/encryption", headers, nil, &res); err != nil {
+		return nil, err
+	}
+
+	// Room keys are only trusted when signed by the member who wrapped them
+	signers := make(map[string]ed25519.PublicKey)
+	for _, k := range res.Keys {
+		if _, ok := signers[k.Sender]; ok {
+			continue
+		}
+		// Left nil if the sender can't be found, e.g. they were deleted before their key was pinned
+		signers[k.Sender], _ = c.signingKey(ctx, k.Sender)
+	}
+
+	c.e2e.mu.Lock()
+	defer c.e2e.mu.Unlock()
+	keys = &roomKeys{
+		encrypted: res.Encrypted,
+		version:   res.Version,
+		rekey:     res.Rekey,
+		members:   res.Members,
+		keys:      make(map[int][]byte),
+	}
+	for _, k := range res.Keys {
+		signing := signers[k.Sender]
+		if signing == nil {
+			continue
+		}
+		key, err := unwrapRoomKey(c.e2e.identity, signing, k.WrappedKey, room, k.Version, k.Sender, name)
+		if err != nil {
+			// Wrapped for an identity key this client no longer has, or not signed by the sender
+			continue
+		}
+		keys.keys[k.Version] = key
+	}
+	c.e2e.rooms[room] = keys
+	return keys, nil
+}
+
+// Makes sure the client holds the current key of an encrypted room, rotating it if the members
+// changed since it was made
+func (c *Client) currentRoomKey(ctx context.Context, room string, refresh bool) (*roomKeys, error) {
+	keys, err := c.roomKeys(ctx, room, refresh)
+	if err != nil || !keys.encrypted {
+		return keys, err
+	}
+	c.e2e.mu.Lock()
+	current := keys.current()
+	c.e2e.mu.Unlock()
+	if current {
+		return keys, nil
+	}
+	return c.rotate(ctx, room, false)
+}
+
+// Reports whether the client holds a room key that is still good to send with
+func (k *roomKeys) current() bool {
+	_, ok := k.keys[k.version]
+	return ok && !k.rekey
+}
+
+// Generates a new key for an encrypted room and wraps it for each active member. Removed members
+// can't read anything sent after a rotation, and new members can't read anything sent before it.
+func (c *Client) RotateRoomKey(ctx context.Context, room string) error {
+	if c.e2e == nil {
+		return ErrEncryptionDisabled
+	}
+	_, err := c.rotate(ctx, room, true)
+	return err
+}
+
+// Rotates a room key. Unless force is set, a rotation by another member that already gave this
+// client a current key is good enough.
+func (c *Client) rotate(ctx context.Context, room string, force bool) (*roomKeys, error) {
+	name := c.UserName()
+	if name == "" {
+		return nil, ErrNotLoggedIn
+	}
+	var err error
+	for attempt := 0; attempt < rotateAttempts; attempt++ {
+		var keys *roomKeys
+		keys, err = c.roomKeys(ctx, room, true)
+		if err != nil {
+			return nil, err
+		}
+		if !keys.encrypted {
+			return nil, fmt.Errorf("client: room %q is not end-to-end encrypted", room)
+		}
+		c.e2e.mu.Lock()
+		current := keys.current()
+		c.e2e.mu.Unlock()
+		if current && !force {
+			return keys, nil
+		}
+
+		key := make([]byte, roomKeySize)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		version := keys.version + 1
+		req := rotateRoomKeyRequest{Version: version, Keys: make(map[string]string, len(keys.members))}
+		c.e2e.mu.Lock()
+		signing := c.e2e.signing
+		c.e2e.mu.Unlock()
+		for _, member := range keys.members {
+			// Refuses to give the key to anyone whose key changed since it was pinned
+			pub, _, err := c.userKeys(ctx, member)
+			if err != nil {
+				return nil, err
+			}
+			if req.Keys[member], err = wrapRoomKey(signing, pub, key, room, version, name, member); err != nil {
+				return nil, err
+			}
+		}
+		headers := map[string]string{"User-Name": name}
+		err = c.do(ctx, http.MethodPost, "/chat/room/"+neturl.PathEscape(room)+"/encryption/keys", headers, req, nil)
+		if IsCode(err, ErrCodeKeyConflict) {
+			// Someone else rotated or the members changed, look again
+			force = false
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c.e2e.mu.Lock()
+		keys.keys[version] = key
+		keys.version = version
+		keys.rekey = false
+		c.e2e.mu.Unlock()
+		return keys, nil
+	}
+	return nil, err
+}
+
+// Encrypts the text for an encrypted room. Text for other rooms is returned unchanged with
+// encrypted set to false.
+func (c *Client) encrypt(ctx context.Context, room, sender, text string, refresh bool) (string, bool, error) {
+	keys, err := c.currentRoomKey(ctx, room, refresh)
+	if err != nil || !keys.encrypted {
+		return text, false, err
+	}
+	c.e2e.mu.Lock()
+	version := keys.version
+	key := keys.keys[version]
+	c.e2e.mu.Unlock()
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", false, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", false, err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(text), messageAD(room, version, sender))
+	return encryptedPrefix + strconv.Itoa(version) + ":" + base64.StdEncoding.EncodeToString(sealed), true, nil
+}
+
+// Decrypts an encrypted message in place. Messages that can't be decrypted get a placeholder text.
+func (c *Client) decrypt(ctx context.Context, msg *Message) {
+	if c.e2e == nil || msg.MessageText == nil || !strings.HasPrefix(*msg.MessageText, encryptedPrefix) {
+		return
+	}
+	msg.Encrypted = true
+	text, err := c.open(ctx, msg.Room(), msg.SenderName(), *msg.MessageText)
+	if err != nil {
+		text = undecryptableText
+	}
+	msg.MessageText = &text
+}
+
+func (c *Client) open(ctx context.Context, room, sender, text string) (string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(text, encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("client: malformed encrypted message")
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return "", errors.New("client: malformed encrypted message")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("client: malformed encrypted message")
+	}
+
+	keys, err := c.roomKeys(ctx, room, false)
+	if err != nil {
+		return "", err
+	}
+	c.e2e.mu.Lock()
+	key, ok := keys.keys[version]
+	c.e2e.mu.Unlock()
+	if !ok {
+		// Sent with a key from a rotation this client hasn't seen yet
+		if keys, err = c.roomKeys(ctx, room, true); err != nil {
+			return "", err
+		}
+		c.e2e.mu.Lock()
+		key, ok = keys.keys[version]
+		c.e2e.mu.Unlock()
+		if !ok {
+			return "", fmt.Errorf("client: no key for version %d of room %q", version, room)
+		}
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("client: malformed encrypted message")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], messageAD(room, version, sender))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// Additional data bound to a message, so the server can't move it to another room or sender
+func messageAD(room string, version int, sender string) []byte {
+	return []byte("gochat message\x00" + room + "\x00" + strconv.Itoa(version) + "\x00" + sender)
+}
+
+// Additional data bound to a wrapped room key
+func roomKeyAD(room string, version int, member string) []byte {
+	return []byte("gochat room key\x00" + room + "\x00" + strconv.Itoa(version) + "\x00" + member)
+}
+
+// Signed along with a wrapped room key, so the server can't hand out a room key of its own or
+// replay one wrapped for another room, version or member
+func roomKeySignedData(room string, version int, sender, member string, wrapped []byte) []byte {
+	return append([]byte("gochat room key signature\x00"+room+"\x00"+strconv.Itoa(version)+"\x00"+sender+"\x00"+member+"\x00"), wrapped...)
+}
+
+// Encrypts a room key for a member. An ephemeral X25519 key agreement with the member's public key
+// is run through HKDF to get an AES-256-GCM key. The result is the ephemeral public key, nonce,
+// ciphertext and the sender's Ed25519 signature over them, base64 encoded.
+func wrapRoomKey(signing ed25519.PrivateKey, pub *ecdh.PublicKey, key []byte, room string, version int, sender, member string) (string, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	kek, err := keyEncryptionKey(eph, pub, eph.PublicKey().Bytes(), pub.Bytes())
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return "", err
+	}
+	out := append([]byte(nil), eph.PublicKey().Bytes()...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, key, roomKeyAD(room, version, member))
+	out = append(out, ed25519.Sign(signing, roomKeySignedData(room, version, sender, member, out))...)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// Checks the sender's signature and reverses wrapRoomKey with the member's identity key
+func unwrapRoomKey(identity *ecdh.PrivateKey, signing ed25519.PublicKey, wrapped, room string, version int, sender, member string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < ed25519.SignatureSize {
+		return nil, errors.New("client: malformed room key")
+	}
+	sig := data[len(data)-ed25519.SignatureSize:]
+	data = data[:len(data)-ed25519.SignatureSize]
+	if !ed25519.Verify(signing, roomKeySignedData(room, version, sender, member, data), sig) {
+		return nil, errors.New("client: room key not signed by its sender")
+	}
+	const pubSize = 32
+	if len(data) < pubSize {
+		return nil, errors.New("client: malformed room key")
+	}
+	eph, err := ecdh.X25519().NewPublicKey(data[:pubSize])
+	if err != nil {
+		return nil, err
+	}
+	kek, err := keyEncryptionKey(identity, eph, eph.Bytes(), identity.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	data = data[pubSize:]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("client: malformed room key")
+	}
+	key, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], roomKeyAD(room, version, member))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != roomKeySize {
+		return nil, errors.New("client: malformed room key")
+	}
+	return key, nil
+}
+
+// Derives the key that wraps a room key from an X25519 agreement, salted with the ephemeral and
+// recipient public keys
+func keyEncryptionKey(priv *ecdh.PrivateKey, peer *ecdh.PublicKey, eph, recipient []byte) ([]byte, error) {
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte(nil), eph...), recipient...)
+	return hkdf.Key(sha256.New, shared, salt, "gochat room key", roomKeySize)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestWrapRoomKey(t *testing.T) {
+	member, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingPub, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := bytes.Repeat([]byte{7}, roomKeySize)
+	wrapped, err := wrapRoomKey(signing, member.PublicKey(), key, "room", 2, "alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := unwrapRoomKey(member, signingPub, wrapped, "room", 2, "alice", "bob")
+	if err != nil {
+		t.Fatalf("unwrapRoomKey: %v", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Fatalf("unwrapRoomKey = %x, want %x", got, key)
+	}
+
+	tampered, _ := base64.StdEncoding.DecodeString(wrapped)
+	tampered[40] ^= 1
+	for _, tc := range []struct {
+		name    string
+		signer  ed25519.PublicKey
+		wrapped string
+		room    string
+		version int
+		sender  string
+		member  string
+	}{
+		{"other signer", otherPub, wrapped, "room", 2, "alice", "bob"},
+		{"other sender", signingPub, wrapped, "room", 2, "mallory", "bob"},
+		{"other room", signingPub, wrapped, "lobby", 2, "alice", "bob"},
+		{"other version", signingPub, wrapped, "room", 3, "alice", "bob"},
+		{"other member", signingPub, wrapped, "room", 2, "alice", "carol"},
+		{"tampered", signingPub, base64.StdEncoding.EncodeToString(tampered), "room", 2, "alice", "bob"},
+		{"truncated", signingPub, wrapped[:40], "room", 2, "alice", "bob"},
+	} {
+		if _, err := unwrapRoomKey(member, tc.signer, tc.wrapped, tc.room, tc.version, tc.sender, tc.member); err == nil {
+			t.Errorf("%s: unwrapRoomKey succeeded, want an error", tc.name)
+		}
+	}
+}
+
+// A key wrapped by someone who only knows the member's public key, e.g. the server, isn't accepted
+func TestUnwrapUnsignedRoomKey(t *testing.T) {
+	member, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, forger, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := wrapRoomKey(forger, member.PublicKey(), make([]byte, roomKeySize), "room", 1, "alice", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unwrapRoomKey(member, signingPub, wrapped, "room", 1, "alice", "bob"); err == nil {
+		t.Fatal("unwrapRoomKey accepted a key not signed by its sender")
+	}
+}
+
+func TestKeyringPinsKeys(t *testing.T) {
+	dir := t.TempDir()
+	k := &keyring{dir: dir}
+	if err := k.load("alice"); err != nil {
+		t.Fatal(err)
+	}
+	own := k.published()
+	bob := publishedKey{PublicKey: own.PublicKey, SigningKey: "c2lnbmluZw=="}
+	if err := k.pin("bob", bob); err != nil {
+		t.Fatal(err)
+	}
+
+	// The identity key, and so the signing key derived from it, and the pins survive a new login
+	again := &keyring{dir: dir}
+	if err := again.load("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if again.published() != own {
+		t.Errorf("published keys changed across logins: %+v, want %+v", again.published(), own)
+	}
+	if again.known["bob"] != bob {
+		t.Errorf("pinned key for bob = %+v, want %+v", again.known["bob"], bob)
+	}
+	if own.fingerprint() == bob.fingerprint() {
+		t.Error("different keys have the same fingerprint")
+	}
+}
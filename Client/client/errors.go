@@ -0,0 +1,73 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Error codes returned by the server that callers commonly check for
+const (
+	ErrCodeInvalidJSON  = "invalid_json"
+	ErrCodeInvalidParam = "invalid_parameter"
+	ErrCodeMissingField = "missing_field"
+	ErrCodeUserExists   = "user_exists"
+	ErrCodeUserNotFound = "user_not_found"
+	ErrCodeRoomExists   = "room_exists"
+	ErrCodeRoomNotFound = "room_not_found"
+	ErrCodeKeyNotFound  = "key_not_found"
+	ErrCodeKeyConflict  = "key_conflict"
+	ErrCodeKeyExists    = "key_exists"
+	ErrCodeStaleKey     = "stale_room_key"
+	ErrCodeEncrypted    = "encryption_required"
+	ErrCodeUserDisabled = "user_disabled"
+	ErrCodeRoomDisabled = "room_disabled"
+)
+
+// Returned by methods that need a user before Login has succeeded
+var ErrNotLoggedIn = errors.New("client: not logged in")
+
+// Returned by methods called after Close
+var ErrClosed = errors.New("client: closed")
+
+// Details of a single API error returned by the server
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Status  int    `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// Reports whether err is an APIError with the given code
+func IsCode(err error, code string) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
+// HTTP Response struct for all error responses
+type errorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// Checks an HTTP response for an error status and returns the server's error if there is one
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var errResp errorResponse
+	if err := json.Unmarshal(body, &errResp); err != nil || errResp.Error.Code == "" {
+		// Not a structured error, fall back to the status text
+		return &APIError{Code: "http_error", Message: http.StatusText(resp.StatusCode), Status: resp.StatusCode}
+	}
+	errResp.Error.Status = resp.StatusCode
+	return &errResp.Error
+}
@@ -0,0 +1,36 @@
+package client
+
+import "time"
+
+// An event delivered through Client.Events or a handler registered with Client.OnEvent.
+// It is one of MessageEvent, ConnectedEvent, DisconnectedEvent or ReconnectingEvent.
+type Event interface {
+	event()
+}
+
+// A message posted to one of the joined rooms
+type MessageEvent struct {
+	Message Message
+}
+
+// The client connected, or reconnected after a drop, over Transport
+type ConnectedEvent struct {
+	Reconnect bool
+	Transport Transport
+}
+
+// The connection dropped. The client reconnects automatically unless it was closed.
+type DisconnectedEvent struct {
+	Err error
+}
+
+// The client is about to try reconnecting after Delay
+type ReconnectingEvent struct {
+	Attempt int
+	Delay   time.Duration
+}
+
+func (MessageEvent) event()      {}
+func (ConnectedEvent) event()    {}
+func (DisconnectedEvent) event() {}
+func (ReconnectingEvent) event() {}
@@ -0,0 +1,368 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Paths of the fallback event endpoints on the server
+const (
+	streamPath = "/chat/events/stream"
+	pollPath   = "/chat/events/poll"
+)
+
+// How long each long-poll asks the server to wait for messages, and the extra time allowed for
+// the response to arrive before giving up on it
+const (
+	pollWait  = 25 * time.Second
+	pollGrace = 10 * time.Second
+)
+
+// How many times a poll that failed with a network error is retried in the same session, and the
+// time between tries. The server keeps the last batch until a poll acknowledges it, so retrying
+// gets a lost response again rather than losing its messages.
+const (
+	pollRetries    = 3
+	pollRetryDelay = time.Second
+)
+
+// How a Client receives events from the server
+type Transport string
+
+const (
+	// A websocket, which messages are also posted over
+	TransportWebsocket Transport = "websocket"
+	// A server-sent event stream, for networks that block websockets
+	TransportSSE Transport = "sse"
+	// Repeated long-polls, for proxies that also buffer streamed responses
+	TransportLongPoll Transport = "longpoll"
+)
+
+// Every transport, best first
+var defaultTransports = []Transport{TransportWebsocket, TransportSSE, TransportLongPoll}
+
+// An open connection events are read from
+type stream interface {
+	transport() Transport
+	// Blocks until the next message arrives or the connection fails. The server closing the
+	// connection is returned as a *websocket.CloseError whichever the transport.
+	next() (Message, error)
+	close() error
+}
+
+// Opens the first of the client's transports that works. An error about the user is returned
+// straight away, since every transport would fail the same way.
+func (c *Client) openStream(ctx context.Context) (stream, error) {
+	var errs []error
+	for _, t := range c.transports {
+		var s stream
+		var err error
+		switch t {
+		case TransportWebsocket:
+			s, err = c.openWebsocket(ctx)
+		case TransportSSE:
+			s, err = c.openSSE(ctx)
+		case TransportLongPoll:
+			s, err = c.openLongPoll(ctx)
+		default:
+			err = errors.New("unknown transport")
+		}
+		if err == nil {
+			return s, nil
+		}
+		if IsCode(err, ErrCodeUserNotFound) || IsCode(err, ErrCodeUserDisabled) || ctx.Err() != nil {
+			return nil, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", t, err))
+	}
+	return nil, fmt.Errorf("client: no transport could connect: %w", errors.Join(errs...))
+}
+
+// Returns the query identifying the logged in user to the event endpoints
+func (c *Client) userQuery() string {
+	return "?user-id=" + strconv.Itoa(*c.User().UserID)
+}
+
+type websocketStream struct {
+	c        *Client
+	conn     *websocket.Conn
+	encoding Encoding
+}
+
+func (c *Client) openWebsocket(ctx context.Context) (stream, error) {
+	header := http.Header{}
+	if c.auth != nil {
+		// Run the authenticator on a throwaway request to collect its headers for the handshake
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.auth.Authenticate(req); err != nil {
+			return nil, err
+		}
+		header = req.Header
+	}
+	// A copy, so the caller's dialer isn't changed
+	dialer := *c.dialer
+	dialer.EnableCompression = c.compression
+	if subprotocol := c.encoding.subprotocol(); subprotocol != "" {
+		dialer.Subprotocols = []string{subprotocol}
+	}
+	conn, resp, err := dialer.DialContext(ctx, c.socketURL+c.userQuery(), header)
+	if err != nil && resp != nil {
+		// Surface the server's JSON error instead of the generic handshake error
+		defer resp.Body.Close()
+		if apiErr := checkResponse(resp); apiErr != nil {
+			return nil, apiErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &websocketStream{c: c, conn: conn, encoding: encodingForSubprotocol(conn.Subprotocol())}, nil
+}
+
+func (s *websocketStream) transport() Transport {
+	return TransportWebsocket
+}
+
+func (s *websocketStream) next() (Message, error) {
+	frameType, data, err := s.conn.ReadMessage()
+	if err != nil {
+		return Message{}, err
+	}
+	if frameType == websocket.TextMessage {
+		return EncodingJSON.Decode(data)
+	}
+	return s.encoding.Decode(data)
+}
+
+// Posts a message over the websocket, giving up at ctx's deadline
+func (s *websocketStream) write(ctx context.Context, msg Message) error {
+	data, err := s.encoding.Encode(msg)
+	if err != nil {
+		return err
+	}
+	s.c.writeMu.Lock()
+	defer s.c.writeMu.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetWriteDeadline(deadline)
+	} else {
+		s.conn.SetWriteDeadline(time.Time{})
+	}
+	return s.conn.WriteMessage(s.encoding.frameType(), data)
+}
+
+func (s *websocketStream) close() error {
+	s.c.writeMu.Lock()
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	s.c.writeMu.Unlock()
+	return s.conn.Close()
+}
+
+type sseStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	cancel context.CancelFunc
+}
+
+func (c *Client) openSSE(ctx context.Context) (stream, error) {
+	// The stream outlives ctx, which only bounds opening it
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stop := context.AfterFunc(ctx, cancel)
+	resp, err := c.send(streamCtx, http.MethodGet, streamPath+c.userQuery(), map[string]string{"Accept": "text/event-stream"}, nil)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		cancel()
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, err
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		// Something between us and the server answered instead
+		cancel()
+		resp.Body.Close()
+		return nil, fmt.Errorf("client: expected an event stream, got %q", resp.Header.Get("Content-Type"))
+	}
+	return &sseStream{body: resp.Body, reader: bufio.NewReader(resp.Body), cancel: cancel}, nil
+}
+
+func (s *sseStream) transport() Transport {
+	return TransportSSE
+}
+
+func (s *sseStream) next() (Message, error) {
+	var event string
+	var data []byte
+	hasData := false
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Message{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			// A blank line ends the event
+			if hasData {
+				switch event {
+				case "", "message":
+					var msg Message
+					err := json.Unmarshal(data, &msg)
+					return msg, err
+				case "close":
+					return Message{}, closeError(data)
+				}
+			}
+			event, data, hasData = "", nil, false
+		case strings.HasPrefix(line, ":"):
+			// A comment, which the server sends to keep the stream open
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				event = value
+			case "data":
+				if hasData {
+					data = append(data, '\n')
+				}
+				data = append(data, value...)
+				hasData = true
+			}
+		}
+	}
+}
+
+func (s *sseStream) close() error {
+	s.cancel()
+	return s.body.Close()
+}
+
+// Body of the server's close event, and of the close field of a long-poll response
+type closeEvent struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// Decodes the server's close event into the error a websocket close frame would have given
+func closeError(data []byte) error {
+	var ev closeEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return err
+	}
+	return &websocket.CloseError{Code: ev.Code, Text: ev.Reason}
+}
+
+type pollResponse struct {
+	Session  string      `json:"session"`
+	Cursor   int64       `json:"cursor"`
+	Messages []Message   `json:"messages"`
+	Close    *closeEvent `json:"close"`
+}
+
+type pollStream struct {
+	c       *Client
+	session string
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	// Messages from the last poll that haven't been returned by next yet
+	pending []Message
+	// Cursor of the last response, acknowledged by the next poll
+	cursor int64
+	// Set once the server has closed the session
+	closed error
+}
+
+func (c *Client) openLongPoll(ctx context.Context) (stream, error) {
+	var res pollResponse
+	if err := c.do(ctx, http.MethodGet, pollPath+c.userQuery(), nil, nil, &res); err != nil {
+		return nil, err
+	}
+	if res.Session == "" {
+		return nil, errors.New("client: server did not open a long-poll session")
+	}
+	pollCtx, cancel := context.WithCancel(context.Background())
+	return &pollStream{c: c, session: res.Session, ctx: pollCtx, cancel: cancel, pending: res.Messages, cursor: res.Cursor}, nil
+}
+
+func (s *pollStream) transport() Transport {
+	return TransportLongPoll
+}
+
+// Returns the path of the session's endpoint
+func (s *pollStream) path() string {
+	return pollPath + s.c.userQuery() + "&session=" + s.session
+}
+
+func (s *pollStream) next() (Message, error) {
+	for len(s.pending) == 0 {
+		if s.closed != nil {
+			return Message{}, s.closed
+		}
+		res, err := s.poll()
+		if err != nil {
+			return Message{}, err
+		}
+		s.pending = res.Messages
+		s.cursor = res.Cursor
+		if res.Close != nil {
+			s.closed = &websocket.CloseError{Code: res.Close.Code, Text: res.Close.Reason}
+		}
+	}
+	msg := s.pending[0]
+	s.pending = s.pending[1:]
+	return msg, nil
+}
+
+// Polls once, acknowledging the last response, and retries network errors a few times before
+// giving up on the session
+func (s *pollStream) poll() (pollResponse, error) {
+	path := s.path() + "&wait=" + strconv.Itoa(int(pollWait/time.Second)) + "&ack=" + strconv.FormatInt(s.cursor, 10)
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(s.ctx, pollWait+pollGrace)
+		var res pollResponse
+		err := s.c.do(ctx, http.MethodGet, path, nil, nil, &res)
+		cancel()
+		var apiErr *APIError
+		if err == nil || errors.As(err, &apiErr) || s.ctx.Err() != nil || attempt == pollRetries {
+			return res, err
+		}
+		select {
+		case <-time.After(pollRetryDelay):
+		case <-s.ctx.Done():
+			return res, err
+		}
+	}
+}
+
+func (s *pollStream) close() error {
+	s.cancel()
+	// End the session now rather than leaving the server to expire it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := s.c.do(ctx, http.MethodDelete, s.path(), nil, nil, nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		// The server has already ended it
+		return nil
+	}
+	return err
+}
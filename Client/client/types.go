@@ -0,0 +1,117 @@
+package client
+
+import "time"
+
+// A chat user
+type User struct {
+	Name   *string `json:"name"`
+	UserID *int    `json:"userID"`
+}
+
+// Holds the data for a message
+type Message struct {
+	Sender      *string     `json:"sender"`
+	Epoch       *int64      `json:"epoch"`
+	MessageText *string     `json:"messageText"`
+	RoomName    *string     `json:"roomName"`
+	Attachment  *Attachment `json:"attachment,omitempty"`
+
+	// Set by the client on messages from end-to-end encrypted rooms. The text has been decrypted,
+	// or replaced with a placeholder if that wasn't possible.
+	Encrypted bool `json:"-"`
+}
+
+// A file attached to a message. The ID is the SHA-256 of the content.
+type Attachment struct {
+	ID          string `json:"id"`
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Thumbnail   bool   `json:"thumbnail,omitempty"`
+}
+
+// Returns the sender, or "" if it isn't set
+func (m Message) SenderName() string {
+	if m.Sender == nil {
+		return ""
+	}
+	return *m.Sender
+}
+
+// Returns the room name, or "" if it isn't set
+func (m Message) Room() string {
+	if m.RoomName == nil {
+		return ""
+	}
+	return *m.RoomName
+}
+
+// Returns the message text, or "" if it isn't set
+func (m Message) Text() string {
+	if m.MessageText == nil {
+		return ""
+	}
+	return *m.MessageText
+}
+
+// Returns the time the server received the message, or the zero time if it isn't set
+func (m Message) Time() time.Time {
+	if m.Epoch == nil {
+		return time.Time{}
+	}
+	return time.Unix(*m.Epoch, 0)
+}
+
+// Result of one of the server's health checks. Status is "ok" or "fail".
+type HealthCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// State of the server's websocket hub and background goroutines
+type HubHealth struct {
+	Connections     int  `json:"connections"`
+	ActiveRooms     int  `json:"activeRooms"`
+	RoomMembers     int  `json:"roomMembers"`
+	QueuedMessages  int  `json:"queuedMessages"`
+	FullQueues      int  `json:"fullQueues"`
+	ClosedClients   int  `json:"closedClients"`
+	WebhookWorkers  int  `json:"webhookWorkers"`
+	WebhookQueue    int  `json:"webhookQueue"`
+	RetentionActive bool `json:"retentionActive"`
+	Goroutines      int  `json:"goroutines"`
+}
+
+// Result of a liveness or readiness probe. Status is "ok" when every check passed.
+type Health struct {
+	Status        string        `json:"status"`
+	Uptime        string        `json:"uptime"`
+	SchemaVersion int           `json:"schemaVersion"`
+	Checks        []HealthCheck `json:"checks"`
+	Hub           *HubHealth    `json:"hub,omitempty"`
+}
+
+// Reports whether every check passed
+func (h *Health) OK() bool {
+	return h.Status == "ok"
+}
+
+// HTTP Response struct containing a slice of Message
+type messagesResponse struct {
+	Messages []Message `json:"messages"`
+}
+
+// HTTP Response struct containing the names of users active in a room
+type membersResponse struct {
+	Room    string   `json:"room"`
+	Members []string `json:"members"`
+}
+
+// HTTP Response struct containing the names of all rooms
+type roomsResponse struct {
+	Rooms []string `json:"rooms"`
+}
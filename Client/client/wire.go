@@ -0,0 +1,292 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// How events are encoded on a websocket. The binary encodings are negotiated with a websocket
+// subprotocol and wrap each message in an envelope naming the type of event; the server's
+// wire.proto has the protobuf schema. A server that doesn't offer the encoding sends JSON instead.
+type Encoding string
+
+const (
+	// Text frames holding bare JSON messages, which every server understands
+	EncodingJSON Encoding = "json"
+	// Binary frames holding MessagePack envelopes, with each structure as an array of its fields
+	EncodingMsgpack Encoding = "msgpack"
+	// Binary frames holding protobuf envelopes, the most compact
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+// Envelope type of a message posted to a room, the only type so far
+const envelopeMessage = "message"
+
+// Returns the websocket subprotocol requesting the encoding, or "" for JSON
+func (e Encoding) subprotocol() string {
+	switch e {
+	case EncodingMsgpack:
+		return "gochat.v1.msgpack"
+	case EncodingProtobuf:
+		return "gochat.v1.protobuf"
+	}
+	return ""
+}
+
+// Returns the encoding the server agreed to with the subprotocol, JSON if it didn't agree to any
+func encodingForSubprotocol(subprotocol string) Encoding {
+	for _, e := range []Encoding{EncodingMsgpack, EncodingProtobuf} {
+		if subprotocol == e.subprotocol() {
+			return e
+		}
+	}
+	return EncodingJSON
+}
+
+// Returns websocket.TextMessage or websocket.BinaryMessage
+func (e Encoding) frameType() int {
+	if e.subprotocol() == "" {
+		return websocket.TextMessage
+	}
+	return websocket.BinaryMessage
+}
+
+// Encodes msg as a websocket frame in the encoding
+func (e Encoding) Encode(msg Message) ([]byte, error) {
+	switch e {
+	case EncodingMsgpack:
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		enc.UseArrayEncodedStructs(true)
+		enc.UseCompactInts(true)
+		if err := enc.Encode(msgpackEnvelope{Type: envelopeMessage, Message: &msg}); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case EncodingProtobuf:
+		b := protowire.AppendTag(nil, envelopeTypeField, protowire.BytesType)
+		b = protowire.AppendString(b, envelopeMessage)
+		b = protowire.AppendTag(b, envelopeMessageField, protowire.BytesType)
+		return protowire.AppendBytes(b, appendProtoMessage(nil, msg)), nil
+	}
+	return json.Marshal(msg)
+}
+
+// Decodes a websocket frame in the encoding
+func (e Encoding) Decode(data []byte) (Message, error) {
+	switch e {
+	case EncodingMsgpack:
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		var env msgpackEnvelope
+		if err := dec.Decode(&env); err != nil {
+			return Message{}, err
+		}
+		if env.Type != envelopeMessage || env.Message == nil {
+			return Message{}, fmt.Errorf("client: unsupported envelope type %q", env.Type)
+		}
+		return *env.Message, nil
+	case EncodingProtobuf:
+		return decodeProtoEnvelope(data)
+	}
+	var msg Message
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+type msgpackEnvelope struct {
+	Type    string   `json:"type"`
+	Message *Message `json:"message"`
+}
+
+// Field numbers from the server's wire.proto
+const (
+	envelopeTypeField    protowire.Number = 1
+	envelopeMessageField protowire.Number = 2
+
+	messageSenderField     protowire.Number = 1
+	messageEpochField      protowire.Number = 2
+	messageTextField       protowire.Number = 3
+	messageRoomNameField   protowire.Number = 4
+	messageAttachmentField protowire.Number = 5
+
+	attachmentIDField          protowire.Number = 1
+	attachmentNameField        protowire.Number = 2
+	attachmentContentTypeField protowire.Number = 3
+	attachmentSizeField        protowire.Number = 4
+	attachmentWidthField       protowire.Number = 5
+	attachmentHeightField      protowire.Number = 6
+	attachmentThumbnailField   protowire.Number = 7
+)
+
+func appendProtoMessage(b []byte, msg Message) []byte {
+	b = appendProtoString(b, messageSenderField, msg.Sender)
+	if msg.Epoch != nil {
+		b = protowire.AppendTag(b, messageEpochField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*msg.Epoch))
+	}
+	b = appendProtoString(b, messageTextField, msg.MessageText)
+	b = appendProtoString(b, messageRoomNameField, msg.RoomName)
+	if att := msg.Attachment; att != nil {
+		var a []byte
+		if att.ID != "" {
+			a = appendProtoString(a, attachmentIDField, &att.ID)
+		}
+		if att.Name != "" {
+			a = appendProtoString(a, attachmentNameField, &att.Name)
+		}
+		if att.ContentType != "" {
+			a = appendProtoString(a, attachmentContentTypeField, &att.ContentType)
+		}
+		a = appendProtoVarint(a, attachmentSizeField, uint64(att.Size))
+		a = appendProtoVarint(a, attachmentWidthField, uint64(att.Width))
+		a = appendProtoVarint(a, attachmentHeightField, uint64(att.Height))
+		a = appendProtoVarint(a, attachmentThumbnailField, protowire.EncodeBool(att.Thumbnail))
+		b = protowire.AppendTag(b, messageAttachmentField, protowire.BytesType)
+		b = protowire.AppendBytes(b, a)
+	}
+	return b
+}
+
+// Appends a string field if s is set, even to "", so the decoder can tell it was set
+func appendProtoString(b []byte, num protowire.Number, s *string) []byte {
+	if s == nil {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, *s)
+}
+
+// Appends a varint field unless it is zero, which proto3 leaves out
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func decodeProtoEnvelope(data []byte) (Message, error) {
+	var eventType string
+	var msg *Message
+	err := consumeProto(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == envelopeTypeField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			eventType = v
+			return n, nil
+		case num == envelopeMessageField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			m, err := decodeProtoMessage(v)
+			msg = &m
+			return n, err
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	if eventType != envelopeMessage || msg == nil {
+		return Message{}, fmt.Errorf("client: unsupported envelope type %q", eventType)
+	}
+	return *msg, nil
+}
+
+func decodeProtoMessage(data []byte) (Message, error) {
+	var msg Message
+	err := consumeProto(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == messageSenderField && typ == protowire.BytesType:
+			return consumeProtoString(b, &msg.Sender)
+		case num == messageEpochField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			epoch := int64(v)
+			msg.Epoch = &epoch
+			return n, nil
+		case num == messageTextField && typ == protowire.BytesType:
+			return consumeProtoString(b, &msg.MessageText)
+		case num == messageRoomNameField && typ == protowire.BytesType:
+			return consumeProtoString(b, &msg.RoomName)
+		case num == messageAttachmentField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			att, err := decodeProtoAttachment(v)
+			msg.Attachment = &att
+			return n, err
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return msg, err
+}
+
+func decodeProtoAttachment(data []byte) (Attachment, error) {
+	var att Attachment
+	err := consumeProto(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			switch num {
+			case attachmentIDField:
+				att.ID = v
+			case attachmentNameField:
+				att.Name = v
+			case attachmentContentTypeField:
+				att.ContentType = v
+			}
+			return n, nil
+		}
+		if typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case attachmentSizeField:
+				att.Size = int64(v)
+			case attachmentWidthField:
+				att.Width = int(int32(v))
+			case attachmentHeightField:
+				att.Height = int(int32(v))
+			case attachmentThumbnailField:
+				att.Thumbnail = protowire.DecodeBool(v)
+			}
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return att, err
+}
+
+func consumeProtoString(b []byte, s **string) (int, error) {
+	v, n := protowire.ConsumeString(b)
+	*s = &v
+	return n, nil
+}
+
+// Calls field with the number, type and remaining bytes of each field in data. field returns how
+// many bytes the value took, negative for a protowire error, and skips fields it doesn't know.
+func consumeProto(data []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n, err := field(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Frames the server's codecs write for each fixture, kept with the server's wire.proto. Reading
+// them here checks the client and server codecs against each other.
+var wireGoldenDir = filepath.Join("..", "..", "Database", "testdata", "wire")
+
+var encodings = []Encoding{EncodingJSON, EncodingMsgpack, EncodingProtobuf}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func int64Ptr(n int64) *int64 {
+	return &n
+}
+
+// The same messages as the server's wire tests
+var wireFixtures = []struct {
+	name string
+	msg  Message
+}{
+	{"text", Message{Sender: strPtr("alice"), Epoch: int64Ptr(1704067200), MessageText: strPtr("hello, world"), RoomName: strPtr("lobby")}},
+	{"attachment", Message{Sender: strPtr("bob"), Epoch: int64Ptr(1704067201), MessageText: strPtr("see attached"), RoomName: strPtr("ops"),
+		Attachment: &Attachment{
+			ID:   "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			Name: "screenshot.png", ContentType: "image/png", Size: 123456, Width: 1280, Height: 720, Thumbnail: true,
+		}}},
+	// A message as a client posts it, without an epoch, and with text set but empty
+	{"posted", Message{Sender: strPtr("carol"), MessageText: strPtr(""), RoomName: strPtr("lobby")}},
+	{"unset", Message{}},
+	{"unicode", Message{Sender: strPtr("dörte"), Epoch: int64Ptr(1), MessageText: strPtr("héllo 👋 <b>\u2028\"quoted\"</b>"), RoomName: strPtr("café")}},
+}
+
+// Frames the client encodes are the ones the server writes, and it decodes the server's frames
+func TestWireGolden(t *testing.T) {
+	for _, e := range encodings {
+		for _, fx := range wireFixtures {
+			path := filepath.Join(wireGoldenDir, fx.name+"."+string(e))
+			golden, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := e.Encode(fx.msg)
+			if err != nil {
+				t.Fatalf("%s: encoding %s: %v", e, fx.name, err)
+			}
+			if !bytes.Equal(data, golden) {
+				t.Errorf("%s: encoded %s = %x, want %x from %s", e, fx.name, data, golden, path)
+			}
+			got, err := e.Decode(golden)
+			if err != nil {
+				t.Fatalf("%s: decoding %s: %v", e, path, err)
+			}
+			if !reflect.DeepEqual(got, fx.msg) {
+				t.Errorf("%s: decoded %s = %s, want %s", e, path, describe(got), describe(fx.msg))
+			}
+		}
+	}
+}
+
+// Formats a message with its pointers followed, for failures
+func describe(msg Message) string {
+	s := func(p *string) string {
+		if p == nil {
+			return "nil"
+		}
+		return fmt.Sprintf("%q", *p)
+	}
+	epoch := "nil"
+	if msg.Epoch != nil {
+		epoch = fmt.Sprint(*msg.Epoch)
+	}
+	return fmt.Sprintf("{sender %s epoch %s text %s room %s attachment %+v}", s(msg.Sender), epoch, s(msg.MessageText), s(msg.RoomName), msg.Attachment)
+}
+
+func TestWireDecodeErrors(t *testing.T) {
+	text := wireFixtures[0].msg
+	protoFrame, _ := EncodingProtobuf.Encode(text)
+	msgpackFrame, _ := EncodingMsgpack.Encode(text)
+
+	for _, tc := range []struct {
+		name     string
+		encoding Encoding
+		data     []byte
+	}{
+		{"json truncated", EncodingJSON, []byte(`{"sender":"alice"`)},
+		{"msgpack truncated", EncodingMsgpack, msgpackFrame[:len(msgpackFrame)-1]},
+		{"msgpack other type", EncodingMsgpack, bytes.Replace(msgpackFrame, []byte(envelopeMessage), []byte("receipt"), 1)},
+		{"protobuf truncated", EncodingProtobuf, protoFrame[:len(protoFrame)-1]},
+		{"protobuf other type", EncodingProtobuf, bytes.Replace(protoFrame, []byte(envelopeMessage), []byte("receipt"), 1)},
+		{"protobuf no message", EncodingProtobuf, protowire.AppendString(protowire.AppendTag(nil, envelopeTypeField, protowire.BytesType), envelopeMessage)},
+	} {
+		if _, err := tc.encoding.Decode(tc.data); err == nil {
+			t.Errorf("%s: Decode succeeded, want an error", tc.name)
+		}
+	}
+}
+
+// Fields a newer server adds to wire.proto are skipped
+func TestWireProtobufUnknownFields(t *testing.T) {
+	msg := wireFixtures[1].msg
+	inner := appendProtoMessage(nil, msg)
+	inner = protowire.AppendTag(inner, 15, protowire.VarintType)
+	inner = protowire.AppendVarint(inner, 42)
+	inner = protowire.AppendTag(inner, 16, protowire.BytesType)
+	inner = protowire.AppendString(inner, "later")
+	data := protowire.AppendTag(nil, envelopeTypeField, protowire.BytesType)
+	data = protowire.AppendString(data, envelopeMessage)
+	data = protowire.AppendTag(data, 3, protowire.Fixed64Type)
+	data = protowire.AppendFixed64(data, 7)
+	data = protowire.AppendTag(data, envelopeMessageField, protowire.BytesType)
+	data = protowire.AppendBytes(data, inner)
+
+	got, err := EncodingProtobuf.Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("decoded %s, want %s", describe(got), describe(msg))
+	}
+}
+
+// Returns n messages like those in a busy chat: short lines of text from a handful of senders
+// across many rooms, one in ten with an attachment
+func sampleMessages(n int) []Message {
+	words := strings.Fields("the quick brown fox jumps over lazy dog deploy failed again build green " +
+		"review merged ticket lunch meeting tomorrow thanks sounds good see you there ok")
+	rng := rand.New(rand.NewSource(1))
+	msgs := make([]Message, n)
+	for i := range msgs {
+		text := make([]string, 3+rng.Intn(20))
+		for j := range text {
+			text[j] = words[rng.Intn(len(words))]
+		}
+		msgs[i] = Message{
+			Sender:      strPtr(fmt.Sprintf("user-%d", rng.Intn(50))),
+			Epoch:       int64Ptr(1704067200 + int64(i)),
+			MessageText: strPtr(strings.Join(text, " ")),
+			RoomName:    strPtr(fmt.Sprintf("room-%d", rng.Intn(200))),
+		}
+		if i%10 == 0 {
+			id := make([]byte, 32)
+			rng.Read(id)
+			msgs[i].Attachment = &Attachment{
+				ID: hex.EncodeToString(id), Name: "screenshot.png", ContentType: "image/png",
+				Size: int64(20000 + rng.Intn(500000)), Width: 1280, Height: 720,
+			}
+		}
+	}
+	return msgs
+}
+
+// Also reports each encoding's average frame size, and its size compressed on its own as
+// permessage-deflate without context takeover does
+func BenchmarkWireEncode(b *testing.B) {
+	sample := sampleMessages(1000)
+	for _, e := range encodings {
+		b.Run(string(e), func(b *testing.B) {
+			var size, deflated int
+			var buf bytes.Buffer
+			w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+			for _, msg := range sample {
+				frame, err := e.Encode(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				buf.Reset()
+				w.Reset(&buf)
+				w.Write(frame)
+				w.Flush()
+				size += len(frame)
+				// Flush ends with an empty block that permessage-deflate leaves off
+				deflated += buf.Len() - 4
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := e.Encode(sample[i%len(sample)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size)/float64(len(sample)), "bytes/msg")
+			b.ReportMetric(float64(deflated)/float64(len(sample)), "deflated-bytes/msg")
+		})
+	}
+}
+
+func BenchmarkWireDecode(b *testing.B) {
+	sample := sampleMessages(1000)
+	for _, e := range encodings {
+		frames := make([][]byte, len(sample))
+		for i, msg := range sample {
+			var err error
+			if frames[i], err = e.Encode(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(string(e), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := e.Decode(frames[i%len(frames)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
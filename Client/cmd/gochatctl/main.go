@@ -0,0 +1,577 @@
+/*
+gochatctl manages a GoChat server through its admin API.
+
+	gochatctl -server http://localhost:8080 -token $TOKEN users
+	gochatctl users disable mallory
+	gochatctl -o json stats
+
+The server and token default to the GOCHAT_SERVER and GOCHAT_ADMIN_TOKEN environment variables.
+The token is the server's admin.token. Run gochatctl help for the list of commands.
+*/
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/austin-mc/GoChat/Client/client"
+)
+
+// A gochatctl command. Names are one or two words, e.g. "users" or "users create".
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(ctx context.Context, c *client.Client, args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"users", "", "list users", listUsers},
+		{"users create", "<name>", "create a user", createUser},
+		{"users rename", "<name> <new-name>", "rename a user", renameUser},
+		{"users disable", "<name>", "disable a user, disconnecting them and removing them from their rooms", setUserDisabled(true)},
+		{"users enable", "<name>", "enable a disabled user", setUserDisabled(false)},
+		{"users delete", "<name>", "delete a user and their messages", deleteUser},
+		{"users reset-key", "<name>", "remove a user's published encryption keys so they can publish new ones", resetKey},
+		{"rooms", "", "list rooms", listRooms},
+		{"rooms create", "<name> [-owner user] [-encrypted]", "create a room", createRoom},
+		{"rooms rename", "<name> <new-name>", "rename a room", renameRoom},
+		{"rooms owner", "<name> [user]", "make a user the owner of a room, or leave it without one", setRoomOwner},
+		{"rooms disable", "<name>", "disable a room, removing its members and stopping new messages", setRoomDisabled(true)},
+		{"rooms enable", "<name>", "enable a disabled room", setRoomDisabled(false)},
+		{"rooms delete", "<name>", "delete a room and its messages", deleteRoom},
+		{"rooms export", "<name> [-file path]", "export a room, gzipped if the file ends in .gz", exportRoom},
+		{"rooms import", "[-file path] [-room name] [-user old:new] [-merge]", "import a room export", importRoom},
+		{"connections", "", "list open websocket connections", listConnections},
+		{"connections drop", "<user>", "close a user's websocket", dropConnection},
+		{"stats", "", "show server wide counts", showStats},
+		{"retention", "[-limit n]", "show retention settings and recent prune runs", showRetention},
+		{"retention run", "", "run the message pruner now", runRetention},
+		{"backup", "", "back up the server's database", backup},
+		{"backups", "", "list the database backups on the server", listBackups},
+		{"help", "", "show this help", nil},
+	}
+}
+
+// Output mode, "table" or "json"
+var output string
+
+// Skip confirmation prompts
+var assumeYes bool
+
+func main() {
+	server := flag.String("server", envOr("GOCHAT_SERVER", "http://localhost:8080"), "URL of the chat server (env GOCHAT_SERVER)")
+	token := flag.String("token", "", "admin token (env GOCHAT_ADMIN_TOKEN)")
+	timeout := flag.Duration("timeout", 30*time.Second, "time allowed for each command, 0 for none")
+	flag.StringVar(&output, "o", "table", "output format: table or json")
+	flag.BoolVar(&assumeYes, "y", false, "don't ask before deleting")
+	flag.Usage = usage
+	flag.Parse()
+
+	if output != "table" && output != "json" {
+		fatal(fmt.Errorf("output format %q must be table or json", output))
+	}
+	cmd, args := findCommand(flag.Args())
+	if cmd == nil || cmd.run == nil {
+		usage()
+		if cmd == nil {
+			os.Exit(2)
+		}
+		return
+	}
+	// Read after parsing so the token isn't printed as the flag's default
+	if *token == "" {
+		*token = os.Getenv("GOCHAT_ADMIN_TOKEN")
+	}
+	if *token == "" {
+		fatal(errors.New("an admin token is required: pass -token or set GOCHAT_ADMIN_TOKEN"))
+	}
+
+	c, err := client.New(*server, client.WithAuth(client.BearerToken(*token)))
+	if err != nil {
+		fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	if err := cmd.run(ctx, c, args); err != nil {
+		fatal(err)
+	}
+}
+
+// Finds the command named by the first one or two arguments and returns the rest
+func findCommand(args []string) (*command, []string) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	if len(args) > 1 {
+		for i := range commands {
+			if commands[i].name == args[0]+" "+args[1] {
+				return &commands[i], args[2:]
+			}
+		}
+	}
+	for i := range commands {
+		if commands[i].name == args[0] {
+			return &commands[i], args[1:]
+		}
+	}
+	return nil, nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: gochatctl [flags] <command> [args]\n\nCommands:\n")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.usage)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// Prints the error and exits. API errors are printed without their code in table mode.
+func fatal(err error) {
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) && output == "table" {
+		fmt.Fprintf(os.Stderr, "gochatctl: %s\n", apiErr.Message)
+	} else {
+		fmt.Fprintf(os.Stderr, "gochatctl: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// Checks that a command was given exactly n positional arguments
+func wantArgs(args []string, n int, names string) error {
+	if len(args) != n {
+		return fmt.Errorf("usage: %s", names)
+	}
+	return nil
+}
+
+// Asks the user to confirm a destructive action, unless -y was given
+func confirm(prompt string) bool {
+	if assumeYes {
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+var errCancelled = errors.New("cancelled")
+
+func listUsers(ctx context.Context, c *client.Client, args []string) error {
+	users, err := c.AdminUsers(ctx)
+	if err != nil {
+		return err
+	}
+	return render(users, func(t *table) {
+		t.row("NAME", "ID", "STATUS", "MESSAGES", "LAST MESSAGE", "CONNECTED", "ROOMS")
+		for _, u := range users {
+			status := "active"
+			if u.Disabled {
+				status = "disabled"
+			} else if u.Integration {
+				status = "integration"
+			}
+			t.row(u.Name, u.UserID, status, u.Messages, formatTime(u.LastMessage), yesNo(u.Connected), strings.Join(u.Rooms, ","))
+		}
+	})
+}
+
+func createUser(ctx context.Context, c *client.Client, args []string) error {
+	if err := wantArgs(args, 1, "users create <name>"); err != nil {
+		return err
+	}
+	user, err := c.AdminCreateUser(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return renderDone(user, "Created user %s with id %d", *user.Name, *user.UserID)
+}
+
+func renameUser(ctx context.Context, c *client.Client, args []string) error {
+	if err := wantArgs(args, 2, "users rename <name> <new-name>"); err != nil {
+		return err
+	}
+	user, err := c.UpdateUser(ctx, args[0], client.AdminUpdate{Name: &args[1]})
+	if err != nil {
+		return err
+	}
+	return renderDone(user, "Renamed user %s to %s", args[0], args[1])
+}
+
+func setUserDisabled(disabled bool) func(ctx context.Context, c *client.Client, args []string) error {
+	return func(ctx context.Context, c *client.Client, args []string) error {
+		if err := wantArgs(args, 1, "users disable|enable <name>"); err != nil {
+			return err
+		}
+		user, err := c.UpdateUser(ctx, args[0], client.AdminUpdate{Disabled: &disabled})
+		if err != nil {
+			return err
+		}
+		return renderDone(user, "User %s is now %s", args[0], enabledText(disabled))
+	}
+}
+
+func deleteUser(ctx context.Context, c *client.Client, args []string) error {
+	if err := wantArgs(args, 1, "users delete <name>"); err != nil {
+		return err
+	}
+	if !confirm(fmt.Sprintf("Delete user %s and all of their messages?", args[0])) {
+		return errCancelled
+	}
+	if err := c.DeleteUser(ctx, args[0]); err != nil {
+		return err
+	}
+	return renderDone(nil, "Deleted user %s", args[0])
+}
+
+func resetKey(ctx context.Context, c *client.Client, args []string) error {
+	if err := wantArgs(args, 1, "users reset-key <name>"); err != nil {
+		return err
+	}
+	if !confirm(fmt.Sprintf("Reset the encryption keys of %s? Other members will be warned their key changed.", args[0])) {
+		return errCancelled
+	}
+	if err := c.ResetKey(ctx, args[0]); err != nil {
+		return err
+	}
+	return renderDone(nil, "Reset the keys of user %s", args[0])
+}
+
+func listRooms(ctx context.Context, c *client.Client, args []string) error {
+	rooms, err := c.AdminRooms(ctx)
+	if err != nil {
+		return err
+	}
+	return render(rooms, func(t *table) {
+		t.row("NAME", "ID", "OWNER", "STATUS", "ENCRYPTED", "MESSAGES", "LAST MESSAGE", "MEMBERS")
+		for _, r := range rooms {
+			status := "active"
+			if r.Disabled {
+				status = "disabled"
+			}
+			t.row(r.Name, r.RoomID, orDash(r.Owner), status, yesNo(r.Encrypted), r.Messages, formatTime(r.LastMessage), strings.Join(r.Members, ","))
+		}
+	})
+}
+
+func createRoom(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("rooms create", flag.ContinueOnError)
+	owner := fs.String("owner", "", "user who owns the room")
+	encrypted := fs.Bool("encrypted", false, "only accept end-to-end encrypted messages")
+	name, err := parseWithName(fs, args, "rooms create <name> [-owner user] [-encrypted]")
+	if err != nil {
+		return err
+	}
+	if err := c.AdminCreateRoom(ctx, name, *owner, *encrypted); err != nil {
+		return err
+	}
+	return renderDone(nil, "Created room %s", name)
+}
+
+func renameRoom(ctx context.Context, c *client.Client, args []string) error {
+	if err := wantArgs(args, 2, "rooms rename <name> <new-name>"); err != nil {
+		return err
+	}
+	if err := c.UpdateRoom(ctx, args[0], client.AdminUpdate{Name: &args[1]}); err != nil {
+		return err
+	}
+	return renderDone(nil, "Renamed room %s to %s", args[0], args[1])
+}
+
+func setRoomOwner(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return fmt.Errorf("usage: rooms owner <name> [user]")
+	}
+	owner := ""
+	if len(args) == 2 {
+		owner = args[1]
+	}
+	if err := c.UpdateRoom(ctx, args[0], client.AdminUpdate{Owner: &owner}); err != nil {
+		return err
+	}
+	if owner == "" {
+		return renderDone(nil, "Room %s no longer has an owner", args[0])
+	}
+	return renderDone(nil, "Room %s is now owned by %s", args[0], owner)
+}
+
+func setRoomDisabled(disabled bool) func(ctx context.Context, c *client.Client, args []string) error {
+	return func(ctx context.Context, c *client.Client, args []string) error {
+		if err := wantArgs(args, 1, "rooms disable|enable <name>"); err != nil {
+			return err
+		}
+		if err := c.UpdateRoom(ctx, args[0], client.AdminUpdate{Disabled: &disabled}); err != nil {
+			return err
+		}
+		return renderDone(nil, "Room %s is now %s", args[0], enabledText(disabled))
+	}
+}
+
+func deleteRoom(ctx context.Context, c *client.Client, args []string) error {
+	if err := wantArgs(args, 1, "rooms delete <name>"); err != nil {
+		return err
+	}
+	if !confirm(fmt.Sprintf("Delete room %s and all of its messages?", args[0])) {
+		return errCancelled
+	}
+	if err := c.DeleteRoom(ctx, args[0]); err != nil {
+		return err
+	}
+	return renderDone(nil, "Deleted room %s", args[0])
+}
+
+func exportRoom(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("rooms export", flag.ContinueOnError)
+	file := fs.String("file", "-", "file to write, - for stdout")
+	name, err := parseWithName(fs, args, "rooms export <name> [-file path]")
+	if err != nil {
+		return err
+	}
+	if *file == "-" {
+		return c.ExportRoom(ctx, name, os.Stdout)
+	}
+
+	// Write to a temporary file so a failed export doesn't leave a truncated one behind
+	tmp := *file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if strings.HasSuffix(*file, ".gz") {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+	err = c.ExportRoom(ctx, name, w)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, *file); err != nil {
+		return err
+	}
+	if output == "table" {
+		fmt.Fprintf(os.Stderr, "Exported room %s to %s\n", name, *file)
+	}
+	return nil
+}
+
+func importRoom(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("rooms import", flag.ContinueOnError)
+	file := fs.String("file", "-", "export to read, - for stdin")
+	room := fs.String("room", "", "import under this room name instead of the exported one")
+	merge := fs.Bool("merge", false, "add the messages to an existing room")
+	opts := client.ImportOptions{Users: make(map[string]string)}
+	fs.Func("user", "map an exported user to another name, as old:new (repeatable)", func(v string) error {
+		from, to, ok := strings.Cut(v, ":")
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("user mapping %q must be old:new", v)
+		}
+		opts.Users[from] = to
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("usage: rooms import [-file path] [-room name] [-user old:new] [-merge]")
+	}
+	opts.Room = *room
+	opts.Merge = *merge
+
+	var r io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+		opts.Gzip = strings.HasSuffix(*file, ".gz")
+	}
+	result, err := c.ImportRoom(ctx, r, opts)
+	if err != nil {
+		return err
+	}
+	return renderDone(result, "Imported %d messages into room %s, created %d users, %d attachments missing",
+		result.Messages, result.Room, len(result.UsersCreated), result.AttachmentsMissing)
+}
+
+func listConnections(ctx context.Context, c *client.Client, args []string) error {
+	conns, err := c.Connections(ctx)
+	if err != nil {
+		return err
+	}
+	return render(conns, func(t *table) {
+		t.row("USER", "ID", "REMOTE ADDRESS", "TRANSPORT", "ENCODING", "CONNECTED", "QUEUED", "ROOMS")
+		for _, conn := range conns {
+			t.row(conn.User, conn.UserID, conn.RemoteAddr, conn.Transport, conn.Encoding, formatTime(conn.Connected), conn.Queued, strings.Join(conn.Rooms, ","))
+		}
+	})
+}
+
+func dropConnection(ctx context.Context, c *client.Client, args []string) error {
+	if err := wantArgs(args, 1, "connections drop <user>"); err != nil {
+		return err
+	}
+	if err := c.DropConnection(ctx, args[0]); err != nil {
+		return err
+	}
+	return renderDone(nil, "Dropped the connection of %s", args[0])
+}
+
+func showStats(ctx context.Context, c *client.Client, args []string) error {
+	stats, err := c.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	return render(stats, func(t *table) {
+		t.row("Started", formatTime(stats.Started))
+		t.row("Uptime", stats.Uptime)
+		t.row("Schema version", stats.SchemaVersion)
+		t.row("Database size", formatBytes(stats.DatabaseBytes))
+		t.row("Users", stats.Users)
+		t.row("Rooms", stats.Rooms)
+		t.row("Messages", stats.Messages)
+		t.row("Attachments", fmt.Sprintf("%d (%s)", stats.Attachments, formatBytes(stats.AttachmentBytes)))
+		t.row("Connections", stats.Connections)
+		t.row("Room members", stats.RoomMembers)
+		t.row("Goroutines", stats.Goroutines)
+	})
+}
+
+func showRetention(ctx context.Context, c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ContinueOnError)
+	limit := fs.Int("limit", 10, "number of recent runs to show")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	status, err := c.RetentionStatus(ctx, *limit)
+	if err != nil {
+		return err
+	}
+	return render(status, func(t *table) {
+		t.row("Max age", status.MaxAge)
+		t.row("Max count", status.MaxCount)
+		t.row("Interval", status.Interval)
+		t.row("Archive dir", orDash(status.ArchiveDir))
+		t.row("")
+		t.row("RUN", "STARTED", "DURATION", "DELETED", "ERROR")
+		for _, run := range status.Runs {
+			duration := time.Duration(run.Finished-run.Started) * time.Second
+			t.row(run.ID, formatTime(run.Started), duration, run.Deleted, orDash(run.Error))
+		}
+	})
+}
+
+func runRetention(ctx context.Context, c *client.Client, args []string) error {
+	run, err := c.RunRetention(ctx)
+	if err != nil {
+		return err
+	}
+	return render(run, func(t *table) {
+		t.row("ROOM", "DELETED")
+		for _, room := range run.Rooms {
+			t.row(room.Room, room.Deleted)
+		}
+		t.row("total", run.Deleted)
+		if run.Archive != "" {
+			t.row("")
+			t.row("Archived to", run.Archive)
+		}
+	})
+}
+
+func backup(ctx context.Context, c *client.Client, args []string) error {
+	b, err := c.Backup(ctx)
+	if err != nil {
+		return err
+	}
+	if err := renderDone(b, "Backed up the database to %s on the server (%s in %s)", b.Path, formatBytes(b.Size), b.Duration); err != nil {
+		return err
+	}
+	if output != "json" {
+		for _, path := range b.Removed {
+			fmt.Println("Removed old backup", path)
+		}
+	}
+	return nil
+}
+
+func listBackups(ctx context.Context, c *client.Client, args []string) error {
+	backups, err := c.Backups(ctx)
+	if err != nil {
+		return err
+	}
+	return render(backups, func(t *table) {
+		t.row("CREATED", "SIZE", "PATH")
+		for _, b := range backups.Backups {
+			t.row(formatTime(b.Created), formatBytes(b.Size), b.Path)
+		}
+	})
+}
+
+// Parses a command's flags, which may come before or after its single name argument
+func parseWithName(fs *flag.FlagSet, args []string, usage string) (string, error) {
+	var name string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if name == "" && fs.NArg() == 1 {
+		name = fs.Arg(0)
+	} else if fs.NArg() != 0 {
+		name = ""
+	}
+	if name == "" {
+		return "", errors.New("usage: " + usage)
+	}
+	return name, nil
+}
+
+func enabledText(disabled bool) string {
+	if disabled {
+		return "disabled"
+	}
+	return "enabled"
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Aligned columns written to stdout
+type table struct {
+	w *tabwriter.Writer
+}
+
+// Writes one row, formatting each cell with %v
+func (t *table) row(cells ...interface{}) {
+	parts := make([]string, len(cells))
+	for i, cell := range cells {
+		parts[i] = fmt.Sprint(cell)
+	}
+	fmt.Fprintln(t.w, strings.Join(parts, "\t"))
+}
+
+// Prints v as JSON, or as a table drawn by fill
+func render(v interface{}, fill func(t *table)) error {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	t := &table{w: tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)}
+	fill(t)
+	return t.w.Flush()
+}
+
+// Prints the result of an action: v as JSON, or the formatted message. Actions without a result
+// print nothing in JSON mode.
+func renderDone(v interface{}, format string, args ...interface{}) error {
+	if output == "json" {
+		if v == nil {
+			return nil
+		}
+		return render(v, nil)
+	}
+	fmt.Printf(format+"\n", args...)
+	return nil
+}
+
+// Formats an epoch in seconds as local time, or "-" for zero
+func formatTime(epoch int64) string {
+	if epoch == 0 {
+		return "-"
+	}
+	return time.Unix(epoch, 0).Format("2006-01-02 15:04:05")
+}
+
+// Formats a byte count with a binary unit
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1024*1024*1024:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1024*1024*1024))
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,308 @@
+/*
+wirebench compares the websocket encodings, JSON, MessagePack and protobuf, by measuring delivery
+from a running server. For each encoding, with and without compression, it connects -receivers
+websocket clients to a room, posts -messages messages to it and reports how many messages a second
+reached the receivers and how many bytes each message took on the wire:
+
+	wirebench -server http://localhost:8080 -token $TOKEN
+
+The users and rooms it creates are named with a random prefix. With an admin token they are
+deleted afterwards, so it can run against a server that already has data. The encoders themselves
+are benchmarked by go test -bench Wire in Client/client and Database.
+*/
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/austin-mc/GoChat/Client/client"
+	"github.com/gorilla/websocket"
+)
+
+// Encodings compared, JSON first as the baseline
+var encodings = []client.Encoding{client.EncodingJSON, client.EncodingMsgpack, client.EncodingProtobuf}
+
+// Words the sample texts are made of
+var words = strings.Fields("the quick brown fox jumps over lazy dog deploy failed again build green " +
+	"review merged ticket lunch meeting tomorrow thanks sounds good see you there ok")
+
+func main() {
+	server := flag.String("server", envOr("GOCHAT_SERVER", "http://localhost:8080"), "URL of the chat server to measure delivery from (env GOCHAT_SERVER)")
+	token := flag.String("token", "", "admin token, to delete the users and rooms created (env GOCHAT_ADMIN_TOKEN)")
+	samples := flag.Int("samples", 1000, "distinct sample texts to post")
+	messages := flag.Int("messages", 1000, "messages posted to each room when measuring delivery")
+	receivers := flag.Int("receivers", 10, "websocket clients receiving each message")
+	senders := flag.Int("senders", 4, "clients posting messages concurrently")
+	timeout := flag.Duration("timeout", 2*time.Minute, "time allowed for each delivery run")
+	flag.Parse()
+
+	// Read after parsing so the token isn't printed as the flag's default
+	if *token == "" {
+		*token = os.Getenv("GOCHAT_ADMIN_TOKEN")
+	}
+	if *samples < 1 || *messages < 1 || *receivers < 1 || *senders < 1 {
+		fatal(errors.New("-samples, -messages, -receivers and -senders must be at least 1"))
+	}
+
+	b := &bench{server: *server, prefix: randomPrefix(), sample: sampleTexts(*samples), messages: *messages, receivers: *receivers, senders: *senders}
+	if *token != "" {
+		admin, err := client.New(*server, client.WithAuth(client.BearerToken(*token)))
+		if err != nil {
+			fatal(err)
+		}
+		b.admin = admin
+	}
+	fmt.Printf("Delivering %d messages to %d receivers from %s:\n", *messages, *receivers, *server)
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "ENCODING\tCOMPRESSION\tWIRE BYTES/MSG\tMSGS/S\tELAPSED")
+	for _, e := range encodings {
+		for _, compression := range []bool{false, true} {
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			r, err := b.run(ctx, e, compression)
+			cancel()
+			if err != nil {
+				out.Flush()
+				b.fail(fmt.Errorf("%s, compression %t: %w", e, compression, err))
+			}
+			fmt.Fprintf(out, "%s\t%t\t%.1f\t%.0f\t%v\n", e, compression, r.bytesPerMessage, r.rate, r.elapsed.Round(time.Millisecond))
+		}
+	}
+	out.Flush()
+	b.cleanup()
+}
+
+// Returns n lines of text like those in a busy chat
+func sampleTexts(n int) []string {
+	rng := mathrand.New(mathrand.NewSource(1))
+	texts := make([]string, n)
+	for i := range texts {
+		text := make([]string, 3+rng.Intn(20))
+		for j := range text {
+			text[j] = words[rng.Intn(len(words))]
+		}
+		texts[i] = strings.Join(text, " ")
+	}
+	return texts
+}
+
+// Settings and names shared by the delivery runs
+type bench struct {
+	server string
+	prefix string
+	// Texts posted are taken from the sample
+	sample    []string
+	messages  int
+	receivers int
+	senders   int
+	// Deletes what was created, nil without a token
+	admin *client.Client
+
+	users []string
+	rooms []string
+}
+
+// Results of one delivery run
+type deliveryResult struct {
+	bytesPerMessage float64
+	rate            float64
+	elapsed         time.Duration
+}
+
+// Posts the messages to a new room with every receiver connected in the encoding, and waits for
+// all of them to arrive everywhere
+func (b *bench) run(ctx context.Context, e client.Encoding, compression bool) (deliveryResult, error) {
+	var r deliveryResult
+	room := fmt.Sprintf("%s%s-%t", b.prefix, e, compression)
+	b.rooms = append(b.rooms, room)
+
+	// Counts the bytes read from every receiver's connection
+	var read atomic.Int64
+	dialer := *websocket.DefaultDialer
+	dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, read: &read}, nil
+	}
+
+	received := make(chan struct{}, b.receivers)
+	for i := 0; i < b.receivers; i++ {
+		c, err := b.login(ctx, fmt.Sprintf("receiver%d", i), room,
+			client.WithTransports(client.TransportWebsocket), client.WithEncoding(e),
+			client.WithCompression(compression), client.WithDialer(&dialer),
+			client.WithEventBuffer(b.messages))
+		if err != nil {
+			return r, err
+		}
+		defer c.Close()
+		events := c.Events()
+		if err := c.Connect(ctx); err != nil {
+			return r, err
+		}
+		if got := c.Encoding(); got != e {
+			return r, fmt.Errorf("the server agreed to %q", got)
+		}
+		go func() {
+			n := 0
+			for ev := range events {
+				if msg, ok := ev.(client.MessageEvent); ok && deref(msg.Message.RoomName) == room {
+					if n++; n == b.messages {
+						received <- struct{}{}
+					}
+				}
+			}
+		}()
+	}
+
+	// Senders post over HTTP, so their own encoding doesn't count
+	senders := make([]*client.Client, b.senders)
+	for i := range senders {
+		c, err := b.login(ctx, fmt.Sprintf("sender%d", i), room)
+		if err != nil {
+			return r, err
+		}
+		senders[i] = c
+	}
+
+	before := read.Load()
+	start := time.Now()
+	errs := make(chan error, b.senders)
+	var wg sync.WaitGroup
+	for i, c := range senders {
+		wg.Add(1)
+		go func(i int, c *client.Client) {
+			defer wg.Done()
+			for n := i; n < b.messages; n += len(senders) {
+				if err := c.PostMessage(ctx, room, b.sample[n%len(b.sample)]); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return r, err
+	}
+	for i := 0; i < b.receivers; i++ {
+		select {
+		case <-received:
+		case <-ctx.Done():
+			return r, fmt.Errorf("only %d of %d receivers got every message", i, b.receivers)
+		}
+	}
+	r.elapsed = time.Since(start)
+	delivered := float64(b.messages * b.receivers)
+	r.bytesPerMessage = float64(read.Load()-before) / delivered
+	r.rate = delivered / r.elapsed.Seconds()
+	return r, nil
+}
+
+// Returns a client logged in as the user, who has joined the room
+func (b *bench) login(ctx context.Context, name, room string, opts ...client.Option) (*client.Client, error) {
+	name = b.prefix + name
+	c, err := client.New(b.server, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Login(ctx, name); err != nil {
+		return nil, err
+	}
+	if !contains(b.users, name) {
+		b.users = append(b.users, name)
+	}
+	if err := c.JoinRoom(ctx, room); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Deletes the users and rooms created, if there is an admin token
+func (b *bench) cleanup() {
+	if b.admin == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, room := range b.rooms {
+		if err := b.admin.DeleteRoom(ctx, room); err != nil && !client.IsCode(err, client.ErrCodeRoomNotFound) {
+			fmt.Fprintf(os.Stderr, "wirebench: deleting room %s: %v\n", room, err)
+		}
+	}
+	for _, user := range b.users {
+		if err := b.admin.DeleteUser(ctx, user); err != nil {
+			fmt.Fprintf(os.Stderr, "wirebench: deleting user %s: %v\n", user, err)
+		}
+	}
+}
+
+// Cleans up, then exits like fatal
+func (b *bench) fail(err error) {
+	b.cleanup()
+	fatal(err)
+}
+
+// A connection that counts the bytes read from it
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// Returns a prefix for this run's names, so runs don't collide with each other or existing data
+func randomPrefix() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		fatal(err)
+	}
+	return "wb" + hex.EncodeToString(b) + "-"
+}
+
+// Returns the environment variable, or def if it is unset
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "wirebench: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Server used when there is no config file and no --server flag
+const defaultServerURL = "http://localhost:8080"
+
+// Client configuration file containing named server profiles
+type ClientConfig struct {
+	DefaultProfile string             `yaml:"defaultProfile"`
+	Profiles       map[string]Profile `yaml:"profiles"`
+}
+
+// Everything needed to connect to one chat server
+type Profile struct {
+	URL      string    `yaml:"url"`
+	Username string    `yaml:"username"`
+	TLS      TLSConfig `yaml:"tls"`
+	Rooms    []string  `yaml:"rooms"`
+	TUI      bool      `yaml:"tui"`
+
+	// Directory holding the identity keys for end-to-end encrypted rooms
+	KeyDir string `yaml:"keyDir"`
+}
+
+type TLSConfig struct {
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+// Profile the client is running with
+var profile Profile
+
+// Returns the default location of the client config file, ~/.config/gochat/client.yaml on Linux
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gochat", "client.yaml")
+}
+
+// Returns the default directory for identity keys on the server, e.g.
+// ~/.config/gochat/keys/chat.example.com_8443 on Linux. Key files are named after the user, so each
+// server gets its own directory to keep the same name on two servers from sharing a key.
+func defaultKeyDir(serverURL string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	u, err := neturl.Parse(serverURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	// Ports are separated with a colon, which Windows doesn't allow in file names
+	return filepath.Join(dir, "gochat", "keys", strings.ReplaceAll(u.Host, ":", "_"))
+}
+
+// Reads the config file. A missing file at the default location is not an error.
+func readClientConfig(path string, explicit bool) (ClientConfig, error) {
+	var cfg ClientConfig
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("reading config file: %v", err)
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing config file %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Selects the profile to use from the config file and command line flags
+func loadProfile(args []string) (Profile, error) {
+	fs := flag.NewFlagSet("gochat", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to the client config file (default "+defaultConfigPath()+")")
+	profileName := fs.String("profile", "", "name of the server profile to use")
+	server := fs.String("server", "", "server URL, overrides the profile's url")
+	user := fs.String("user", "", "user name, overrides the profile's username")
+	tui := fs.Bool("tui", false, "use the full-screen terminal interface")
+	if err := fs.Parse(args); err != nil {
+		return Profile{}, err
+	}
+
+	path, explicit := *configPath, true
+	if path == "" {
+		path, explicit = defaultConfigPath(), false
+	}
+	cfg, err := readClientConfig(path, explicit)
+	if err != nil {
+		return Profile{}, err
+	}
+
+	name := *profileName
+	if name == "" {
+		name = cfg.DefaultProfile
+	}
+	var p Profile
+	if name != "" {
+		var ok bool
+		if p, ok = cfg.Profiles[name]; !ok {
+			return Profile{}, fmt.Errorf("unknown profile %q, available profiles: %s", name, strings.Join(cfg.profileNames(), ", "))
+		}
+	}
+
+	if *server != "" {
+		p.URL = *server
+	}
+	if *user != "" {
+		p.Username = *user
+	}
+	if *tui {
+		p.TUI = true
+	}
+	if p.URL == "" {
+		p.URL = defaultServerURL
+	}
+	p.URL = strings.TrimRight(p.URL, "/")
+	if !strings.HasPrefix(p.URL, "http://") && !strings.HasPrefix(p.URL, "https://") {
+		return Profile{}, fmt.Errorf("server url %q must start with http:// or https://", p.URL)
+	}
+	if p.KeyDir == "" {
+		p.KeyDir = defaultKeyDir(p.URL)
+	}
+	return p, nil
+}
+
+// Returns the sorted names of all profiles in the config
+func (c ClientConfig) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testClientConfig = `
+defaultProfile: dev
+profiles:
+  dev:
+    url: http://localhost:8080/
+    username: alice
+    rooms: [general]
+  staging:
+    url: https://chat.staging.example.com:8443
+    username: alice
+    tui: true
+  pinned:
+    url: https://chat.example.com
+    username: bob
+    keyDir: /srv/gochat/keys
+`
+
+// Points the user config directory at a new temporary directory and writes the client config to
+// its default location there, unless config is empty. Returns the config directory.
+func setupClientConfig(t *testing.T, config string) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != "" {
+		path := filepath.Join(configDir, "gochat", "client.yaml")
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return configDir
+}
+
+func TestLoadProfile(t *testing.T) {
+	configDir := setupClientConfig(t, testClientConfig)
+	keys := filepath.Join(configDir, "gochat", "keys")
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		want Profile
+	}{
+		{"default profile", nil, Profile{URL: "http://localhost:8080", Username: "alice", Rooms: []string{"general"},
+			KeyDir: filepath.Join(keys, "localhost_8080")}},
+		{"named profile", []string{"--profile", "staging"}, Profile{URL: "https://chat.staging.example.com:8443", Username: "alice", TUI: true,
+			KeyDir: filepath.Join(keys, "chat.staging.example.com_8443")}},
+		{"profile's key directory", []string{"--profile", "pinned"}, Profile{URL: "https://chat.example.com", Username: "bob",
+			KeyDir: "/srv/gochat/keys"}},
+		// The key directory follows the server, so keys aren't shared with the profile's own server
+		{"server overrides profile", []string{"--profile", "staging", "--server", "https://chat.example.com"}, Profile{URL: "https://chat.example.com", Username: "alice", TUI: true,
+			KeyDir: filepath.Join(keys, "chat.example.com")}},
+		{"user overrides profile", []string{"--user", "carol", "--tui"}, Profile{URL: "http://localhost:8080", Username: "carol", Rooms: []string{"general"}, TUI: true,
+			KeyDir: filepath.Join(keys, "localhost_8080")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := loadProfile(tc.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.URL != tc.want.URL || p.Username != tc.want.Username || p.TUI != tc.want.TUI || p.KeyDir != tc.want.KeyDir ||
+				strings.Join(p.Rooms, ",") != strings.Join(tc.want.Rooms, ",") {
+				t.Errorf("loadProfile(%q) = %+v, want %+v", tc.args, p, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadProfileErrors(t *testing.T) {
+	setupClientConfig(t, testClientConfig)
+	for _, tc := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"unknown profile", []string{"--profile", "prod"}, "dev, pinned, staging"},
+		{"missing config", []string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}, "reading config file"},
+		{"bad server", []string{"--server", "chat.example.com"}, "must start with http:// or https://"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := loadProfile(tc.args); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("loadProfile(%q) returned %v, want an error containing %q", tc.args, err, tc.want)
+			}
+		})
+	}
+}
+
+// Without a config file the client connects to the local server as before
+func TestLoadProfileWithoutConfig(t *testing.T) {
+	configDir := setupClientConfig(t, "")
+	p, err := loadProfile(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.URL != defaultServerURL || p.KeyDir != filepath.Join(configDir, "gochat", "keys", "localhost_8080") {
+		t.Errorf("loadProfile = %+v, want the default server and its key directory", p)
+	}
+}
+
+// The example config only selects profiles that load
+func TestExampleClientConfig(t *testing.T) {
+	setupClientConfig(t, "")
+	for _, name := range []string{"dev", "staging"} {
+		if _, err := loadProfile([]string{"--config", "client.example.yaml", "--profile", name}); err != nil {
+			t.Errorf("loading profile %s from client.example.yaml: %v", name, err)
+		}
+	}
+}
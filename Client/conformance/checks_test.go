@@ -0,0 +1,876 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/austin-mc/GoChat/Client/client"
+	"github.com/gorilla/websocket"
+)
+
+// One conformance check
+type check struct {
+	name string
+	run  func(ctx context.Context, s *suite) error
+}
+
+var checks = []check{
+	{"users are created, fetched and unique", checkUsers},
+	{"rooms are unique and listed in byte order", checkRooms},
+	{"messages keep their order and text", checkMessages},
+	{"history pages from the newest message", checkHistory},
+	{"admin counts messages per user and room", checkAdminCounts},
+	{"renamed users keep their messages", checkRename},
+	{"disabled users can't post", checkDisabled},
+	{"retention keeps the newest messages", checkRetention},
+	{"exported rooms import unchanged", checkExportImport},
+	{"deleted rooms and users are gone", checkDelete},
+	{"schema version matches", checkSchema},
+	{"messages arrive over every transport", checkTransports},
+	{"closes reach every transport", checkTransportClose},
+	{"messages arrive in every websocket encoding", checkEncodings},
+}
+
+// Transports the event checks connect over
+var transports = []client.Transport{client.TransportWebsocket, client.TransportSSE, client.TransportLongPoll}
+
+// Encodings the encoding check asks websockets for
+var encodings = []client.Encoding{client.EncodingJSON, client.EncodingMsgpack, client.EncodingProtobuf}
+
+// Checks run by TestCluster against two servers sharing a database and broker
+var clusterChecks = []check{
+	{"messages reach sockets on the other server", checkClusterMessages},
+	{"room members are shared", checkClusterMembers},
+	{"renames reach the other server", checkClusterRename},
+	{"dropped connections close on the other server", checkClusterDrop},
+	{"a user connects to one server at a time", checkClusterReplace},
+}
+
+// Time allowed for an event to reach the other server
+const relayTimeout = 5 * time.Second
+
+// State shared by the checks
+type suite struct {
+	server string
+	admin  *client.Client
+	// The second server and its admin client, in TestCluster
+	peer      string
+	peerAdmin *client.Client
+	prefix    string
+	users     []string
+	rooms     []string
+}
+
+// Returns a prefix for this run's names, so runs don't collide with each other or existing data
+func randomPrefix(t *testing.T) string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return "cf" + hex.EncodeToString(b) + "-"
+}
+
+// Returns a name for this run, remembered as a user or room to delete afterwards
+func (s *suite) user(name string) string {
+	name = s.prefix + name
+	s.users = append(s.users, name)
+	return name
+}
+
+func (s *suite) room(name string) string {
+	name = s.prefix + name
+	s.rooms = append(s.rooms, name)
+	return name
+}
+
+// Returns a client of the first server logged in as the user, created if needed, who has joined the given rooms
+func (s *suite) login(ctx context.Context, name string, rooms ...string) (*client.Client, error) {
+	return s.loginTo(ctx, s.server, name, rooms...)
+}
+
+// Returns a client of the given server logged in as the user, creating them if needed, who has
+// joined the given rooms. The client doesn't reconnect on its own, so a closed socket stays closed.
+func (s *suite) loginTo(ctx context.Context, server, name string, rooms ...string) (*client.Client, error) {
+	return s.loginWith(ctx, server, name, nil, rooms...)
+}
+
+// Returns a client of the first server that connects only over the given transport, logged in as
+// the user who has joined the given rooms
+func (s *suite) loginOver(ctx context.Context, t client.Transport, name string, rooms ...string) (*client.Client, error) {
+	return s.loginWith(ctx, s.server, name, []client.Option{client.WithTransports(t)}, rooms...)
+}
+
+func (s *suite) loginWith(ctx context.Context, server, name string, opts []client.Option, rooms ...string) (*client.Client, error) {
+	opts = append([]client.Option{client.WithReconnectBackoff(time.Hour, time.Hour)}, opts...)
+	c, err := client.New(server, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Login(ctx, name); err != nil {
+		return nil, err
+	}
+	for _, room := range rooms {
+		if err := c.JoinRoom(ctx, room); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Posts each text to the room in order
+func post(ctx context.Context, c *client.Client, room string, texts ...string) error {
+	for _, text := range texts {
+		if err := c.PostMessage(ctx, room, text); err != nil {
+			return fmt.Errorf("posting %q: %w", text, err)
+		}
+	}
+	return nil
+}
+
+// Returns the sender and text of each message as "sender: text"
+func lines(msgs []client.Message) []string {
+	out := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, deref(m.Sender)+": "+deref(m.MessageText))
+	}
+	return out
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return "<nil>"
+	}
+	return *s
+}
+
+// Returns an error describing the difference if got isn't want
+func expect(what string, got, want []string) error {
+	if strings.Join(got, "\n") != strings.Join(want, "\n") || len(got) != len(want) {
+		return fmt.Errorf("%s: got %q, want %q", what, got, want)
+	}
+	return nil
+}
+
+// Returns an error unless err is an API error with the given code
+func expectCode(what string, err error, code string) error {
+	if !client.IsCode(err, code) {
+		return fmt.Errorf("%s: got error %v, want %s", what, err, code)
+	}
+	return nil
+}
+
+func checkUsers(ctx context.Context, s *suite) error {
+	name := s.user("alice")
+	created, err := s.admin.CreateUser(ctx, name)
+	if err != nil {
+		return err
+	}
+	got, err := s.admin.GetUser(ctx, name)
+	if err != nil {
+		return err
+	}
+	if got.UserID == nil || created.UserID == nil || *got.UserID != *created.UserID {
+		return fmt.Errorf("user ID changed between create and get")
+	}
+	_, err = s.admin.CreateUser(ctx, name)
+	if err := expectCode("creating a duplicate user", err, client.ErrCodeUserExists); err != nil {
+		return err
+	}
+	_, err = s.admin.GetUser(ctx, s.prefix+"nobody")
+	return expectCode("getting a missing user", err, client.ErrCodeUserNotFound)
+}
+
+func checkRooms(ctx context.Context, s *suite) error {
+	owner := s.user("owner")
+	if _, err := s.admin.CreateUser(ctx, owner); err != nil {
+		return err
+	}
+	// Upper case sorts before lower case byte by byte, but not in most locale collations
+	want := []string{s.room("B"), s.room("a"), s.room("b")}
+	for _, room := range []string{want[2], want[0], want[1]} {
+		if err := s.admin.AdminCreateRoom(ctx, room, owner, false); err != nil {
+			return err
+		}
+	}
+	err := s.admin.AdminCreateRoom(ctx, want[0], owner, false)
+	if err := expectCode("creating a duplicate room", err, client.ErrCodeRoomExists); err != nil {
+		return err
+	}
+	rooms, err := s.admin.Rooms(ctx)
+	if err != nil {
+		return err
+	}
+	var ours []string
+	for _, room := range rooms {
+		if strings.HasPrefix(room, s.prefix) {
+			ours = append(ours, room)
+		}
+	}
+	return expect("room list", ours, want)
+}
+
+// Texts that would break a careless rewrite of placeholders or quoting
+var awkwardTexts = []string{
+	"first",
+	"it's a 'quoted' \"string\"",
+	"what about ? and $1 and :name",
+	"héllo, 世界 🙂",
+	"second to last; DROP TABLE Messages; --",
+	"last",
+}
+
+func checkMessages(ctx context.Context, s *suite) error {
+	room := s.room("messages")
+	name := s.user("poster")
+	c, err := s.login(ctx, name, room)
+	if err != nil {
+		return err
+	}
+	// Posted within the same second, so only insertion order tells them apart
+	if err := post(ctx, c, room, awkwardTexts...); err != nil {
+		return err
+	}
+	msgs, err := c.Messages(ctx, room, time.Time{})
+	if err != nil {
+		return err
+	}
+	var want []string
+	for _, text := range awkwardTexts {
+		want = append(want, name+": "+text)
+	}
+	if err := expect("messages", lines(msgs), want); err != nil {
+		return err
+	}
+	since, err := c.Messages(ctx, room, time.Unix(*msgs[0].Epoch, 0))
+	if err != nil {
+		return err
+	}
+	return expect("messages since the first", lines(since), want)
+}
+
+func checkHistory(ctx context.Context, s *suite) error {
+	room := s.room("history")
+	name := s.user("historian")
+	c, err := s.login(ctx, name, room)
+	if err != nil {
+		return err
+	}
+	if err := post(ctx, c, room, "h1", "h2", "h3", "h4", "h5"); err != nil {
+		return err
+	}
+	page, err := c.History(ctx, room, time.Time{}, 2)
+	if err != nil {
+		return err
+	}
+	if err := expect("newest page", lines(page), []string{name + ": h4", name + ": h5"}); err != nil {
+		return err
+	}
+	// Everything was sent before the next second
+	page, err = c.History(ctx, room, time.Now().Add(2*time.Second), 10)
+	if err != nil {
+		return err
+	}
+	return expect("whole history", lines(page), []string{name + ": h1", name + ": h2", name + ": h3", name + ": h4", name + ": h5"})
+}
+
+func checkAdminCounts(ctx context.Context, s *suite) error {
+	room := s.room("counts")
+	name := s.user("counter")
+	c, err := s.login(ctx, name, room)
+	if err != nil {
+		return err
+	}
+	if err := post(ctx, c, room, "one", "two", "three"); err != nil {
+		return err
+	}
+	users, err := s.admin.AdminUsers(ctx)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, u := range users {
+		if u.Name == name {
+			found = true
+			if u.Messages != 3 || u.LastMessage == 0 || u.Disabled || u.Integration {
+				return fmt.Errorf("admin user %s: got %d messages, last %d, disabled %v, integration %v", name, u.Messages, u.LastMessage, u.Disabled, u.Integration)
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("user %s missing from the admin user list", name)
+	}
+	rooms, err := s.admin.AdminRooms(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range rooms {
+		if r.Name == room {
+			if r.Messages != 3 || r.LastMessage == 0 || r.Encrypted || r.Disabled {
+				return fmt.Errorf("admin room %s: got %d messages, last %d, encrypted %v, disabled %v", room, r.Messages, r.LastMessage, r.Encrypted, r.Disabled)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("room %s missing from the admin room list", room)
+}
+
+func checkRename(ctx context.Context, s *suite) error {
+	room := s.room("rename")
+	name := s.user("before")
+	renamed := s.user("after")
+	c, err := s.login(ctx, name, room)
+	if err != nil {
+		return err
+	}
+	if err := post(ctx, c, room, "hello"); err != nil {
+		return err
+	}
+	if _, err := s.admin.UpdateUser(ctx, name, client.AdminUpdate{Name: &renamed}); err != nil {
+		return err
+	}
+	msgs, err := s.admin.Messages(ctx, room, time.Time{})
+	if err != nil {
+		return err
+	}
+	if err := expect("messages after rename", lines(msgs), []string{renamed + ": hello"}); err != nil {
+		return err
+	}
+	_, err = s.admin.GetUser(ctx, name)
+	return expectCode("getting the old name", err, client.ErrCodeUserNotFound)
+}
+
+func checkDisabled(ctx context.Context, s *suite) error {
+	room := s.room("disabled")
+	name := s.user("mallory")
+	c, err := s.login(ctx, name, room)
+	if err != nil {
+		return err
+	}
+	disabled := true
+	if _, err := s.admin.UpdateUser(ctx, name, client.AdminUpdate{Disabled: &disabled}); err != nil {
+		return err
+	}
+	err = c.PostMessage(ctx, room, "let me in")
+	if err := expectCode("posting while disabled", err, client.ErrCodeUserDisabled); err != nil {
+		return err
+	}
+	disabled = false
+	if _, err := s.admin.UpdateUser(ctx, name, client.AdminUpdate{Disabled: &disabled}); err != nil {
+		return err
+	}
+	// Disabling removed the user from their rooms
+	if err := c.JoinRoom(ctx, room); err != nil {
+		return err
+	}
+	if err := post(ctx, c, room, "back again"); err != nil {
+		return err
+	}
+	msgs, err := c.Messages(ctx, room, time.Time{})
+	if err != nil {
+		return err
+	}
+	return expect("messages", lines(msgs), []string{name + ": back again"})
+}
+
+func checkRetention(ctx context.Context, s *suite) error {
+	room := s.room("retention")
+	name := s.user("keeper")
+	c, err := s.login(ctx, name, room)
+	if err != nil {
+		return err
+	}
+	if err := post(ctx, c, room, "r1", "r2", "r3", "r4"); err != nil {
+		return err
+	}
+	// Joining created the room, so the user owns it
+	body, _ := json.Marshal(map[string]int{"maxCount": 2})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.server+"/chat/room/"+neturl.PathEscape(room)+"/retention", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Name", name)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("setting the room's retention: %s", resp.Status)
+	}
+
+	run, err := s.admin.RunRetention(ctx)
+	if err != nil {
+		return err
+	}
+	if run.Error != "" {
+		return fmt.Errorf("prune run failed: %s", run.Error)
+	}
+	msgs, err := c.Messages(ctx, room, time.Time{})
+	if err != nil {
+		return err
+	}
+	return expect("messages after pruning", lines(msgs), []string{name + ": r3", name + ": r4"})
+}
+
+func checkExportImport(ctx context.Context, s *suite) error {
+	room := s.room("export")
+	copied := s.room("import")
+	name := s.user("exporter")
+	c, err := s.login(ctx, name, room)
+	if err != nil {
+		return err
+	}
+	if err := post(ctx, c, room, awkwardTexts...); err != nil {
+		return err
+	}
+	var export bytes.Buffer
+	if err := s.admin.ExportRoom(ctx, room, &export); err != nil {
+		return err
+	}
+	res, err := s.admin.ImportRoom(ctx, &export, client.ImportOptions{Room: copied})
+	if err != nil {
+		return err
+	}
+	if res.Messages != len(awkwardTexts) || len(res.UsersCreated) != 0 {
+		return fmt.Errorf("import: got %d messages and created users %q, want %d and none", res.Messages, res.UsersCreated, len(awkwardTexts))
+	}
+	orig, err := c.Messages(ctx, room, time.Time{})
+	if err != nil {
+		return err
+	}
+	imported, err := c.Messages(ctx, copied, time.Time{})
+	if err != nil {
+		return err
+	}
+	if err := expect("imported messages", lines(imported), lines(orig)); err != nil {
+		return err
+	}
+	for i := range orig {
+		if *orig[i].Epoch != *imported[i].Epoch {
+			return fmt.Errorf("imported message %d: got epoch %d, want %d", i, *imported[i].Epoch, *orig[i].Epoch)
+		}
+	}
+	return nil
+}
+
+func checkDelete(ctx context.Context, s *suite) error {
+	room := s.prefix + "deleted"
+	name := s.prefix + "deleted"
+	c, err := s.login(ctx, name, room)
+	if err != nil {
+		return err
+	}
+	if err := post(ctx, c, room, "soon gone"); err != nil {
+		return err
+	}
+	if err := s.admin.DeleteRoom(ctx, room); err != nil {
+		return err
+	}
+	_, err = s.admin.Messages(ctx, room, time.Time{})
+	if err := expectCode("reading a deleted room", err, client.ErrCodeRoomNotFound); err != nil {
+		return err
+	}
+	if err := s.admin.DeleteUser(ctx, name); err != nil {
+		return err
+	}
+	_, err = s.admin.GetUser(ctx, name)
+	return expectCode("getting a deleted user", err, client.ErrCodeUserNotFound)
+}
+
+func checkSchema(ctx context.Context, s *suite) error {
+	health, err := s.admin.Ready(ctx)
+	if err != nil {
+		return err
+	}
+	if !health.OK() {
+		return fmt.Errorf("server isn't ready: %s", health.Status)
+	}
+	stats, err := s.admin.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if health.SchemaVersion == 0 || stats.SchemaVersion != health.SchemaVersion {
+		return fmt.Errorf("schema version is %d in /health/ready and %d in stats", health.SchemaVersion, stats.SchemaVersion)
+	}
+	return nil
+}
+
+// Calls fn until it succeeds, returning its last error if it hasn't within relayTimeout
+func eventually(ctx context.Context, fn func() error) error {
+	ctx, cancel := context.WithTimeout(ctx, relayTimeout)
+	defer cancel()
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// Waits for the client's websocket to deliver a message with the given text
+func waitForMessage(ctx context.Context, c *client.Client, text string) error {
+	ctx, cancel := context.WithTimeout(ctx, relayTimeout)
+	defer cancel()
+	events := c.Events()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s didn't receive %q", c.UserName(), text)
+		case ev, ok := <-events:
+			if !ok {
+				return fmt.Errorf("%s's client closed waiting for %q", c.UserName(), text)
+			}
+			if msg, isMsg := ev.(client.MessageEvent); isMsg && deref(msg.Message.MessageText) == text {
+				return nil
+			}
+		}
+	}
+}
+
+// Returns an error unless the members of the room on the given server are want, in any order
+func expectMembers(ctx context.Context, c *client.Client, room string, want ...string) error {
+	members, err := c.Members(ctx, room)
+	if err != nil {
+		return err
+	}
+	sort.Strings(members)
+	sort.Strings(want)
+	return expect("members of "+room+" on "+c.BaseURL(), members, want)
+}
+
+// Returns an error unless the user's connection to the server is open, or closed
+func expectConnected(ctx context.Context, admin *client.Client, user string, open bool) error {
+	conns, err := admin.Connections(ctx)
+	if err != nil {
+		return err
+	}
+	for _, conn := range conns {
+		if conn.User == user {
+			if !open {
+				return fmt.Errorf("%s is still connected to %s", user, admin.BaseURL())
+			}
+			return nil
+		}
+	}
+	if open {
+		return fmt.Errorf("%s isn't connected to %s", user, admin.BaseURL())
+	}
+	return nil
+}
+
+// Returns an error unless the user's connection to the server uses the transport
+func expectTransport(ctx context.Context, admin *client.Client, user string, t client.Transport) error {
+	conns, err := admin.Connections(ctx)
+	if err != nil {
+		return err
+	}
+	for _, conn := range conns {
+		if conn.User == user {
+			if conn.Transport != string(t) {
+				return fmt.Errorf("%s is connected over %q, want %q", user, conn.Transport, t)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't connected to %s", user, admin.BaseURL())
+}
+
+func expectEncoding(ctx context.Context, admin *client.Client, user string, e client.Encoding) error {
+	conns, err := admin.Connections(ctx)
+	if err != nil {
+		return err
+	}
+	for _, conn := range conns {
+		if conn.User == user {
+			if conn.Encoding != string(e) {
+				return fmt.Errorf("%s is connected with %q, want %q", user, conn.Encoding, e)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't connected to %s", user, admin.BaseURL())
+}
+
+func checkTransports(ctx context.Context, s *suite) error {
+	room := s.room("transports")
+	sender, err := s.login(ctx, s.user("sender"), room)
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	for _, t := range transports {
+		name := s.user("over-" + string(t))
+		c, err := s.loginOver(ctx, t, name, room)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		// Events sent before the channel exists are only given to handlers
+		c.Events()
+		if err := c.Connect(ctx); err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
+		if got := c.Transport(); got != t {
+			return fmt.Errorf("connected over %q, want %q", got, t)
+		}
+		if err := expectTransport(ctx, s.admin, name, t); err != nil {
+			return err
+		}
+		// Posting over HTTP and over a websocket both reach the connection
+		text := "to " + string(t)
+		if err := post(ctx, sender, room, text); err != nil {
+			return err
+		}
+		if err := waitForMessage(ctx, c, text); err != nil {
+			return err
+		}
+		if err := post(ctx, c, room, "from "+string(t)); err != nil {
+			return err
+		}
+		if err := waitForMessage(ctx, c, "from "+string(t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkEncodings(ctx context.Context, s *suite) error {
+	room := s.room("encodings")
+	sender, err := s.login(ctx, s.user("sender"), room)
+	if err != nil {
+		return err
+	}
+	defer sender.Close()
+	for _, e := range encodings {
+		for _, compression := range []bool{false, true} {
+			name := s.user(fmt.Sprintf("in-%s-%t", e, compression))
+			opts := []client.Option{client.WithTransports(client.TransportWebsocket), client.WithEncoding(e), client.WithCompression(compression)}
+			c, err := s.loginWith(ctx, s.server, name, opts, room)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			c.Events()
+			if err := c.Connect(ctx); err != nil {
+				return fmt.Errorf("%s: %w", e, err)
+			}
+			if got := c.Encoding(); got != e {
+				return fmt.Errorf("connected with %q, want %q", got, e)
+			}
+			if err := expectEncoding(ctx, s.admin, name, e); err != nil {
+				return err
+			}
+			// Posting over HTTP and in the encoding both reach the connection
+			text := fmt.Sprintf("to %s, compressed %t", e, compression)
+			if err := post(ctx, sender, room, text); err != nil {
+				return err
+			}
+			if err := waitForMessage(ctx, c, text); err != nil {
+				return err
+			}
+			text = fmt.Sprintf("from %s, compressed %t", e, compression)
+			if err := post(ctx, c, room, text); err != nil {
+				return err
+			}
+			if err := waitForMessage(ctx, c, text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkTransportClose(ctx context.Context, s *suite) error {
+	for _, t := range transports {
+		name := s.user("closed-" + string(t))
+		c, err := s.loginOver(ctx, t, name)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		events := c.Events()
+		if err := c.Connect(ctx); err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
+		if err := s.admin.DropConnection(ctx, name); err != nil {
+			return err
+		}
+		if err := waitForClose(ctx, events, "Disconnected by an administrator"); err != nil {
+			return fmt.Errorf("%s: %w", t, err)
+		}
+		if err := expectConnected(ctx, s.admin, name, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Waits for a disconnect with the close reason the server gave
+func waitForClose(ctx context.Context, events <-chan client.Event, reason string) error {
+	ctx, cancel := context.WithTimeout(ctx, relayTimeout)
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no disconnect with reason %q", reason)
+		case ev := <-events:
+			d, ok := ev.(client.DisconnectedEvent)
+			if !ok {
+				continue
+			}
+			var closeErr *websocket.CloseError
+			if !errors.As(d.Err, &closeErr) || closeErr.Text != reason {
+				return fmt.Errorf("disconnected with %v, want close reason %q", d.Err, reason)
+			}
+			return nil
+		}
+	}
+}
+
+func checkClusterMessages(ctx context.Context, s *suite) error {
+	room := s.room("relay")
+	a, err := s.loginTo(ctx, s.server, s.user("here"), room)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := s.loginTo(ctx, s.peer, s.user("there"), room)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	if err := a.Connect(ctx); err != nil {
+		return err
+	}
+	if err := b.Connect(ctx); err != nil {
+		return err
+	}
+	// Each posts over its own server's websocket and hears the other through the broker
+	if err := post(ctx, b, room, "from the peer"); err != nil {
+		return err
+	}
+	if err := waitForMessage(ctx, a, "from the peer"); err != nil {
+		return err
+	}
+	if err := post(ctx, a, room, "from the server"); err != nil {
+		return err
+	}
+	return waitForMessage(ctx, b, "from the server")
+}
+
+func checkClusterMembers(ctx context.Context, s *suite) error {
+	room := s.room("members")
+	name := s.user("member")
+	a, err := s.loginTo(ctx, s.server, name, room)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if err := eventually(ctx, func() error { return expectMembers(ctx, s.peerAdmin, room, name) }); err != nil {
+		return err
+	}
+	// Leaving on the peer is seen by the first server
+	b, err := s.loginTo(ctx, s.peer, name)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	if err := b.LeaveRoom(ctx, room); err != nil {
+		return err
+	}
+	return eventually(ctx, func() error { return expectMembers(ctx, s.admin, room) })
+}
+
+func checkClusterRename(ctx context.Context, s *suite) error {
+	room := s.room("renamed")
+	name := s.user("old")
+	renamed := s.user("new")
+	a, err := s.loginTo(ctx, s.server, name, room)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if err := eventually(ctx, func() error { return expectMembers(ctx, s.peerAdmin, room, name) }); err != nil {
+		return err
+	}
+	if _, err := s.peerAdmin.UpdateUser(ctx, name, client.AdminUpdate{Name: &renamed}); err != nil {
+		return err
+	}
+	return eventually(ctx, func() error { return expectMembers(ctx, s.admin, room, renamed) })
+}
+
+func checkClusterDrop(ctx context.Context, s *suite) error {
+	name := s.user("dropped")
+	a, err := s.loginTo(ctx, s.server, name)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if err := a.Connect(ctx); err != nil {
+		return err
+	}
+	if err := expectConnected(ctx, s.admin, name, true); err != nil {
+		return err
+	}
+	if err := s.peerAdmin.DropConnection(ctx, name); err != nil {
+		return err
+	}
+	return eventually(ctx, func() error { return expectConnected(ctx, s.admin, name, false) })
+}
+
+func checkClusterReplace(ctx context.Context, s *suite) error {
+	name := s.user("roamer")
+	a, err := s.loginTo(ctx, s.server, name)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if err := a.Connect(ctx); err != nil {
+		return err
+	}
+	b, err := s.loginTo(ctx, s.peer, name)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	if err := b.Connect(ctx); err != nil {
+		return err
+	}
+	if err := eventually(ctx, func() error { return expectConnected(ctx, s.admin, name, false) }); err != nil {
+		return err
+	}
+	return expectConnected(ctx, s.peerAdmin, name, true)
+}
+
+// Deletes the rooms and users the checks created. Ones already deleted or renamed away are skipped.
+func (s *suite) cleanup(ctx context.Context) error {
+	var errs []error
+	for _, room := range s.rooms {
+		if err := s.admin.DeleteRoom(ctx, room); err != nil && !client.IsCode(err, client.ErrCodeRoomNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	for _, user := range s.users {
+		if err := s.admin.DeleteUser(ctx, user); err != nil && !client.IsCode(err, client.ErrCodeUserNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
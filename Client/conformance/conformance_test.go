@@ -0,0 +1,201 @@
+// Package conformance checks that a GoChat server stores and returns data the same way whichever
+// database it runs on. The tests build the server from ../../Database and drive it through the
+// public and admin APIs, so the same checks run against the SQLite and PostgreSQL backends. They
+// also check that websockets, server-sent event streams and long-polling deliver the same events,
+// in every websocket encoding, and that servers sharing a database and a NATS broker relay room
+// events to each other.
+//
+// SQLite always runs. PostgreSQL runs against GOCHAT_TEST_POSTGRES_URL, an empty database the
+// checks may migrate and write to, and the cluster checks against the NATS server at
+// GOCHAT_TEST_NATS_URL; each is skipped when its variable is unset. scripts/conformance.sh and
+// scripts/cluster.sh start those servers locally or in docker and run the tests against them.
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/austin-mc/GoChat/Client/client"
+)
+
+// Admin token the test servers are started with
+const adminToken = "conformance"
+
+// Time allowed for each check
+const checkTimeout = 30 * time.Second
+
+// Time allowed for a server to start answering, and to stop
+const serverTimeout = 10 * time.Second
+
+// Server binary built by TestMain
+var serverBinary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gochat-conformance")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "conformance:", err)
+		os.Exit(1)
+	}
+	serverBinary = filepath.Join(dir, "gochat")
+	build := exec.Command("go", "build", "-o", serverBinary, ".")
+	build.Dir = filepath.Join("..", "..", "Database")
+	build.Stdout, build.Stderr = os.Stderr, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "conformance: building the server:", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("sqlite", func(t *testing.T) {
+		server := startServer(t, "-database-path", filepath.Join(t.TempDir(), "gochat.db"))
+		runChecks(t, newSuite(t, server, ""), checks)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		url := os.Getenv("GOCHAT_TEST_POSTGRES_URL")
+		if url == "" {
+			t.Skip("set GOCHAT_TEST_POSTGRES_URL to run the checks against PostgreSQL")
+		}
+		server := startServer(t, "-database-driver", "postgres", "-database-url", url)
+		runChecks(t, newSuite(t, server, ""), checks)
+	})
+}
+
+// Runs two servers sharing one SQLite database and a NATS broker, and checks that they still pass
+// the checks and that room events posted to one reach members connected to the other
+func TestCluster(t *testing.T) {
+	url := os.Getenv("GOCHAT_TEST_NATS_URL")
+	if url == "" {
+		t.Skip("set GOCHAT_TEST_NATS_URL to run the cluster checks")
+	}
+	path := filepath.Join(t.TempDir(), "gochat.db")
+	// The subject is unique to this run so a shared NATS server doesn't mix runs
+	subject := fmt.Sprintf("gochat.test.%d", time.Now().UnixNano())
+	args := []string{"-database-path", path, "-broker-driver", "nats", "-broker-url", url, "-broker-subject", subject}
+	server := startServer(t, args...)
+	peer := startServer(t, args...)
+	runChecks(t, newSuite(t, server, peer), append(append([]check(nil), checks...), clusterChecks...))
+}
+
+// Returns a suite driving server, and peer when it is set, that deletes what it created when the
+// test ends
+func newSuite(t *testing.T, server, peer string) *suite {
+	t.Helper()
+	admin, err := client.New(server, client.WithAuth(client.BearerToken(adminToken)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &suite{server: server, admin: admin, prefix: randomPrefix(t)}
+	if peer != "" {
+		s.peer = peer
+		if s.peerAdmin, err = client.New(peer, client.WithAuth(client.BearerToken(adminToken))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		defer cancel()
+		if err := s.cleanup(ctx); err != nil {
+			t.Errorf("cleaning up: %v", err)
+		}
+	})
+	return s
+}
+
+// Runs each check as a subtest
+func runChecks(t *testing.T, s *suite, run []check) {
+	for _, c := range run {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+			defer cancel()
+			if err := c.run(ctx, s); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Starts the server with the given flags on a free port and returns its URL once it is ready. The
+// server is stopped when the test ends, and its log is printed if the test failed.
+func startServer(t *testing.T, args ...string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	dir := t.TempDir()
+	logFile, err := os.Create(filepath.Join(dir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(serverBinary, append([]string{
+		"-listen", addr,
+		"-admin-token", adminToken,
+		"-attachments-dir", filepath.Join(dir, "attachments"),
+		"-backup-dir", filepath.Join(dir, "backups"),
+	}, args...)...)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		// Interrupt asks for a graceful shutdown, which Windows can't deliver
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			cmd.Process.Kill()
+		}
+		select {
+		case <-exited:
+		case <-time.After(serverTimeout):
+			cmd.Process.Kill()
+			<-exited
+		}
+		logFile.Close()
+		if t.Failed() {
+			if log, err := os.ReadFile(logFile.Name()); err == nil {
+				t.Logf("server %s log:\n%s", addr, log)
+			}
+		}
+	})
+
+	url := "http://" + addr
+	deadline := time.Now().Add(serverTimeout)
+	for {
+		resp, err := http.Get(url + "/health/ready")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return url
+			}
+		}
+		select {
+		case <-exited:
+			t.Fatalf("server exited before it was ready")
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server wasn't ready within %s", serverTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
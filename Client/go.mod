@@ -1,5 +1,22 @@
 module github.com/austin-mc/GoChat/Client
 
-go 1.18
+go 1.24.0
 
-require github.com/gorilla/websocket v1.5.0
+require (
+	github.com/gdamore/tcell/v2 v2.13.10
+	github.com/gorilla/websocket v1.5.0
+	github.com/rivo/tview v0.42.0
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/protobuf v1.36.5
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/gdamore/encoding v1.0.1 // indirect
+	github.com/lucasb-eyer/go-colorful v1.3.0 // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+	golang.org/x/term v0.37.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
+)
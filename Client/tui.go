@@ -0,0 +1,525 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/austin-mc/GoChat/Client/client"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// How often the member list is refreshed, and rooms are polled when there is no websocket
+const tuiRefreshInterval = 5 * time.Second
+
+// Maximum number of lines kept per room
+const tuiScrollbackLines = 1000
+
+// Full-screen terminal interface with a room list, per room scrollback, member list and a fixed input line
+type tui struct {
+	app        *tview.Application
+	roomList   *tview.List
+	scrollback *tview.TextView
+	members    *tview.TextView
+	input      *tview.InputField
+
+	mu        sync.Mutex
+	rooms     []string
+	current   string
+	history   map[string][]string
+	unread    map[string]int
+	lastEpoch map[string]int64
+}
+
+// Runs the TUI until the user quits
+func runTUI() error {
+	t := &tui{
+		app:       tview.NewApplication(),
+		history:   make(map[string][]string),
+		unread:    make(map[string]int),
+		lastEpoch: make(map[string]int64),
+	}
+	t.build()
+
+	// Messages and log output go to the screen instead of stdout while the TUI is running
+	messageHandler = t.addMessage
+	log.SetOutput(t)
+	defer func() {
+		messageHandler = printMessage
+		log.SetOutput(os.Stderr)
+	}()
+
+	for _, room := range chat.JoinedRooms() {
+		t.addRoom(room)
+	}
+	t.systemf("Logged in as %s. Press F1 for help.", chat.UserName())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go t.refreshLoop(stop)
+
+	return t.app.Run()
+}
+
+// Lays out the panes and installs the keyboard shortcuts
+func (t *tui) build() {
+	t.roomList = tview.NewList().ShowSecondaryText(false).SetHighlightFullLine(true)
+	t.roomList.SetBorder(true).SetTitle(" Rooms ")
+	t.roomList.SetChangedFunc(t.roomChanged)
+
+	t.scrollback = tview.NewTextView().SetDynamicColors(true).SetScrollable(true).SetWrap(true)
+	t.scrollback.SetBorder(true)
+
+	t.members = tview.NewTextView().SetDynamicColors(true)
+	t.members.SetBorder(true).SetTitle(" Members ")
+
+	t.input = tview.NewInputField().SetLabel("> ").SetFieldBackgroundColor(tcell.ColorDefault)
+	t.input.SetDoneFunc(func(key tcell.Key) {
+		if key != tcell.KeyEnter {
+			return
+		}
+		text := strings.TrimSpace(t.input.GetText())
+		t.input.SetText("")
+		if text != "" {
+			go t.handleInput(text)
+		}
+	})
+
+	panes := tview.NewFlex().
+		AddItem(t.roomList, 24, 0, false).
+		AddItem(t.scrollback, 0, 1, false).
+		AddItem(t.members, 20, 0, false)
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(panes, 0, 1, false).
+		AddItem(t.input, 1, 0, true)
+
+	t.app.SetInputCapture(t.handleKey)
+	t.app.SetRoot(layout, true).SetFocus(t.input)
+}
+
+// Global keyboard shortcuts. The input line keeps focus so typing is never interrupted.
+func (t *tui) handleKey(ev *tcell.EventKey) *tcell.EventKey {
+	switch ev.Key() {
+	case tcell.KeyCtrlN, tcell.KeyTab:
+		t.cycleRoom(1)
+		return nil
+	case tcell.KeyCtrlP, tcell.KeyBacktab:
+		t.cycleRoom(-1)
+		return nil
+	case tcell.KeyPgUp, tcell.KeyPgDn:
+		row, _ := t.scrollback.GetScrollOffset()
+		_, _, _, height := t.scrollback.GetInnerRect()
+		if ev.Key() == tcell.KeyPgUp {
+			row -= height
+		} else {
+			row += height
+		}
+		if row < 0 {
+			row = 0
+		}
+		t.scrollback.ScrollTo(row, 0)
+		return nil
+	case tcell.KeyEnd:
+		if ev.Modifiers()&tcell.ModCtrl != 0 {
+			t.scrollback.ScrollToEnd()
+			return nil
+		}
+	case tcell.KeyF1:
+		t.showHelp()
+		return nil
+	case tcell.KeyRune:
+		// Alt+1 through Alt+9 jump straight to a room
+		if ev.Modifiers()&tcell.ModAlt != 0 && ev.Rune() >= '1' && ev.Rune() <= '9' {
+			t.selectRoom(int(ev.Rune() - '1'))
+			return nil
+		}
+	}
+	return ev
+}
+
+// Handles a line typed into the input field
+func (t *tui) handleInput(text string) {
+	cmd, arg := sanitizeInput(text)
+	switch cmd {
+	case "":
+		t.mu.Lock()
+		room := t.current
+		t.mu.Unlock()
+		if room == "" {
+			t.systemf("Join a room with /join before sending messages")
+			return
+		}
+		if err := postMessage(room, arg); err != nil {
+			t.systemf("Error sending message: %v", err)
+		}
+	case "join":
+		if arg == "" {
+			t.systemf("Usage: /join <room>")
+			return
+		}
+		if err := joinRoom(arg); err != nil {
+			t.systemf("Error joining room %s: %v", arg, err)
+			return
+		}
+		t.app.QueueUpdateDraw(func() {
+			t.addRoom(arg)
+			t.selectRoom(t.roomIndex(arg))
+		})
+	case "encrypt":
+		if err := encryptRoom(arg); err != nil {
+			t.systemf("Error creating encrypted room %s: %v", arg, err)
+			return
+		}
+		t.app.QueueUpdateDraw(func() {
+			t.addRoom(arg)
+			t.selectRoom(t.roomIndex(arg))
+		})
+	case "trust":
+		fingerprint, err := trustKey(arg)
+		switch {
+		case err != nil:
+			t.systemf("Error trusting key: %v", err)
+		case arg == "":
+			t.systemf("Your key fingerprint: %s", fingerprint)
+		default:
+			t.systemf("Now trusting the key of %s with fingerprint: %s", arg, fingerprint)
+		}
+	case "leave":
+		t.mu.Lock()
+		if arg == "" {
+			arg = t.current
+		}
+		t.mu.Unlock()
+		if err := leaveRoom(arg); err != nil {
+			t.systemf("Error leaving room %s: %v", arg, err)
+			return
+		}
+		t.app.QueueUpdateDraw(func() { t.removeRoom(arg) })
+	case "status":
+		ctx, cancel := requestContext()
+		lines, err := serverStatus(ctx)
+		cancel()
+		if err != nil {
+			t.systemf("Error getting server status: %v", err)
+			return
+		}
+		// One call so the lines can't be reordered
+		t.systemf("%s", strings.Join(lines, "\n"))
+	case "upload":
+		t.mu.Lock()
+		room := t.current
+		t.mu.Unlock()
+		// Uploads can take a while, so don't block the input
+		go func() {
+			if err := uploadFile(room, arg); err != nil {
+				t.systemf("Error uploading file: %v", err)
+			}
+		}()
+	case "download":
+		go func() {
+			path, err := downloadAttachment(arg)
+			if err != nil {
+				t.systemf("Error downloading attachment: %v", err)
+				return
+			}
+			t.systemf("Saved attachment to %s", path)
+		}()
+	case "help":
+		t.app.QueueUpdateDraw(t.showHelp)
+	case "quit":
+		t.app.Stop()
+	default:
+		t.systemf("Unknown command /%s, press F1 for help", cmd)
+	}
+}
+
+// Adds a room to the room list and loads the last hour of its history
+func (t *tui) addRoom(room string) {
+	t.mu.Lock()
+	for _, r := range t.rooms {
+		if r == room {
+			t.mu.Unlock()
+			return
+		}
+	}
+	t.rooms = append(t.rooms, room)
+	t.lastEpoch[room] = time.Now().Unix() - 3600
+	first := t.current == ""
+	t.renderRoomListLocked()
+	if first {
+		t.switchRoomLocked(room)
+	}
+	t.mu.Unlock()
+
+	go t.loadHistory(room)
+}
+
+// Removes a room from the room list and switches to another room if it was the current one
+func (t *tui) removeRoom(room string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, r := range t.rooms {
+		if r == room {
+			t.rooms = append(t.rooms[:i], t.rooms[i+1:]...)
+			break
+		}
+	}
+	delete(t.history, room)
+	delete(t.unread, room)
+	delete(t.lastEpoch, room)
+	if t.current == room {
+		t.current = ""
+		if len(t.rooms) > 0 {
+			t.switchRoomLocked(t.rooms[0])
+		} else {
+			t.scrollback.Clear()
+			t.scrollback.SetTitle("")
+			t.members.Clear()
+		}
+	}
+	t.renderRoomListLocked()
+}
+
+// Fetches recent messages for a room into its scrollback
+func (t *tui) loadHistory(room string) {
+	t.mu.Lock()
+	since := t.lastEpoch[room]
+	t.mu.Unlock()
+
+	ctx, cancel := requestContext()
+	messages, err := chat.Messages(ctx, room, time.Unix(since, 0))
+	cancel()
+	if err != nil {
+		t.systemf("Error loading history for %s: %v", room, err)
+		return
+	}
+	t.app.QueueUpdateDraw(func() {
+		for _, msg := range messages {
+			t.appendMessage(msg, false)
+		}
+	})
+}
+
+// Called from the receive goroutine for every incoming message
+func (t *tui) addMessage(msg client.Message) {
+	t.app.QueueUpdateDraw(func() { t.appendMessage(msg, true) })
+}
+
+// Appends a message to its room's scrollback, counting it as unread if the room isn't shown
+func (t *tui) appendMessage(msg client.Message, live bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	room := *msg.RoomName
+	if _, ok := t.lastEpoch[room]; !ok {
+		// A message for a room that was left
+		return
+	}
+	sent := time.Now()
+	if msg.Epoch != nil {
+		sent = time.Unix(*msg.Epoch, 0)
+		if *msg.Epoch > t.lastEpoch[room] {
+			t.lastEpoch[room] = *msg.Epoch
+		}
+	}
+	line := fmt.Sprintf("[gray]%s[-] [yellow]%s[-]: %s", sent.Format("15:04"), tview.Escape(*msg.Sender), tview.Escape(*msg.MessageText))
+	if msg.Attachment != nil {
+		line += " [green]" + tview.Escape(describeAttachment(msg.Attachment)) + "[-]"
+	}
+	t.appendLineLocked(room, line)
+	if room != t.current && live {
+		t.unread[room]++
+		t.renderRoomListLocked()
+	}
+}
+
+// Shows a status line in the current room's scrollback. QueueUpdateDraw waits for the event
+// loop, so it runs in its own goroutine to be safe to call from anywhere, including log output.
+func (t *tui) systemf(format string, args ...interface{}) {
+	line := "[blue]*** " + tview.Escape(fmt.Sprintf(format, args...)) + "[-]"
+	go t.app.QueueUpdateDraw(func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.appendLineLocked(t.current, line)
+	})
+}
+
+// Write lets the TUI be used as the log output
+func (t *tui) Write(p []byte) (int, error) {
+	t.systemf("%s", strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+func (t *tui) appendLineLocked(room string, line string) {
+	lines := append(t.history[room], line)
+	if len(lines) > tuiScrollbackLines {
+		lines = lines[len(lines)-tuiScrollbackLines:]
+	}
+	t.history[room] = lines
+	if room == t.current {
+		fmt.Fprintln(t.scrollback, line)
+	}
+}
+
+// Shows the given room in the scrollback and member panes
+func (t *tui) switchRoomLocked(room string) {
+	t.current = room
+	t.unread[room] = 0
+	t.scrollback.Clear()
+	t.scrollback.SetTitle(" " + tview.Escape(room) + " ")
+	for _, line := range t.history[room] {
+		fmt.Fprintln(t.scrollback, line)
+	}
+	t.scrollback.ScrollToEnd()
+	lastActiveRoom = room
+	t.renderRoomListLocked()
+	go t.refreshMembers(room)
+}
+
+// Called when the selected item of the room list changes
+func (t *tui) roomChanged(index int, _ string, _ string, _ rune) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if index >= 0 && index < len(t.rooms) && t.rooms[index] != t.current {
+		t.switchRoomLocked(t.rooms[index])
+	}
+}
+
+// Redraws the room list with unread badges
+func (t *tui) renderRoomListLocked() {
+	// The list calls the changed func while it is rebuilt, which would try to take t.mu again
+	t.roomList.SetChangedFunc(nil)
+	defer t.roomList.SetChangedFunc(t.roomChanged)
+	t.roomList.Clear()
+	current := 0
+	for i, room := range t.rooms {
+		label := tview.Escape(room)
+		if n := t.unread[room]; n > 0 {
+			label += fmt.Sprintf(" [red](%d)[-]", n)
+		}
+		if i < 9 {
+			label = fmt.Sprintf("%d %s", i+1, label)
+		}
+		t.roomList.AddItem(label, "", 0, nil)
+		if room == t.current {
+			current = i
+		}
+	}
+	t.roomList.SetCurrentItem(current)
+}
+
+// Moves to the next or previous room, wrapping around
+func (t *tui) cycleRoom(delta int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.rooms) == 0 {
+		return
+	}
+	i := 0
+	for j, room := range t.rooms {
+		if room == t.current {
+			i = j
+		}
+	}
+	i = (i + delta + len(t.rooms)) % len(t.rooms)
+	t.switchRoomLocked(t.rooms[i])
+}
+
+// Switches to the room at index i of the room list
+func (t *tui) selectRoom(i int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if i >= 0 && i < len(t.rooms) {
+		t.switchRoomLocked(t.rooms[i])
+	}
+}
+
+func (t *tui) roomIndex(room string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, r := range t.rooms {
+		if r == room {
+			return i
+		}
+	}
+	return -1
+}
+
+// Fetches the member list of a room and shows it if the room is still current
+func (t *tui) refreshMembers(room string) {
+	ctx, cancel := requestContext()
+	members, err := chat.Members(ctx, room)
+	cancel()
+	if err != nil {
+		return
+	}
+	t.app.QueueUpdateDraw(func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if room != t.current {
+			return
+		}
+		t.members.Clear()
+		for _, name := range members {
+			fmt.Fprintln(t.members, tview.Escape(name))
+		}
+	})
+}
+
+// Refreshes the member list, and polls for messages when the websocket is down
+func (t *tui) refreshLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		t.mu.Lock()
+		current := t.current
+		rooms := append([]string(nil), t.rooms...)
+		t.mu.Unlock()
+		if current != "" {
+			t.refreshMembers(current)
+		}
+		if chat.Connected() {
+			continue
+		}
+		for _, room := range rooms {
+			t.mu.Lock()
+			since := t.lastEpoch[room] + 1
+			t.mu.Unlock()
+			ctx, cancel := requestContext()
+			messages, err := chat.Messages(ctx, room, time.Unix(since, 0))
+			cancel()
+			if err != nil {
+				continue
+			}
+			for _, msg := range messages {
+				t.addMessage(msg)
+			}
+		}
+	}
+}
+
+// Prints the keyboard shortcuts and commands into the scrollback
+func (t *tui) showHelp() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, line := range []string{
+		"Type a message and press Enter to send it to the current room",
+		"/join <room>   join a room        /leave [room]  leave a room",
+		"/status        server status      /quit          exit",
+		"/upload <path> send a file        /download <id> save an attachment",
+		"/encrypt <room> create an end-to-end encrypted room",
+		"/trust [user]  show your key fingerprint, or accept a user's changed key",
+		"Tab/Ctrl-N     next room          Shift-Tab/Ctrl-P previous room",
+		"Alt-1..9       jump to room       PgUp/PgDn      scroll, Ctrl-End to the bottom",
+	} {
+		t.appendLineLocked(t.current, "[blue]*** "+tview.Escape(line)+"[-]")
+	}
+}
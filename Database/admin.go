@@ -0,0 +1,701 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Time the server started, reported by the stats endpoint
+var startTime = time.Now()
+
+// A user as seen by an admin
+type AdminUser struct {
+	Name        string   `json:"name"`
+	UserID      int      `json:"userID"`
+	Integration bool     `json:"integration"`
+	Disabled    bool     `json:"disabled"`
+	Messages    int64    `json:"messages"`
+	LastMessage int64    `json:"lastMessage,omitempty"`
+	Connected   bool     `json:"connected"`
+	Rooms       []string `json:"rooms"`
+}
+
+type AdminUsersResponse struct {
+	Users []AdminUser `json:"users"`
+}
+
+// A room as seen by an admin
+type AdminRoom struct {
+	Name        string   `json:"name"`
+	RoomID      int      `json:"roomID"`
+	Owner       string   `json:"owner,omitempty"`
+	Encrypted   bool     `json:"encrypted"`
+	Disabled    bool     `json:"disabled"`
+	Messages    int64    `json:"messages"`
+	LastMessage int64    `json:"lastMessage,omitempty"`
+	Members     []string `json:"members"`
+}
+
+type AdminRoomsResponse struct {
+	Rooms []AdminRoom `json:"rooms"`
+}
+
+// Body of POST /admin/users
+type NewAdminUserRequest struct {
+	Name string `json:"name"`
+}
+
+// Body of POST /admin/rooms
+type NewAdminRoomRequest struct {
+	Name      string `json:"name"`
+	Owner     string `json:"owner"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// Body of PATCH /admin/users/{name} and /admin/rooms/{room}. Fields left out are unchanged.
+type UpdateRequest struct {
+	Name     *string `json:"name"`
+	Disabled *bool   `json:"disabled"`
+	// Rooms only. An empty owner leaves the room without one.
+	Owner *string `json:"owner"`
+}
+
+// An open connection receiving room events, over any transport
+type Connection struct {
+	UserID     int      `json:"userID"`
+	User       string   `json:"user"`
+	RemoteAddr string   `json:"remoteAddr"`
+	Transport  string   `json:"transport"`
+	Encoding   string   `json:"encoding"`
+	Connected  int64    `json:"connected"`
+	Queued     int      `json:"queued"`
+	Rooms      []string `json:"rooms"`
+}
+
+type ConnectionsResponse struct {
+	Connections []Connection `json:"connections"`
+}
+
+// Server wide counts reported by GET /admin/stats
+type Stats struct {
+	Started         int64  `json:"started"`
+	Uptime          string `json:"uptime"`
+	SchemaVersion   int    `json:"schemaVersion"`
+	DatabaseBytes   int64  `json:"databaseBytes"`
+	Users           int64  `json:"users"`
+	Rooms           int64  `json:"rooms"`
+	Messages        int64  `json:"messages"`
+	Attachments     int64  `json:"attachments"`
+	AttachmentBytes int64  `json:"attachmentBytes"`
+	Connections     int    `json:"connections"`
+	RoomMembers     int    `json:"roomMembers"`
+	Goroutines      int    `json:"goroutines"`
+}
+
+// Wraps a handler so it only runs for requests carrying the admin token as a bearer token
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.Admin.Token == "" {
+			writeError(w, http.StatusForbidden, ErrCodeForbidden, "Admin endpoints are disabled: set admin.token to enable them")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Admin.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gochat admin"`)
+			writeError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "A valid admin token is required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Reports whether an admin has disabled the user
+func userDisabled(name string) bool {
+	var disabled bool
+	db.QueryRow("SELECT Disabled FROM Users WHERE Name = ?", name).Scan(&disabled)
+	return disabled
+}
+
+// Reports whether an admin has disabled the room
+func roomDisabled(roomID int) bool {
+	var disabled bool
+	db.QueryRow("SELECT Disabled FROM Rooms WHERE RoomID = ?", roomID).Scan(&disabled)
+	return disabled
+}
+
+// Returns the name of every room by ID
+func roomNamesByID() (map[int]string, error) {
+	names := make(map[int]string)
+	rows, err := db.Query("SELECT RoomID, RoomName FROM Rooms")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+// Returns the sorted names of the rooms each user is active in
+func activeRoomsByUser() (map[string][]string, error) {
+	names, err := roomNamesByID()
+	if err != nil {
+		return nil, err
+	}
+	rooms := make(map[string][]string)
+	roomsMu.RLock()
+	for roomID, members := range activeRooms {
+		for _, member := range members {
+			rooms[member] = append(rooms[member], names[roomID])
+		}
+	}
+	roomsMu.RUnlock()
+	for _, r := range rooms {
+		sort.Strings(r)
+	}
+	return rooms, nil
+}
+
+// Removes the user from every room they are active in, as if they had left
+func removeFromAllRooms(user string) {
+	roomsMu.RLock()
+	var roomIDs []int
+	for roomID, members := range activeRooms {
+		for _, member := range members {
+			if member == user {
+				roomIDs = append(roomIDs, roomID)
+				break
+			}
+		}
+	}
+	roomsMu.RUnlock()
+
+	names, err := roomNamesByID()
+	if err != nil {
+		slog.Error("Error loading room names", "err", err)
+	}
+	for _, roomID := range roomIDs {
+		if removeRoomMember(roomID, user) {
+			emitRoomEvent(roomID, names[roomID], EventLeave, user, nil)
+		}
+	}
+}
+
+// Closes the user's websocket, on whichever instance holds it. Returns false if they weren't
+// connected to this one.
+func disconnectUser(user, reason string) bool {
+	closed := closeUserConnection(user, reason)
+	publishEvent(clusterEvent{Type: clusterDisconnect, User: user, Reason: reason})
+	return closed
+}
+
+// Closes the user's websocket on this instance. Returns false if they weren't connected to it.
+func closeUserConnection(user, reason string) bool {
+	connsMu.RLock()
+	var client *wsClient
+	for _, c := range wsconns {
+		if c.userName == user {
+			client = c
+			break
+		}
+	}
+	connsMu.RUnlock()
+	if client == nil {
+		return false
+	}
+	unregisterClient(client)
+	client.close(websocket.ClosePolicyViolation, reason)
+	return true
+}
+
+// Handles listing every user with their activity
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	rooms, err := activeRoomsByUser()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	connected := make(map[string]bool)
+	connsMu.RLock()
+	for _, c := range wsconns {
+		connected[c.userName] = true
+	}
+	connsMu.RUnlock()
+
+	rows, err := db.Query(`SELECT UserID, Name, Integration, Disabled,
+		(SELECT COUNT(*) FROM Messages WHERE Messages.UserID = Users.UserID),
+		(SELECT MAX(Epoch) FROM Messages WHERE Messages.UserID = Users.UserID)
+		FROM Users ORDER BY Name`)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	response := AdminUsersResponse{Users: make([]AdminUser, 0)}
+	for rows.Next() {
+		var u AdminUser
+		var last sql.NullInt64
+		if err := rows.Scan(&u.UserID, &u.Name, &u.Integration, &u.Disabled, &u.Messages, &last); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		u.LastMessage = last.Int64
+		u.Connected = connected[u.Name]
+		u.Rooms = rooms[u.Name]
+		if u.Rooms == nil {
+			u.Rooms = make([]string, 0)
+		}
+		response.Users = append(response.Users, u)
+	}
+	if err := rows.Err(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Handles creating a user
+func adminNewUserHandler(w http.ResponseWriter, r *http.Request) {
+	var req NewAdminUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeMissingField, "A user name is required")
+		return
+	}
+	if userExists(req.Name) {
+		writeError(w, http.StatusConflict, ErrCodeUserExists, "Error creating user with name \"%s\": A user with this name already exists", req.Name)
+		return
+	}
+	userID, err := newUser(req.Name)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, User{Name: &req.Name, UserID: &userID})
+}
+
+// Handles renaming, disabling and enabling a user. Disabling a user closes their websocket and
+// removes them from their rooms.
+func adminUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var req UpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	userID, err := getUserIDByName(&name)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", name)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if req.Name != nil && *req.Name != name {
+		if *req.Name == "" {
+			writeError(w, http.StatusBadRequest, ErrCodeMissingField, "A user name is required")
+			return
+		}
+		if userExists(*req.Name) {
+			writeError(w, http.StatusConflict, ErrCodeUserExists, "Error renaming user to \"%s\": A user with this name already exists", *req.Name)
+			return
+		}
+		encrypted, err := usesEncryption(userID, name)
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		// Encrypted messages and room keys are bound to the user's name, so renaming would make them unreadable
+		if encrypted {
+			writeError(w, http.StatusConflict, ErrCodeEncrypted, "User \"%s\" uses end-to-end encryption and can't be renamed", name)
+			return
+		}
+		if err := renameUser(userID, name, *req.Name); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		requestLogger(r.Context()).Info("Admin renamed user", "user", name, "new_name", *req.Name)
+		name = *req.Name
+	}
+
+	if req.Disabled != nil {
+		if _, err := db.Exec("UPDATE Users SET Disabled = ? WHERE UserID = ?", *req.Disabled, userID); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		if *req.Disabled {
+			disconnectUser(name, "Disabled by an administrator")
+			removeFromAllRooms(name)
+			requestLogger(r.Context()).Info("Admin disabled user", "user", name)
+		}
+	}
+	writeJSON(w, http.StatusOK, User{Name: &name, UserID: &userID})
+}
+
+// Renames a user everywhere their name is stored, including the rooms they are active in and
+// their open connection
+func renameUser(userID int, oldName, newName string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	statements := []string{
+		"UPDATE Users SET Name = ? WHERE Name = ?",
+		"UPDATE Rooms SET Owner = ? WHERE Owner = ?",
+		"UPDATE Webhooks SET CreatedBy = ? WHERE CreatedBy = ?",
+		"UPDATE IncomingWebhooks SET CreatedBy = ? WHERE CreatedBy = ?",
+		"UPDATE Attachments SET Uploader = ? WHERE Uploader = ?",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, newName, oldName); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	renameActiveUser(userID, oldName, newName)
+	publishEvent(clusterEvent{Type: clusterRename, UserID: userID, User: oldName, NewName: newName})
+	return nil
+}
+
+// Renames the user in activeRooms and on their websocket
+func renameActiveUser(userID int, oldName, newName string) {
+	roomsMu.Lock()
+	for _, members := range activeRooms {
+		for i, member := range members {
+			if member == oldName {
+				members[i] = newName
+			}
+		}
+	}
+	roomsMu.Unlock()
+	connsMu.Lock()
+	if c, ok := wsconns[userID]; ok {
+		c.userName = newName
+	}
+	connsMu.Unlock()
+}
+
+// Handles deleting a user along with their messages and keys
+func adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	userID, err := getUserIDByName(&name)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", name)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	disconnectUser(name, "Deleted by an administrator")
+	removeFromAllRooms(name)
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	statements := []string{
+		"DELETE FROM Messages WHERE UserID = ?",
+		"DELETE FROM UserKeys WHERE UserID = ?",
+		"DELETE FROM RoomKeys WHERE UserID = ?",
+		"DELETE FROM IncomingWebhooks WHERE UserID = ?",
+		"DELETE FROM Users WHERE UserID = ?",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, userID); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if _, err := tx.Exec("UPDATE Rooms SET Owner = NULL WHERE Owner = ?", name); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	requestLogger(r.Context()).Info("Admin deleted user", "user", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles listing every room with its activity
+func adminRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT RoomID, RoomName, Owner, Encrypted, Disabled,
+		(SELECT COUNT(*) FROM Messages WHERE Messages.RoomID = Rooms.RoomID),
+		(SELECT MAX(Epoch) FROM Messages WHERE Messages.RoomID = Rooms.RoomID)
+		FROM Rooms ORDER BY RoomName`)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	response := AdminRoomsResponse{Rooms: make([]AdminRoom, 0)}
+	for rows.Next() {
+		var room AdminRoom
+		var owner sql.NullString
+		var last sql.NullInt64
+		if err := rows.Scan(&room.RoomID, &room.Name, &owner, &room.Encrypted, &room.Disabled, &room.Messages, &last); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		room.Owner = owner.String
+		room.LastMessage = last.Int64
+		room.Members = roomMembers(room.RoomID)
+		sort.Strings(room.Members)
+		response.Rooms = append(response.Rooms, room)
+	}
+	if err := rows.Err(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Handles creating a room, optionally owned by an existing user
+func adminNewRoomHandler(w http.ResponseWriter, r *http.Request) {
+	var req NewAdminRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeMissingField, "A room name is required")
+		return
+	}
+	if req.Owner != "" && !userExists(req.Owner) {
+		writeError(w, http.StatusBadRequest, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", req.Owner)
+		return
+	}
+	if roomExists(req.Name) {
+		writeError(w, http.StatusConflict, ErrCodeRoomExists, "Error creating room with name \"%s\": A room with this name already exists", req.Name)
+		return
+	}
+	if err := createRoom(req.Name, req.Owner, req.Encrypted); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Handles renaming, disabling and enabling a room and changing its owner. Disabling a room removes
+// its active members and stops new messages and joins.
+func adminUpdateRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	var req UpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	roomID, err := getRoomID(room)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return
+	}
+	if req.Owner != nil && *req.Owner != "" && !userExists(*req.Owner) {
+		writeError(w, http.StatusBadRequest, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", *req.Owner)
+		return
+	}
+
+	if req.Name != nil && *req.Name != room {
+		if *req.Name == "" {
+			writeError(w, http.StatusBadRequest, ErrCodeMissingField, "A room name is required")
+			return
+		}
+		if roomExists(*req.Name) {
+			writeError(w, http.StatusConflict, ErrCodeRoomExists, "Error renaming room to \"%s\": A room with this name already exists", *req.Name)
+			return
+		}
+		encrypted, _, _, err := roomEncryption(roomID)
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		// Encrypted messages are bound to the room name, so renaming would make them unreadable
+		if encrypted {
+			writeError(w, http.StatusConflict, ErrCodeEncrypted, "Room \"%s\" is end-to-end encrypted and can't be renamed", room)
+			return
+		}
+		if _, err := db.Exec("UPDATE Rooms SET RoomName = ? WHERE RoomID = ?", *req.Name, roomID); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		requestLogger(r.Context()).Info("Admin renamed room", "room", room, "new_name", *req.Name)
+		room = *req.Name
+	}
+
+	if req.Owner != nil {
+		var owner interface{}
+		if *req.Owner != "" {
+			owner = *req.Owner
+		}
+		if _, err := db.Exec("UPDATE Rooms SET Owner = ? WHERE RoomID = ?", owner, roomID); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		requestLogger(r.Context()).Info("Admin changed room owner", "room", room, "owner", *req.Owner)
+	}
+
+	if req.Disabled != nil {
+		if _, err := db.Exec("UPDATE Rooms SET Disabled = ? WHERE RoomID = ?", *req.Disabled, roomID); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		if *req.Disabled {
+			for _, member := range roomMembers(roomID) {
+				if removeRoomMember(roomID, member) {
+					emitRoomEvent(roomID, room, EventLeave, member, nil)
+				}
+			}
+			requestLogger(r.Context()).Info("Admin disabled room", "room", room)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles deleting a room along with its messages, webhooks and keys
+func adminDeleteRoomHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	roomID, err := getRoomID(room)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	statements := []string{
+		"DELETE FROM Messages WHERE RoomID = ?",
+		"DELETE FROM WebhookDeliveries WHERE WebhookID IN (SELECT WebhookID FROM Webhooks WHERE RoomID = ?)",
+		"DELETE FROM WebhookDeadLetters WHERE WebhookID IN (SELECT WebhookID FROM Webhooks WHERE RoomID = ?)",
+		"DELETE FROM Webhooks WHERE RoomID = ?",
+		"DELETE FROM IncomingWebhooks WHERE RoomID = ?",
+		"DELETE FROM RoomKeys WHERE RoomID = ?",
+		"DELETE FROM Rooms WHERE RoomID = ?",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt, roomID); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	roomsMu.Lock()
+	delete(activeRooms, roomID)
+	roomsMu.Unlock()
+	publishEvent(clusterEvent{Type: clusterRoomDeleted, RoomID: roomID})
+	requestLogger(r.Context()).Info("Admin deleted room", "room", room)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles listing the open connections, over any transport
+func connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	rooms, err := activeRoomsByUser()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := ConnectionsResponse{Connections: make([]Connection, 0)}
+	connsMu.RLock()
+	for _, c := range wsconns {
+		conn := Connection{
+			UserID:     c.userID,
+			User:       c.userName,
+			RemoteAddr: c.remoteAddr,
+			Transport:  c.transport,
+			Encoding:   c.codec.name(),
+			Connected:  c.connected.Unix(),
+			Queued:     len(c.send),
+			Rooms:      rooms[c.userName],
+		}
+		if conn.Rooms == nil {
+			conn.Rooms = make([]string, 0)
+		}
+		response.Connections = append(response.Connections, conn)
+	}
+	connsMu.RUnlock()
+	sort.Slice(response.Connections, func(i, j int) bool {
+		return response.Connections[i].User < response.Connections[j].User
+	})
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Handles closing a user's websocket. The client is free to reconnect unless the user is disabled.
+func dropConnectionHandler(w http.ResponseWriter, r *http.Request) {
+	user := mux.Vars(r)["user"]
+	// Another instance may hold the connection, in which case it closes it
+	if !disconnectUser(user, "Disconnected by an administrator") && !clustered() {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, "User \"%s\" has no open connection", user)
+		return
+	}
+	requestLogger(r.Context()).Info("Admin dropped connection", "user", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles reporting server wide counts
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{
+		Started:       startTime.Unix(),
+		Uptime:        time.Since(startTime).Round(time.Second).String(),
+		SchemaVersion: schemaVersion,
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM Users), (SELECT COUNT(*) FROM Rooms), (SELECT COUNT(*) FROM Messages),
+		(SELECT COUNT(*) FROM Attachments), (SELECT CAST(COALESCE(SUM(Size), 0) AS BIGINT) FROM Attachments)`).
+		Scan(&stats.Users, &stats.Rooms, &stats.Messages, &stats.Attachments, &stats.AttachmentBytes)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if usingPostgres() {
+		db.QueryRow("SELECT pg_database_size(current_database())").Scan(&stats.DatabaseBytes)
+	} else if info, err := os.Stat(config.Database.Path); err == nil {
+		stats.DatabaseBytes = info.Size()
+	}
+
+	connsMu.RLock()
+	stats.Connections = len(wsconns)
+	connsMu.RUnlock()
+	roomsMu.RLock()
+	for _, members := range activeRooms {
+		stats.RoomMembers += len(members)
+	}
+	roomsMu.RUnlock()
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Returns a router serving the admin routes that change users and rooms
+func adminRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/users/{name}", adminOnly(adminUpdateUserHandler)).Methods("PATCH")
+	router.HandleFunc("/admin/rooms/{room}", adminOnly(adminUpdateRoomHandler)).Methods("PATCH")
+	return router
+}
+
+// Sends a PATCH with the body to path, with auth in the Authorization header and alice, the room's
+// owner, in User-Name
+func patchAdmin(router http.Handler, path, auth, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("PATCH", path, strings.NewReader(body))
+	r.Header.Set("User-Name", "alice")
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// Opens a database with users alice and bob and the room lobby owned by alice
+func openAdminDatabase(t *testing.T, args ...string) {
+	t.Helper()
+	openTestDatabase(t, args...)
+	startTestHub(t)
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := newUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := createRoom("lobby", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The changes an admin can make to users and rooms, with a query returning want once it is made
+var adminChanges = []struct {
+	name, path, body string
+	query, want      string
+}{
+	{"disable user", "/admin/users/bob", `{"disabled":true}`, "SELECT Disabled FROM Users WHERE Name = 'bob'", "1"},
+	{"assign owner", "/admin/rooms/lobby", `{"owner":"bob"}`, "SELECT Owner FROM Rooms WHERE RoomName = 'lobby'", "bob"},
+	{"disable room", "/admin/rooms/lobby", `{"disabled":true}`, "SELECT Disabled FROM Rooms WHERE RoomName = 'lobby'", "1"},
+	{"rename room", "/admin/rooms/lobby", `{"name":"hall"}`, "SELECT COUNT(*) FROM Rooms WHERE RoomName = 'hall'", "1"},
+	{"rename user", "/admin/users/bob", `{"name":"robert"}`, "SELECT COUNT(*) FROM Users WHERE Name = 'robert'", "1"},
+}
+
+// Returns every user and room with the fields an admin can change
+func adminState(t *testing.T) string {
+	t.Helper()
+	rows, err := db.Query("SELECT Name, Disabled, '' FROM Users UNION ALL SELECT RoomName, Disabled, COALESCE(Owner, '') FROM Rooms ORDER BY 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var state []string
+	for rows.Next() {
+		var name, disabled, owner string
+		if err := rows.Scan(&name, &disabled, &owner); err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, name+" "+disabled+" "+owner)
+	}
+	return strings.Join(state, ", ")
+}
+
+// Without the admin token, owning the room or naming an admin in User-Name changes nothing
+func TestAdminChangesRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		auth   string
+		status int
+	}{
+		{"no token", []string{"-admin-token", "admin-secret"}, "", http.StatusUnauthorized},
+		{"wrong token", []string{"-admin-token", "admin-secret"}, "Bearer guess", http.StatusUnauthorized},
+		{"token without bearer", []string{"-admin-token", "admin-secret"}, "Basic YWRtaW4tc2VjcmV0", http.StatusUnauthorized},
+		{"admin disabled", nil, "Bearer ", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			openAdminDatabase(t, tc.args...)
+			before := adminState(t)
+			router := adminRouter()
+			for _, change := range adminChanges {
+				if w := patchAdmin(router, change.path, tc.auth, change.body); w.Code != tc.status {
+					t.Errorf("%s returned %d, want %d", change.name, w.Code, tc.status)
+				}
+			}
+			if after := adminState(t); after != before {
+				t.Errorf("state changed from %q to %q", before, after)
+			}
+		})
+	}
+}
+
+func TestAdminChanges(t *testing.T) {
+	openAdminDatabase(t, "-admin-token", "admin-secret")
+	router := adminRouter()
+	for _, change := range adminChanges {
+		w := patchAdmin(router, change.path, "Bearer admin-secret", change.body)
+		if w.Code != http.StatusOK && w.Code != http.StatusNoContent {
+			t.Fatalf("%s returned %d: %s", change.name, w.Code, w.Body)
+		}
+		var got string
+		if err := db.QueryRow(change.query).Scan(&got); err != nil || got != change.want {
+			t.Errorf("after %s, %q returned %q (%v), want %q", change.name, change.query, got, err, change.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// A file attached to a message. The ID is the SHA-256 of the content.
+type Attachment struct {
+	ID          string `json:"id"`
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Thumbnail   bool   `json:"thumbnail,omitempty"`
+}
+
+// Attachment IDs are lower case hex SHA-256 hashes
+var attachmentIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Longest file name kept for an attachment, in bytes
+const maxAttachmentName = 255
+
+// Sets up the attachment store from the configuration
+func startAttachments() error {
+	var err error
+	blobs, err = newBlobStore(config.Attachments.Dir, config.Attachments.MaxSize)
+	return err
+}
+
+// Handles uploading an attachment as the "file" field of a multipart form. The uploader is given
+// in the User-Name header. Returns the attachment to reference from a message.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Header.Get("User-Name")
+	if !userExists(user) {
+		writeError(w, http.StatusBadRequest, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", user)
+		return
+	}
+	// Leave room for the multipart headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, config.Attachments.MaxSize+64*1024)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "Expected a multipart/form-data upload: %v", err)
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			writeError(w, http.StatusBadRequest, ErrCodeMissingField, "The upload requires a \"file\" field")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "Invalid upload: %v", err)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		att, err := storeAttachment(part, part.FileName(), user)
+		part.Close()
+		switch {
+		case err == errBlobTooLarge:
+			writeError(w, http.StatusRequestEntityTooLarge, ErrCodeTooLarge, "Attachments can be at most %d bytes", config.Attachments.MaxSize)
+		case err != nil:
+			writeErr(w, http.StatusUnsupportedMediaType, err)
+		default:
+			writeJSON(w, http.StatusCreated, att)
+		}
+		return
+	}
+}
+
+// Saves the content to the blob store and records it, returning the stored attachment. Content
+// that was uploaded before keeps its original name.
+func storeAttachment(r io.Reader, name, user string) (*Attachment, error) {
+	hash, size, contentType, err := blobs.put(r, checkAttachmentType)
+	if err != nil {
+		return nil, err
+	}
+	width, height, thumbnail := 0, 0, false
+	if strings.HasPrefix(contentType, "image/") {
+		width, height, thumbnail = blobs.makeThumbnail(hash, config.Attachments.ThumbnailSize)
+	}
+	_, err = db.Exec("INSERT INTO Attachments (AttachmentID, Name, ContentType, Size, Width, Height, Thumbnail, Uploader, Created) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+		hash, cleanAttachmentName(name), contentType, size, width, height, thumbnail, user, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return getAttachment(hash)
+}
+
+// Checks the sniffed media type against attachments.allowedTypes. Entries like "image/*" match a
+// whole family.
+func checkAttachmentType(contentType string) error {
+	for _, allowed := range strings.Split(config.Attachments.AllowedTypes, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == contentType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(allowed, "*"))) {
+			return nil
+		}
+	}
+	return newAPIError(ErrCodeUnsupported, "Attachments of type %s are not allowed", contentType)
+}
+
+// Keeps only the base name of an uploaded file, without path separators or control characters
+func cleanAttachmentName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "." || name == ".." || name == "/" || name == "" {
+		name = "attachment"
+	}
+	for len(name) > maxAttachmentName {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// Returns the stored attachment with the ID
+func getAttachment(id string) (*Attachment, error) {
+	att := Attachment{ID: id}
+	err := db.QueryRow("SELECT Name, ContentType, Size, Width, Height, Thumbnail FROM Attachments WHERE AttachmentID = ?", id).
+		Scan(&att.Name, &att.ContentType, &att.Size, &att.Width, &att.Height, &att.Thumbnail)
+	if err != nil {
+		return nil, err
+	}
+	return &att, nil
+}
+
+// Looks up the attachment in the URL, writing a not found error if it doesn't exist
+func requireAttachment(w http.ResponseWriter, r *http.Request) (*Attachment, bool) {
+	id := mux.Vars(r)["id"]
+	if !attachmentIDPattern.MatchString(id) {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid attachment id supplied \"%s\"", id)
+		return nil, false
+	}
+	att, err := getAttachment(id)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, "Attachment %s does not exist", id)
+		return nil, false
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return att, true
+}
+
+// Handles downloading an attachment. Images are shown inline, anything else is downloaded.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	att, ok := requireAttachment(w, r)
+	if !ok {
+		return
+	}
+	disposition := "attachment"
+	if att.Thumbnail {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", att.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": att.Name}))
+	serveBlob(w, r, blobs.path(att.ID), att.ID)
+}
+
+// Handles downloading a PNG thumbnail of an image attachment
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	att, ok := requireAttachment(w, r)
+	if !ok {
+		return
+	}
+	if !att.Thumbnail {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, "Attachment %s has no thumbnail", att.ID)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	serveBlob(w, r, blobs.thumbnailPath(att.ID), att.ID+"-thumb")
+}
+
+// Serves a stored file. Blobs never change, so they can be cached forever.
+func serveBlob(w http.ResponseWriter, r *http.Request, path, etag string) {
+	f, err := os.Open(path)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Returns a router serving the attachment routes
+func attachmentRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/chat/attachments", uploadHandler).Methods("POST")
+	router.HandleFunc("/chat/attachments/{id}", downloadHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/chat/attachments/{id}/thumbnail", thumbnailHandler).Methods("GET", "HEAD")
+	return router
+}
+
+// Opens a database with the attachment store and a user named alice
+func openAttachmentDatabase(t *testing.T, args ...string) {
+	t.Helper()
+	openTestDatabase(t, args...)
+	if err := startAttachments(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Uploads content as alice under the file name
+func uploadTestFile(t *testing.T, router http.Handler, name string, content []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/chat/attachments", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("User-Name", "alice")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// Uploads content and returns the stored attachment, failing unless it was created
+func uploadTestAttachment(t *testing.T, router http.Handler, name string, content []byte) Attachment {
+	t.Helper()
+	w := uploadTestFile(t, router, name, content)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("uploading %s returned %d: %s", name, w.Code, w.Body)
+	}
+	var att Attachment
+	if err := json.NewDecoder(w.Body).Decode(&att); err != nil {
+		t.Fatal(err)
+	}
+	return att
+}
+
+// Returns a PNG of the given size
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, height/2, color.RGBA{R: 255, A: 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	openAttachmentDatabase(t, "-attachments-max-size", "1024")
+	w := uploadTestFile(t, attachmentRouter(), "notes.txt", bytes.Repeat([]byte("a"), 2048))
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), ErrCodeTooLarge) {
+		t.Errorf("uploading over the limit returned %d %s, want 413 too_large", w.Code, w.Body)
+	}
+	entries, _ := os.ReadDir(config.Attachments.Dir)
+	for _, e := range entries {
+		if !e.IsDir() {
+			t.Errorf("the rejected upload left %s behind", e.Name())
+		}
+	}
+}
+
+// The type is sniffed from the content, so the file name can't get a disallowed type through
+func TestUploadDisallowedType(t *testing.T) {
+	openAttachmentDatabase(t)
+	w := uploadTestFile(t, attachmentRouter(), "notes.txt", []byte("<!DOCTYPE html><html><script>alert(1)</script></html>"))
+	if w.Code != http.StatusUnsupportedMediaType || !strings.Contains(w.Body.String(), ErrCodeUnsupported) {
+		t.Errorf("uploading HTML returned %d %s, want 415 unsupported_type", w.Code, w.Body)
+	}
+}
+
+func TestCleanAttachmentName(t *testing.T) {
+	for _, tc := range []struct {
+		name, want string
+	}{
+		{"report.pdf", "report.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Users\alice\report.pdf`, "report.pdf"},
+		{"bad\r\nname\x00.txt\x7f", "badname.txt"},
+		{"../", "attachment"},
+		{"", "attachment"},
+		{strings.Repeat("é", 200), strings.Repeat("é", 127)},
+	} {
+		if got := cleanAttachmentName(tc.name); got != tc.want {
+			t.Errorf("cleanAttachmentName(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// Uploading content that is already stored returns the original attachment and name
+func TestUploadDuplicate(t *testing.T) {
+	openAttachmentDatabase(t)
+	router := attachmentRouter()
+	content := []byte("meeting notes")
+	first := uploadTestAttachment(t, router, "notes.txt", content)
+	second := uploadTestAttachment(t, router, "copy.txt", content)
+	if second.ID != first.ID || second.Name != "notes.txt" {
+		t.Errorf("duplicate upload returned %+v, want the original %+v", second, first)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM Attachments").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d attachments stored, want 1", n)
+	}
+}
+
+// Images get their size recorded and a PNG thumbnail that fits in attachments.thumbnailSize
+func TestUploadThumbnail(t *testing.T) {
+	openAttachmentDatabase(t, "-attachments-thumbnail-size", "64")
+	router := attachmentRouter()
+	att := uploadTestAttachment(t, router, "chart.png", testPNG(t, 400, 200))
+	if att.ContentType != "image/png" || att.Width != 400 || att.Height != 200 || !att.Thumbnail {
+		t.Fatalf("uploaded image stored as %+v", att)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/chat/attachments/"+att.ID+"/thumbnail", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("thumbnail returned %d with type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	thumb, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := thumb.Bounds().Size(); size.X != 64 || size.Y != 32 {
+		t.Errorf("thumbnail is %v, want 64x32", size)
+	}
+
+	text := uploadTestAttachment(t, router, "notes.txt", []byte("meeting notes"))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/chat/attachments/"+text.ID+"/thumbnail", nil))
+	if text.Thumbnail || w.Code != http.StatusNotFound {
+		t.Errorf("a text attachment has a thumbnail: %+v, %d", text, w.Code)
+	}
+}
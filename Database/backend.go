@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -14,9 +20,6 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-//address for http requests
-const url = "http://localhost:8080"
-
 //websocket upgrader
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
@@ -30,10 +33,37 @@ type User struct {
 
 // Holds the data for a message
 type Message struct {
-	Sender      *string `json:"sender"`
-	Epoch       *int64  `json:"epoch"`
-	MessageText *string `json:"messageText"`
-	RoomName    *string `json:"roomName"`
+	Sender      *string     `json:"sender"`
+	Epoch       *int64      `json:"epoch"`
+	MessageText *string     `json:"messageText"`
+	RoomName    *string     `json:"roomName"`
+	Attachment  *Attachment `json:"attachment,omitempty"`
+}
+
+// Selects the columns read by scanMessage. Callers add WHERE and ORDER BY clauses.
+const messageQuery = "SELECT Users.Name, Epoch, MessageText, Rooms.RoomName, Attachments.AttachmentID, Attachments.Name, Attachments.ContentType, Attachments.Size, Attachments.Width, Attachments.Height, Attachments.Thumbnail FROM Messages INNER JOIN Users ON Messages.UserID = Users.UserID INNER JOIN Rooms ON Messages.RoomID = Rooms.RoomID LEFT JOIN Attachments ON Messages.AttachmentID = Attachments.AttachmentID"
+
+// Scans a row selected with messageQuery
+func scanMessage(rows *sql.Rows) (Message, error) {
+	var msg Message
+	var id, name, contentType sql.NullString
+	var size, width, height sql.NullInt64
+	var thumbnail sql.NullBool
+	if err := rows.Scan(&msg.Sender, &msg.Epoch, &msg.MessageText, &msg.RoomName, &id, &name, &contentType, &size, &width, &height, &thumbnail); err != nil {
+		return msg, err
+	}
+	if id.Valid {
+		msg.Attachment = &Attachment{
+			ID:          id.String,
+			Name:        name.String,
+			ContentType: contentType.String,
+			Size:        size.Int64,
+			Width:       int(width.Int64),
+			Height:      int(height.Int64),
+			Thumbnail:   thumbnail.Bool,
+		}
+	}
+	return msg, nil
 }
 
 // HTTP Response struct containing a slice of Message
@@ -41,38 +71,108 @@ type Response struct {
 	Messages []Message `json:"messages"`
 }
 
+// HTTP Response struct containing the names of all rooms
+type RoomsResponse struct {
+	Rooms []string `json:"rooms"`
+}
+
+// HTTP Response struct containing the names of users active in a room
+type MembersResponse struct {
+	Room    string   `json:"room"`
+	Members []string `json:"members"`
+}
+
 // Global DB variable
 var db *sql.DB
 
 // All websocket connections and their userID's
-var wsconns map[int]*websocket.Conn
+var wsconns map[int]*wsClient
 
 // map[roomID]userName
 var activeRooms map[int][]string
 
 func main() {
-	// Open the DB and attach it to the global variable
-	DB, err := sql.Open("sqlite3", "ChatApp.db")
-	db = DB
+	if len(os.Args) > 1 && (os.Args[1] == "export" || os.Args[1] == "import") {
+		if err := runRoomCommand(os.Args[1], os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			fatal("Error running "+os.Args[1], err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := runRestoreCommand(os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			fatal("Error restoring database", err)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatal(err)
+		fatal("Error loading configuration", err)
+	}
+	config = cfg
+	if err := setupLogging(config.Log); err != nil {
+		fatal("Error setting up logging", err)
+	}
+	slog.Info("Starting server", "listen", config.Listen, "driver", config.Database.Driver, "database", config.Database.String(), "tls", config.TLS.CertFile != "")
+	slog.Info("Effective configuration", "config", config.String())
+
+	upgrader.ReadBufferSize = config.Limits.ReadBufferSize
+	upgrader.WriteBufferSize = config.Limits.WriteBufferSize
+	upgrader.Subprotocols = wireSubprotocols
+	upgrader.EnableCompression = config.Limits.Compression
+
+	// Open the DB and attach it to the global variable
+	if db, err = openDatabase(); err != nil {
+		fatal("Error opening database", err)
+	}
+	startWebhooks()
+	startIncomingWebhooks()
+	if err := startAttachments(); err != nil {
+		fatal("Error starting attachments", err)
 	}
-	defer db.Close()
+	startRetention()
+	startBackups()
 
 	// Creating the maps
 	activeRooms = make(map[int][]string)
-	wsconns = make(map[int]*websocket.Conn)
+	wsconns = make(map[int]*wsClient)
+
+	// Events from other instances update the maps, so they must exist first
+	if err := startBroker(); err != nil {
+		fatal("Error connecting to broker", err)
+	}
 
 	// Setting up the mux router and http handlers
 	router := mux.NewRouter()
+	// Middleware only runs for matched routes, so these are wrapped separately
+	router.NotFoundHandler = requestIDMiddleware(metricsMiddleware(http.HandlerFunc(notFoundHandler)))
+	router.MethodNotAllowedHandler = requestIDMiddleware(metricsMiddleware(http.HandlerFunc(methodNotAllowedHandler)))
+	router.Use(requestIDMiddleware, metricsMiddleware, recoverMiddleware)
 	router.HandleFunc("/status", statusCheck)
 
-	// /chat/room/new?room-name=room%20name%20here
+	// Liveness and readiness probes, JSON with a 503 when a check fails
+	router.HandleFunc("/health/live", livenessHandler).Methods("GET")
+	router.HandleFunc("/health/ready", readinessHandler).Methods("GET")
+
+	// Prometheus metrics in the text exposition format
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+
+	// /chat/room/new?room-name=room%20name%20here, add &encrypted=true for an end-to-end encrypted room
 	router.HandleFunc("/chat/room/new", newRoomHandler).Methods("POST")
 
 	// Experimental websocket handler
 	router.HandleFunc("/chat/sockets/connect", socketHandler)
 
+	// Fallbacks delivering the same events when websockets are blocked
+	// /chat/events/stream?user-id=1 streams them as server-sent events
+	router.HandleFunc("/chat/events/stream", streamHandler).Methods("GET")
+	// /chat/events/poll?user-id=1 opens a long-poll session, then &session=<id> waits for its events
+	router.HandleFunc("/chat/events/poll", pollHandler).Methods("GET")
+	router.HandleFunc("/chat/events/poll", closePollHandler).Methods("DELETE")
+
 	// /chat/room/join
 	// User-Name and Room-Name as header data
 	router.HandleFunc("/chat/room/join", joinRoomHandler).Methods("POST")
@@ -81,127 +181,272 @@ func main() {
 
 	router.HandleFunc("/chat/postmsg", newMessageHandler).Methods("POST")
 
+	// /chat/rooms
+	router.HandleFunc("/chat/rooms", roomsHandler).Methods("GET")
+
+	// /chat/room/(RoomName)/members
+	router.HandleFunc("/chat/room/{room}/members", membersHandler).Methods("GET")
+
+	// Outgoing webhooks, managed by the room owner given in the User-Name header
+	router.HandleFunc("/chat/room/{room}/webhooks", newWebhookHandler).Methods("POST")
+	router.HandleFunc("/chat/room/{room}/webhooks", webhooksHandler).Methods("GET")
+	router.HandleFunc("/chat/room/{room}/webhooks/{id}", deleteWebhookHandler).Methods("DELETE")
+	router.HandleFunc("/chat/room/{room}/webhooks/{id}/deliveries", webhookDeliveriesHandler).Methods("GET")
+	router.HandleFunc("/chat/room/{room}/webhooks/{id}/dead-letters", webhookDeadLettersHandler).Methods("GET")
+
+	// Attachments are uploaded as multipart/form-data with the uploader in the User-Name header,
+	// then referenced by id from a message
+	router.HandleFunc("/chat/attachments", uploadHandler).Methods("POST")
+	router.HandleFunc("/chat/attachments/{id}", downloadHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/chat/attachments/{id}/thumbnail", thumbnailHandler).Methods("GET", "HEAD")
+
+	// Incoming webhooks: tools POST text or JSON to /hooks/(Token) to post as an integration
+	router.HandleFunc("/chat/room/{room}/hooks", newIncomingWebhookHandler).Methods("POST")
+	router.HandleFunc("/chat/room/{room}/hooks", incomingWebhooksHandler).Methods("GET")
+	router.HandleFunc("/chat/room/{room}/hooks/{id}", revokeIncomingWebhookHandler).Methods("DELETE")
+	router.HandleFunc("/hooks/{token}", hookHandler).Methods("POST")
+
+	// Key directory and room keys for end-to-end encrypted rooms. Keys are published and room keys
+	// fetched by the user in the User-Name header.
+	router.HandleFunc("/chat/keys/{name}", publishKeyHandler).Methods("PUT")
+	router.HandleFunc("/chat/keys/{name}", getKeyHandler).Methods("GET")
+	router.HandleFunc("/chat/room/{room}/encryption", roomEncryptionHandler).Methods("GET")
+	router.HandleFunc("/chat/room/{room}/encryption/keys", rotateRoomKeyHandler).Methods("POST")
+
+	// Retention overrides, set by the room owner given in the User-Name header
+	router.HandleFunc("/chat/room/{room}/retention", roomRetentionHandler).Methods("GET")
+	router.HandleFunc("/chat/room/{room}/retention", setRoomRetentionHandler).Methods("PUT")
+
+	// Admin endpoints, which require the admin token as a bearer token
+	router.HandleFunc("/admin/retention", adminOnly(retentionStatusHandler)).Methods("GET")
+	router.HandleFunc("/admin/retention/run", adminOnly(runRetentionHandler)).Methods("POST")
+	router.HandleFunc("/admin/rooms/{room}/export", adminOnly(exportHandler)).Methods("GET")
+	router.HandleFunc("/admin/rooms/import", adminOnly(importHandler)).Methods("POST")
+	router.HandleFunc("/admin/users", adminOnly(adminUsersHandler)).Methods("GET")
+	router.HandleFunc("/admin/users", adminOnly(adminNewUserHandler)).Methods("POST")
+	router.HandleFunc("/admin/users/{name}", adminOnly(adminUpdateUserHandler)).Methods("PATCH")
+	router.HandleFunc("/admin/users/{name}", adminOnly(adminDeleteUserHandler)).Methods("DELETE")
+	router.HandleFunc("/admin/users/{name}/key", adminOnly(resetKeyHandler)).Methods("DELETE")
+	router.HandleFunc("/admin/rooms", adminOnly(adminRoomsHandler)).Methods("GET")
+	router.HandleFunc("/admin/rooms", adminOnly(adminNewRoomHandler)).Methods("POST")
+	router.HandleFunc("/admin/rooms/{room}", adminOnly(adminUpdateRoomHandler)).Methods("PATCH")
+	router.HandleFunc("/admin/rooms/{room}", adminOnly(adminDeleteRoomHandler)).Methods("DELETE")
+	router.HandleFunc("/admin/connections", adminOnly(connectionsHandler)).Methods("GET")
+	router.HandleFunc("/admin/connections/{user}", adminOnly(dropConnectionHandler)).Methods("DELETE")
+	router.HandleFunc("/admin/stats", adminOnly(statsHandler)).Methods("GET")
+	router.HandleFunc("/admin/backup", adminOnly(backupHandler)).Methods("POST")
+	router.HandleFunc("/admin/backups", adminOnly(backupsHandler)).Methods("GET")
+
 	// /chat/room/(RoomName) OR /chat/room/(RoomName)?message-start-time=(Epoch)
+	// OR /chat/room/(RoomName)?limit=(Count)&before=(Epoch) to page back through the history
 	router.HandleFunc("/chat/room/{room}", chatHandler).Methods("GET")
 
 	// /chat/users/new
 	// User-Name as header data
 	router.HandleFunc("/chat/user/new", newUserHandler).Methods("POST")
 
-	http.Handle("/", router)
+	// /chat/user/(UserName)
+	router.HandleFunc("/chat/user/{name}", getUserHandler).Methods("GET")
 
-	// Using Port 8080 for now
-	http.ListenAndServe(":8080", router)
+	// Browser client served from the embedded web directory
+	registerWebClient(router)
 
+	srv := &http.Server{
+		Addr:    config.Listen,
+		Handler: router,
+	}
+	if config.TLS.CertFile != "" {
+		reloader, err := newCertReloader(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			fatal("Error loading TLS certificate", err)
+		}
+		srv.TLSConfig, err = serverTLSConfig(config.TLS, reloader)
+		if err != nil {
+			fatal("Error configuring TLS", err)
+		}
+		go reloader.watch()
+	}
+	if err := runServer(context.Background(), srv, config.ShutdownTimeout); err != nil {
+		fatal("Server error", err)
+	}
 }
 
 // Handles POST requests to add users
 func newUserHandler(w http.ResponseWriter, r *http.Request) {
 	userInfo := User{}
 	if err := json.NewDecoder(r.Body).Decode(&userInfo); err != nil {
-		fmt.Println(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	if userInfo.Name == nil || *userInfo.Name == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeMissingField, "A user name is required")
+		return
 	}
 	if userExists(*userInfo.Name) {
 		// Check if the user name already exists
 		// User exists, return an error
-		http.Error(w, fmt.Sprintf("Error creating user with name \"%s\": A user with this name already exists", *userInfo.Name), http.StatusBadRequest)
-	} else {
-		// User doesn't exist, create the room
-		userID, err := newUser(*userInfo.Name)
-		if err != nil {
-			fmt.Println(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
-		userInfo.UserID = &userID
-		json, err := json.Marshal(userInfo)
-		if err != nil {
-			log.Fatal(err)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(json)
+		writeError(w, http.StatusConflict, ErrCodeUserExists, "Error creating user with name \"%s\": A user with this name already exists", *userInfo.Name)
+		return
+	}
+	// User doesn't exist, create the user
+	userID, err := newUser(*userInfo.Name)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
 	}
+	userInfo.UserID = &userID
+	writeJSON(w, http.StatusOK, userInfo)
 }
 
-func newUser(name string) (int, error) {
-	res, err := db.Exec("INSERT INTO Users (Name) VALUES (?)", name)
+// Handles looking up an existing user by name
+func getUserHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	userID, err := getUserIDByName(&name)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", name)
+		return
+	}
 	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, User{Name: &name, UserID: &userID})
+}
+
+func newUser(name string) (int, error) {
+	var userID int
+	if err := db.QueryRow("INSERT INTO Users (Name) VALUES (?) RETURNING UserID", name).Scan(&userID); err != nil {
 		return 0, err
 	}
-	fmt.Println(res.LastInsertId())
-	userID, err := res.LastInsertId()
+	return userID, nil
+}
+
+// Checks the user-id of a request opening a connection for room events. Writes the error response
+// and returns false if the user can't connect.
+func connectingUser(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	userIDString := r.URL.Query().Get("user-id")
+	userID, err := strconv.Atoi(userIDString)
 	if err != nil {
-		return 0, err
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid user-id supplied \"%s\": must be an integer", userIDString)
+		return 0, "", false
 	}
-	return int(userID), nil
+	userName, err := getUserByID(userID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ErrCodeUserNotFound, "Invalid user-id supplied \"%d\": A user with this ID does not exist", userID)
+		return 0, "", false
+	}
+	if userDisabled(userName) {
+		writeError(w, http.StatusForbidden, ErrCodeUserDisabled, "User \"%s\" has been disabled by an administrator", userName)
+		return 0, "", false
+	}
+	if isShuttingDown() {
+		writeError(w, http.StatusServiceUnavailable, ErrCodeShuttingDown, "The server is shutting down")
+		return 0, "", false
+	}
+	return userID, userName, true
 }
 
 // Experimental websockets
 func socketHandler(w http.ResponseWriter, r *http.Request) {
-	userIDString := r.URL.Query().Get("user-id")
-	c, err := upgrader.Upgrade(w, r, nil)
-	go websocketListener(c)
-	if err != nil {
-		log.Println("Upgrader error: ", err)
+	userID, userName, ok := connectingUser(w, r)
+	if !ok {
 		return
 	}
 
-	userID, err := strconv.Atoi(userIDString)
+	// The upgrader writes its own error response if the handshake fails
+	logger := requestLogger(r.Context()).With("user", userName)
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Fatal(err)
+		logger.Warn("Websocket upgrade failed", "err", err)
+		return
 	}
-	wsconns[userID] = c
+	conn.SetReadLimit(config.Limits.MaxMessageSize)
+	// The session keeps the handshake's request ID, so everything logged for it can be traced back
+	c := newWSClient(userID, userName, conn, logger)
+	logger.Info("Websocket connected", "remote_addr", c.remoteAddr, "encoding", c.codec.name())
+	registerClient(c)
+	wsConnectionsOpened.inc(c.codec.name())
+	go c.writePump()
+	go websocketListener(c)
+	sendRecentMessages(c)
+}
 
-	//When the user connects, send them the last hour of messages immediately
-	rows, err := db.Query("SELECT Users.Name, Epoch, MessageText, Rooms.RoomName FROM Messages INNER JOIN Users ON Messages.UserID = Users.UserID INNER JOIN Rooms ON Messages.RoomID = Rooms.RoomID WHERE Rooms.RoomName = ? AND Epoch >= ?", "TEST", time.Now().Unix()-3600)
+// Sends a user who just connected the last hour of messages in the TEST room
+func sendRecentMessages(c *wsClient) {
+	rows, err := db.Query(messageQuery+" WHERE Rooms.RoomName = ? AND Epoch >= ?", "TEST", time.Now().Unix()-3600)
 	if err != nil {
-		log.Println(err)
+		c.logger.Error("Error loading recent messages", "err", err)
+		return
 	}
-	var nextMessage Message
+	defer rows.Close()
 	for rows.Next() {
-		rows.Scan(&nextMessage.Sender, &nextMessage.Epoch, &nextMessage.MessageText, &nextMessage.RoomName)
-		err = c.WriteJSON(nextMessage)
-		if err != nil {
-			log.Println(err)
-		}
+		nextMessage, _ := scanMessage(rows)
+		sendHandler(c, nextMessage)
 	}
 }
 
-func websocketListener(conn *websocket.Conn) {
+func websocketListener(c *wsClient) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("Error", fmt.Sprintf("%v", r))
+			c.logger.Error("Recovered from panic in websocket listener", "panic", fmt.Sprintf("%v", r))
 		}
 	}()
 
-	var msg Message
+	// Anything read, pongs included, shows the connection is alive
+	c.conn.SetReadDeadline(time.Now().Add(config.Limits.ReadTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(config.Limits.ReadTimeout))
+	})
 	for {
-		err := conn.ReadJSON(&msg)
+		msg, err := c.readMessage()
 		if err != nil {
-			fmt.Println("Error, closing connection", err)
-			conn.Close()
-			//Remove the user from the map of connections
-			for k, v := range wsconns {
-				if v == conn {
-					delete(wsconns, k)
-				}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				c.logger.Warn("Websocket timed out, closing connection", "read_timeout", config.Limits.ReadTimeout)
+			} else if !c.isClosed() && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.logger.Warn("Error reading from websocket, closing connection", "err", err)
 			}
-		} else {
-			postMessage(msg)
+			c.logger.Info("Websocket disconnected")
+			//Remove the user from the map of connections
+			unregisterClient(c)
+			c.close(websocket.CloseNormalClosure, "")
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(config.Limits.ReadTimeout))
+		wsMessagesReceived.inc()
+		if err := postMessage(c.logger, msg); err != nil {
+			c.logger.Warn("Error posting message over websocket", "err", err)
 		}
 	}
 }
 
 //Send the new message over websockets
-func sendHandler(c *websocket.Conn, msg Message) {
-	err := c.WriteJSON(msg)
-	if err != nil {
-		log.Println(err)
+func sendHandler(c *wsClient, msg Message) {
+	switch reason := c.enqueue(msg); reason {
+	case "":
+	case "slow_consumer":
+		droppedSends.inc(reason)
+		c.logger.Warn("Closing connection too slow to keep up with messages", "queue_size", cap(c.send))
+		unregisterClient(c)
+	default:
+		droppedSends.inc(reason)
+		c.logger.Warn("Dropping message for closed connection")
 	}
 }
 
-// Handles the /status page to ensure the API is working
+// Handles the /status page for older clients. Reports the readiness checks as plain text,
+// /health/ready has the details.
 func statusCheck(w http.ResponseWriter, r *http.Request) {
+	health := readiness(r.Context())
+	if health.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, check := range health.Checks {
+			if check.Status != "ok" {
+				fmt.Fprintf(w, "API is not ready: %s: %s", check.Name, check.Detail)
+				return
+			}
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "API is running properly")
 }
@@ -209,44 +454,82 @@ func statusCheck(w http.ResponseWriter, r *http.Request) {
 // Post a new message to a room
 func newMessageHandler(w http.ResponseWriter, r *http.Request) {
 	userReq := Message{}
+	r.Body = http.MaxBytesReader(w, r.Body, config.Limits.MaxMessageSize)
 	err := json.NewDecoder(r.Body).Decode(&userReq)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
 		return
 	}
-	err = postMessage(userReq)
+	err = postMessage(requestLogger(r.Context()), userReq)
 
+	if apiErr, ok := err.(*APIError); ok && apiErr.Code == ErrCodeStaleKey {
+		writeErr(w, http.StatusConflict, err)
+		return
+	}
+	if apiErr, ok := err.(*APIError); ok && (apiErr.Code == ErrCodeUserDisabled || apiErr.Code == ErrCodeRoomDisabled) {
+		writeErr(w, http.StatusForbidden, err)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeErr(w, http.StatusBadRequest, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-// Post a message to the given room
-func postMessage(msg Message) error {
+// Post a message to the given room, logging with the logger of the request or websocket it came from
+func postMessage(logger *slog.Logger, msg Message) error {
+	if msg.Sender == nil || msg.RoomName == nil || msg.MessageText == nil {
+		return newAPIError(ErrCodeMissingField, "A message requires a sender, roomName and messageText")
+	}
 	roomName := *msg.RoomName
-	fmt.Println("Posting message to room: ", roomName, ". Message Text: ", *msg.MessageText)
-	epoch := time.Now().Unix()
-	if roomID, err := getRoomID(roomName); err != nil {
-		log.Println(err)
-	} else {
-		// Use websockets to send the message to all users in the room with active connections
-		for userID := range activeRooms[roomID] {
-			if c, ok := wsconns[userID]; ok {
-				sendHandler(c, msg)
-			}
-		}
+	logger.Debug("Posting message", "room", roomName, "sender", *msg.Sender, messageText(*msg.MessageText))
+	if !userExists(*msg.Sender) {
+		return newAPIError(ErrCodeUserNotFound, "Invalid sender supplied \"%s\": A user with this name does not exist", *msg.Sender)
+	}
+	if userDisabled(*msg.Sender) {
+		return newAPIError(ErrCodeUserDisabled, "User \"%s\" has been disabled by an administrator", *msg.Sender)
 	}
-	res, err := db.Exec("INSERT INTO Messages (UserID, Epoch, MessageText, RoomID) VALUES ((SELECT UserID FROM Users WHERE Name = ?), ?, ?, (SELECT RoomID FROM Rooms WHERE RoomName = ?))", msg.Sender, epoch, msg.MessageText, msg.RoomName)
+	roomID, err := getRoomID(roomName)
 	if err != nil {
-		log.Fatal(err)
+		return newAPIError(ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", roomName)
+	}
+	if roomDisabled(roomID) {
+		return newAPIError(ErrCodeRoomDisabled, "Room \"%s\" has been disabled by an administrator", roomName)
+	}
+	// Fill in the stored details so clients can't misdescribe an attachment
+	var attachmentID interface{}
+	if msg.Attachment != nil {
+		att, err := getAttachment(msg.Attachment.ID)
+		if err != nil {
+			return newAPIError(ErrCodeNotFound, "Invalid attachment supplied \"%s\": An attachment with this id does not exist", msg.Attachment.ID)
+		}
+		msg.Attachment = att
+		attachmentID = att.ID
+	}
+	if err := checkEncryptedMessage(roomID, msg); err != nil {
+		return err
 	}
+	epoch := time.Now().Unix()
+	msg.Epoch = &epoch
 
-	if _, err = res.LastInsertId(); err != nil {
+	// Store the message before anyone is sent it, so no one sees a message that is then lost
+	_, err = db.Exec("INSERT INTO Messages (UserID, Epoch, MessageText, RoomID, AttachmentID) VALUES ((SELECT UserID FROM Users WHERE Name = ?), ?, ?, ?, ?)", msg.Sender, epoch, msg.MessageText, roomID, attachmentID)
+	if err != nil {
 		return err
 	}
 
+	// Use websockets to send the message to all users in the room with active connections
+	fanoutStart := time.Now()
+	for _, c := range clientsForUsers(roomMembers(roomID)) {
+		sendHandler(c, msg)
+	}
+	fanoutDuration.since(fanoutStart)
+	// Members connected to other instances get it from them
+	publishEvent(clusterEvent{Type: clusterMessage, RoomID: roomID, Message: &msg})
+	messagesPosted.inc(roomName)
+
+	emitRoomEvent(roomID, roomName, EventMessage, *msg.Sender, &msg)
 	return nil
 }
 
@@ -257,36 +540,54 @@ func chatHandler(w http.ResponseWriter, r *http.Request) {
 	var response Response
 	var messages []Message
 
-	if messageStartTime != "" {
+	if !roomExists(room) {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return
+	}
+
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		// Page backwards through the history: the newest messages sent before the given epoch
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid limit supplied \"%s\": must be a positive integer", limit)
+			return
+		}
+		before := time.Now().Unix() + 1
+		if b := r.URL.Query().Get("before"); b != "" {
+			if before, err = strconv.ParseInt(b, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid before supplied \"%s\": must be an epoch in seconds", b)
+				return
+			}
+		}
+		messages, err = getMessagesBefore(room, before, n)
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+	} else if messageStartTime != "" {
 		// Parse the start time into an epoch int64
 		epoch, err := strconv.ParseInt(messageStartTime, 10, 64)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid message-start-time supplied \"%s\": must be an epoch in seconds", messageStartTime)
+			return
 		}
 		messages, err = getMessagesAfter(room, epoch)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeErr(w, http.StatusInternalServerError, err)
+			return
 		}
 	} else {
 		var err error
 		messages, err = getMessages(room)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeErr(w, http.StatusInternalServerError, err)
+			return
 		}
 	}
 
 	// Setting the response up in JSON format
 	response.Messages = messages
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	json, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-
-	}
-
-	w.Write(json)
+	writeJSON(w, http.StatusOK, response)
 }
 
 // Return a slice of all Messages from the given room
@@ -295,15 +596,16 @@ func getMessages(roomName string) ([]Message, error) {
 	var nextMessage Message
 
 	// Query the DB to get the username, epoch time, message text, and roomname for all messages in the room
-	rows, err := db.Query("SELECT Users.Name, Epoch, MessageText, Rooms.RoomName FROM Messages INNER JOIN Users ON Messages.UserID = Users.UserID INNER JOIN Rooms ON Messages.RoomID = Rooms.RoomID WHERE Rooms.RoomName = ?", roomName)
+	rows, err := db.Query(messageQuery+" WHERE Rooms.RoomName = ? ORDER BY Epoch, Messages.rowid", roomName)
 
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	// Scan the rows and extract the data into a Message, then append it to the slice of Messages
 	for rows.Next() {
-		rows.Scan(&nextMessage.Sender, &nextMessage.Epoch, &nextMessage.MessageText, &nextMessage.RoomName)
+		nextMessage, _ = scanMessage(rows)
 		messages = append(messages, nextMessage)
 	}
 
@@ -315,43 +617,130 @@ func getMessagesAfter(roomName string, epoch int64) ([]Message, error) {
 	var messages []Message
 	var nextMessage Message
 
-	fmt.Println("Getting messages")
+	slog.Debug("Getting messages", "room", roomName, "since", epoch)
 
 	// Query the DB to get the username, epoch time, message text, and roomname for all messages in the room
-	rows, err := db.Query("SELECT Users.Name, Epoch, MessageText, Rooms.RoomName FROM Messages INNER JOIN Users ON Messages.UserID = Users.UserID INNER JOIN Rooms ON Messages.RoomID = Rooms.RoomID WHERE Rooms.RoomName = ? AND Epoch >= ?", roomName, epoch)
+	rows, err := db.Query(messageQuery+" WHERE Rooms.RoomName = ? AND Epoch >= ? ORDER BY Epoch, Messages.rowid", roomName, epoch)
 
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	// Scan the rows and extract the data into a Message, then append it to the slice of Messages
 	for rows.Next() {
-		rows.Scan(&nextMessage.Sender, &nextMessage.Epoch, &nextMessage.MessageText, &nextMessage.RoomName)
+		nextMessage, _ = scanMessage(rows)
 		messages = append(messages, nextMessage)
 	}
 
 	return messages, nil
 }
 
-// Handles creation of new chat rooms at /chat/room/new. If the room already exists, return an error
+// Handles listing the users active in a room
+func membersHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	members, err := getUsersInRoom(room)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Strings(members)
+	writeJSON(w, http.StatusOK, MembersResponse{Room: room, Members: members})
+}
+
+// Returns up to limit of the newest messages in the room sent before the given epoch, oldest first
+func getMessagesBefore(roomName string, before int64, limit int) ([]Message, error) {
+	var messages []Message
+
+	rows, err := db.Query(messageQuery+" WHERE Rooms.RoomName = ? AND Epoch < ? ORDER BY Epoch DESC, Messages.rowid DESC LIMIT ?", roomName, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		nextMessage, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, nextMessage)
+	}
+
+	// Reverse so the messages read oldest to newest like the other queries
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, rows.Err()
+}
+
+// Handles listing all chat rooms
+func roomsHandler(w http.ResponseWriter, r *http.Request) {
+	rooms, err := getRooms()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, RoomsResponse{Rooms: rooms})
+}
+
+// Returns the names of all rooms in alphabetical order
+func getRooms() ([]string, error) {
+	rooms := make([]string, 0)
+	rows, err := db.Query("SELECT RoomName FROM Rooms ORDER BY RoomName")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, name)
+	}
+	return rooms, rows.Err()
+}
+
+// Handles creation of new chat rooms at /chat/room/new. If the room already exists, return an error.
+// The user in the optional User-Name header becomes the room's owner.
+// With encrypted=true the room only accepts end-to-end encrypted messages.
 func newRoomHandler(w http.ResponseWriter, r *http.Request) {
 	name := r.URL.Query().Get("room-name")
+	if name == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeMissingField, "The room-name query parameter is required")
+		return
+	}
+	owner := r.Header.Get("User-Name")
+	if owner != "" && !userExists(owner) {
+		writeError(w, http.StatusBadRequest, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", owner)
+		return
+	}
 	//Check if the room already exists
 	if roomExists(name) {
 		// Room exists, return an error
-		http.Error(w, fmt.Sprintf("Error creating room with name \"%s\": A room with this name already exists", name), http.StatusConflict)
-	} else {
-		// Room doesn't existm create a new room
-		if err := createRoom(name); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
-		w.WriteHeader(http.StatusOK)
+		writeError(w, http.StatusConflict, ErrCodeRoomExists, "Error creating room with name \"%s\": A room with this name already exists", name)
+		return
+	}
+	encrypted := r.URL.Query().Get("encrypted") == "true"
+	// Room doesn't exist, create a new room
+	if err := createRoom(name, owner, encrypted); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
 }
 
-// Creates a chat room if it doesn't already exist
-func createRoom(name string) error {
-	if _, err := db.Exec("INSERT OR IGNORE INTO Rooms (RoomName) VALUES (?)", name); err != nil {
+// Creates a chat room if it doesn't already exist. An empty owner leaves the room without one.
+func createRoom(name, owner string, encrypted bool) error {
+	var ownerValue interface{}
+	if owner != "" {
+		ownerValue = owner
+	}
+	if _, err := db.Exec("INSERT INTO Rooms (RoomName, Owner, Encrypted) VALUES (?, ?, ?) ON CONFLICT DO NOTHING", name, ownerValue, encrypted); err != nil {
 		return err
 	}
 	return nil
@@ -383,28 +772,88 @@ func joinRoomHandler(w http.ResponseWriter, r *http.Request) {
 	room := r.Header.Get("Room-Name")
 
 	if !userExists(user) {
-		http.Error(w, fmt.Sprintf("Invalid user name supplied \"%s\": A user with this name does not exist", user), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", user)
+		return
+	}
+	if room == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeMissingField, "The Room-Name header is required")
+		return
+	}
+	if userDisabled(user) {
+		writeError(w, http.StatusForbidden, ErrCodeUserDisabled, "User \"%s\" has been disabled by an administrator", user)
 		return
 	}
 
 	if !roomExists(room) {
-		if err := createRoom(room); err != nil {
-			http.Error(w, fmt.Sprintf("Error creating room with name \"%s\"", room), http.StatusBadRequest)
+		// The user creating a room by joining it becomes its owner
+		if err := createRoom(room, user, false); err != nil {
+			requestLogger(r.Context()).Error("Error creating room", "room", room, "err", err)
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Error creating room with name \"%s\"", room)
+			return
 		}
 	}
 	roomID, err := getRoomID(room)
 	if err != nil {
 		// Trying to join a room that doesn't exist, return an http error
-		http.Error(w, fmt.Sprintf("Error joining room with name \"%s\"", room), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrCodeRoomNotFound, "Error joining room with name \"%s\"", room)
 		return
 	}
+	if roomDisabled(roomID) {
+		writeError(w, http.StatusForbidden, ErrCodeRoomDisabled, "Room \"%s\" has been disabled by an administrator", room)
+		return
+	}
+	// Members of an encrypted room need a public key to be sent the room key
+	encrypted, _, _, err := roomEncryption(roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if encrypted {
+		if ok, err := hasPublicKey(user); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		} else if !ok {
+			writeError(w, http.StatusBadRequest, ErrCodeKeyNotFound, "Room \"%s\" is end-to-end encrypted: publish a key with PUT /chat/keys/%s before joining", room, user)
+			return
+		}
+	}
+
+	if addRoomMember(roomID, user) {
+		emitRoomEvent(roomID, room, EventJoin, user, nil)
+	}
+}
 
+// Adds the user to the room's active members. Returns false if they were already in it.
+func addRoomMember(roomID int, user string) bool {
+	roomsMu.Lock()
+	added := addActiveMember(roomID, user)
+	if added {
+		// The new member doesn't have the room key yet, and shouldn't get the current one
+		if err := markRekey(roomID); err != nil {
+			slog.Error("Error marking room for rekey", "room_id", roomID, "err", err)
+		}
+	}
+	roomsMu.Unlock()
+	if added {
+		publishEvent(clusterEvent{Type: clusterJoin, RoomID: roomID, User: user})
+	}
+	return added
+}
+
+// Adds the user to activeRooms. Returns false if they were already in the room. Callers hold roomsMu.
+func addActiveMember(roomID int, user string) bool {
 	if _, ok := activeRooms[roomID]; !ok {
 		activeRooms[roomID] = make([]string, 0)
 	}
 
-	// Add the user to the slice
+	// Add the user to the slice if they aren't already in the room
+	for _, userName := range activeRooms[roomID] {
+		if userName == user {
+			return false
+		}
+	}
 	activeRooms[roomID] = append(activeRooms[roomID], user)
+	return true
 }
 
 // Removes the user/room pair from ActiveRooms when they leave
@@ -413,21 +862,47 @@ func leaveRoomHandler(w http.ResponseWriter, r *http.Request) {
 	room := r.Header.Get("Room-Name")
 
 	if !userExists(user) {
-		http.Error(w, fmt.Sprintf("Invalid user name supplied \"%s\": A user with this name does not exist", user), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", user)
 		return
 	}
 
 	roomID, err := getRoomID(room)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Invalid room name supplied \"%s\": A room with this name does not exist", room), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return
+	}
+
+	if removeRoomMember(roomID, user) {
+		emitRoomEvent(roomID, room, EventLeave, user, nil)
+	}
+}
+
+// Removes the user from the room's active members. Returns false if they weren't in it.
+func removeRoomMember(roomID int, user string) bool {
+	roomsMu.Lock()
+	removed := removeActiveMember(roomID, user)
+	if removed {
+		// Stop sending with a key the departed member holds
+		if err := markRekey(roomID); err != nil {
+			slog.Error("Error marking room for rekey", "room_id", roomID, "err", err)
+		}
 	}
+	roomsMu.Unlock()
+	if removed {
+		publishEvent(clusterEvent{Type: clusterLeave, RoomID: roomID, User: user})
+	}
+	return removed
+}
 
+// Removes the user from activeRooms. Returns false if they weren't in the room. Callers hold roomsMu.
+func removeActiveMember(roomID int, user string) bool {
 	for i, userName := range activeRooms[roomID] {
 		if userName == user {
-			remove(activeRooms[roomID], i)
+			activeRooms[roomID] = remove(activeRooms[roomID], i)
+			return true
 		}
 	}
-
+	return false
 }
 
 // Remove the element at index i from the slice
@@ -471,7 +946,7 @@ func getUserIDByName(name *string) (int, error) {
 
 	var userID int
 
-	row := db.QueryRow("SELECT UserID FROM Users WHERE Name = ?", &name)
+	row := db.QueryRow("SELECT UserID FROM Users WHERE Name = ?", *name)
 	// Scan the row, return the error if found
 	if err := row.Scan(&userID); err != nil {
 		return -1, err
@@ -482,23 +957,9 @@ func getUserIDByName(name *string) (int, error) {
 
 // Returns a slice of strings containing names of all users actively in a room
 func getUsersInRoom(roomName string) ([]string, error) {
-	var names []string
-	var nextName string
-
-	rows, err := db.Query(
-		"SELECT Users.Name FROM ActiveRooms INNER JOIN Users ON ActiveRooms.UserID = Users.UserID INNER JOIN Rooms ON ActiveRooms.RoomID = Rooms.RoomID WHERE Rooms.RoomName = ?", roomName)
-
+	roomID, err := getRoomID(roomName)
 	if err != nil {
-		return names, err
-	}
-
-	//Scan the returned names and return them in a slice
-	for rows.Next() {
-		err = rows.Scan(&nextName)
-		if err != nil {
-			return names, err
-		}
-		names = append(names, nextName)
+		return nil, err
 	}
-	return names, nil
+	return roomMembers(roomID), nil
 }
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp in backup file names, to the millisecond. It sorts in the order the backups were taken.
+const backupTimeFormat = "20060102T150405.000Z"
+
+// Timestamp in the names of backups taken before they had milliseconds
+const legacyBackupTimeFormat = "20060102T150405Z"
+
+// A copy of the database written by backupDatabase
+type Backup struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Created  int64  `json:"created"`
+	Duration string `json:"duration,omitempty"`
+
+	// Older backups deleted to stay within backup.keep
+	Removed []string `json:"removed,omitempty"`
+}
+
+// HTTP Response struct containing the backups in the backup directory, newest first
+type BackupsResponse struct {
+	Dir     string   `json:"dir"`
+	Keep    int      `json:"keep"`
+	Backups []Backup `json:"backups"`
+}
+
+// Serializes backups so two can't write the same file
+var backupMu sync.Mutex
+
+var backupQuit chan struct{}
+var backupDone chan struct{}
+
+// Starts taking a backup every backup.interval. Nothing runs when the interval is 0.
+func startBackups() {
+	backupQuit = make(chan struct{})
+	backupDone = make(chan struct{})
+	if config.Backup.Interval == 0 {
+		close(backupDone)
+		return
+	}
+	go func() {
+		defer close(backupDone)
+		ticker := time.NewTicker(config.Backup.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-backupQuit:
+				return
+			case <-ticker.C:
+			}
+			backup, err := backupDatabase()
+			if err != nil {
+				slog.Error("Error backing up database", "err", err)
+				continue
+			}
+			slog.Info("Backed up database", "path", backup.Path, "bytes", backup.Size,
+				"duration", backup.Duration, "removed", len(backup.Removed))
+		}
+	}()
+}
+
+// Stops the scheduled backups, waiting for one in progress until ctx is done
+func stopBackups(ctx context.Context) {
+	close(backupQuit)
+	select {
+	case <-backupDone:
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for the database backup to finish")
+	}
+}
+
+// Returns the start and end of backup file names for the configured database, around the timestamp
+func backupNameParts() (string, string) {
+	base := filepath.Base(config.Database.Path)
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "-", ext
+}
+
+// Writes a consistent copy of the live database to the backup directory with VACUUM INTO.
+// Writers are only blocked while the copy is read, and the copy is compacted. The copy is checked
+// before older backups are rotated out, so a bad backup never replaces a good one.
+func backupDatabase() (backup Backup, err error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	defer func() {
+		if err != nil {
+			backupsTaken.inc("error")
+		} else {
+			backupsTaken.inc("ok")
+		}
+	}()
+
+	if err := os.MkdirAll(config.Backup.Dir, 0o755); err != nil {
+		return Backup{}, err
+	}
+	started := time.Now()
+	prefix, ext := backupNameParts()
+	// VACUUM INTO fails if the file exists, so a backup taken in the same millisecond as the last
+	// one, or after the clock stepped back, takes the next free name
+	stamp := started.UTC()
+	path := filepath.Join(config.Backup.Dir, prefix+stamp.Format(backupTimeFormat)+ext)
+	for {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			break
+		} else if err != nil {
+			return Backup{}, err
+		}
+		stamp = stamp.Add(time.Millisecond)
+		path = filepath.Join(config.Backup.Dir, prefix+stamp.Format(backupTimeFormat)+ext)
+	}
+
+	if _, err := db.Exec("VACUUM INTO ?", path); err != nil {
+		return Backup{}, err
+	}
+	if _, err := checkDatabaseFile(path, "quick_check"); err != nil {
+		os.Remove(path)
+		return Backup{}, fmt.Errorf("checking backup: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Backup{}, err
+	}
+	backup = Backup{
+		Path:     path,
+		Size:     info.Size(),
+		Created:  started.Unix(),
+		Duration: time.Since(started).Round(time.Millisecond).String(),
+	}
+	if backup.Removed, err = rotateBackups(); err != nil {
+		// The new backup is fine, so don't fail it
+		slog.Warn("Error removing old backups", "err", err)
+	}
+	return backup, nil
+}
+
+// Returns the backups of the configured database in the backup directory, newest first. Files
+// that don't match the backup naming scheme are ignored.
+func listBackups() ([]Backup, error) {
+	entries, err := os.ReadDir(config.Backup.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Backup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix, ext := backupNameParts()
+	backups := make([]Backup, 0)
+	// When each backup was taken, to the millisecond, since Created only has seconds
+	taken := make(map[string]time.Time)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		created, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			if created, err = time.Parse(legacyBackupTimeFormat, stamp); err != nil {
+				continue
+			}
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(config.Backup.Dir, name)
+		taken[path] = created
+		backups = append(backups, Backup{
+			Path:    path,
+			Size:    info.Size(),
+			Created: created.Unix(),
+		})
+	}
+	sort.Slice(backups, func(i, j int) bool { return taken[backups[i].Path].After(taken[backups[j].Path]) })
+	return backups, nil
+}
+
+// Deletes the oldest backups beyond backup.keep and returns their paths. 0 keeps every backup.
+func rotateBackups() ([]string, error) {
+	if config.Backup.Keep == 0 {
+		return nil, nil
+	}
+	backups, err := listBackups()
+	if err != nil || len(backups) <= config.Backup.Keep {
+		return nil, err
+	}
+	var removed []string
+	for _, b := range backups[config.Backup.Keep:] {
+		if err := os.Remove(b.Path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, b.Path)
+	}
+	return removed, nil
+}
+
+// Opens the database file at path read only and runs the integrity check pragma, either
+// "integrity_check" or the faster "quick_check". Returns the file's schema version, which must not
+// be newer than this server's.
+func checkDatabaseFile(path, pragma string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+	// Escape the characters SQLite treats specially in a URI filename
+	uri := "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path) + "?mode=ro"
+	// The plain driver so checks don't show up in the live database's query metrics
+	check, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return 0, err
+	}
+	defer check.Close()
+
+	rows, err := check.Query("PRAGMA " + pragma)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return 0, err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(problems) > 0 {
+		return 0, fmt.Errorf("%s failed: %s", pragma, strings.Join(problems, "; "))
+	}
+
+	var version int
+	if err := check.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	if version > schemaVersion {
+		return 0, fmt.Errorf("schema version %d is newer than this server supports (%d)", version, schemaVersion)
+	}
+	return version, nil
+}
+
+// Handles taking a backup on demand
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	if usingPostgres() {
+		writeError(w, http.StatusNotImplemented, ErrCodeNotSupported, "Backups are only taken of SQLite databases, back up PostgreSQL with pg_dump")
+		return
+	}
+	backup, err := backupDatabase()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	requestLogger(r.Context()).Info("Backed up database", "path", backup.Path, "bytes", backup.Size,
+		"duration", backup.Duration, "removed", len(backup.Removed))
+	writeJSON(w, http.StatusCreated, backup)
+}
+
+// Handles listing the backups in the backup directory
+func backupsHandler(w http.ResponseWriter, r *http.Request) {
+	backups, err := listBackups()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, BackupsResponse{Dir: config.Backup.Dir, Keep: config.Backup.Keep, Backups: backups})
+}
+
+// Runs "gochat restore", which replaces the database with a backup. Every server using the database
+// must be stopped first since they keep the old file open, and restore refuses to run until they are.
+// Where there are no file locks to tell, it refuses unless -force says they have been stopped.
+func runRestoreCommand(args []string) error {
+	fs := flag.NewFlagSet("gochat restore", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML config file (env "+envPrefix+"CONFIG)")
+	dbPath := fs.String("database-path", "", "path to the SQLite database, overrides the config")
+	backupDir := fs.String("backup-dir", "", "directory to find the latest backup in, overrides the config")
+	file := fs.String("file", "", "backup to restore, latest for the newest backup in backup.dir")
+	force := fs.Bool("force", false, "restore where the database can't be locked, after stopping every server using it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+
+	var configArgs []string
+	if *configPath != "" {
+		configArgs = append(configArgs, "-config", *configPath)
+	}
+	if *dbPath != "" {
+		configArgs = append(configArgs, "-database-path", *dbPath)
+	}
+	if *backupDir != "" {
+		configArgs = append(configArgs, "-backup-dir", *backupDir)
+	}
+	cfg, err := loadConfig(configArgs)
+	if err != nil {
+		return err
+	}
+	config = cfg
+	if usingPostgres() {
+		return errors.New("restore only works with SQLite, restore PostgreSQL with pg_restore")
+	}
+
+	source := *file
+	if source == "latest" {
+		backups, err := listBackups()
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return fmt.Errorf("no backups in %s", config.Backup.Dir)
+		}
+		source = backups[0].Path
+	}
+	previous, err := restoreDatabase(source, config.Database.Path, *force)
+	if err != nil {
+		return err
+	}
+	slog.Info("Restored database", "backup", source, "database", config.Database.Path, "previous", previous)
+	return nil
+}
+
+// Replaces the database at dest with a copy of the backup at source. The copy is written next to
+// dest and checked with a full integrity check before it is renamed into place, and files already
+// moved are put back if a rename fails, so a failure leaves the database untouched. The replaced
+// database and its WAL are kept alongside with a .pre-restore suffix, whose path is returned.
+// Refuses to run while a server holds its lock on dest, or without force where there is no lock.
+func restoreDatabase(source, dest string, force bool) (string, error) {
+	lock, err := lockDatabase(dest, true)
+	switch {
+	case errors.Is(err, errDatabaseLocked):
+		return "", fmt.Errorf("%s is in use: stop every server using it before restoring", dest)
+	case errors.Is(err, errLockUnsupported) && !force:
+		return "", fmt.Errorf("can't tell whether %s is in use on this platform: stop every server using it and restore with -force", dest)
+	case errors.Is(err, errLockUnsupported):
+	case err != nil:
+		return "", err
+	default:
+		defer lock.Close()
+	}
+
+	if _, err := checkDatabaseFile(source, "integrity_check"); err != nil {
+		return "", fmt.Errorf("checking %s: %w", source, err)
+	}
+
+	tmp := dest + ".restore"
+	if err := copyFile(source, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if _, err := checkDatabaseFile(tmp, "integrity_check"); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("checking copy of %s: %w", source, err)
+	}
+
+	previous := ""
+	var moved []string
+	// Puts back the files already moved aside
+	undo := func() error {
+		var errs []error
+		for _, suffix := range moved {
+			errs = append(errs, os.Rename(previous+suffix, dest+suffix))
+		}
+		return errors.Join(errs...)
+	}
+	if _, err := os.Stat(dest); err == nil {
+		previous = dest + ".pre-restore-" + time.Now().UTC().Format(backupTimeFormat)
+		// SQLite pairs -wal and -shm files with the database by name, so they move with it
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			err := os.Rename(dest+suffix, previous+suffix)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				os.Remove(tmp)
+				return "", errors.Join(err, undo())
+			}
+			moved = append(moved, suffix)
+		}
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return "", errors.Join(err, undo())
+	}
+	return previous, nil
+}
+
+// Copies the file at src to dst and syncs it to disk
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Takes a backup, failing the test if it doesn't succeed
+func takeTestBackup(t *testing.T) Backup {
+	t.Helper()
+	backup, err := backupDatabase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backup
+}
+
+// Returns the contents of the file at path
+func readTestFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Returns the paths of the files next to dest whose names start with its name, other than dest
+// itself and its lock file
+func restoreLeftovers(t *testing.T, dest string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(dest + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leftovers []string
+	for _, m := range matches {
+		if m != dest && m != dest+".lock" {
+			leftovers = append(leftovers, m)
+		}
+	}
+	return leftovers
+}
+
+func TestBackup(t *testing.T) {
+	openTestDatabase(t)
+	createTestRoom(t, "lobby")
+
+	backup := takeTestBackup(t)
+	if dir := filepath.Dir(backup.Path); dir != config.Backup.Dir {
+		t.Errorf("backup written to %s, want %s", dir, config.Backup.Dir)
+	}
+	if _, err := checkDatabaseFile(backup.Path, "quick_check"); err != nil {
+		t.Errorf("backup fails its check: %v", err)
+	}
+	backups, err := listBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Path != backup.Path || backups[0].Size != backup.Size {
+		t.Errorf("listed backups %+v, want only %+v", backups, backup)
+	}
+}
+
+// Backups taken back to back get names of their own, and the oldest beyond backup.keep are removed
+func TestBackupRotation(t *testing.T) {
+	openTestDatabase(t, "-backup-keep", "2")
+
+	var taken []string
+	for i := 0; i < 5; i++ {
+		taken = append(taken, takeTestBackup(t).Path)
+	}
+	backups, err := listBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, b := range backups {
+		kept = append(kept, b.Path)
+	}
+	want := []string{taken[4], taken[3]}
+	if strings.Join(kept, ",") != strings.Join(want, ",") {
+		t.Errorf("kept %v, want the newest two %v", kept, want)
+	}
+}
+
+// Backups named before backup names had milliseconds are still listed, in order
+func TestListLegacyBackups(t *testing.T) {
+	openTestDatabase(t)
+	prefix, ext := backupNameParts()
+	if err := os.MkdirAll(config.Backup.Dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{
+		prefix + "20261018T152452Z" + ext,
+		prefix + "20261018T152453.500Z" + ext,
+		prefix + "20261018T152453Z" + ext,
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(config.Backup.Dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := listBackups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, b := range backups {
+		listed = append(listed, filepath.Base(b.Path))
+	}
+	want := []string{names[1], names[2], names[0]}
+	if strings.Join(listed, ",") != strings.Join(want, ",") {
+		t.Errorf("listed %v, want %v", listed, want)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	openTestDatabase(t)
+	createTestRoom(t, "lobby")
+	older := takeTestBackup(t)
+	createTestRoom(t, "ops")
+	newer := takeTestBackup(t)
+	dest := filepath.Join(t.TempDir(), "restored.db")
+	if err := copyFile(older.Path, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	previous, err := restoreDatabase(newer.Path, dest, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readTestFile(t, dest), readTestFile(t, newer.Path)) {
+		t.Error("the database wasn't replaced with the backup")
+	}
+	if !strings.HasPrefix(previous, dest+".pre-restore-") {
+		t.Errorf("replaced database kept as %s, want a .pre-restore- copy", previous)
+	}
+	if !bytes.Equal(readTestFile(t, previous), readTestFile(t, older.Path)) {
+		t.Error("the .pre-restore copy isn't the replaced database")
+	}
+}
+
+// A backup that fails its integrity check leaves the database as it was
+func TestRestoreCorruptBackup(t *testing.T) {
+	openTestDatabase(t)
+	createTestRoom(t, "lobby")
+	backup := takeTestBackup(t)
+	dest := filepath.Join(t.TempDir(), "restored.db")
+	if err := copyFile(backup.Path, dest); err != nil {
+		t.Fatal(err)
+	}
+	before := readTestFile(t, dest)
+
+	// Keep the header so the file still opens, and scribble over the pages after it
+	corrupt := readTestFile(t, backup.Path)
+	for i := 100; i < len(corrupt); i++ {
+		corrupt[i] = 0xAA
+	}
+	source := filepath.Join(t.TempDir(), "corrupt.db")
+	if err := os.WriteFile(source, corrupt, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := restoreDatabase(source, dest, false); err == nil {
+		t.Fatal("restored a corrupt backup")
+	}
+	if !bytes.Equal(readTestFile(t, dest), before) {
+		t.Error("the database changed")
+	}
+	if leftovers := restoreLeftovers(t, dest); len(leftovers) > 0 {
+		t.Errorf("restore left %v behind", leftovers)
+	}
+}
+
+// Restore refuses to replace a database a server holds the lock on
+func TestRestoreLocked(t *testing.T) {
+	openTestDatabase(t)
+	backup := takeTestBackup(t)
+	dest := filepath.Join(t.TempDir(), "restored.db")
+	if err := copyFile(backup.Path, dest); err != nil {
+		t.Fatal(err)
+	}
+	before := readTestFile(t, dest)
+
+	lock, err := lockDatabase(dest, false)
+	if errors.Is(err, errLockUnsupported) {
+		if _, err := restoreDatabase(backup.Path, dest, false); err == nil {
+			t.Error("restored without -force where the database can't be locked")
+		}
+		t.Skip("no database locks on this platform")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+
+	if _, err := restoreDatabase(backup.Path, dest, true); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("restore while the database is locked returned %v, want it in use", err)
+	}
+	if !bytes.Equal(readTestFile(t, dest), before) {
+		t.Error("the database changed")
+	}
+	if leftovers := restoreLeftovers(t, dest); len(leftovers) > 0 {
+		t.Errorf("restore left %v behind", leftovers)
+	}
+}
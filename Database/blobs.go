@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Returned by put when the content is larger than the store allows
+var errBlobTooLarge = errors.New("blob is too large")
+
+// Images with more pixels than this don't get a thumbnail, to bound the memory used decoding them
+const maxThumbnailPixels = 40 * 1000 * 1000
+
+// Content addressed files on local disk. A blob is stored under its SHA-256 as
+// dir/ab/abcdef..., so uploading the same content twice stores it once.
+type blobStore struct {
+	dir     string
+	maxSize int64
+}
+
+// Attachment store, set up at startup
+var blobs *blobStore
+
+func newBlobStore(dir string, maxSize int64) (*blobStore, error) {
+	for _, sub := range []string{"tmp", "thumbs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &blobStore{dir: dir, maxSize: maxSize}, nil
+}
+
+// Returns the path of the blob with the given hash
+func (s *blobStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Returns the path of the blob's thumbnail
+func (s *blobStore) thumbnailPath(hash string) string {
+	return filepath.Join(s.dir, "thumbs", hash+".png")
+}
+
+// Stores the content read from r and returns its hash, size and sniffed media type. If accept
+// returns an error for the media type nothing is stored and the error is returned.
+func (s *blobStore) put(r io.Reader, accept func(contentType string) error) (string, int64, string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "upload-")
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	sniff := &sniffWriter{}
+	// Read one byte past the limit to tell a file of exactly maxSize from a larger one
+	size, err := io.Copy(io.MultiWriter(tmp, hash, sniff), io.LimitReader(r, s.maxSize+1))
+	if err != nil {
+		return "", 0, "", err
+	}
+	if size > s.maxSize {
+		return "", 0, "", errBlobTooLarge
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(sniff.buf))
+	if err := accept(contentType); err != nil {
+		return "", 0, "", err
+	}
+	dest := s.path(sum)
+	if _, err := os.Stat(dest); err == nil {
+		return sum, size, contentType, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", 0, "", err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", 0, "", err
+	}
+	return sum, size, contentType, nil
+}
+
+// Opens a stored blob
+func (s *blobStore) open(hash string) (*os.File, error) {
+	return os.Open(s.path(hash))
+}
+
+// Writes a thumbnail of the image blob that fits in a size x size box and returns the image's
+// dimensions. ok is false if the blob isn't an image that can be decoded.
+func (s *blobStore) makeThumbnail(hash string, size int) (width, height int, ok bool) {
+	f, err := s.open(hash)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil || cfg.Width*cfg.Height > maxThumbnailPixels {
+		return 0, 0, false
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, false
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	out, err := os.Create(s.thumbnailPath(hash))
+	if err != nil {
+		return cfg.Width, cfg.Height, false
+	}
+	defer out.Close()
+	if err := png.Encode(out, scaleImage(img, size)); err != nil {
+		os.Remove(out.Name())
+		return cfg.Width, cfg.Height, false
+	}
+	return cfg.Width, cfg.Height, true
+}
+
+// Scales the image down to fit in a size x size box, averaging the source pixels under each
+// destination pixel. Smaller images are returned unchanged.
+func scaleImage(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// Keeps the first 512 bytes written, which is all http.DetectContentType looks at
+type sniffWriter struct {
+	buf []byte
+}
+
+func (w *sniffWriter) Write(p []byte) (int, error) {
+	if room := 512 - len(w.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		w.buf = append(w.buf, p[:room]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+// Relays cluster events between the server instances sharing a database, so a message posted to one
+// instance reaches members connected to another. Each instance applies its own changes directly and
+// publishes them, and applies the events published by the others.
+type Broker interface {
+	// Sends an event to every subscribed instance, this one included
+	Publish(data []byte) error
+	// Calls handle with each event published by any instance, in the order each instance published them
+	Subscribe(handle func(data []byte)) error
+	// Returns an error if events can't currently be relayed
+	Check(ctx context.Context) error
+	Close() error
+}
+
+// A change to the in-memory hub state of one instance that the others need to apply
+type clusterEvent struct {
+	// Instance that published the event, which ignores it when it comes back
+	Origin string `json:"origin"`
+	Type   string `json:"type"`
+
+	RoomID  int      `json:"roomID,omitempty"`
+	UserID  int      `json:"userID,omitempty"`
+	User    string   `json:"user,omitempty"`
+	NewName string   `json:"newName,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+	Message *Message `json:"message,omitempty"`
+	// When the connection in a connect event was opened, in Unix nanoseconds
+	Connected int64 `json:"connected,omitempty"`
+}
+
+// Types of cluster event
+const (
+	clusterMessage     = "message"
+	clusterJoin        = "join"
+	clusterLeave       = "leave"
+	clusterRename      = "rename"
+	clusterConnect     = "connect"
+	clusterDisconnect  = "disconnect"
+	clusterRoomDeleted = "room_deleted"
+)
+
+// The broker this instance publishes to, replaced by startBroker. Subcommands that never start
+// one publish to nobody.
+var broker Broker = newLocalBroker()
+
+// Random ID of this instance, set by startBroker
+var instanceID string
+
+// Connects to the configured broker and starts applying the events other instances publish
+func startBroker() error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	instanceID = hex.EncodeToString(b)
+
+	var err error
+	switch config.Broker.Driver {
+	case "nats":
+		broker, err = newNATSBroker(config.Broker)
+	default:
+		broker = newLocalBroker()
+	}
+	if err != nil {
+		return err
+	}
+	return broker.Subscribe(handleClusterEvent)
+}
+
+// Flushes events still being published and disconnects from the broker
+func stopBroker() {
+	if err := broker.Close(); err != nil {
+		slog.Warn("Error closing broker", "err", err)
+	}
+}
+
+// Returns true when other instances may share the database, so this instance's hub state is only
+// part of the picture
+func clustered() bool {
+	return config.Broker.Driver != "local"
+}
+
+// Publishes an event for the other instances. A failure is logged rather than returned: the change
+// has already been made here and stored, so only live delivery elsewhere is lost.
+func publishEvent(ev clusterEvent) {
+	ev.Origin = instanceID
+	data, err := json.Marshal(ev)
+	if err == nil {
+		err = broker.Publish(data)
+	}
+	if err != nil {
+		brokerEvents.inc("publish_error", ev.Type)
+		slog.Warn("Error publishing cluster event", "type", ev.Type, "err", err)
+		return
+	}
+	brokerEvents.inc("published", ev.Type)
+}
+
+// Applies an event published by another instance to this instance's hub
+func handleClusterEvent(data []byte) {
+	var ev clusterEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		slog.Warn("Ignoring invalid cluster event", "err", err)
+		return
+	}
+	if ev.Origin == instanceID {
+		return
+	}
+	brokerEvents.inc("received", ev.Type)
+	slog.Debug("Applying cluster event", "type", ev.Type, "origin", ev.Origin, "room_id", ev.RoomID, "user", ev.User)
+
+	switch ev.Type {
+	case clusterMessage:
+		if ev.Message == nil {
+			return
+		}
+		for _, c := range clientsForUsers(roomMembers(ev.RoomID)) {
+			sendHandler(c, *ev.Message)
+		}
+	case clusterJoin:
+		roomsMu.Lock()
+		addActiveMember(ev.RoomID, ev.User)
+		roomsMu.Unlock()
+	case clusterLeave:
+		roomsMu.Lock()
+		removeActiveMember(ev.RoomID, ev.User)
+		roomsMu.Unlock()
+	case clusterRename:
+		renameActiveUser(ev.UserID, ev.User, ev.NewName)
+	case clusterConnect:
+		// One connection per user across the cluster, the newest wins
+		connsMu.RLock()
+		c, ok := wsconns[ev.UserID]
+		connsMu.RUnlock()
+		if ok && c.connected.UnixNano() < ev.Connected {
+			unregisterClient(c)
+			c.close(websocket.ClosePolicyViolation, "Replaced by a new connection")
+		}
+	case clusterDisconnect:
+		closeUserConnection(ev.User, ev.Reason)
+	case clusterRoomDeleted:
+		roomsMu.Lock()
+		delete(activeRooms, ev.RoomID)
+		roomsMu.Unlock()
+	default:
+		slog.Debug("Ignoring unknown cluster event", "type", ev.Type)
+	}
+}
+
+// A broker for a single instance, or several in one process. Events are handed straight to the
+// subscribers.
+type localBroker struct {
+	mu       sync.RWMutex
+	handlers []func(data []byte)
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{}
+}
+
+func (b *localBroker) Publish(data []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, handle := range b.handlers {
+		handle(data)
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(handle func(data []byte)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handle)
+	return nil
+}
+
+func (b *localBroker) Check(ctx context.Context) error {
+	return nil
+}
+
+func (b *localBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = nil
+	return nil
+}
+
+// Time allowed to flush published events when closing the NATS connection
+const natsFlushTimeout = 2 * time.Second
+
+// A broker that publishes events to a NATS subject every instance subscribes to. The client
+// reconnects forever, buffering events published meanwhile.
+type natsBroker struct {
+	conn    *nats.Conn
+	subject string
+
+	mu  sync.Mutex
+	sub *nats.Subscription
+}
+
+func newNATSBroker(cfg BrokerConfig) (*natsBroker, error) {
+	conn, err := nats.Connect(cfg.URL,
+		nats.Name("gochat "+instanceID),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("Disconnected from NATS", "err", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			slog.Info("Reconnected to NATS", "server", c.ConnectedUrlRedacted())
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			slog.Warn("NATS error", "err", err)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Connected to NATS", "server", conn.ConnectedUrlRedacted(), "subject", cfg.Subject, "instance", instanceID)
+	return &natsBroker{conn: conn, subject: cfg.Subject}, nil
+}
+
+func (b *natsBroker) Publish(data []byte) error {
+	return b.conn.Publish(b.subject, data)
+}
+
+// NATS calls a subscription's handler from one goroutine, so events are applied in order
+func (b *natsBroker) Subscribe(handle func(data []byte)) error {
+	sub, err := b.conn.Subscribe(b.subject, func(msg *nats.Msg) {
+		handle(msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.sub = sub
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *natsBroker) Check(ctx context.Context) error {
+	if !b.conn.IsConnected() {
+		return errors.New("not connected to NATS, status " + b.conn.Status().String())
+	}
+	return b.conn.FlushWithContext(ctx)
+}
+
+func (b *natsBroker) Close() error {
+	b.mu.Lock()
+	sub := b.sub
+	b.mu.Unlock()
+	if sub != nil {
+		sub.Unsubscribe()
+	}
+	err := b.conn.FlushTimeout(natsFlushTimeout)
+	b.conn.Close()
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// The hub state of one server instance. The hub keeps it in globals, so the instances of a test
+// take turns: run swaps an instance's state in for as long as fn runs.
+type testInstance struct {
+	id          string
+	wsconns     map[int]*wsClient
+	activeRooms map[int][]string
+}
+
+func (inst *testInstance) run(fn func()) {
+	prevID, prevConns, prevRooms := instanceID, wsconns, activeRooms
+	instanceID, wsconns, activeRooms = inst.id, inst.wsconns, inst.activeRooms
+	defer func() {
+		instanceID, wsconns, activeRooms = prevID, prevConns, prevRooms
+	}()
+	fn()
+}
+
+// Starts two instances sharing the test database and one local broker. The local broker hands
+// events straight to its subscribers, so an event has been applied everywhere by the time the call
+// that published it returns.
+func startTestCluster(t *testing.T) (a, b *testInstance) {
+	t.Helper()
+	prevBroker := broker
+	broker = newLocalBroker()
+	t.Cleanup(func() {
+		broker.Close()
+		broker = prevBroker
+	})
+	a = &testInstance{id: "a", wsconns: make(map[int]*wsClient), activeRooms: make(map[int][]string)}
+	b = &testInstance{id: "b", wsconns: make(map[int]*wsClient), activeRooms: make(map[int][]string)}
+	for _, inst := range []*testInstance{a, b} {
+		inst := inst
+		broker.Subscribe(func(data []byte) {
+			inst.run(func() { handleClusterEvent(data) })
+		})
+	}
+	return a, b
+}
+
+// Creates a user and connects them to inst
+func connectTestUser(t *testing.T, inst *testInstance, name string) *wsClient {
+	t.Helper()
+	userID, err := getUserIDByName(&name)
+	if err != nil {
+		if userID, err = newUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newClient(userID, name, transportWebsocket, "test", slog.Default())
+	inst.run(func() { registerClient(c) })
+	return c
+}
+
+// Returns the messages queued for c without waiting
+func queued(c *wsClient) []string {
+	var texts []string
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return texts
+			}
+			texts = append(texts, *msg.MessageText)
+		default:
+			return texts
+		}
+	}
+}
+
+func TestClusterMessages(t *testing.T) {
+	openTestDatabase(t)
+	a, b := startTestCluster(t)
+	roomID := createTestRoom(t, "lobby")
+	alice := connectTestUser(t, a, "alice")
+	bob := connectTestUser(t, b, "bob")
+	a.run(func() { addRoomMember(roomID, "alice") })
+	b.run(func() { addRoomMember(roomID, "bob") })
+
+	// Each instance stores a message before any other instance hears of it
+	stored := -1
+	broker.Subscribe(func(data []byte) {
+		db.QueryRow("SELECT COUNT(*) FROM Messages").Scan(&stored)
+	})
+
+	sender, room, text := "alice", "lobby", "hello from a"
+	a.run(func() {
+		if err := postMessage(slog.Default(), Message{Sender: &sender, RoomName: &room, MessageText: &text}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if stored != 1 {
+		t.Errorf("messages stored when the event was published = %d, want 1", stored)
+	}
+	for _, c := range []*wsClient{alice, bob} {
+		if got := queued(c); len(got) != 1 || got[0] != text {
+			t.Errorf("%s was sent %q, want [%q]", c.userName, got, text)
+		}
+	}
+
+	sender, text = "bob", "hello from b"
+	b.run(func() {
+		if err := postMessage(slog.Default(), Message{Sender: &sender, RoomName: &room, MessageText: &text}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got := queued(alice); len(got) != 1 || got[0] != text {
+		t.Errorf("alice was sent %q, want [%q]", got, text)
+	}
+	if stored != 2 {
+		t.Errorf("messages stored when the event was published = %d, want 2", stored)
+	}
+}
+
+func TestClusterMembership(t *testing.T) {
+	openTestDatabase(t)
+	a, b := startTestCluster(t)
+	roomID := createTestRoom(t, "lobby")
+	connectTestUser(t, a, "alice")
+
+	a.run(func() { addRoomMember(roomID, "alice") })
+	b.run(func() {
+		if got := roomMembers(roomID); len(got) != 1 || got[0] != "alice" {
+			t.Errorf("members on b after the join = %q, want [alice]", got)
+		}
+	})
+
+	a.run(func() { removeRoomMember(roomID, "alice") })
+	b.run(func() {
+		if got := roomMembers(roomID); len(got) != 0 {
+			t.Errorf("members on b after the leave = %q, want none", got)
+		}
+	})
+}
+
+func TestClusterRename(t *testing.T) {
+	openTestDatabase(t)
+	a, b := startTestCluster(t)
+	roomID := createTestRoom(t, "lobby")
+	alice := connectTestUser(t, b, "alice")
+	b.run(func() { addRoomMember(roomID, "alice") })
+
+	a.run(func() {
+		if err := renameUser(alice.userID, "alice", "alicia"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	b.run(func() {
+		if got := roomMembers(roomID); len(got) != 1 || got[0] != "alicia" {
+			t.Errorf("members on b after the rename = %q, want [alicia]", got)
+		}
+	})
+	if alice.userName != "alicia" {
+		t.Errorf("connection on b is named %q, want alicia", alice.userName)
+	}
+}
+
+func TestClusterConnections(t *testing.T) {
+	openTestDatabase(t)
+	a, b := startTestCluster(t)
+
+	// One connection per user across the cluster, so connecting to b closes the one on a
+	first := connectTestUser(t, a, "alice")
+	second := connectTestUser(t, b, "alice")
+	if !first.isClosed() {
+		t.Error("connection on a is still open after alice connected to b")
+	}
+	if _, ok := a.wsconns[first.userID]; ok {
+		t.Error("connection on a is still registered after alice connected to b")
+	}
+	if second.isClosed() {
+		t.Error("new connection on b was closed")
+	}
+
+	// An admin on a can disconnect the user from b
+	a.run(func() {
+		if disconnectUser("alice", "Disconnected by an administrator") {
+			t.Error("disconnectUser found alice connected to a")
+		}
+	})
+	if !second.isClosed() {
+		t.Error("connection on b is still open after the disconnect")
+	}
+}
+
+func TestClusterRoomDeleted(t *testing.T) {
+	openTestDatabase(t)
+	a, b := startTestCluster(t)
+	roomID := createTestRoom(t, "lobby")
+	connectTestUser(t, b, "bob")
+	b.run(func() { addRoomMember(roomID, "bob") })
+
+	r := mux.SetURLVars(httptest.NewRequest("DELETE", "/admin/rooms/lobby", nil), map[string]string{"room": "lobby"})
+	w := httptest.NewRecorder()
+	a.run(func() { adminDeleteRoomHandler(w, r) })
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("deleting the room returned %d: %s", w.Code, w.Body)
+	}
+	if _, ok := b.activeRooms[roomID]; ok {
+		t.Error("room is still active on b after it was deleted on a")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Encrypted messages are stored as "e2e:1:<key version>:<base64 nonce and ciphertext>". The server
+// only reads the key version, everything else is opaque to it.
+const encryptedPrefix = "e2e:1:"
+
+// Public keys are X25519 keys and signing keys Ed25519 keys, both 32 bytes before encoding
+const (
+	publicKeySize  = 32
+	signingKeySize = 32
+)
+
+// Largest wrapped room key accepted, in bytes before encoding
+const maxWrappedKeySize = 1024
+
+// Serializes room key rotations
+var rotateMu sync.Mutex
+
+// A user's keys from the key directory, base64 encoded. PublicKey wraps room keys for the user,
+// and SigningKey checks the room keys they wrap for others.
+type UserKey struct {
+	User       string `json:"user"`
+	PublicKey  string `json:"publicKey"`
+	SigningKey string `json:"signingKey"`
+	Updated    int64  `json:"updated"`
+}
+
+// Request body for publishing a user's keys
+type PublishKeyRequest struct {
+	PublicKey  string `json:"publicKey"`
+	SigningKey string `json:"signingKey"`
+}
+
+// A room key wrapped for one member with their public key
+type RoomKey struct {
+	Version    int    `json:"version"`
+	WrappedKey string `json:"wrappedKey"`
+	Sender     string `json:"sender"`
+	Created    int64  `json:"created"`
+}
+
+// A room's encryption state as seen by one user. Keys holds every version wrapped for that user,
+// so older messages can still be decrypted after a rotation.
+type RoomEncryption struct {
+	Room      string    `json:"room"`
+	Encrypted bool      `json:"encrypted"`
+	Version   int       `json:"version"`
+	Rekey     bool      `json:"rekey"`
+	Members   []string  `json:"members"`
+	Keys      []RoomKey `json:"keys"`
+}
+
+// Request body for rotating a room key. Keys maps every active member to the new key wrapped
+// with their public key.
+type RotateRoomKeyRequest struct {
+	Version int               `json:"version"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// Handles publishing the keys of the user in the URL, who must match the User-Name header. Keys
+// can't be replaced, since anyone could otherwise swap in their own key and be given the room keys
+// meant for the user. Publishing the same keys again is fine. An administrator resets a lost key
+// with DELETE /admin/users/{name}/key.
+//
+// Like the rest of the API, this trusts the User-Name header: there are no per-user credentials,
+// so whoever publishes first for a user owns the key. Clients pin keys on first use and show
+// fingerprints to compare, which is what catches a key published by someone else.
+func publishKeyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if r.Header.Get("User-Name") != name {
+		writeError(w, http.StatusForbidden, ErrCodeForbidden, "Users can only publish their own key")
+		return
+	}
+	userID, err := getUserIDByName(&name)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", name)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	var req PublishKeyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	if key, err := base64.StdEncoding.DecodeString(req.PublicKey); err != nil || len(key) != publicKeySize {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "The public key must be a base64 encoded %d byte X25519 key", publicKeySize)
+		return
+	}
+	if key, err := base64.StdEncoding.DecodeString(req.SigningKey); err != nil || len(key) != signingKeySize {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "The signing key must be a base64 encoded %d byte Ed25519 key", signingKeySize)
+		return
+	}
+
+	// Two first publishes may race, so the insert decides which one wins
+	key := UserKey{User: name, PublicKey: req.PublicKey, SigningKey: req.SigningKey, Updated: time.Now().Unix()}
+	res, err := db.Exec("INSERT INTO UserKeys (UserID, PublicKey, SigningKey, Updated) VALUES (?, ?, ?, ?) ON CONFLICT (UserID) DO NOTHING", userID, key.PublicKey, key.SigningKey, key.Updated)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var current UserKey
+		err = db.QueryRow("SELECT PublicKey, SigningKey, Updated FROM UserKeys WHERE UserID = ?", userID).Scan(&current.PublicKey, &current.SigningKey, &current.Updated)
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		if current.PublicKey != req.PublicKey || current.SigningKey != req.SigningKey {
+			writeError(w, http.StatusConflict, ErrCodeKeyExists, "User \"%s\" has already published a different key", name)
+			return
+		}
+		key.Updated = current.Updated
+	}
+	writeJSON(w, http.StatusOK, key)
+}
+
+// Handles looking up a user's public key in the key directory
+func getKeyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	key := UserKey{User: name}
+	err := db.QueryRow("SELECT PublicKey, SigningKey, Updated FROM UserKeys INNER JOIN Users ON UserKeys.UserID = Users.UserID WHERE Users.Name = ?", name).Scan(&key.PublicKey, &key.SigningKey, &key.Updated)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeKeyNotFound, "User \"%s\" has not published a key", name)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, key)
+}
+
+// Reports whether the user has published a key
+func hasPublicKey(user string) (bool, error) {
+	err := db.QueryRow("SELECT UserKeys.UserID FROM UserKeys INNER JOIN Users ON UserKeys.UserID = Users.UserID WHERE Users.Name = ?", user).Scan(new(int))
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Returns whether the room is encrypted, its current key version and whether it needs a new key
+func roomEncryption(roomID int) (bool, int, bool, error) {
+	var encrypted, rekey bool
+	var version int
+	err := db.QueryRow("SELECT Encrypted, KeyVersion, Rekey FROM Rooms WHERE RoomID = ?", roomID).Scan(&encrypted, &version, &rekey)
+	return encrypted, version, rekey, err
+}
+
+// Marks an encrypted room as needing a new key, so messages are refused until a member rotates it.
+// Called with roomsMu held whenever the active members change.
+func markRekey(roomID int) error {
+	_, err := db.Exec("UPDATE Rooms SET Rekey = 1 WHERE RoomID = ? AND Encrypted = 1", roomID)
+	return err
+}
+
+// Returns the key version of an encrypted message's text
+func encryptedKeyVersion(text string) (int, bool) {
+	if !strings.HasPrefix(text, encryptedPrefix) {
+		return 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(text, encryptedPrefix), ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, false
+	}
+	version, err := strconv.Atoi(parts[0])
+	return version, err == nil
+}
+
+// Checks a message posted to an encrypted room is encrypted with the room's current key
+func checkEncryptedMessage(roomID int, msg Message) error {
+	encrypted, version, rekey, err := roomEncryption(roomID)
+	if err != nil || !encrypted {
+		return err
+	}
+	// Attachments are stored unencrypted, so they would leak the room's content
+	if msg.Attachment != nil {
+		return newAPIError(ErrCodeEncrypted, "Attachments can't be posted to end-to-end encrypted room \"%s\"", *msg.RoomName)
+	}
+	v, ok := encryptedKeyVersion(*msg.MessageText)
+	if !ok {
+		return newAPIError(ErrCodeEncrypted, "Room \"%s\" is end-to-end encrypted: messages must be encrypted with the room key", *msg.RoomName)
+	}
+	if rekey || v != version {
+		return newAPIError(ErrCodeStaleKey, "The key for room \"%s\" has changed: fetch or rotate the room key and try again", *msg.RoomName)
+	}
+	return nil
+}
+
+// Handles getting a room's encryption state and the room keys wrapped for the user in the
+// User-Name header. Anyone can send that header, but only the user's private key unwraps the keys.
+func roomEncryptionHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	user := r.Header.Get("User-Name")
+	userID, err := getUserIDByName(&user)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", user)
+		return
+	}
+	roomID, err := getRoomID(room)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return
+	}
+	res := RoomEncryption{Room: room, Members: roomMembers(roomID), Keys: make([]RoomKey, 0)}
+	res.Encrypted, res.Version, res.Rekey, err = roomEncryption(roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	sort.Strings(res.Members)
+
+	rows, err := db.Query("SELECT Version, WrappedKey, Sender, Created FROM RoomKeys WHERE RoomID = ? AND UserID = ? ORDER BY Version", roomID, userID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key RoomKey
+		if err := rows.Scan(&key.Version, &key.WrappedKey, &key.Sender, &key.Created); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		res.Keys = append(res.Keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Handles a member distributing a new room key. The version must be the next one and the request
+// must wrap the key for exactly the room's active members, otherwise it conflicts with a rotation
+// or membership change that happened in the meantime. The sender is taken from the User-Name
+// header, so members' clients only accept the keys when they are signed with the sender's pinned
+// signing key.
+func rotateRoomKeyHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	user := r.Header.Get("User-Name")
+	roomID, err := getRoomID(room)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return
+	}
+	var req RotateRoomKeyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	for name, wrapped := range req.Keys {
+		if key, err := base64.StdEncoding.DecodeString(wrapped); err != nil || len(key) == 0 || len(key) > maxWrappedKeySize {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid wrapped key for \"%s\": must be base64 and at most %d bytes", name, maxWrappedKeySize)
+			return
+		}
+	}
+
+	// Hold the members steady so a join can't slip in between the check and the new key, and
+	// rotate one room key at a time so two members can't both claim the next version
+	roomsMu.RLock()
+	defer roomsMu.RUnlock()
+	rotateMu.Lock()
+	defer rotateMu.Unlock()
+	members := activeRooms[roomID]
+	if !containsString(members, user) {
+		writeError(w, http.StatusForbidden, ErrCodeForbidden, "Only active members of room \"%s\" can rotate its key", room)
+		return
+	}
+	encrypted, version, _, err := roomEncryption(roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !encrypted {
+		writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "Room \"%s\" is not end-to-end encrypted", room)
+		return
+	}
+	if req.Version != version+1 {
+		writeError(w, http.StatusConflict, ErrCodeKeyConflict, "The next key version of room \"%s\" is %d", room, version+1)
+		return
+	}
+	if len(req.Keys) != len(members) {
+		writeError(w, http.StatusConflict, ErrCodeKeyConflict, "The key must be wrapped for exactly the active members of room \"%s\"", room)
+		return
+	}
+	for _, member := range members {
+		if _, ok := req.Keys[member]; !ok {
+			writeError(w, http.StatusConflict, ErrCodeKeyConflict, "The key must be wrapped for exactly the active members of room \"%s\"", room)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE Rooms SET KeyVersion = ?, Rekey = 0 WHERE RoomID = ?", req.Version, roomID); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	now := time.Now().Unix()
+	for _, member := range members {
+		if _, err := tx.Exec("INSERT INTO RoomKeys (RoomID, Version, UserID, WrappedKey, Sender, Created) VALUES (?, ?, (SELECT UserID FROM Users WHERE Name = ?), ?, ?, ?)",
+			roomID, req.Version, member, req.Keys[member], user, now); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles an administrator removing a user's published keys, e.g. after they lost their key
+// directory, so they can publish new ones. The rooms they are active in need a new room key.
+func resetKeyHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	userID, err := getUserIDByName(&name)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", name)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := db.Exec("DELETE FROM UserKeys WHERE UserID = ?", userID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, ErrCodeKeyNotFound, "User \"%s\" has not published a key", name)
+		return
+	}
+	if err := rekeyRoomsOf(name); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	requestLogger(r.Context()).Info("Reset published key", "user", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Reports whether the user has published a key, holds or sent a room key, or posted in an
+// encrypted room. Their name is bound into all of those, so such a user can't be renamed.
+func usesEncryption(userID int, name string) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM UserKeys WHERE UserID = ?) +
+		(SELECT COUNT(*) FROM RoomKeys WHERE UserID = ? OR Sender = ?) +
+		(SELECT COUNT(*) FROM Messages INNER JOIN Rooms ON Messages.RoomID = Rooms.RoomID WHERE Messages.UserID = ? AND Rooms.Encrypted = 1)`,
+		userID, userID, name, userID).Scan(&n)
+	return n > 0, err
+}
+
+// Marks every encrypted room the user is active in as needing a new room key
+func rekeyRoomsOf(user string) error {
+	roomsMu.RLock()
+	defer roomsMu.RUnlock()
+	for roomID, members := range activeRooms {
+		if containsString(members, user) {
+			if err := markRekey(roomID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Returns a router serving the key directory
+func keyRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/chat/keys/{name}", publishKeyHandler).Methods("PUT")
+	router.HandleFunc("/chat/keys/{name}", getKeyHandler).Methods("GET")
+	return router
+}
+
+// Returns a random base64 encoded 32 byte key
+func randomTestKey(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// Publishes keys for user with sender in the User-Name header
+func publishTestKey(router http.Handler, user, sender string, req PublishKeyRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest("PUT", "/chat/keys/"+user, strings.NewReader(string(body)))
+	r.Header.Set("User-Name", sender)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestPublishKeyOnlyOwnKey(t *testing.T) {
+	openTestDatabase(t)
+	if _, err := newUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	req := PublishKeyRequest{PublicKey: randomTestKey(t), SigningKey: randomTestKey(t)}
+	if w := publishTestKey(keyRouter(), "alice", "mallory", req); w.Code != http.StatusForbidden {
+		t.Errorf("publishing another user's key returned %d, want 403", w.Code)
+	}
+}
+
+// Of several first publishes racing for one user, exactly one wins and the rest conflict. The
+// winner can publish the same keys again.
+func TestPublishKeyFirstPublishRace(t *testing.T) {
+	openTestDatabase(t)
+	if _, err := newUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	router := keyRouter()
+
+	const publishers = 8
+	reqs := make([]PublishKeyRequest, publishers)
+	codes := make([]int, publishers)
+	for i := range reqs {
+		reqs[i] = PublishKeyRequest{PublicKey: randomTestKey(t), SigningKey: randomTestKey(t)}
+	}
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range reqs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			codes[i] = publishTestKey(router, "alice", "alice", reqs[i]).Code
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	winner := -1
+	for i, code := range codes {
+		switch code {
+		case http.StatusOK:
+			if winner >= 0 {
+				t.Fatalf("publishes %d and %d both succeeded", winner, i)
+			}
+			winner = i
+		case http.StatusConflict:
+		default:
+			t.Fatalf("publish %d returned %d, want 200 or 409", i, code)
+		}
+	}
+	if winner < 0 {
+		t.Fatal("no publish succeeded")
+	}
+
+	r := httptest.NewRequest("GET", "/chat/keys/alice", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	var key UserKey
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	if key.PublicKey != reqs[winner].PublicKey || key.SigningKey != reqs[winner].SigningKey {
+		t.Error("the directory doesn't hold the winning keys")
+	}
+	if w := publishTestKey(router, "alice", "alice", reqs[winner]); w.Code != http.StatusOK {
+		t.Errorf("publishing the same keys again returned %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Machine readable error codes returned in the "code" field of an ErrorResponse
+const (
+	ErrCodeBadRequest   = "bad_request"
+	ErrCodeInvalidJSON  = "invalid_json"
+	ErrCodeInvalidParam = "invalid_parameter"
+	ErrCodeMissingField = "missing_field"
+	ErrCodeUserExists   = "user_exists"
+	ErrCodeUserNotFound = "user_not_found"
+	ErrCodeRoomExists   = "room_exists"
+	ErrCodeRoomNotFound = "room_not_found"
+	ErrCodeNotFound     = "not_found"
+	ErrCodeForbidden    = "forbidden"
+	ErrCodeUnauthorized = "unauthorized"
+	ErrCodeRateLimited  = "rate_limited"
+	ErrCodeTooLarge     = "too_large"
+	ErrCodeUnsupported  = "unsupported_type"
+	ErrCodeKeyNotFound  = "key_not_found"
+	ErrCodeKeyConflict  = "key_conflict"
+	ErrCodeKeyExists    = "key_exists"
+	ErrCodeStaleKey     = "stale_room_key"
+	ErrCodeEncrypted    = "encryption_required"
+	ErrCodeUserDisabled = "user_disabled"
+	ErrCodeRoomDisabled = "room_disabled"
+	ErrCodeMethod       = "method_not_allowed"
+	ErrCodeInternal     = "internal_error"
+	ErrCodeShuttingDown = "shutting_down"
+	ErrCodeNotSupported = "not_supported"
+)
+
+// Details of a single API error
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface so an APIError can be returned from helpers
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// HTTP Response struct for all error responses
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// Creates a new APIError with a formatted message
+func newAPIError(code string, format string, args ...interface{}) *APIError {
+	return &APIError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Writes an ErrorResponse with the given status code
+func writeError(w http.ResponseWriter, status int, code string, format string, args ...interface{}) {
+	writeJSON(w, status, ErrorResponse{Error: *newAPIError(code, format, args...)})
+}
+
+// Writes an error returned from a helper. APIErrors keep their code, anything else is an internal error
+func writeErr(w http.ResponseWriter, status int, err error) {
+	if apiErr, ok := err.(*APIError); ok {
+		writeJSON(w, status, ErrorResponse{Error: *apiErr})
+		return
+	}
+	responseLogger(w).Error("Internal server error", "err", err)
+	writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Internal server error")
+}
+
+// Writes v as a JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		responseLogger(w).Error("Error encoding response", "err", err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":{"code":"internal_error","message":"Internal server error"}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Recovers from panics in handlers so a bad request can never take down the server
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				requestLogger(r.Context()).Error("Recovered from panic", "method", r.Method, "route", routeTemplate(r), "panic", fmt.Sprint(rec))
+				writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Internal server error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns a JSON 404 for unknown routes
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, ErrCodeNotFound, "No route matches %s %s", r.Method, r.URL.Path)
+}
+
+// Returns a JSON 405 for known routes called with the wrong method
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, ErrCodeMethod, "Method %s is not allowed on %s", r.Method, r.URL.Path)
+}
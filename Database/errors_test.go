@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Decodes the error in an ErrorResponse body
+func decodeTestError(t *testing.T, w *httptest.ResponseRecorder) APIError {
+	t.Helper()
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var resp ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decoding error response: %v", err)
+	}
+	return resp.Error
+}
+
+// Unmatched routes and methods get JSON errors like every other failure
+func TestRouterErrors(t *testing.T) {
+	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+	router.HandleFunc("/chat/room/{room}", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		code         string
+	}{
+		{"GET", "/nowhere", http.StatusNotFound, ErrCodeNotFound},
+		{"DELETE", "/chat/room/lobby", http.StatusMethodNotAllowed, ErrCodeMethod},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s %s returned %d, want %d", tc.method, tc.path, w.Code, tc.status)
+		}
+		if apiErr := decodeTestError(t, w); apiErr.Code != tc.code {
+			t.Errorf("%s %s returned code %q, want %q", tc.method, tc.path, apiErr.Code, tc.code)
+		}
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	handler := recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler bug")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/chat/room/lobby", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("a panicking handler returned %d, want 500", w.Code)
+	}
+	apiErr := decodeTestError(t, w)
+	if apiErr.Code != ErrCodeInternal || strings.Contains(apiErr.Message, "handler bug") {
+		t.Errorf("a panicking handler returned %+v, want an internal error without the panic", apiErr)
+	}
+}
+
+// APIErrors keep their code and message, anything else is hidden behind an internal error
+func TestWriteErr(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeErr(w, http.StatusNotFound, newAPIError(ErrCodeRoomNotFound, "No room named %s", "lobby"))
+	if apiErr := decodeTestError(t, w); w.Code != http.StatusNotFound || apiErr.Code != ErrCodeRoomNotFound || apiErr.Message != "No room named lobby" {
+		t.Errorf("writeErr with an APIError returned %d %+v", w.Code, apiErr)
+	}
+
+	w = httptest.NewRecorder()
+	writeErr(w, http.StatusBadRequest, errors.New("no such table: Secrets"))
+	apiErr := decodeTestError(t, w)
+	if w.Code != http.StatusInternalServerError || apiErr.Code != ErrCodeInternal {
+		t.Errorf("writeErr with a plain error returned %d %+v, want a 500 internal error", w.Code, apiErr)
+	}
+	if strings.Contains(apiErr.Message, "Secrets") {
+		t.Errorf("the response leaks the error: %q", apiErr.Message)
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Name and version of the room export format, written in the first record of every export
+const (
+	exportFormat  = "gochat-room"
+	exportVersion = 1
+)
+
+// Record types in an export. An export is JSONL: one "room" record, then "member" records,
+// then "message" records oldest first.
+const (
+	recordRoom    = "room"
+	recordMember  = "member"
+	recordMessage = "message"
+)
+
+// One line of a room export. Which fields are set depends on Type.
+type ExportRecord struct {
+	Type string `json:"type"`
+
+	// room and member
+	Name string `json:"name,omitempty"`
+
+	// room
+	Format    string           `json:"format,omitempty"`
+	Version   int              `json:"version,omitempty"`
+	Exported  int64            `json:"exported,omitempty"`
+	Owner     string           `json:"owner,omitempty"`
+	Encrypted bool             `json:"encrypted,omitempty"`
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+
+	// member
+	Active      bool `json:"active,omitempty"`
+	Integration bool `json:"integration,omitempty"`
+
+	// message
+	Sender     string      `json:"sender,omitempty"`
+	Epoch      int64       `json:"epoch,omitempty"`
+	Text       string      `json:"text,omitempty"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+}
+
+// How an export is imported
+type ImportOptions struct {
+	// Name of the room to create, the exported name if empty
+	Room string
+	// Maps exported user names to names on this server
+	Users map[string]string
+	// Add the messages to an existing room instead of failing
+	Merge bool
+}
+
+// What an import did
+type ImportResult struct {
+	Room               string   `json:"room"`
+	Messages           int      `json:"messages"`
+	UsersCreated       []string `json:"usersCreated"`
+	AttachmentsMissing int      `json:"attachmentsMissing"`
+}
+
+// Writes the room's metadata, members and messages in the export format
+func exportRoom(w io.Writer, room string) error {
+	var roomID int
+	var owner sql.NullString
+	var encrypted bool
+	err := db.QueryRow("SELECT RoomID, Owner, Encrypted FROM Rooms WHERE RoomName = ?", room).Scan(&roomID, &owner, &encrypted)
+	if err == sql.ErrNoRows {
+		return newAPIError(ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+	}
+	if err != nil {
+		return err
+	}
+	header := ExportRecord{
+		Type:      recordRoom,
+		Format:    exportFormat,
+		Version:   exportVersion,
+		Exported:  time.Now().Unix(),
+		Name:      room,
+		Owner:     owner.String,
+		Encrypted: encrypted,
+	}
+	retention, err := getRoomRetention(room)
+	if err != nil {
+		return err
+	}
+	if retention.Override.MaxAge != nil || retention.Override.MaxCount != nil {
+		header.Retention = &retention.Override
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	members, err := exportMembers(roomID, owner.String)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Query(messageQuery+" WHERE Messages.RoomID = ? ORDER BY Epoch, Messages.rowid", roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		rec := ExportRecord{Type: recordMessage, Sender: *msg.Sender, Epoch: *msg.Epoch, Attachment: msg.Attachment}
+		if msg.MessageText != nil {
+			rec.Text = *msg.MessageText
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Returns everyone who posted in the room, is active in it or owns it, sorted by name
+func exportMembers(roomID int, owner string) ([]ExportRecord, error) {
+	members := make(map[string]*ExportRecord)
+	add := func(name string) *ExportRecord {
+		if m, ok := members[name]; ok {
+			return m
+		}
+		m := &ExportRecord{Type: recordMember, Name: name}
+		members[name] = m
+		return m
+	}
+
+	names := roomMembers(roomID)
+	if owner != "" {
+		names = append(names, owner)
+	}
+	rows, err := db.Query("SELECT DISTINCT Users.Name FROM Messages INNER JOIN Users ON Messages.UserID = Users.UserID WHERE Messages.RoomID = ?", roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		add(name)
+	}
+	for _, name := range roomMembers(roomID) {
+		add(name).Active = true
+	}
+	for name, m := range members {
+		if err := db.QueryRow("SELECT Integration FROM Users WHERE Name = ?", name).Scan(&m.Integration); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	list := make([]ExportRecord, 0, len(members))
+	for _, m := range members {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// Reads an export and recreates the room in a single transaction, keeping the original senders and
+// timestamps. Users that don't exist are created. Attachments are kept only if this server already
+// has the same file, since exports don't contain the files themselves.
+func importRoom(r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	dec := json.NewDecoder(r)
+	var header ExportRecord
+	if err := dec.Decode(&header); err != nil {
+		return nil, newAPIError(ErrCodeInvalidJSON, "Invalid export: reading the room record: %v", err)
+	}
+	if header.Type != recordRoom || header.Format != exportFormat {
+		return nil, newAPIError(ErrCodeBadRequest, "Invalid export: the first record must be a %s room record", exportFormat)
+	}
+	if header.Version != exportVersion {
+		return nil, newAPIError(ErrCodeUnsupported, "Unsupported export version %d, this server reads version %d", header.Version, exportVersion)
+	}
+	room := opts.Room
+	if room == "" {
+		room = header.Name
+	}
+	if room == "" {
+		return nil, newAPIError(ErrCodeMissingField, "Invalid export: the room record has no name")
+	}
+	mapUser := func(name string) string {
+		if mapped, ok := opts.Users[name]; ok {
+			return mapped
+		}
+		return name
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result := &ImportResult{Room: room, UsersCreated: make([]string, 0)}
+	userIDs := make(map[string]int)
+	ensureUser := func(name string, integration bool) (int, error) {
+		if id, ok := userIDs[name]; ok {
+			return id, nil
+		}
+		var id int
+		err := tx.QueryRow("SELECT UserID FROM Users WHERE Name = ?", name).Scan(&id)
+		if err == sql.ErrNoRows {
+			err := tx.QueryRow("INSERT INTO Users (Name, Integration) VALUES (?, ?) RETURNING UserID", name, integration).Scan(&id)
+			if err != nil {
+				return 0, err
+			}
+			result.UsersCreated = append(result.UsersCreated, name)
+		} else if err != nil {
+			return 0, err
+		}
+		userIDs[name] = id
+		return id, nil
+	}
+
+	roomID, err := importRoomRecord(tx, room, header, mapUser, opts.Merge)
+	if err != nil {
+		return nil, err
+	}
+
+	for line := 2; ; line++ {
+		var rec ExportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, newAPIError(ErrCodeInvalidJSON, "Invalid export: record %d: %v", line, err)
+		}
+		switch rec.Type {
+		case recordMember:
+			if rec.Name == "" {
+				return nil, newAPIError(ErrCodeMissingField, "Invalid export: record %d: a member requires a name", line)
+			}
+			if _, err := ensureUser(mapUser(rec.Name), rec.Integration); err != nil {
+				return nil, err
+			}
+		case recordMessage:
+			if rec.Sender == "" || rec.Epoch == 0 {
+				return nil, newAPIError(ErrCodeMissingField, "Invalid export: record %d: a message requires a sender and epoch", line)
+			}
+			userID, err := ensureUser(mapUser(rec.Sender), false)
+			if err != nil {
+				return nil, err
+			}
+			var attachmentID interface{}
+			if rec.Attachment != nil {
+				if err := tx.QueryRow("SELECT AttachmentID FROM Attachments WHERE AttachmentID = ?", rec.Attachment.ID).Scan(new(string)); err == nil {
+					attachmentID = rec.Attachment.ID
+				} else if err == sql.ErrNoRows {
+					result.AttachmentsMissing++
+				} else {
+					return nil, err
+				}
+			}
+			if _, err := tx.Exec("INSERT INTO Messages (UserID, Epoch, MessageText, RoomID, AttachmentID) VALUES (?, ?, ?, ?, ?)",
+				userID, rec.Epoch, rec.Text, roomID, attachmentID); err != nil {
+				return nil, err
+			}
+			result.Messages++
+		default:
+			// Skip record types added by later versions
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Creates the room from the export's room record, or returns the existing room when merging
+func importRoomRecord(tx *sql.Tx, room string, header ExportRecord, mapUser func(string) string, merge bool) (int, error) {
+	var roomID int
+	err := tx.QueryRow("SELECT RoomID FROM Rooms WHERE RoomName = ?", room).Scan(&roomID)
+	if err == nil {
+		if !merge {
+			return 0, newAPIError(ErrCodeRoomExists, "Error importing room with name \"%s\": A room with this name already exists", room)
+		}
+		return roomID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var owner, maxAge, maxCount interface{}
+	if header.Owner != "" {
+		owner = mapUser(header.Owner)
+	}
+	if header.Retention != nil {
+		if header.Retention.MaxAge != nil {
+			age, err := time.ParseDuration(*header.Retention.MaxAge)
+			if err != nil || age < 0 {
+				return 0, newAPIError(ErrCodeInvalidParam, "Invalid export: invalid retention maxAge \"%s\"", *header.Retention.MaxAge)
+			}
+			maxAge = int64(age / time.Second)
+		}
+		if header.Retention.MaxCount != nil {
+			maxCount = *header.Retention.MaxCount
+		}
+	}
+	var id int
+	err = tx.QueryRow("INSERT INTO Rooms (RoomName, Owner, Encrypted, RetentionMaxAge, RetentionMaxCount) VALUES (?, ?, ?, ?, ?) RETURNING RoomID",
+		room, owner, header.Encrypted, maxAge, maxCount).Scan(&id)
+	return id, err
+}
+
+// Handles an admin exporting a room as JSONL
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	if !roomExists(room) {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", room+".jsonl"))
+	if err := exportRoom(w, room); err != nil {
+		// The status has been sent, so all that can be done is cut the export short
+		requestLogger(r.Context()).Error("Error exporting room", "room", room, "err", err)
+	}
+}
+
+// Handles an admin importing an export given as the request body, gzipped if Content-Encoding
+// is gzip. The room query parameter renames the room, user=old:new maps a user and merge=true
+// adds to an existing room.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	opts := ImportOptions{
+		Room:  r.URL.Query().Get("room"),
+		Users: make(map[string]string),
+		Merge: r.URL.Query().Get("merge") == "true",
+	}
+	for _, m := range r.URL.Query()["user"] {
+		if err := addUserMapping(opts.Users, m); err != nil {
+			writeErr(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeBadRequest, "Invalid gzip body: %v", err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	result, err := importRoom(body, opts)
+	if apiErr, ok := err.(*APIError); ok && apiErr.Code == ErrCodeRoomExists {
+		writeErr(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, result)
+}
+
+// Parses an "old:new" user mapping into users
+func addUserMapping(users map[string]string, mapping string) error {
+	parts := strings.SplitN(mapping, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return newAPIError(ErrCodeInvalidParam, "Invalid user mapping \"%s\": must be old:new", mapping)
+	}
+	users[parts[0]] = parts[1]
+	return nil
+}
+
+// Runs the export and import subcommands, which work on the database directly without starting
+// the server:
+//
+//	Database export -room general -file general.jsonl.gz
+//	Database import -file general.jsonl.gz -room general-archive -user alice:alice2
+func runRoomCommand(name string, args []string) error {
+	fs := flag.NewFlagSet("gochat "+name, flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "path to a YAML config file (env "+envPrefix+"CONFIG)")
+	dbPath := fs.String("database-path", "", "path to the SQLite database, overrides the config")
+	file := fs.String("file", "", "export file, - for stdin/stdout; gzipped if it ends in .gz")
+	room := fs.String("room", "", "room to export, or the name to import as")
+	merge := fs.Bool("merge", false, "import into an existing room")
+	users := make(map[string]string)
+	fs.Func("user", "map an exported user to a user on this server, as old:new (repeatable)", func(v string) error {
+		return addUserMapping(users, v)
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	if name == "export" && *room == "" {
+		return errors.New("-room is required")
+	}
+
+	var configArgs []string
+	if *configPath != "" {
+		configArgs = append(configArgs, "-config", *configPath)
+	}
+	if *dbPath != "" {
+		configArgs = append(configArgs, "-database-path", *dbPath)
+	}
+	cfg, err := loadConfig(configArgs)
+	if err != nil {
+		return err
+	}
+	config = cfg
+	if db, err = openDatabase(); err != nil {
+		return err
+	}
+	defer db.Close()
+	activeRooms = make(map[int][]string)
+
+	if name == "export" {
+		return exportFile(*file, *room)
+	}
+	return importFile(*file, ImportOptions{Room: *room, Users: users, Merge: *merge})
+}
+
+// Writes a room export to path
+func exportFile(path, room string) (err error) {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = f
+	}
+	if strings.HasSuffix(path, ".gz") {
+		gz := gzip.NewWriter(w)
+		defer func() {
+			if closeErr := gz.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = gz
+	}
+	return exportRoom(w, room)
+}
+
+// Imports the export at path and logs what was imported
+func importFile(path string, opts ImportOptions) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	result, err := importRoom(r, opts)
+	if err != nil {
+		return err
+	}
+	slog.Info("Imported room", "room", result.Room, "messages", result.Messages,
+		"usersCreated", result.UsersCreated, "attachmentsMissing", result.AttachmentsMissing)
+	if result.AttachmentsMissing > 0 {
+		slog.Warn("Attachments were not found on this server and were left off their messages", "count", result.AttachmentsMissing)
+	}
+	return nil
+}
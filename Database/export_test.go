@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns each of the room's messages as "sender epoch text attachment", oldest first
+func dumpRoomMessages(t *testing.T, room string) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT Users.Name, Epoch, MessageText, COALESCE(AttachmentID, '') FROM Messages INNER JOIN Users ON Messages.UserID = Users.UserID INNER JOIN Rooms ON Messages.RoomID = Rooms.RoomID WHERE RoomName = ? ORDER BY Epoch, Messages.rowid", room)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var messages []string
+	for rows.Next() {
+		var sender, text, attachment string
+		var epoch int64
+		if err := rows.Scan(&sender, &epoch, &text, &attachment); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, fmt.Sprintf("%s %d %s %s", sender, epoch, text, attachment))
+	}
+	return messages
+}
+
+// Imports the export, failing the test on an error
+func importTestRoom(t *testing.T, export []byte, opts ImportOptions) *ImportResult {
+	t.Helper()
+	result, err := importRoom(bytes.NewReader(export), opts)
+	if err != nil {
+		t.Fatalf("importing as %q: %v", opts.Room, err)
+	}
+	return result
+}
+
+// An exported room imports with its senders, timestamps, attachments, owner and retention. Senders
+// can be mapped to other names, and attachments this server doesn't have are counted and dropped.
+func TestExportImportRoundTrip(t *testing.T) {
+	openTestDatabase(t)
+	startTestHub(t)
+	if err := startAttachments(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := newUser(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := createRoom("general", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	roomID, _ := getRoomID("general")
+	maxCount := 500
+	setTestRetention(t, roomID, nil, &maxCount)
+	att, err := storeAttachment(strings.NewReader("meeting notes"), "notes.txt", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	for i, m := range []struct{ sender, text, attachment string }{
+		{"alice", "hello", ""},
+		{"bob", "notes attached", att.ID},
+		{"alice", "thanks", ""},
+	} {
+		var attachment interface{}
+		if m.attachment != "" {
+			attachment = m.attachment
+		}
+		_, err := db.Exec("INSERT INTO Messages (UserID, Epoch, MessageText, RoomID, AttachmentID) VALUES ((SELECT UserID FROM Users WHERE Name = ?), ?, ?, ?, ?)",
+			m.sender, now-int64(60*(3-i)), m.text, roomID, attachment)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var export bytes.Buffer
+	if err := exportRoom(&export, "general"); err != nil {
+		t.Fatal(err)
+	}
+	original := dumpRoomMessages(t, "general")
+
+	result := importTestRoom(t, export.Bytes(), ImportOptions{Room: "general-copy", Users: map[string]string{"alice": "alice2"}})
+	if result.Messages != 3 || strings.Join(result.UsersCreated, ",") != "alice2" || result.AttachmentsMissing != 0 {
+		t.Errorf("import returned %+v, want 3 messages and alice2 created", result)
+	}
+	want := strings.Join(original, "\n")
+	want = strings.ReplaceAll(want, "alice ", "alice2 ")
+	if got := strings.Join(dumpRoomMessages(t, "general-copy"), "\n"); got != want {
+		t.Errorf("imported messages\n%s\nwant\n%s", got, want)
+	}
+	retention, err := getRoomRetention("general-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retention.MaxCount != 500 {
+		t.Errorf("imported room keeps %d messages, want the exported 500", retention.MaxCount)
+	}
+	var owner string
+	if err := db.QueryRow("SELECT Owner FROM Rooms WHERE RoomName = 'general-copy'").Scan(&owner); err != nil || owner != "alice2" {
+		t.Errorf("imported room is owned by %q (%v), want the mapped alice2", owner, err)
+	}
+
+	// Exports don't carry the files, so a server without the attachment drops it from its message
+	if _, err := db.Exec("DELETE FROM Attachments"); err != nil {
+		t.Fatal(err)
+	}
+	result = importTestRoom(t, export.Bytes(), ImportOptions{Room: "general-elsewhere"})
+	if result.Messages != 3 || result.AttachmentsMissing != 1 {
+		t.Errorf("import returned %+v, want 3 messages and 1 attachment missing", result)
+	}
+	if got := dumpRoomMessages(t, "general-elsewhere"); len(got) != 3 || strings.HasSuffix(got[1], att.ID) {
+		t.Errorf("imported messages %v, want the attachment left off the second", got)
+	}
+}
+
+// Importing over an existing room fails unless merging, and a failed import leaves nothing behind
+func TestImportExistingRoom(t *testing.T) {
+	openTestDatabase(t)
+	startTestHub(t)
+	if _, err := newUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	roomID := createTestRoom(t, "general")
+	insertAgedMessages(t, roomID, time.Hour, time.Minute)
+	var export bytes.Buffer
+	if err := exportRoom(&export, "general"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := importRoom(bytes.NewReader(export.Bytes()), ImportOptions{})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != ErrCodeRoomExists {
+		t.Fatalf("importing over the room returned %v, want room_exists", err)
+	}
+	if n := len(dumpRoomMessages(t, "general")); n != 2 {
+		t.Errorf("the room has %d messages after a failed import, want 2", n)
+	}
+
+	importTestRoom(t, export.Bytes(), ImportOptions{Merge: true})
+	if n := len(dumpRoomMessages(t, "general")); n != 4 {
+		t.Errorf("the room has %d messages after merging, want 4", n)
+	}
+
+	bad := strings.Replace(export.String(), `"type":"message"`, `"type":"message","epoch":"soon"`, 1)
+	if _, err := importRoom(strings.NewReader(bad), ImportOptions{Room: "general-bad"}); err == nil {
+		t.Error("imported an export with a bad record")
+	}
+	if roomExists("general-bad") {
+		t.Error("a failed import left its room behind")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Time allowed for the database checks and for acquiring the hub locks
+const healthCheckTimeout = 2 * time.Second
+
+// Result of one health check. Status is "ok" or "fail".
+type HealthCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// State of the websocket hub and the background goroutines
+type HubHealth struct {
+	Connections     int  `json:"connections"`
+	ActiveRooms     int  `json:"activeRooms"`
+	RoomMembers     int  `json:"roomMembers"`
+	QueuedMessages  int  `json:"queuedMessages"`
+	FullQueues      int  `json:"fullQueues"`
+	ClosedClients   int  `json:"closedClients"`
+	WebhookWorkers  int  `json:"webhookWorkers"`
+	WebhookQueue    int  `json:"webhookQueue"`
+	RetentionActive bool `json:"retentionActive"`
+	Goroutines      int  `json:"goroutines"`
+}
+
+// HTTP Response for /health/live and /health/ready. Status is "ok" when every check passed and
+// "fail" otherwise, in which case the response is a 503.
+type Health struct {
+	Status        string        `json:"status"`
+	Uptime        string        `json:"uptime"`
+	SchemaVersion int           `json:"schemaVersion"`
+	Checks        []HealthCheck `json:"checks"`
+	Hub           *HubHealth    `json:"hub,omitempty"`
+}
+
+// Number of webhook workers that are running, guarded by workersMu
+var webhookWorkersRunning int
+var workersMu sync.Mutex
+
+// Adds delta to the number of running webhook workers
+func trackWebhookWorker(delta int) {
+	workersMu.Lock()
+	webhookWorkersRunning += delta
+	workersMu.Unlock()
+}
+
+// Returns true while the background pruner's goroutine is running
+func retentionActive() bool {
+	if retentionDone == nil {
+		return false
+	}
+	select {
+	case <-retentionDone:
+		return false
+	default:
+		return true
+	}
+}
+
+// Takes a read lock on mu, giving up after the timeout. A lock that can't be taken for that long
+// means the hub is stuck.
+func rlockWithin(mu *sync.RWMutex, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !mu.TryRLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+// Runs check and records its result and how long it took
+func runCheck(name string, check func() (string, error)) HealthCheck {
+	start := time.Now()
+	detail, err := check()
+	result := HealthCheck{Name: name, Status: "ok", Detail: detail, Duration: time.Since(start).Round(time.Microsecond).String()}
+	if err != nil {
+		result.Status = "fail"
+		result.Detail = err.Error()
+	}
+	return result
+}
+
+// Collects the hub state and checks the connection registry and the background goroutines.
+// These only fail when restarting the process would help.
+func hubChecks() ([]HealthCheck, *HubHealth) {
+	hub := &HubHealth{Goroutines: runtime.NumGoroutine()}
+	checks := []HealthCheck{
+		runCheck("connections", func() (string, error) {
+			if !rlockWithin(&connsMu, healthCheckTimeout) {
+				return "", fmt.Errorf("connection registry locked for over %s", healthCheckTimeout)
+			}
+			defer connsMu.RUnlock()
+			hub.Connections = len(wsconns)
+			for _, c := range wsconns {
+				queued := len(c.send)
+				hub.QueuedMessages += queued
+				if queued == cap(c.send) {
+					hub.FullQueues++
+				}
+				// Not isClosed, so the check never takes a client's lock
+				select {
+				case <-c.done:
+					hub.ClosedClients++
+				default:
+				}
+			}
+			return fmt.Sprintf("%d open, %d queued messages", hub.Connections, hub.QueuedMessages), nil
+		}),
+		runCheck("rooms", func() (string, error) {
+			if !rlockWithin(&roomsMu, healthCheckTimeout) {
+				return "", fmt.Errorf("room registry locked for over %s", healthCheckTimeout)
+			}
+			defer roomsMu.RUnlock()
+			hub.ActiveRooms = len(activeRooms)
+			for _, members := range activeRooms {
+				hub.RoomMembers += len(members)
+			}
+			return fmt.Sprintf("%d members in %d rooms", hub.RoomMembers, hub.ActiveRooms), nil
+		}),
+		runCheck("webhook_workers", func() (string, error) {
+			workersMu.Lock()
+			hub.WebhookWorkers = webhookWorkersRunning
+			workersMu.Unlock()
+			hub.WebhookQueue = len(webhookQueue)
+			detail := fmt.Sprintf("%d of %d running, %d queued", hub.WebhookWorkers, config.Webhooks.Workers, hub.WebhookQueue)
+			// Workers exit on shutdown
+			if hub.WebhookWorkers < config.Webhooks.Workers && !isShuttingDown() {
+				return "", fmt.Errorf("only %s", detail)
+			}
+			return detail, nil
+		}),
+		runCheck("retention", func() (string, error) {
+			hub.RetentionActive = retentionActive()
+			if !hub.RetentionActive && !isShuttingDown() {
+				return "", fmt.Errorf("message pruner is not running")
+			}
+			return "pruner running every " + config.Retention.Interval.String(), nil
+		}),
+	}
+	return checks, hub
+}
+
+// Checks the database can be queried and its schema is the version this server expects
+func databaseChecks(ctx context.Context) []HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	return []HealthCheck{
+		runCheck("database", func() (string, error) {
+			query := "SELECT COUNT(*) FROM sqlite_master"
+			if usingPostgres() {
+				query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema()"
+			}
+			var tables int
+			if err := db.QueryRowContext(ctx, query).Scan(&tables); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d schema objects in %s", tables, config.Database.Driver), nil
+		}),
+		runCheck("schema", func() (string, error) {
+			version, err := readSchemaVersion(ctx, db)
+			if err != nil {
+				return "", err
+			}
+			if version != schemaVersion {
+				return "", fmt.Errorf("database is at version %d, server expects %d", version, schemaVersion)
+			}
+			return fmt.Sprintf("version %d", version), nil
+		}),
+	}
+}
+
+// Checks events can be relayed to the other instances
+func brokerCheck(ctx context.Context) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	return runCheck("broker", func() (string, error) {
+		if err := broker.Check(ctx); err != nil {
+			return "", err
+		}
+		if !clustered() {
+			return "single instance", nil
+		}
+		return fmt.Sprintf("%s on %s as instance %s", config.Broker.Driver, config.Broker.Subject, instanceID), nil
+	})
+}
+
+// Fails once the server has started draining for shutdown
+func shutdownCheck() HealthCheck {
+	return runCheck("accepting", func() (string, error) {
+		if isShuttingDown() {
+			return "", fmt.Errorf("server is shutting down")
+		}
+		return "accepting connections", nil
+	})
+}
+
+// Builds the health response, failing it if any check failed
+func newHealth(checks []HealthCheck, hub *HubHealth) Health {
+	health := Health{
+		Status:        "ok",
+		Uptime:        time.Since(startTime).Round(time.Second).String(),
+		SchemaVersion: schemaVersion,
+		Checks:        checks,
+		Hub:           hub,
+	}
+	for _, check := range checks {
+		if check.Status != "ok" {
+			health.Status = "fail"
+		}
+	}
+	return health
+}
+
+// Runs every readiness check: the database, the schema version, the broker, shutdown and the hub
+func readiness(ctx context.Context) Health {
+	checks := databaseChecks(ctx)
+	checks = append(checks, brokerCheck(ctx), shutdownCheck())
+	hub, hubState := hubChecks()
+	return newHealth(append(checks, hub...), hubState)
+}
+
+// Writes the health response, with a 503 if it failed
+func writeHealth(w http.ResponseWriter, health Health) {
+	status := http.StatusOK
+	if health.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, health)
+}
+
+// Handles /health/live. Only checks the process itself, so a failure means it should be restarted.
+// The database is left to readiness so an outage doesn't get every instance restarted.
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	checks, hub := hubChecks()
+	writeHealth(w, newHealth(checks, hub))
+}
+
+// Handles /health/ready. Fails while the database is unreachable or at the wrong schema version,
+// while the server is shutting down and whenever liveness fails, so no traffic is sent here.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, readiness(r.Context()))
+}
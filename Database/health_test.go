@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A broker that can't relay events
+type downBroker struct {
+	Broker
+}
+
+func (downBroker) Check(ctx context.Context) error {
+	return errors.New("no servers available for connection")
+}
+
+// Starts the background goroutines and the broker the health checks look at, as main does
+func startHealthyServer(t *testing.T) {
+	t.Helper()
+	openTestDatabase(t)
+	startTestHub(t)
+	prevBroker := broker
+	startWebhooks()
+	startRetention()
+	if err := startBroker(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stopBroker()
+		broker = prevBroker
+		stopRetention(context.Background())
+		stopWebhooks(context.Background())
+	})
+
+	// The workers count themselves once their goroutines run
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		workersMu.Lock()
+		running := webhookWorkersRunning
+		workersMu.Unlock()
+		if running == config.Webhooks.Workers {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d webhook workers started", running, config.Webhooks.Workers)
+		}
+	}
+}
+
+// Requests path and returns the status and the decoded health
+func getHealth(t *testing.T, path string) (int, Health) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", path, nil)
+	if path == "/health/live" {
+		livenessHandler(w, r)
+	} else {
+		readinessHandler(w, r)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cc)
+	}
+	var health Health
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, health
+}
+
+// Returns the named check from health
+func findCheck(t *testing.T, health Health, name string) HealthCheck {
+	t.Helper()
+	for _, check := range health.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	t.Fatalf("no %s check in %+v", name, health.Checks)
+	return HealthCheck{}
+}
+
+func TestReadinessHealthy(t *testing.T) {
+	startHealthyServer(t)
+
+	status, health := getHealth(t, "/health/ready")
+	if status != http.StatusOK || health.Status != "ok" {
+		t.Fatalf("readiness returned %d %+v, want 200 and ok", status, health)
+	}
+	for _, name := range []string{"database", "schema", "broker", "accepting", "connections", "rooms", "webhook_workers", "retention"} {
+		if check := findCheck(t, health, name); check.Status != "ok" || check.Duration == "" {
+			t.Errorf("check %+v, want ok with a duration", check)
+		}
+	}
+	if health.SchemaVersion != schemaVersion || health.Hub == nil || !health.Hub.RetentionActive {
+		t.Errorf("readiness returned schema version %d and hub %+v", health.SchemaVersion, health.Hub)
+	}
+
+	status, health = getHealth(t, "/health/live")
+	if status != http.StatusOK || len(health.Checks) != 4 {
+		t.Errorf("liveness returned %d with checks %+v, want 200 and only the hub checks", status, health.Checks)
+	}
+}
+
+// An unreachable database fails readiness but not liveness, so the instance isn't restarted
+func TestReadinessDatabaseDown(t *testing.T) {
+	startHealthyServer(t)
+	db.Close()
+
+	status, health := getHealth(t, "/health/ready")
+	if status != http.StatusServiceUnavailable || health.Status != "fail" {
+		t.Errorf("readiness returned %d %q, want 503 and fail", status, health.Status)
+	}
+	if check := findCheck(t, health, "database"); check.Status != "fail" || check.Detail == "" {
+		t.Errorf("database check %+v, want a failure with the error", check)
+	}
+	if status, _ := getHealth(t, "/health/live"); status != http.StatusOK {
+		t.Errorf("liveness returned %d with the database down, want 200", status)
+	}
+}
+
+func TestReadinessBrokerDown(t *testing.T) {
+	startHealthyServer(t)
+	up := broker
+	broker = downBroker{up}
+	defer func() { broker = up }()
+
+	status, health := getHealth(t, "/health/ready")
+	if status != http.StatusServiceUnavailable || health.Status != "fail" {
+		t.Errorf("readiness returned %d %q, want 503 and fail", status, health.Status)
+	}
+	if check := findCheck(t, health, "broker"); check.Status != "fail" || check.Detail != "no servers available for connection" {
+		t.Errorf("broker check %+v, want the broker's error", check)
+	}
+	if check := findCheck(t, health, "database"); check.Status != "ok" {
+		t.Errorf("database check %+v, want ok", check)
+	}
+}
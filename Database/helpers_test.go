@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Loads the default configuration with a fresh SQLite database, which is closed when the test ends
+func openTestDatabase(t *testing.T, args ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg, err := loadConfig(append([]string{
+		"-database-path", filepath.Join(dir, "chat.db"),
+		"-attachments-dir", filepath.Join(dir, "attachments"),
+		"-backup-dir", filepath.Join(dir, "backups"),
+	}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = cfg
+	if db, err = openDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		if databaseLock != nil {
+			databaseLock.Close()
+			databaseLock = nil
+		}
+	})
+}
+
+// Creates a room and returns its ID
+func createTestRoom(t *testing.T, name string) int {
+	t.Helper()
+	if err := createRoom(name, "", false); err != nil {
+		t.Fatal(err)
+	}
+	roomID, err := getRoomID(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return roomID
+}
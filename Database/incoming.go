@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// An incoming webhook lets a tool post into a room as a named integration. The token is only
+// returned when the hook is created; the database keeps its SHA-256 hash.
+type IncomingWebhook struct {
+	ID        int    `json:"id"`
+	Room      string `json:"room"`
+	Name      string `json:"name"`
+	Token     string `json:"token,omitempty"`
+	Path      string `json:"path,omitempty"`
+	CreatedBy string `json:"createdBy"`
+	Created   int64  `json:"created"`
+	Revoked   int64  `json:"revoked,omitempty"`
+}
+
+// Request body for creating an incoming webhook
+type NewIncomingWebhookRequest struct {
+	Name string `json:"name"`
+}
+
+// JSON body accepted by /hooks/{token}. A text/plain body is used as the text directly.
+type HookPayload struct {
+	Text        string           `json:"text"`
+	Attachments []HookAttachment `json:"attachments"`
+}
+
+// A simple rich attachment, rendered into the message text
+type HookAttachment struct {
+	Title     string `json:"title"`
+	TitleLink string `json:"titleLink"`
+	Text      string `json:"text"`
+}
+
+type IncomingWebhooksResponse struct {
+	Hooks []IncomingWebhook `json:"hooks"`
+}
+
+// Limits how fast each incoming webhook can post, keyed by hook ID
+var hookLimiter *rateLimiter
+
+func startIncomingWebhooks() {
+	hookLimiter = newRateLimiter(float64(config.Hooks.RatePerMinute)/60, config.Hooks.Burst)
+}
+
+// Handles a tool posting into a room with an incoming webhook token
+func hookHandler(w http.ResponseWriter, r *http.Request) {
+	hookID, user, room, ok := lookupHook(w, mux.Vars(r)["token"])
+	if !ok {
+		return
+	}
+	if allowed, wait := hookLimiter.allow(hookID); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, ErrCodeRateLimited, "Too many messages from this webhook, retry in %v", wait.Round(time.Second))
+		return
+	}
+
+	text, err := readHookPayload(w, r)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	msg := Message{Sender: &user, RoomName: &room, MessageText: &text}
+	if err := postMessage(requestLogger(r.Context()), msg); err != nil {
+		writeErr(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Finds the integration user and room for a token. Unknown and revoked tokens are both reported
+// as not found.
+func lookupHook(w http.ResponseWriter, token string) (int, string, string, bool) {
+	var hookID int
+	var user, room string
+	err := db.QueryRow("SELECT IncomingWebhooks.HookID, Users.Name, Rooms.RoomName FROM IncomingWebhooks INNER JOIN Users ON IncomingWebhooks.UserID = Users.UserID INNER JOIN Rooms ON IncomingWebhooks.RoomID = Rooms.RoomID WHERE TokenHash = ? AND Revoked IS NULL", hashToken(token)).Scan(&hookID, &user, &room)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, "Unknown or revoked webhook")
+		return 0, "", "", false
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return 0, "", "", false
+	}
+	return hookID, user, room, true
+}
+
+// Reads the message text from a text/plain or JSON body
+func readHookPayload(w http.ResponseWriter, r *http.Request) (string, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config.Limits.MaxMessageSize))
+	if err != nil {
+		return "", newAPIError(ErrCodeBadRequest, "Invalid request body: %v", err)
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var text string
+	if mediaType == "text/plain" {
+		text = string(body)
+	} else {
+		var payload HookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return "", newAPIError(ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		}
+		text = renderHookPayload(payload)
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", newAPIError(ErrCodeMissingField, "A webhook message requires text or an attachment")
+	}
+	return text, nil
+}
+
+// Renders the text followed by each attachment as "title (link)" and its text on separate lines
+func renderHookPayload(payload HookPayload) string {
+	lines := make([]string, 0, 1+2*len(payload.Attachments))
+	if payload.Text != "" {
+		lines = append(lines, payload.Text)
+	}
+	for _, a := range payload.Attachments {
+		title := a.Title
+		if a.TitleLink != "" {
+			if title == "" {
+				title = a.TitleLink
+			} else {
+				title += " (" + a.TitleLink + ")"
+			}
+		}
+		if title != "" {
+			lines = append(lines, title)
+		}
+		if a.Text != "" {
+			lines = append(lines, a.Text)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Handles creating an incoming webhook for a room. The name is the user the hook posts as; it can
+// be shared by several hooks but not with a regular user.
+func newIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	roomID, owner, ok := requireRoomOwner(w, r, room)
+	if !ok {
+		return
+	}
+	var req NewIncomingWebhookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeMissingField, "An integration name is required")
+		return
+	}
+
+	userID, err := integrationUser(req.Name)
+	if err != nil {
+		writeErr(w, http.StatusConflict, err)
+		return
+	}
+	token := randomHex(24)
+	hook := IncomingWebhook{
+		Room:      room,
+		Name:      req.Name,
+		Token:     token,
+		Path:      "/hooks/" + token,
+		CreatedBy: owner,
+		Created:   time.Now().Unix(),
+	}
+	err = db.QueryRow("INSERT INTO IncomingWebhooks (RoomID, UserID, TokenHash, CreatedBy, Created) VALUES (?, ?, ?, ?, ?) RETURNING HookID",
+		roomID, userID, hashToken(token), owner, hook.Created).Scan(&hook.ID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// Returns the ID of the integration user with the name, creating it if needed. Fails if a regular
+// user already has the name.
+func integrationUser(name string) (int, error) {
+	var userID, integration int
+	err := db.QueryRow("SELECT UserID, Integration FROM Users WHERE Name = ?", name).Scan(&userID, &integration)
+	if err == sql.ErrNoRows {
+		var id int
+		err := db.QueryRow("INSERT INTO Users (Name, Integration) VALUES (?, 1) RETURNING UserID", name).Scan(&id)
+		return id, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	if integration == 0 {
+		return 0, newAPIError(ErrCodeUserExists, "Error creating integration with name \"%s\": A user with this name already exists", name)
+	}
+	return userID, nil
+}
+
+// Handles listing a room's incoming webhooks, including revoked ones
+func incomingWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	roomID, _, ok := requireRoomOwner(w, r, room)
+	if !ok {
+		return
+	}
+	rows, err := db.Query("SELECT HookID, Users.Name, CreatedBy, Created, COALESCE(Revoked, 0) FROM IncomingWebhooks INNER JOIN Users ON IncomingWebhooks.UserID = Users.UserID WHERE RoomID = ? ORDER BY HookID", roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	hooks := make([]IncomingWebhook, 0)
+	for rows.Next() {
+		hook := IncomingWebhook{Room: room}
+		if err := rows.Scan(&hook.ID, &hook.Name, &hook.CreatedBy, &hook.Created, &hook.Revoked); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		hooks = append(hooks, hook)
+	}
+	if err := rows.Err(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, IncomingWebhooksResponse{Hooks: hooks})
+}
+
+// Handles revoking an incoming webhook. The token stops working immediately.
+func revokeIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	roomID, _, ok := requireRoomOwner(w, r, vars["room"])
+	if !ok {
+		return
+	}
+	hookID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid hook id supplied \"%s\": must be an integer", vars["id"])
+		return
+	}
+	res, err := db.Exec("UPDATE IncomingWebhooks SET Revoked = ? WHERE HookID = ? AND RoomID = ? AND Revoked IS NULL", time.Now().Unix(), hookID, roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, "Incoming webhook %d does not exist in room \"%s\" or is already revoked", hookID, vars["room"])
+		return
+	}
+	hookLimiter.reset(hookID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Tokens are stored hashed so a leaked database doesn't leak working tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
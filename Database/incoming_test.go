@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Returns a router serving the incoming webhook routes
+func hookRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/chat/room/{room}/hooks", newIncomingWebhookHandler).Methods("POST")
+	router.HandleFunc("/chat/room/{room}/hooks/{id}", revokeIncomingWebhookHandler).Methods("DELETE")
+	router.HandleFunc("/hooks/{token}", hookHandler).Methods("POST")
+	return router
+}
+
+// Sends a request to router with user in the User-Name header
+func serveHookRequest(router http.Handler, method, path, user, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	if user != "" {
+		r.Header.Set("User-Name", user)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+// Creates an incoming webhook in room as alice, posting as name
+func createTestHook(t *testing.T, router http.Handler, room, name string) IncomingWebhook {
+	t.Helper()
+	w := serveHookRequest(router, "POST", "/chat/room/"+room+"/hooks", "alice", "application/json", strings.NewReader(`{"name":"`+name+`"}`))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating the hook returned %d: %s", w.Code, w.Body)
+	}
+	var hook IncomingWebhook
+	if err := json.NewDecoder(w.Body).Decode(&hook); err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+// Sets up a database with alice owning lobby and the incoming webhooks started
+func openHookDatabase(t *testing.T) {
+	t.Helper()
+	openTestDatabase(t)
+	startTestHub(t)
+	startIncomingWebhooks()
+	if _, err := newUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := createRoom("lobby", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the sender and text of the room's newest message
+func lastTestMessage(t *testing.T, room string) (string, string) {
+	t.Helper()
+	var sender, text string
+	err := db.QueryRow("SELECT Users.Name, MessageText FROM Messages INNER JOIN Users ON Messages.UserID = Users.UserID INNER JOIN Rooms ON Messages.RoomID = Rooms.RoomID WHERE RoomName = ? ORDER BY Epoch DESC LIMIT 1", room).Scan(&sender, &text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, text
+}
+
+// A valid token posts into the hook's room as its integration user, from plain text or JSON
+func TestHookPosts(t *testing.T) {
+	openHookDatabase(t)
+	router := hookRouter()
+	hook := createTestHook(t, router, "lobby", "ci-bot")
+	if hook.Path != "/hooks/"+hook.Token || hook.CreatedBy != "alice" {
+		t.Errorf("created hook %+v", hook)
+	}
+
+	if w := serveHookRequest(router, "POST", hook.Path, "", "text/plain", strings.NewReader("build passed")); w.Code != http.StatusNoContent {
+		t.Fatalf("posting text returned %d: %s", w.Code, w.Body)
+	}
+	if sender, text := lastTestMessage(t, "lobby"); sender != "ci-bot" || text != "build passed" {
+		t.Errorf("stored %q from %q, want the text from ci-bot", text, sender)
+	}
+
+	body := `{"text":"deploy done","attachments":[{"title":"Logs","titleLink":"https://ci.example/1","text":"all green"}]}`
+	if w := serveHookRequest(router, "POST", hook.Path, "", "application/json", strings.NewReader(body)); w.Code != http.StatusNoContent {
+		t.Fatalf("posting JSON returned %d: %s", w.Code, w.Body)
+	}
+	if _, text := lastTestMessage(t, "lobby"); text != "deploy done\nLogs (https://ci.example/1)\nall green" {
+		t.Errorf("stored %q, want the text and the rendered attachment", text)
+	}
+
+	if w := serveHookRequest(router, "POST", hook.Path, "", "text/plain", strings.NewReader("  ")); w.Code != http.StatusBadRequest {
+		t.Errorf("posting blank text returned %d, want 400", w.Code)
+	}
+}
+
+// Revoked and unknown tokens are both not found
+func TestHookRevoked(t *testing.T) {
+	openHookDatabase(t)
+	router := hookRouter()
+	hook := createTestHook(t, router, "lobby", "ci-bot")
+
+	if w := serveHookRequest(router, "DELETE", "/chat/room/lobby/hooks/"+strconv.Itoa(hook.ID), "alice", "", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("revoking the hook returned %d: %s", w.Code, w.Body)
+	}
+	for _, path := range []string{hook.Path, "/hooks/" + strings.Repeat("0", 48)} {
+		w := serveHookRequest(router, "POST", path, "", "text/plain", strings.NewReader("build passed"))
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), ErrCodeNotFound) {
+			t.Errorf("posting to %s returned %d %s, want 404 not_found", path, w.Code, w.Body)
+		}
+	}
+}
+
+func TestNewHookRejected(t *testing.T) {
+	openHookDatabase(t)
+	router := hookRouter()
+	if _, err := newUser("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, room, user, body string
+		status                 int
+		code                   string
+	}{
+		{"unknown room", "nowhere", "alice", `{"name":"ci-bot"}`, http.StatusNotFound, ErrCodeRoomNotFound},
+		{"not the owner", "lobby", "bob", `{"name":"ci-bot"}`, http.StatusForbidden, ErrCodeForbidden},
+		{"regular user's name", "lobby", "alice", `{"name":"bob"}`, http.StatusConflict, ErrCodeUserExists},
+		{"no name", "lobby", "alice", `{}`, http.StatusBadRequest, ErrCodeMissingField},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveHookRequest(router, "POST", "/chat/room/"+tc.room+"/hooks", tc.user, "application/json", strings.NewReader(tc.body))
+			if w.Code != tc.status || !strings.Contains(w.Body.String(), `"`+tc.code+`"`) {
+				t.Errorf("returned %d %s, want %d %s", w.Code, w.Body, tc.status, tc.code)
+			}
+		})
+	}
+}
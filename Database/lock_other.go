@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Without flock there is no lock, so restore can't tell whether a server is using the database and
+// only runs with -force
+func lockDatabase(path string, exclusive bool) (*os.File, error) {
+	return nil, errLockUnsupported
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Takes an advisory lock on the lock file next to the SQLite database at path. Servers take a
+// shared lock, since several may share a database, and restore an exclusive one. Returns
+// errDatabaseLocked right away if the lock is held the other way. Closing the file releases it.
+func lockDatabase(path string, exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errDatabaseLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
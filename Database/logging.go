@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+)
+
+// Header carrying the request ID. A valid ID sent by the client is kept so requests can be traced
+// across services, otherwise the server generates one.
+const requestIDHeader = "X-Request-ID"
+
+// Request IDs accepted from clients
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// Log level, changed by setupLogging
+var logLevel = new(slog.LevelVar)
+
+// Replaces the default logger with one writing to stderr in the configured format and level.
+// The standard library's log package writes through it too.
+func setupLogging(cfg LogConfig) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch cfg.Format {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Logs the error and exits, for failures during startup
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// Returns message text for logging. Unless log.messageBodies is set, only the length is logged.
+func messageText(text string) slog.Attr {
+	if config.Log.MessageBodies {
+		return slog.String("text", text)
+	}
+	return slog.String("text", fmt.Sprintf("[redacted, %d bytes]", len(text)))
+}
+
+// Returns the logger for a request, which adds its request ID to every record
+func requestLogger(ctx context.Context) *slog.Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// Returns the logger for the request being answered through w. Helpers that only have the
+// ResponseWriter use this to tag their records with the request ID.
+func responseLogger(w http.ResponseWriter) *slog.Logger {
+	if rec, ok := w.(*statusRecorder); ok && rec.requestID != "" {
+		return slog.Default().With("request_id", rec.requestID)
+	}
+	return slog.Default()
+}
+
+// Gives every request an ID, returned in the X-Request-ID header and added to its log records,
+// and logs each request once it has been handled
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = randomHex(8)
+		}
+		w.Header().Set(requestIDHeader, id)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK, requestID: id}
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		level := slog.LevelDebug
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		// Log the route rather than the path, which can hold secrets like incoming webhook tokens
+		requestLogger(r.Context()).Log(r.Context(), level, "Handled request",
+			"method", r.Method, "route", routeTemplate(r), "status", rec.status, "duration", time.Since(start))
+	})
+}
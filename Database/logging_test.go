@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Collects log records written while a test runs
+type logCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+// Returns the captured records, decoded
+func (c *logCapture) records(t *testing.T) []map[string]interface{} {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(c.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("bad log record %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// Sends the default logger's records to a capture as JSON until the test ends
+func captureLogs(t *testing.T) *logCapture {
+	t.Helper()
+	c := &logCapture{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(c, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return c
+}
+
+// A handler that logs through both request loggers and then fails
+func loggingTestHandler() http.Handler {
+	return requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r.Context()).Info("Looking up room")
+		writeErr(w, http.StatusBadRequest, errors.New("no such table: Rooms"))
+	}))
+}
+
+func TestRequestID(t *testing.T) {
+	generated := regexp.MustCompile(`^[0-9a-f]{16}$`)
+	for _, tc := range []struct {
+		name string
+		sent string
+		keep bool
+	}{
+		{"kept", "client-7.retry_2", true},
+		{"missing", "", false},
+		{"invalid", "two words\n", false},
+		{"too long", strings.Repeat("a", 129), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			r := httptest.NewRequest("GET", "/chat/room/lobby", nil)
+			if tc.sent != "" {
+				r.Header.Set(requestIDHeader, tc.sent)
+			}
+			w := httptest.NewRecorder()
+			loggingTestHandler().ServeHTTP(w, r)
+
+			id := w.Header().Get(requestIDHeader)
+			if tc.keep && id != tc.sent {
+				t.Errorf("response ID %q, want the request's %q", id, tc.sent)
+			}
+			if !tc.keep && !generated.MatchString(id) {
+				t.Errorf("response ID %q, want a generated one", id)
+			}
+
+			records := logs.records(t)
+			var messages []string
+			for _, record := range records {
+				messages = append(messages, record["msg"].(string))
+				if record["request_id"] != id {
+					t.Errorf("record %v has request_id %v, want %q", record["msg"], record["request_id"], id)
+				}
+			}
+			if want := "Looking up room,Internal server error,Handled request"; strings.Join(messages, ",") != want {
+				t.Errorf("logged %q, want %q", messages, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Upper bounds of the histogram buckets for request durations, in seconds
+var requestBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Upper bounds of the histogram buckets for fast operations like queries and fan-out, in seconds
+var fastBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1}
+
+// Metrics exposed at /metrics in the Prometheus text format. The server keeps its own small registry
+// of counters, gauges and histograms rather than pulling in a client library.
+var (
+	httpRequests = newCounterVec("gochat_http_requests_total",
+		"HTTP requests handled, by route template, method and status code.", "route", "method", "status")
+	httpDuration = newHistogramVec("gochat_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route template and method.", requestBuckets, "route", "method")
+	messagesPosted = newCounterVec("gochat_messages_posted_total",
+		"Messages stored, by room.", "room")
+	wsConnections = newGaugeFunc("gochat_websocket_connections",
+		"Open websocket connections.", func() float64 {
+			return float64(countClients(transportWebsocket))
+		})
+	streamConnections = newGaugeFunc("gochat_stream_connections",
+		"Open server-sent event streams and long-poll sessions.", func() float64 {
+			return float64(countClients(transportSSE) + countClients(transportLongPoll))
+		})
+	wsConnectionsOpened = newCounterVec("gochat_websocket_connections_opened_total",
+		"Websocket connections accepted, by encoding.", "encoding")
+	wsMessagesReceived = newCounterVec("gochat_websocket_messages_received_total",
+		"Messages read from websockets.")
+	wsMessagesSent = newCounterVec("gochat_websocket_messages_sent_total",
+		"Messages written to websockets.")
+	streamConnectionsOpened = newCounterVec("gochat_stream_connections_opened_total",
+		"Server-sent event streams and long-poll sessions opened, by transport.", "transport")
+	streamMessagesSent = newCounterVec("gochat_stream_messages_sent_total",
+		"Messages delivered over server-sent event streams and long-polls, by transport.", "transport")
+	droppedSends = newCounterVec("gochat_dropped_sends_total",
+		"Messages that were not queued for a connection, by reason.", "reason")
+	fanoutDuration = newHistogramVec("gochat_fanout_duration_seconds",
+		"Time taken to queue a posted message for every connected member of its room.", fastBuckets)
+	dbQueryDuration = newHistogramVec("gochat_db_query_duration_seconds",
+		"Time taken by database statements, by kind of statement.", fastBuckets, "op")
+	brokerEvents = newCounterVec("gochat_broker_events_total",
+		"Cluster events relayed through the broker, by direction and event type.", "direction", "type")
+	backupsTaken = newCounterVec("gochat_backups_total",
+		"Database backups taken, by result.", "result")
+	goroutines = newGaugeFunc("gochat_goroutines",
+		"Goroutines currently running.", func() float64 { return float64(runtime.NumGoroutine()) })
+	uptime = newGaugeFunc("gochat_uptime_seconds",
+		"Seconds since the server started.", func() float64 { return time.Since(startTime).Seconds() })
+)
+
+// A metric that can write itself in the text format
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Every metric, in the order they are written
+var metricsRegistry []collector
+
+// Label values of a series, joined with a byte that can't appear in valid UTF-8
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// Formats label names and values as {a="x",b="y"}, with extra appended after them
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, names[i]+`="`+labelEscaper.Replace(v)+`"`)
+		}
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Escapes a label value for the text format, which only escapes backslashes, quotes and newlines
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// A counter with a series for each combination of label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metricsRegistry = append(metricsRegistry, c)
+	return c
+}
+
+// Adds one to the series with the given label values
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	c.values[seriesKey(values)]++
+	c.mu.Unlock()
+}
+
+// Adds n to the series with the given label values
+func (c *counterVec) add(n float64, values ...string) {
+	c.mu.Lock()
+	c.values[seriesKey(values)] += n
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key), formatFloat(c.values[key]))
+	}
+}
+
+// A gauge read from a function each time metrics are collected
+type gaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	metricsRegistry = append(metricsRegistry, g)
+	return g
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.fn()))
+}
+
+// A histogram with a series for each combination of label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	// Observations in each bucket, not cumulative. The last element counts those above every bound.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+// Records a value in the series with the given label values
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := seriesKey(values)
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+// Records the time since start in seconds
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, `le="`+formatFloat(bound)+`"`), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Handles GET /metrics. When metrics.token is set, scrapers must send it as a bearer token.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Metrics.Token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Metrics.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gochat metrics"`)
+			writeError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "A valid metrics token is required")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, c := range metricsRegistry {
+		c.write(bw)
+	}
+	bw.Flush()
+}
+
+// Returns the template of the route the request matched, e.g. "/chat/room/{room}", or "unmatched"
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// Counts requests and times them by route template, so IDs and tokens in paths don't become labels
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		rec, ok := w.(*statusRecorder)
+		if !ok {
+			rec = &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		httpDuration.since(start, route, r.Method)
+		httpRequests.inc(route, r.Method, strconv.Itoa(rec.status))
+	})
+}
+
+// Remembers the status code written through it and the request's ID. Websocket upgrades hijack
+// the connection, so Hijack is passed through and recorded as 101 Switching Protocols.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	requestID   string
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Lets http.ResponseController reach the connection, e.g. to set write deadlines on event streams
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	r.status = http.StatusSwitchingProtocols
+	r.wroteHeader = true
+	return hj.Hijack()
+}
+
+// Name of the SQLite driver that times every statement for gochat_db_query_duration_seconds
+const sqliteDriver = "sqlite3-instrumented"
+
+func init() {
+	sql.Register(sqliteDriver, instrumentedDriver{&sqlite3.SQLiteDriver{}})
+}
+
+type instrumentedDriver struct {
+	*sqlite3.SQLiteDriver
+}
+
+func (d instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+// A SQLite connection that times queries and execs. Everything else is passed through.
+type instrumentedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer dbQueryDuration.since(time.Now(), statementKind(query))
+	return c.SQLiteConn.QueryContext(ctx, query, args)
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer dbQueryDuration.since(time.Now(), statementKind(query))
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+// Returns the lower case first keyword of a statement, e.g. "select", or "other" for the uncommon ones
+func statementKind(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+	switch kind := strings.ToLower(fields[0]); kind {
+	case "select", "insert", "update", "delete":
+		return kind
+	}
+	return "other"
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Scrapes /metrics and returns the value of every series and the type of every metric
+func scrapeMetrics(t *testing.T) (map[string]float64, map[string]string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics returned %d", w.Code)
+	}
+	series := make(map[string]float64)
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); strings.HasPrefix(line, "# TYPE ") && len(fields) == 4 {
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad sample %q: %v", line, err)
+		}
+		series[line[:i]] = v
+	}
+	return series, types
+}
+
+func TestMetricsExposed(t *testing.T) {
+	openTestDatabase(t)
+	_, types := scrapeMetrics(t)
+	for name, typ := range map[string]string{
+		"gochat_http_requests_total":               "counter",
+		"gochat_http_request_duration_seconds":     "histogram",
+		"gochat_messages_posted_total":             "counter",
+		"gochat_websocket_connections":             "gauge",
+		"gochat_websocket_messages_received_total": "counter",
+		"gochat_dropped_sends_total":               "counter",
+		"gochat_fanout_duration_seconds":           "histogram",
+		"gochat_db_query_duration_seconds":         "histogram",
+		"gochat_broker_events_total":               "counter",
+		"gochat_backups_total":                     "counter",
+		"gochat_goroutines":                        "gauge",
+		"gochat_uptime_seconds":                    "gauge",
+	} {
+		if types[name] != typ {
+			t.Errorf("%s has type %q, want %s", name, types[name], typ)
+		}
+	}
+}
+
+// Handling a request and posting a message move their counters and histograms
+func TestMetricsCount(t *testing.T) {
+	openTestDatabase(t)
+	startTestHub(t)
+	createTestRoom(t, "lobby")
+	if _, err := newUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.HandleFunc("/chat/room/{room}", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "No such room")
+	}).Methods("GET")
+
+	const (
+		requests = `gochat_http_requests_total{route="/chat/room/{room}",method="GET",status="404"}`
+		duration = `gochat_http_request_duration_seconds_count{route="/chat/room/{room}",method="GET"}`
+		posted   = `gochat_messages_posted_total{room="lobby"}`
+		queries  = `gochat_db_query_duration_seconds_count{op="insert"}`
+	)
+	before, _ := scrapeMetrics(t)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/chat/room/someone-42", nil))
+	sender, room, text := "alice", "lobby", "hello"
+	if err := postMessage(slog.Default(), Message{Sender: &sender, RoomName: &room, MessageText: &text}); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := scrapeMetrics(t)
+
+	for _, name := range []string{requests, duration, posted} {
+		if after[name] != before[name]+1 {
+			t.Errorf("%s went from %v to %v, want one more", name, before[name], after[name])
+		}
+	}
+	if after[queries] <= before[queries] {
+		t.Errorf("%s went from %v to %v, want it to grow", queries, before[queries], after[queries])
+	}
+	for name := range after {
+		if strings.Contains(name, "someone-42") {
+			t.Errorf("series %s is labelled with the path rather than the route", name)
+		}
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	openTestDatabase(t, "-metrics-token", "scrape-secret")
+	for _, tc := range []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer scrape-secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		metricsHandler(w, r)
+		if w.Code != tc.status {
+			t.Errorf("scraping with %q returned %d, want %d", tc.auth, w.Code, tc.status)
+		}
+	}
+}
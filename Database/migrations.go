@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Schema changes applied in order at startup. The number of migrations applied is stored in
+// SQLite's user_version, so new changes must be appended and existing ones never edited. Each one
+// needs a matching entry in postgresMigrations.
+var migrations = []string{
+	// 1: the original tables, for databases created from scratch
+	`CREATE TABLE IF NOT EXISTS "Rooms" (
+		RoomID INTEGER PRIMARY KEY,
+		RoomName TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS "Users" (
+		UserID INTEGER PRIMARY KEY,
+		Name TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS "Messages" (
+		UserID INT NOT NULL,
+		Epoch INT NOT NULL,
+		MessageText TEXT,
+		RoomID INT
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS RoomIndex ON Rooms (RoomName);
+	CREATE UNIQUE INDEX IF NOT EXISTS UsernameIndex ON Users (Name);`,
+
+	// 2: room owners and outgoing webhooks
+	`ALTER TABLE Rooms ADD COLUMN Owner TEXT;
+	CREATE TABLE Webhooks (
+		WebhookID INTEGER PRIMARY KEY,
+		RoomID INT NOT NULL,
+		URL TEXT NOT NULL,
+		Secret TEXT NOT NULL,
+		Events TEXT NOT NULL,
+		CreatedBy TEXT NOT NULL,
+		Created INT NOT NULL
+	);
+	CREATE INDEX WebhookRoomIndex ON Webhooks (RoomID);
+	CREATE TABLE WebhookDeliveries (
+		DeliveryID TEXT NOT NULL,
+		WebhookID INT NOT NULL,
+		Event TEXT NOT NULL,
+		Attempt INT NOT NULL,
+		StatusCode INT NOT NULL,
+		Error TEXT NOT NULL,
+		Duration INT NOT NULL,
+		Epoch INT NOT NULL
+	);
+	CREATE INDEX WebhookDeliveryIndex ON WebhookDeliveries (WebhookID, Epoch);
+	CREATE TABLE WebhookDeadLetters (
+		DeliveryID TEXT NOT NULL,
+		WebhookID INT NOT NULL,
+		Event TEXT NOT NULL,
+		Payload TEXT NOT NULL,
+		Attempts INT NOT NULL,
+		Error TEXT NOT NULL,
+		Epoch INT NOT NULL
+	);
+	CREATE INDEX WebhookDeadLetterIndex ON WebhookDeadLetters (WebhookID, Epoch);`,
+
+	// 3: incoming webhooks, which post as an integration user
+	`ALTER TABLE Users ADD COLUMN Integration INT NOT NULL DEFAULT 0;
+	CREATE TABLE IncomingWebhooks (
+		HookID INTEGER PRIMARY KEY,
+		RoomID INT NOT NULL,
+		UserID INT NOT NULL,
+		TokenHash TEXT NOT NULL,
+		CreatedBy TEXT NOT NULL,
+		Created INT NOT NULL,
+		Revoked INT
+	);
+	CREATE UNIQUE INDEX IncomingWebhookTokenIndex ON IncomingWebhooks (TokenHash);`,
+
+	// 4: attachments, stored in the blob store under their SHA-256
+	`CREATE TABLE Attachments (
+		AttachmentID TEXT PRIMARY KEY,
+		Name TEXT NOT NULL,
+		ContentType TEXT NOT NULL,
+		Size INT NOT NULL,
+		Width INT NOT NULL,
+		Height INT NOT NULL,
+		Thumbnail INT NOT NULL,
+		Uploader TEXT NOT NULL,
+		Created INT NOT NULL
+	);
+	ALTER TABLE Messages ADD COLUMN AttachmentID TEXT;`,
+
+	// 5: end-to-end encrypted rooms, public keys and the room keys wrapped for each member
+	`ALTER TABLE Rooms ADD COLUMN Encrypted INT NOT NULL DEFAULT 0;
+	ALTER TABLE Rooms ADD COLUMN KeyVersion INT NOT NULL DEFAULT 0;
+	ALTER TABLE Rooms ADD COLUMN Rekey INT NOT NULL DEFAULT 0;
+	CREATE TABLE UserKeys (
+		UserID INTEGER PRIMARY KEY,
+		PublicKey TEXT NOT NULL,
+		SigningKey TEXT NOT NULL,
+		Updated INT NOT NULL
+	);
+	CREATE TABLE RoomKeys (
+		RoomID INT NOT NULL,
+		Version INT NOT NULL,
+		UserID INT NOT NULL,
+		WrappedKey TEXT NOT NULL,
+		Sender TEXT NOT NULL,
+		Created INT NOT NULL,
+		PRIMARY KEY (RoomID, Version, UserID)
+	);`,
+
+	// 6: per room retention overrides and a log of pruner runs
+	`ALTER TABLE Rooms ADD COLUMN RetentionMaxAge INT;
+	ALTER TABLE Rooms ADD COLUMN RetentionMaxCount INT;
+	CREATE INDEX MessageRoomEpochIndex ON Messages (RoomID, Epoch);
+	CREATE TABLE PruneRuns (
+		RunID INTEGER PRIMARY KEY,
+		Started INT NOT NULL,
+		Finished INT NOT NULL,
+		Deleted INT NOT NULL,
+		Rooms TEXT NOT NULL,
+		Archive TEXT NOT NULL,
+		Error TEXT NOT NULL
+	);`,
+
+	// 7: users and rooms disabled by an admin
+	`ALTER TABLE Users ADD COLUMN Disabled INT NOT NULL DEFAULT 0;
+	ALTER TABLE Rooms ADD COLUMN Disabled INT NOT NULL DEFAULT 0;`,
+}
+
+// Version of the schema this build expects
+var schemaVersion = len(migrations)
+
+func init() {
+	if len(postgresMigrations) != len(migrations) {
+		panic("postgresMigrations must have an entry for each of the SQLite migrations")
+	}
+}
+
+// Reports whether the server is configured to store data in PostgreSQL
+func usingPostgres() bool {
+	return config.Database.Driver == "postgres"
+}
+
+// Returned by lockDatabase when another process holds the lock the other way
+var errDatabaseLocked = errors.New("database is locked")
+
+// Returned by lockDatabase on platforms without advisory file locks
+var errLockUnsupported = errors.New("database locks are not supported on this platform")
+
+// Shared lock on the SQLite database, held until the process exits so restore can tell it is in use
+var databaseLock *os.File
+
+// Opens the configured database and brings its schema up to date
+func openDatabase() (*sql.DB, error) {
+	if !usingPostgres() && databaseLock == nil {
+		lock, err := lockDatabase(config.Database.Path, false)
+		if errors.Is(err, errDatabaseLocked) {
+			return nil, fmt.Errorf("%s is being restored", config.Database.Path)
+		}
+		if err != nil && !errors.Is(err, errLockUnsupported) {
+			return nil, err
+		}
+		databaseLock = lock
+	}
+	// Servers on one host may share the file, so wait for each other's locks rather than failing,
+	// and take the write lock when a transaction begins so two can't deadlock upgrading to it
+	driverName, source := sqliteDriver, config.Database.Path+"?_busy_timeout=5000&_txlock=immediate"
+	if usingPostgres() {
+		driverName, source = postgresDriver, config.Database.URL
+	}
+	conn, err := sql.Open(driverName, source)
+	if err != nil {
+		return nil, err
+	}
+	if usingPostgres() {
+		conn.SetMaxOpenConns(config.Database.MaxConns)
+		conn.SetMaxIdleConns(config.Database.MaxConns)
+	}
+	if err := migrate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Something that runs queries, a *sql.DB or *sql.Tx
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Returns the number of migrations applied to the database. SQLite keeps it in user_version,
+// PostgreSQL in the one row of the SchemaVersion table.
+func readSchemaVersion(ctx context.Context, q queryer) (int, error) {
+	query := "PRAGMA user_version"
+	if usingPostgres() {
+		query = "SELECT Version FROM SchemaVersion"
+	}
+	var version int
+	err := q.QueryRowContext(ctx, query).Scan(&version)
+	return version, err
+}
+
+// Records the number of migrations applied in tx
+func writeSchemaVersion(tx *sql.Tx, version int) error {
+	var err error
+	if usingPostgres() {
+		_, err = tx.Exec("UPDATE SchemaVersion SET Version = ?", version)
+	} else {
+		// PRAGMA doesn't take parameters
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	}
+	return err
+}
+
+// Brings the database schema up to date, applying each pending migration in its own transaction.
+// In PostgreSQL the version row is locked while a migration runs, so servers starting together
+// don't apply the same migration twice.
+func migrate(db *sql.DB) error {
+	steps := migrations
+	if usingPostgres() {
+		steps = postgresMigrations
+		// The statements run as one transaction, and the advisory lock keeps two servers from
+		// creating the table at once
+		if _, err := db.Exec(`SELECT pg_advisory_xact_lock(4662);
+			CREATE TABLE IF NOT EXISTS SchemaVersion (Version BIGINT NOT NULL);
+			INSERT INTO SchemaVersion (Version) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM SchemaVersion);`); err != nil {
+			return fmt.Errorf("creating schema version table: %v", err)
+		}
+	}
+
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		var version int
+		if usingPostgres() {
+			err = tx.QueryRow("SELECT Version FROM SchemaVersion FOR UPDATE").Scan(&version)
+		} else {
+			version, err = readSchemaVersion(context.Background(), tx)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("reading schema version: %v", err)
+		}
+		if version > schemaVersion {
+			tx.Rollback()
+			return fmt.Errorf("database schema version %d is newer than this server supports (%d)", version, schemaVersion)
+		}
+		if version == schemaVersion {
+			return tx.Rollback()
+		}
+
+		if _, err := tx.Exec(steps[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying migration %d: %v", version+1, err)
+		}
+		if err := writeSchemaVersion(tx, version+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying migration %d: %v", version+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("applying migration %d: %v", version+1, err)
+		}
+		slog.Info("Applied database migration", "version", version+1)
+	}
+}
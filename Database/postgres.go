@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Name of the PostgreSQL driver. Like the SQLite one it times every statement, and it also lets
+// the server's queries be written once for both databases.
+const postgresDriver = "pgx-gochat"
+
+func init() {
+	sql.Register(postgresDriver, postgresInstrumentedDriver{})
+}
+
+type postgresInstrumentedDriver struct{}
+
+func (postgresInstrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := stdlib.GetDefaultDriver().Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresConn{conn.(*stdlib.Conn)}, nil
+}
+
+// A PostgreSQL connection that accepts SQLite style statements. ? placeholders are rewritten to
+// $1, $2, ... and arguments are converted the way the SQLite driver sees them, so bools are
+// stored as 0 and 1 in the INT columns shared with the SQLite schema.
+type postgresConn struct {
+	*stdlib.Conn
+}
+
+func (c *postgresConn) CheckNamedValue(nv *driver.NamedValue) error {
+	v, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	if b, ok := v.(bool); ok {
+		v = int64(0)
+		if b {
+			v = int64(1)
+		}
+	}
+	nv.Value = v
+	return nil
+}
+
+func (c *postgresConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.PrepareContext(ctx, rebind(query))
+}
+
+func (c *postgresConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer dbQueryDuration.since(time.Now(), statementKind(query))
+	return c.Conn.QueryContext(ctx, rebind(query), args)
+}
+
+func (c *postgresConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer dbQueryDuration.since(time.Now(), statementKind(query))
+	return c.Conn.ExecContext(ctx, rebind(query), args)
+}
+
+// Rewrites ? placeholders to PostgreSQL's numbered ones, leaving quoted strings and identifiers
+// alone
+func rebind(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// The schema in PostgreSQL, one entry for each of the SQLite migrations so both databases report
+// the same schema version. Column types follow the SQLite ones: INT becomes BIGINT since SQLite
+// integers are 64 bit, and INTEGER PRIMARY KEY becomes an identity column. Names use the C
+// collation so they sort byte by byte as in SQLite. PostgreSQL has no implicit rowid, so the
+// tables ordered by it get an explicit rowid column.
+var postgresMigrations = []string{
+	// 1: the original tables
+	`CREATE TABLE Rooms (
+		RoomID BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		RoomName TEXT COLLATE "C" NOT NULL
+	);
+	CREATE TABLE Users (
+		UserID BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		Name TEXT COLLATE "C" NOT NULL
+	);
+	CREATE TABLE Messages (
+		rowid BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		UserID BIGINT NOT NULL,
+		Epoch BIGINT NOT NULL,
+		MessageText TEXT,
+		RoomID BIGINT
+	);
+	CREATE UNIQUE INDEX RoomIndex ON Rooms (RoomName);
+	CREATE UNIQUE INDEX UsernameIndex ON Users (Name);`,
+
+	// 2: room owners and outgoing webhooks
+	`ALTER TABLE Rooms ADD COLUMN Owner TEXT;
+	CREATE TABLE Webhooks (
+		WebhookID BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		RoomID BIGINT NOT NULL,
+		URL TEXT NOT NULL,
+		Secret TEXT NOT NULL,
+		Events TEXT NOT NULL,
+		CreatedBy TEXT NOT NULL,
+		Created BIGINT NOT NULL
+	);
+	CREATE INDEX WebhookRoomIndex ON Webhooks (RoomID);
+	CREATE TABLE WebhookDeliveries (
+		rowid BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		DeliveryID TEXT NOT NULL,
+		WebhookID BIGINT NOT NULL,
+		Event TEXT NOT NULL,
+		Attempt BIGINT NOT NULL,
+		StatusCode BIGINT NOT NULL,
+		Error TEXT NOT NULL,
+		Duration BIGINT NOT NULL,
+		Epoch BIGINT NOT NULL
+	);
+	CREATE INDEX WebhookDeliveryIndex ON WebhookDeliveries (WebhookID, Epoch);
+	CREATE TABLE WebhookDeadLetters (
+		rowid BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		DeliveryID TEXT NOT NULL,
+		WebhookID BIGINT NOT NULL,
+		Event TEXT NOT NULL,
+		Payload TEXT NOT NULL,
+		Attempts BIGINT NOT NULL,
+		Error TEXT NOT NULL,
+		Epoch BIGINT NOT NULL
+	);
+	CREATE INDEX WebhookDeadLetterIndex ON WebhookDeadLetters (WebhookID, Epoch);`,
+
+	// 3: incoming webhooks, which post as an integration user
+	`ALTER TABLE Users ADD COLUMN Integration BIGINT NOT NULL DEFAULT 0;
+	CREATE TABLE IncomingWebhooks (
+		HookID BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		RoomID BIGINT NOT NULL,
+		UserID BIGINT NOT NULL,
+		TokenHash TEXT NOT NULL,
+		CreatedBy TEXT NOT NULL,
+		Created BIGINT NOT NULL,
+		Revoked BIGINT
+	);
+	CREATE UNIQUE INDEX IncomingWebhookTokenIndex ON IncomingWebhooks (TokenHash);`,
+
+	// 4: attachments, stored in the blob store under their SHA-256
+	`CREATE TABLE Attachments (
+		AttachmentID TEXT PRIMARY KEY,
+		Name TEXT NOT NULL,
+		ContentType TEXT NOT NULL,
+		Size BIGINT NOT NULL,
+		Width BIGINT NOT NULL,
+		Height BIGINT NOT NULL,
+		Thumbnail BIGINT NOT NULL,
+		Uploader TEXT NOT NULL,
+		Created BIGINT NOT NULL
+	);
+	ALTER TABLE Messages ADD COLUMN AttachmentID TEXT;`,
+
+	// 5: end-to-end encrypted rooms, public keys and the room keys wrapped for each member
+	`ALTER TABLE Rooms ADD COLUMN Encrypted BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE Rooms ADD COLUMN KeyVersion BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE Rooms ADD COLUMN Rekey BIGINT NOT NULL DEFAULT 0;
+	CREATE TABLE UserKeys (
+		UserID BIGINT PRIMARY KEY,
+		PublicKey TEXT NOT NULL,
+		SigningKey TEXT NOT NULL,
+		Updated BIGINT NOT NULL
+	);
+	CREATE TABLE RoomKeys (
+		RoomID BIGINT NOT NULL,
+		Version BIGINT NOT NULL,
+		UserID BIGINT NOT NULL,
+		WrappedKey TEXT NOT NULL,
+		Sender TEXT NOT NULL,
+		Created BIGINT NOT NULL,
+		PRIMARY KEY (RoomID, Version, UserID)
+	);`,
+
+	// 6: per room retention overrides and a log of pruner runs
+	`ALTER TABLE Rooms ADD COLUMN RetentionMaxAge BIGINT;
+	ALTER TABLE Rooms ADD COLUMN RetentionMaxCount BIGINT;
+	CREATE INDEX MessageRoomEpochIndex ON Messages (RoomID, Epoch);
+	CREATE TABLE PruneRuns (
+		RunID BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+		Started BIGINT NOT NULL,
+		Finished BIGINT NOT NULL,
+		Deleted BIGINT NOT NULL,
+		Rooms TEXT NOT NULL,
+		Archive TEXT NOT NULL,
+		Error TEXT NOT NULL
+	);`,
+
+	// 7: users and rooms disabled by an admin
+	`ALTER TABLE Users ADD COLUMN Disabled BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE Rooms ADD COLUMN Disabled BIGINT NOT NULL DEFAULT 0;`,
+}
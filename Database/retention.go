@@ -0,0 +1,457 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Returned by a prune that was interrupted by shutdown. What was deleted so far stays deleted.
+var errPruneStopped = errors.New("pruning stopped by shutdown")
+
+// A room's retention overrides. A nil field uses the server wide setting; "0s" and 0 keep messages
+// forever even if the server has a limit.
+type RetentionPolicy struct {
+	MaxAge   *string `json:"maxAge"`
+	MaxCount *int    `json:"maxCount"`
+}
+
+// A room's retention overrides and the limits that apply to it after falling back to the server's
+type RoomRetention struct {
+	Room     string          `json:"room"`
+	Override RetentionPolicy `json:"override"`
+	MaxAge   string          `json:"maxAge"`
+	MaxCount int             `json:"maxCount"`
+}
+
+// What one run of the pruner did
+type PruneRun struct {
+	ID       int          `json:"id"`
+	Started  int64        `json:"started"`
+	Finished int64        `json:"finished"`
+	Deleted  int64        `json:"deleted"`
+	Rooms    []RoomPruned `json:"rooms"`
+	Archive  string       `json:"archive,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// Messages pruned from one room during a run
+type RoomPruned struct {
+	Room    string `json:"room"`
+	Deleted int64  `json:"deleted"`
+}
+
+// Server wide retention settings and the most recent runs, newest first
+type RetentionStatus struct {
+	MaxAge     string     `json:"maxAge"`
+	MaxCount   int        `json:"maxCount"`
+	Interval   string     `json:"interval"`
+	ArchiveDir string     `json:"archiveDir,omitempty"`
+	Runs       []PruneRun `json:"runs"`
+}
+
+// A room's effective retention limits
+type roomPolicy struct {
+	id       int
+	name     string
+	maxAge   time.Duration
+	maxCount int
+}
+
+// Only one prune runs at a time, whether scheduled or requested by an admin
+var pruneMu sync.Mutex
+
+var retentionQuit chan struct{}
+var retentionDone chan struct{}
+
+// Starts the background pruner. It runs once at startup and then every retention.interval.
+func startRetention() {
+	retentionQuit = make(chan struct{})
+	retentionDone = make(chan struct{})
+	go func() {
+		defer close(retentionDone)
+		ticker := time.NewTicker(config.Retention.Interval)
+		defer ticker.Stop()
+		for {
+			run := pruneMessages(retentionQuit)
+			if run.Error != "" {
+				slog.Error("Error pruning messages", "err", run.Error)
+			} else if run.Deleted > 0 {
+				slog.Info("Pruned messages", "deleted", run.Deleted, "rooms", len(run.Rooms))
+			}
+			select {
+			case <-retentionQuit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stops the pruner, waiting for the batch in progress until ctx is done
+func stopRetention(ctx context.Context) {
+	close(retentionQuit)
+	select {
+	case <-retentionDone:
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for the message pruner to stop")
+	}
+}
+
+// Applies the retention policies to every room and records the run. Stops between batches once
+// quit is closed.
+func pruneMessages(quit <-chan struct{}) PruneRun {
+	pruneMu.Lock()
+	defer pruneMu.Unlock()
+
+	started := time.Now()
+	run := PruneRun{Started: started.Unix(), Rooms: make([]RoomPruned, 0)}
+	var archive *pruneArchive
+	err := func() error {
+		policies, err := retentionPolicies()
+		if err != nil {
+			return err
+		}
+		for _, p := range policies {
+			if p.maxAge == 0 && p.maxCount == 0 {
+				continue
+			}
+			n, err := pruneRoom(p, started, &archive, quit)
+			if n > 0 {
+				run.Rooms = append(run.Rooms, RoomPruned{Room: p.name, Deleted: n})
+				run.Deleted += n
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if archive != nil {
+		run.Archive = archive.path
+		if closeErr := archive.close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.Finished = time.Now().Unix()
+
+	rooms, _ := json.Marshal(run.Rooms)
+	err = db.QueryRow("INSERT INTO PruneRuns (Started, Finished, Deleted, Rooms, Archive, Error) VALUES (?, ?, ?, ?, ?, ?) RETURNING RunID",
+		run.Started, run.Finished, run.Deleted, string(rooms), run.Archive, run.Error).Scan(&run.ID)
+	if err != nil {
+		slog.Error("Error recording prune run", "err", err)
+	}
+	return run
+}
+
+// Returns every room's limits with the server wide settings filled in
+func retentionPolicies() ([]roomPolicy, error) {
+	rows, err := db.Query("SELECT RoomID, RoomName, RetentionMaxAge, RetentionMaxCount FROM Rooms ORDER BY RoomName")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var policies []roomPolicy
+	for rows.Next() {
+		var p roomPolicy
+		var maxAge, maxCount sql.NullInt64
+		if err := rows.Scan(&p.id, &p.name, &maxAge, &maxCount); err != nil {
+			return nil, err
+		}
+		p.maxAge, p.maxCount = effectiveRetention(maxAge, maxCount)
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// Falls back to the server wide limits for a room without overrides
+func effectiveRetention(maxAge, maxCount sql.NullInt64) (time.Duration, int) {
+	age, count := config.Retention.MaxAge, config.Retention.MaxCount
+	if maxAge.Valid {
+		age = time.Duration(maxAge.Int64) * time.Second
+	}
+	if maxCount.Valid {
+		count = int(maxCount.Int64)
+	}
+	return age, count
+}
+
+// Deletes the room's messages that are too old or beyond the newest maxCount, oldest first, one
+// batch per transaction. Returns how many were deleted.
+func pruneRoom(p roomPolicy, now time.Time, archive **pruneArchive, quit <-chan struct{}) (int64, error) {
+	// Epoch < 0 matches nothing and a limit of MaxInt64 keeps everything, which disables either
+	// limit. SQLite reads LIMIT -1 as no limit but PostgreSQL rejects it.
+	cutoff := int64(0)
+	if p.maxAge > 0 {
+		cutoff = now.Add(-p.maxAge).Unix()
+	}
+	keep := int64(math.MaxInt64)
+	if p.maxCount > 0 {
+		keep = int64(p.maxCount)
+	}
+
+	var deleted int64
+	for {
+		select {
+		case <-quit:
+			return deleted, errPruneStopped
+		default:
+		}
+
+		ids, err := pruneBatch(p.id, cutoff, keep)
+		if err != nil || len(ids) == 0 {
+			return deleted, err
+		}
+		if config.Retention.ArchiveDir != "" {
+			if *archive == nil {
+				if *archive, err = openPruneArchive(config.Retention.ArchiveDir, now); err != nil {
+					return deleted, err
+				}
+			}
+			if err := (*archive).write(ids); err != nil {
+				return deleted, err
+			}
+		}
+		n, err := deleteMessages(ids)
+		deleted += n
+		if err != nil || len(ids) < config.Retention.BatchSize {
+			return deleted, err
+		}
+	}
+}
+
+// Returns the rowids of the next batch of messages to prune, oldest first
+func pruneBatch(roomID int, cutoff, keep int64) ([]interface{}, error) {
+	rows, err := db.Query("SELECT rowid FROM Messages WHERE RoomID = ? AND (Epoch < ? OR rowid NOT IN (SELECT rowid FROM Messages WHERE RoomID = ? ORDER BY Epoch DESC, rowid DESC LIMIT ?)) ORDER BY Epoch, rowid LIMIT ?",
+		roomID, cutoff, roomID, keep, config.Retention.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Returns "?, ?, ?" with one placeholder per value
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// Deletes the messages with the given rowids in one transaction
+func deleteMessages(ids []interface{}) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM Messages WHERE rowid IN ("+placeholders(len(ids))+")", ids...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// A gzipped JSONL file of pruned messages, one Message per line
+type pruneArchive struct {
+	path string
+	f    *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+func openPruneArchive(dir string, started time.Time) (*pruneArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "messages-"+started.UTC().Format("20060102T150405.000Z")+".jsonl.gz")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &pruneArchive{path: path, f: f, gz: gz, enc: json.NewEncoder(gz)}, nil
+}
+
+// Appends the messages with the given rowids and syncs the file, so they are on disk before
+// they are deleted
+func (a *pruneArchive) write(ids []interface{}) error {
+	rows, err := db.Query(messageQuery+" WHERE Messages.rowid IN ("+placeholders(len(ids))+") ORDER BY Epoch, Messages.rowid", ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return err
+		}
+		if err := a.enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+func (a *pruneArchive) close() error {
+	if err := a.gz.Close(); err != nil {
+		a.f.Close()
+		return err
+	}
+	return a.f.Close()
+}
+
+// Handles getting a room's retention limits
+func roomRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	res, err := getRoomRetention(room)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func getRoomRetention(room string) (*RoomRetention, error) {
+	var maxAge, maxCount sql.NullInt64
+	if err := db.QueryRow("SELECT RetentionMaxAge, RetentionMaxCount FROM Rooms WHERE RoomName = ?", room).Scan(&maxAge, &maxCount); err != nil {
+		return nil, err
+	}
+	res := &RoomRetention{Room: room}
+	if maxAge.Valid {
+		age := (time.Duration(maxAge.Int64) * time.Second).String()
+		res.Override.MaxAge = &age
+	}
+	if maxCount.Valid {
+		count := int(maxCount.Int64)
+		res.Override.MaxCount = &count
+	}
+	age, count := effectiveRetention(maxAge, maxCount)
+	res.MaxAge, res.MaxCount = age.String(), count
+	return res, nil
+}
+
+// Handles the room owner replacing the room's retention overrides. Omitted or null fields go back
+// to the server wide setting.
+func setRoomRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	roomID, _, ok := requireRoomOwner(w, r, room)
+	if !ok {
+		return
+	}
+	var req RetentionPolicy
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	var maxAge, maxCount interface{}
+	if req.MaxAge != nil {
+		age, err := time.ParseDuration(*req.MaxAge)
+		if err != nil || age < 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid maxAge supplied \"%s\": must be a duration like \"720h\", or \"0s\" to keep messages forever", *req.MaxAge)
+			return
+		}
+		maxAge = int64(age / time.Second)
+	}
+	if req.MaxCount != nil {
+		if *req.MaxCount < 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid maxCount supplied %d: must not be negative", *req.MaxCount)
+			return
+		}
+		maxCount = *req.MaxCount
+	}
+	if _, err := db.Exec("UPDATE Rooms SET RetentionMaxAge = ?, RetentionMaxCount = ? WHERE RoomID = ?", maxAge, maxCount, roomID); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	res, err := getRoomRetention(room)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Handles the admin view of the retention settings and recent pruner runs
+func retentionStatusHandler(w http.ResponseWriter, r *http.Request) {
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	status := RetentionStatus{
+		MaxAge:     config.Retention.MaxAge.String(),
+		MaxCount:   config.Retention.MaxCount,
+		Interval:   config.Retention.Interval.String(),
+		ArchiveDir: config.Retention.ArchiveDir,
+		Runs:       make([]PruneRun, 0),
+	}
+	rows, err := db.Query("SELECT RunID, Started, Finished, Deleted, Rooms, Archive, Error FROM PruneRuns ORDER BY RunID DESC LIMIT ?", limit)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var run PruneRun
+		var rooms string
+		if err := rows.Scan(&run.ID, &run.Started, &run.Finished, &run.Deleted, &rooms, &run.Archive, &run.Error); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := json.Unmarshal([]byte(rooms), &run.Rooms); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		status.Runs = append(status.Runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// Handles an admin running the pruner now. Responds with what the run did once it finishes.
+func runRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	run := pruneMessages(retentionQuit)
+	status := http.StatusOK
+	if run.Error != "" {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, run)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stores a message from alice in the room for each age, oldest first, with its age as the text
+func insertAgedMessages(t *testing.T, roomID int, ages ...time.Duration) {
+	t.Helper()
+	now := time.Now()
+	for _, age := range ages {
+		_, err := db.Exec("INSERT INTO Messages (UserID, Epoch, MessageText, RoomID) VALUES ((SELECT UserID FROM Users WHERE Name = 'alice'), ?, ?, ?)",
+			now.Add(-age).Unix(), age.String(), roomID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Returns the texts of the room's messages, oldest first
+func roomMessageTexts(t *testing.T, roomID int) []string {
+	t.Helper()
+	rows, err := db.Query("SELECT MessageText FROM Messages WHERE RoomID = ? ORDER BY Epoch, rowid", roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var texts []string
+	for rows.Next() {
+		var text string
+		if err := rows.Scan(&text); err != nil {
+			t.Fatal(err)
+		}
+		texts = append(texts, text)
+	}
+	return texts
+}
+
+// Sets a room's retention overrides, nil leaving the server wide setting
+func setTestRetention(t *testing.T, roomID int, maxAge *time.Duration, maxCount *int) {
+	t.Helper()
+	var age, count interface{}
+	if maxAge != nil {
+		age = int64(maxAge.Seconds())
+	}
+	if maxCount != nil {
+		count = *maxCount
+	}
+	if _, err := db.Exec("UPDATE Rooms SET RetentionMaxAge = ?, RetentionMaxCount = ? WHERE RoomID = ?", age, count, roomID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Checks the room has only the messages with the given texts left, oldest first
+func expectMessages(t *testing.T, roomID int, want ...string) {
+	t.Helper()
+	if got := roomMessageTexts(t, roomID); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("room %d has %v, want %v", roomID, got, want)
+	}
+}
+
+func TestPruneByAge(t *testing.T) {
+	openTestDatabase(t, "-retention-max-age", "24h")
+	if _, err := newUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	ages := []time.Duration{72 * time.Hour, 30 * time.Hour, 3 * time.Hour, time.Minute}
+	lobby := createTestRoom(t, "lobby")
+	forever := createTestRoom(t, "forever")
+	short := createTestRoom(t, "short")
+	for _, roomID := range []int{lobby, forever, short} {
+		insertAgedMessages(t, roomID, ages...)
+	}
+	keep, twoHours := time.Duration(0), 2*time.Hour
+	setTestRetention(t, forever, &keep, nil)
+	setTestRetention(t, short, &twoHours, nil)
+
+	run := pruneMessages(nil)
+	if run.Error != "" || run.Deleted != 5 {
+		t.Fatalf("prune run %+v, want 5 deleted", run)
+	}
+	expectMessages(t, lobby, "3h0m0s", "1m0s")
+	expectMessages(t, forever, "72h0m0s", "30h0m0s", "3h0m0s", "1m0s")
+	expectMessages(t, short, "1m0s")
+
+	var deleted int64
+	var rooms string
+	if err := db.QueryRow("SELECT Deleted, Rooms FROM PruneRuns WHERE RunID = ?", run.ID).Scan(&deleted, &rooms); err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 5 || rooms != `[{"room":"lobby","deleted":2},{"room":"short","deleted":3}]` {
+		t.Errorf("recorded %d deleted from %s", deleted, rooms)
+	}
+}
+
+// The newest messages are kept, over several batches, and per room counts override the server's
+func TestPruneByCount(t *testing.T) {
+	openTestDatabase(t, "-retention-max-count", "3", "-retention-batch-size", "2")
+	if _, err := newUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	var ages []time.Duration
+	for i := 9; i > 0; i-- {
+		ages = append(ages, time.Duration(i)*time.Hour)
+	}
+	lobby := createTestRoom(t, "lobby")
+	unlimited := createTestRoom(t, "unlimited")
+	larger := createTestRoom(t, "larger")
+	for _, roomID := range []int{lobby, unlimited, larger} {
+		insertAgedMessages(t, roomID, ages...)
+	}
+	zero, five := 0, 5
+	setTestRetention(t, unlimited, nil, &zero)
+	setTestRetention(t, larger, nil, &five)
+
+	if run := pruneMessages(nil); run.Error != "" || run.Deleted != 10 {
+		t.Fatalf("prune run %+v, want 10 deleted", run)
+	}
+	expectMessages(t, lobby, "3h0m0s", "2h0m0s", "1h0m0s")
+	if n := len(roomMessageTexts(t, unlimited)); n != 9 {
+		t.Errorf("the unlimited room has %d messages, want all 9", n)
+	}
+	expectMessages(t, larger, "5h0m0s", "4h0m0s", "3h0m0s", "2h0m0s", "1h0m0s")
+
+	if run := pruneMessages(nil); run.Deleted != 0 {
+		t.Errorf("a second run deleted %d, want nothing left to prune", run.Deleted)
+	}
+}
+
+// With retention.archiveDir set, pruned messages are written to a gzipped JSONL file first
+func TestPruneArchive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "archive")
+	openTestDatabase(t, "-retention-max-count", "1", "-retention-archive-dir", dir)
+	if _, err := newUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	insertAgedMessages(t, createTestRoom(t, "lobby"), 3*time.Hour, 2*time.Hour, time.Hour)
+
+	run := pruneMessages(nil)
+	if run.Error != "" || filepath.Dir(run.Archive) != dir {
+		t.Fatalf("prune run %+v, want an archive in %s", run, dir)
+	}
+	f, err := os.Open(run.Archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archived []string
+	dec := json.NewDecoder(gz)
+	for dec.More() {
+		var msg Message
+		if err := dec.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if *msg.Sender != "alice" || *msg.RoomName != "lobby" {
+			t.Errorf("archived %+v without its sender and room", msg)
+		}
+		archived = append(archived, *msg.MessageText)
+	}
+	if want := "3h0m0s,2h0m0s"; strings.Join(archived, ",") != want {
+		t.Errorf("archived %v, want %s", archived, want)
+	}
+	if run.Deleted != int64(len(archived)) {
+		t.Errorf("deleted %d and archived %d", run.Deleted, len(archived))
+	}
+}
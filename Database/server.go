@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Runs the HTTP server until it fails, ctx is done or the process receives SIGINT/SIGTERM. On a
+// signal the server stops accepting connections, sends every websocket a going away close frame,
+// flushes pending writes and closes the database, giving up on anything left after the timeout.
+func runServer(ctx context.Context, srv *http.Server, timeout time.Duration) error {
+	serverErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate
+			slog.Info("Listening with TLS", "addr", srv.Addr)
+			serverErr <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		slog.Info("Listening", "addr", srv.Addr)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	select {
+	case err := <-serverErr:
+		stopBroker()
+		stopRetention(context.Background())
+		stopBackups(context.Background())
+		stopWebhooks(context.Background())
+		db.Close()
+		return err
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String(), "timeout", timeout)
+	case <-ctx.Done():
+		slog.Info("Shutting down", "timeout", timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Stop the listener and wait for in flight HTTP requests. Websockets are hijacked
+	// connections so they are drained separately.
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+	closeAllClients("Server is shutting down", ctx.Done())
+
+	err := <-shutdownErr
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("Timed out waiting for requests to finish, closing remaining connections")
+		srv.Close()
+	}
+
+	stopBroker()
+	// Deliveries and prune runs record their result in the database, so finish them first
+	stopRetention(ctx)
+	stopBackups(ctx)
+	stopWebhooks(ctx)
+	if dbErr := db.Close(); dbErr != nil {
+		slog.Error("Error closing database", "err", dbErr)
+	}
+	slog.Info("Server stopped")
+	return nil
+}
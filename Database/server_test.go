@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Shutting down sends websockets a going away close frame and lets HTTP requests in flight finish
+// before the database is closed
+func TestRunServerShutdown(t *testing.T) {
+	openTestDatabase(t)
+	startTestHub(t)
+	prevBroker := broker
+	t.Cleanup(func() {
+		broker = prevBroker
+		shutdownMu.Lock()
+		shuttingDown = false
+		shutdownMu.Unlock()
+	})
+	startWebhooks()
+	startRetention()
+	startBackups()
+	if err := startBroker(); err != nil {
+		t.Fatal(err)
+	}
+	userID, err := newUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reserve a free port for the server to listen on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	started := make(chan struct{})
+	router := mux.NewRouter()
+	router.HandleFunc("/chat/sockets/connect", socketHandler)
+	router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		var users int
+		if err := db.QueryRow("SELECT COUNT(*) FROM Users").Scan(&users); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, users)
+	})
+	srv := &http.Server{Addr: addr, Handler: router}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- runServer(ctx, srv, 5*time.Second)
+	}()
+
+	var conn *websocket.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		conn, _, err = websocket.DefaultDialer.Dial("ws://"+addr+"/chat/sockets/connect?user-id="+strconv.Itoa(userID), nil)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the server never started: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	defer conn.Close()
+
+	type result struct {
+		status int
+		body   string
+		err    error
+	}
+	slow := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/slow")
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		slow <- result{resp.StatusCode, string(body), err}
+	}()
+	<-started
+	cancel()
+
+	err = readUntilClosed(t, conn, 5*time.Second)
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("websocket read ended with %v, want a going away close frame", err)
+	}
+	res := <-slow
+	if res.err != nil || res.status != http.StatusOK || res.body != "1" {
+		t.Errorf("request in flight got %d %q (%v), want it to finish with the database open", res.status, res.body, res.err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("runServer returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("runServer didn't return")
+	}
+	if err := db.Ping(); err == nil {
+		t.Error("the database is still open after shutting down")
+	}
+}
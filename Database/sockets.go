@@ -0,0 +1,316 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Time allowed to write the close frame to a connection
+const closeWriteWait = time.Second
+
+// Close code for a connection that fell so far behind its queue filled up. The client may
+// reconnect and fetch the messages it missed.
+const closeSlowConsumer = 4000
+
+// Transports a client can receive room events over
+const (
+	transportWebsocket = "websocket"
+	transportSSE       = "sse"
+	transportLongPoll  = "longpoll"
+)
+
+// A connection receiving room events and the queue of messages waiting to be delivered to it.
+// Websockets, server-sent event streams and long-poll sessions all register one in wsconns, so
+// they are replaced, dropped and drained the same way.
+// Only writePump writes to a websocket's conn, so writes never race with each other.
+type wsClient struct {
+	userID     int
+	userName   string
+	transport  string
+	remoteAddr string
+	send       chan Message
+	// Encodes messages for the connection. Only websockets can negotiate anything but JSON.
+	codec wireCodec
+
+	// Set for websockets only
+	conn *websocket.Conn
+
+	// Stops delivery right away without flushing the queue
+	abort func()
+
+	// When the connection was opened
+	connected time.Time
+
+	// Tags records with the user and the request ID of the handshake
+	logger *slog.Logger
+
+	// Closed when the transport has delivered the queue and stopped
+	done       chan struct{}
+	finishOnce sync.Once
+
+	mu          sync.Mutex
+	closed      bool
+	closeCode   int
+	closeReason string
+	// Set when the queue is abandoned rather than delivered before the close
+	discard bool
+}
+
+// Guards wsconns
+var connsMu sync.RWMutex
+
+// Guards activeRooms
+var roomsMu sync.RWMutex
+
+// Set once the server starts shutting down so no new sockets are accepted
+var shuttingDown bool
+var shutdownMu sync.RWMutex
+
+func newClient(userID int, userName, transport, remoteAddr string, logger *slog.Logger) *wsClient {
+	return &wsClient{
+		userID:     userID,
+		userName:   userName,
+		transport:  transport,
+		remoteAddr: remoteAddr,
+		send:       make(chan Message, config.Limits.SendQueueSize),
+		codec:      jsonCodec{},
+		abort:      func() {},
+		connected:  time.Now(),
+		logger:     logger,
+		done:       make(chan struct{}),
+	}
+}
+
+func newWSClient(userID int, userName string, conn *websocket.Conn, logger *slog.Logger) *wsClient {
+	c := newClient(userID, userName, transportWebsocket, conn.RemoteAddr().String(), logger)
+	c.conn = conn
+	c.abort = func() { conn.Close() }
+	// The upgrader only agrees to subprotocols in wireCodecs
+	if codec, ok := wireCodecs[conn.Subprotocol()]; ok {
+		c.codec = codec
+	}
+	return c
+}
+
+// Reads the next message posted over the websocket. Binary frames use the negotiated encoding,
+// while text frames are always JSON so a client can post JSON whatever it negotiated.
+func (c *wsClient) readMessage() (Message, error) {
+	frameType, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return Message{}, err
+	}
+	if frameType == websocket.TextMessage {
+		return jsonCodec{}.decode(data)
+	}
+	if c.codec.frameType() != websocket.BinaryMessage {
+		return Message{}, errFrameType
+	}
+	return c.codec.decode(data)
+}
+
+// Queues a message to be delivered without ever waiting. A client whose queue is full can't keep
+// up, so rather than hold up everyone else's messages it is closed with closeSlowConsumer and the
+// rest of its queue is dropped. Returns why the message was dropped, or "" if it was queued.
+func (c *wsClient) enqueue(msg Message) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return "closed"
+	}
+	select {
+	case c.send <- msg:
+		return ""
+	default:
+	}
+	c.closeLocked(closeSlowConsumer, "Too slow to keep up with messages")
+	c.discard = true
+	return "slow_consumer"
+}
+
+// Stops accepting new messages. The transport delivers whatever is queued, then the code and
+// reason, e.g. as a websocket close frame, and then stops.
+func (c *wsClient) close(code int, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(code, reason)
+}
+
+// Like close, for callers holding c.mu
+func (c *wsClient) closeLocked(code int, reason string) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.closeCode = code
+	c.closeReason = reason
+	close(c.send)
+}
+
+// Returns true once the queue has been abandoned, so the transport should skip to the close
+func (c *wsClient) discarding() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.discard
+}
+
+// Returns true once the connection has been closed by either side
+func (c *wsClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Returns the code and reason given to close
+func (c *wsClient) closeStatus() (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeCode, c.closeReason
+}
+
+// Marks the client closed once its transport has stopped delivering. Safe to call more than once.
+func (c *wsClient) finish() {
+	c.finishOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+	})
+}
+
+// Writes queued messages to the connection, pinging it when idle, until the queue is closed or a
+// write fails or times out
+func (c *wsClient) writePump() {
+	defer func() {
+		c.conn.Close()
+		c.finish()
+	}()
+
+	ping := time.NewTicker(config.Limits.HeartbeatInterval)
+	defer ping.Stop()
+	for open := true; open; {
+		select {
+		case msg, ok := <-c.send:
+			if !ok || c.discarding() {
+				open = false
+				break
+			}
+			data, err := c.codec.encode(msg)
+			if err != nil {
+				c.logger.Error("Error encoding message", "encoding", c.codec.name(), "err", err)
+				continue
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(config.Limits.WriteTimeout))
+			if err := c.conn.WriteMessage(c.codec.frameType(), data); err != nil {
+				c.logger.Warn("Error writing to websocket", "err", err)
+				return
+			}
+			wsMessagesSent.inc()
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(config.Limits.WriteTimeout)); err != nil {
+				c.logger.Warn("Error pinging websocket", "err", err)
+				return
+			}
+		}
+	}
+
+	code, reason := c.closeStatus()
+	frame := websocket.FormatCloseMessage(code, reason)
+	c.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(closeWriteWait))
+}
+
+// Adds a connection to wsconns, closing any previous connection for the same user on any instance
+func registerClient(c *wsClient) {
+	connsMu.Lock()
+	old, ok := wsconns[c.userID]
+	wsconns[c.userID] = c
+	connsMu.Unlock()
+
+	if ok {
+		old.close(websocket.ClosePolicyViolation, "Replaced by a new connection")
+	}
+	// Other instances close any connection they hold for the user
+	publishEvent(clusterEvent{Type: clusterConnect, UserID: c.userID, User: c.userName, Connected: c.connected.UnixNano()})
+}
+
+// Removes a connection from wsconns if it is still the registered connection for its user
+func unregisterClient(c *wsClient) {
+	connsMu.Lock()
+	if wsconns[c.userID] == c {
+		delete(wsconns, c.userID)
+	}
+	connsMu.Unlock()
+}
+
+// Returns the open connections of all the given users
+func clientsForUsers(names []string) []*wsClient {
+	connsMu.RLock()
+	defer connsMu.RUnlock()
+
+	clients := make([]*wsClient, 0, len(names))
+	for _, c := range wsconns {
+		for _, name := range names {
+			if c.userName == name {
+				clients = append(clients, c)
+				break
+			}
+		}
+	}
+	return clients
+}
+
+// Returns the number of open connections using the transport
+func countClients(transport string) int {
+	connsMu.RLock()
+	defer connsMu.RUnlock()
+	n := 0
+	for _, c := range wsconns {
+		if c.transport == transport {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns a copy of the names of the users active in the room
+func roomMembers(roomID int) []string {
+	roomsMu.RLock()
+	defer roomsMu.RUnlock()
+	return append([]string(nil), activeRooms[roomID]...)
+}
+
+// Returns true once the server has started shutting down
+func isShuttingDown() bool {
+	shutdownMu.RLock()
+	defer shutdownMu.RUnlock()
+	return shuttingDown
+}
+
+// Sends every open connection a going away close frame and waits for the queued messages to be
+// delivered, or for the done channel to close
+func closeAllClients(reason string, done <-chan struct{}) {
+	shutdownMu.Lock()
+	shuttingDown = true
+	shutdownMu.Unlock()
+
+	connsMu.RLock()
+	clients := make([]*wsClient, 0, len(wsconns))
+	for _, c := range wsconns {
+		clients = append(clients, c)
+	}
+	connsMu.RUnlock()
+
+	for _, c := range clients {
+		c.close(websocket.CloseGoingAway, reason)
+	}
+	for _, c := range clients {
+		select {
+		case <-c.done:
+		case <-done:
+			// Out of time, drop whatever is left
+			c.abort()
+		}
+	}
+}
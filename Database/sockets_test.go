@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Starts a server accepting websockets, connects a new user to it and returns the client's end
+// and the server's
+func connectTestSocket(t *testing.T, name string) (*websocket.Conn, *wsClient) {
+	t.Helper()
+	startTestHub(t)
+	userID, err := newUser(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(socketHandler))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/chat/sockets/connect?user-id=" + strconv.Itoa(userID)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	connsMu.RLock()
+	c := wsconns[userID]
+	connsMu.RUnlock()
+	if c == nil {
+		t.Fatal("the connection wasn't registered")
+	}
+	return conn, c
+}
+
+// Reads from conn until it fails, returning the error
+func readUntilClosed(t *testing.T, conn *websocket.Conn, timeout time.Duration) error {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns whether the user still has a registered connection
+func isConnected(userID int) bool {
+	connsMu.RLock()
+	defer connsMu.RUnlock()
+	_, ok := wsconns[userID]
+	return ok
+}
+
+// A client that doesn't read while its queue fills up is dropped, and finds close code 4000 after
+// the messages that did fit once it reads again
+func TestSlowConsumerClosed(t *testing.T) {
+	openTestDatabase(t, "-limits-send-queue", "4")
+	conn, c := connectTestSocket(t, "slow")
+
+	// Random text doesn't compress, so the socket buffers fill up and the writer blocks
+	b := make([]byte, 48*1024)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	text := base64.StdEncoding.EncodeToString(b)
+	sender := "someone"
+	for i := 0; !c.isClosed(); i++ {
+		if i == 100000 {
+			t.Fatal("the queue never filled up")
+		}
+		sendHandler(c, Message{Sender: &sender, MessageText: &text})
+	}
+	if isConnected(c.userID) {
+		t.Error("the slow client is still registered")
+	}
+
+	err := readUntilClosed(t, conn, 10*time.Second)
+	if !websocket.IsCloseError(err, closeSlowConsumer) {
+		t.Fatalf("read ended with %v, want close code %d", err, closeSlowConsumer)
+	}
+}
+
+// A peer that stops answering pings is dropped once the read timeout passes without a pong, while
+// one that answers stays connected
+func TestUnresponsivePeerDropped(t *testing.T) {
+	openTestDatabase(t, "-limits-heartbeat-interval", "50ms", "-limits-read-timeout", "300ms")
+
+	t.Run("answering", func(t *testing.T) {
+		conn, c := connectTestSocket(t, "alive")
+		// Reading handles pings, answering them with pongs
+		err := readUntilClosed(t, conn, 1200*time.Millisecond)
+		if _, closed := err.(*websocket.CloseError); closed || c.isClosed() || !isConnected(c.userID) {
+			t.Fatalf("a peer answering pings was dropped: %v", err)
+		}
+	})
+
+	t.Run("silent", func(t *testing.T) {
+		start := time.Now()
+		conn, c := connectTestSocket(t, "silent")
+		pinged := make(chan struct{}, 1)
+		conn.SetPingHandler(func(string) error {
+			select {
+			case pinged <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		err := readUntilClosed(t, conn, 5*time.Second)
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Fatalf("read ended with %v, want the server to close the connection", err)
+		}
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+			t.Errorf("dropped after %s, before the read timeout", elapsed)
+		}
+		select {
+		case <-pinged:
+		default:
+			t.Error("the server never pinged")
+		}
+		if isConnected(c.userID) {
+			t.Error("the silent peer is still registered")
+		}
+	})
+}
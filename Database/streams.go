@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long a poll waits for events by default, and at most
+const (
+	defaultPollWait = 25 * time.Second
+	maxPollWait     = 60 * time.Second
+)
+
+// Time a long-poll session is kept without a poll waiting before it is closed
+const pollSessionTimeout = 30 * time.Second
+
+// The last event of a stream, and of a long-poll session, when the server closes it. Code is the
+// websocket close code a websocket would have been closed with.
+type CloseEvent struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+type PollResponse struct {
+	Session string `json:"session"`
+	// Identifies the batch of messages, passed back as ack by the next poll once they're handled
+	Cursor   int64     `json:"cursor"`
+	Messages []Message `json:"messages"`
+	// Set on the last response of a session the server closed
+	Close *CloseEvent `json:"close,omitempty"`
+}
+
+// Handles streaming room events as server-sent events, for clients that can't open a websocket.
+// Each message is a "message" event with the JSON the websocket would send, and the stream ends
+// with a "close" event when the server closes it. A comment is sent every heartbeat interval so
+// proxies don't close an idle stream.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	userID, userName, ok := connectingUser(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	logger := requestLogger(r.Context()).With("user", userName)
+	c := newClient(userID, userName, transportSSE, r.RemoteAddr, logger)
+	c.abort = cancel
+	defer func() {
+		unregisterClient(c)
+		c.finish()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stops nginx buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Warn("Event stream can't be flushed", "err", err)
+		return
+	}
+
+	logger.Info("Event stream connected", "remote_addr", c.remoteAddr)
+	registerClient(c)
+	streamConnectionsOpened.inc(transportSSE)
+	// This goroutine delivers the queue, so it can't also fill it
+	go sendRecentMessages(c)
+
+	keepalive := time.NewTicker(config.Limits.HeartbeatInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok || c.discarding() {
+				code, reason := c.closeStatus()
+				writeEvent(rc, w, "close", CloseEvent{Code: code, Reason: reason})
+				logger.Info("Event stream closed", "reason", reason)
+				return
+			}
+			if err := writeEvent(rc, w, "message", msg); err != nil {
+				logger.Warn("Error writing to event stream", "err", err)
+				return
+			}
+			streamMessagesSent.inc(transportSSE)
+		case <-keepalive.C:
+			if err := writeStream(rc, w, ": keepalive\n\n"); err != nil {
+				logger.Warn("Error writing to event stream", "err", err)
+				return
+			}
+		case <-ctx.Done():
+			logger.Info("Event stream disconnected")
+			return
+		}
+	}
+}
+
+// Writes one server-sent event with v as its JSON data
+func writeEvent(rc *http.ResponseController, w io.Writer, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeStream(rc, w, fmt.Sprintf("event: %s\ndata: %s\n\n", event, data))
+}
+
+// Writes and flushes text to an event stream, giving up after the write timeout so a stalled
+// client can't hold up its handler
+func writeStream(rc *http.ResponseController, w io.Writer, text string) error {
+	rc.SetWriteDeadline(time.Now().Add(config.Limits.WriteTimeout))
+	if _, err := io.WriteString(w, text); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// A long-poll session, holding a client's queue between polls
+type pollSession struct {
+	id     string
+	client *wsClient
+	// Ends the session when no poll arrives in time
+	expiry *time.Timer
+
+	// Held by the poll reading the queue
+	reading sync.Mutex
+	// The last batch sent and its cursor, guarded by reading. The batch is sent again until a poll
+	// acknowledges it, so messages in a response lost to a network error aren't lost with it.
+	cursor  int64
+	unacked []Message
+	// Sent with the last batch once the server has closed the session
+	closing *CloseEvent
+
+	mu         sync.Mutex
+	polling    int
+	cancelPoll context.CancelFunc
+	ended      bool
+}
+
+// Open long-poll sessions by ID
+var pollSessions = make(map[string]*pollSession)
+
+// Guards pollSessions
+var pollMu sync.Mutex
+
+// Handles long-polling for room events, for clients that can't open a websocket or an event stream.
+// A request without a session opens one and returns its ID straight away. Requests with the
+// session wait up to wait seconds for messages and return everything queued along with a cursor.
+// Each poll passes the cursor of the last response it got as ack; until a poll acknowledges a
+// batch, polls get the same batch again. When the server closes the session the last response
+// includes close, and polls get that response until the session expires.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	wait := defaultPollWait
+	if waitString := r.URL.Query().Get("wait"); waitString != "" {
+		seconds, err := strconv.Atoi(waitString)
+		if err != nil || seconds < 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid wait supplied \"%s\": must be a number of seconds", waitString)
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, maxPollWait)
+	}
+	// Clients that don't send ack acknowledge every batch as soon as it is sent
+	ack, acked := int64(0), false
+	if ackString := r.URL.Query().Get("ack"); ackString != "" {
+		var err error
+		if ack, err = strconv.ParseInt(ackString, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid ack supplied \"%s\": must be the cursor of a response", ackString)
+			return
+		}
+		acked = true
+	}
+	id := r.URL.Query().Get("session")
+	if id == "" {
+		openPollSession(w, r)
+		return
+	}
+	s := findPollSession(w, r, id)
+	if s == nil {
+		return
+	}
+
+	ctx, cancel, ok := s.begin(r.Context())
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, "Long-poll session \"%s\" does not exist or has expired", id)
+		return
+	}
+	defer s.release(cancel)
+	s.reading.Lock()
+	defer s.reading.Unlock()
+
+	outstanding := len(s.unacked) > 0 || s.closing != nil
+	switch {
+	case !acked || ack == s.cursor:
+		s.unacked = nil
+	case ack != s.cursor-1 || !outstanding:
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid ack supplied \"%d\": the last response's cursor was %d", ack, s.cursor)
+		return
+	}
+	if len(s.unacked) > 0 || s.closing != nil {
+		// The last response didn't arrive, or the session is over
+		writePollResponse(w, PollResponse{Session: id, Cursor: s.cursor, Messages: append(make([]Message, 0), s.unacked...), Close: s.closing})
+		return
+	}
+
+	response := PollResponse{Session: id, Cursor: s.cursor, Messages: make([]Message, 0)}
+	closed := false
+	take := func(msg Message, ok bool) {
+		if !ok {
+			closed = true
+			return
+		}
+		response.Messages = append(response.Messages, msg)
+	}
+	// Only wait when nothing is queued already, since a short wait could win the race below
+	select {
+	case msg, ok := <-s.client.send:
+		take(msg, ok)
+	default:
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case msg, ok := <-s.client.send:
+			take(msg, ok)
+		case <-timer.C:
+		case <-ctx.Done():
+			// Either the client went away or a newer poll replaced this one
+			if r.Context().Err() != nil {
+				return
+			}
+		}
+	}
+	// Take whatever else is queued without waiting
+	for drained := len(response.Messages) == 0; !drained && !closed; {
+		select {
+		case msg, ok := <-s.client.send:
+			take(msg, ok)
+		default:
+			drained = true
+		}
+	}
+	if s.client.discarding() {
+		// Too slow to keep up, so the rest of the queue is dropped
+		response.Messages = response.Messages[:0]
+		closed = true
+	}
+
+	if len(response.Messages) > 0 || closed {
+		s.cursor++
+		response.Cursor = s.cursor
+		s.unacked = response.Messages
+	}
+	if closed {
+		code, reason := s.client.closeStatus()
+		response.Close = &CloseEvent{Code: code, Reason: reason}
+		s.closing = response.Close
+		s.client.logger.Info("Long-poll session closed", "reason", reason)
+		// Nothing more is delivered, but the session stays until it expires so the last response
+		// can be fetched again
+		defer func() {
+			unregisterClient(s.client)
+			s.client.finish()
+		}()
+	}
+	writePollResponse(w, response)
+	streamMessagesSent.add(float64(len(response.Messages)), transportLongPoll)
+}
+
+// Writes a poll's response, giving up after the write timeout
+func writePollResponse(w http.ResponseWriter, response PollResponse) {
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(config.Limits.WriteTimeout))
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Handles closing a long-poll session the client no longer needs
+func closePollHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("session")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeMissingField, "A session is required")
+		return
+	}
+	s := findPollSession(w, r, id)
+	if s == nil {
+		return
+	}
+	s.client.logger.Info("Long-poll session closed by client")
+	s.end()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Opens a session for the requesting user and returns its ID
+func openPollSession(w http.ResponseWriter, r *http.Request) {
+	userID, userName, ok := connectingUser(w, r)
+	if !ok {
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	logger := requestLogger(r.Context()).With("user", userName)
+	s := &pollSession{
+		id:     hex.EncodeToString(b),
+		client: newClient(userID, userName, transportLongPoll, r.RemoteAddr, logger),
+	}
+	s.client.abort = s.end
+	s.expiry = time.AfterFunc(pollSessionTimeout, func() {
+		logger.Info("Long-poll session expired")
+		s.end()
+	})
+	pollMu.Lock()
+	pollSessions[s.id] = s
+	pollMu.Unlock()
+
+	logger.Info("Long-poll session opened", "remote_addr", s.client.remoteAddr)
+	registerClient(s.client)
+	streamConnectionsOpened.inc(transportLongPoll)
+	go sendRecentMessages(s.client)
+	writeJSON(w, http.StatusOK, PollResponse{Session: s.id, Messages: make([]Message, 0)})
+}
+
+// Returns the session with the given ID if it belongs to the request's user-id. Writes a 404 and
+// returns nil otherwise.
+func findPollSession(w http.ResponseWriter, r *http.Request, id string) *pollSession {
+	pollMu.Lock()
+	s := pollSessions[id]
+	pollMu.Unlock()
+	if s == nil || strconv.Itoa(s.client.userID) != r.URL.Query().Get("user-id") {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, "Long-poll session \"%s\" does not exist or has expired", id)
+		return nil
+	}
+	return s
+}
+
+// Starts a poll, cancelling any poll still waiting so a client retrying after a network error
+// doesn't wait for the one it abandoned. Returns false if the session has ended.
+func (s *pollSession) begin(parent context.Context) (context.Context, context.CancelFunc, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return nil, nil, false
+	}
+	if s.cancelPoll != nil {
+		s.cancelPoll()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	s.cancelPoll = cancel
+	s.polling++
+	s.expiry.Stop()
+	return ctx, cancel, true
+}
+
+// Finishes a poll, restarting the expiry timer once no poll is waiting
+func (s *pollSession) release(cancel context.CancelFunc) {
+	cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polling--
+	if s.polling == 0 && !s.ended {
+		s.expiry.Reset(pollSessionTimeout)
+	}
+}
+
+// Ends the session and removes its client from wsconns. Safe to call more than once.
+func (s *pollSession) end() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.expiry.Stop()
+	if s.cancelPoll != nil {
+		s.cancelPoll()
+	}
+	s.mu.Unlock()
+
+	pollMu.Lock()
+	delete(pollSessions, s.id)
+	pollMu.Unlock()
+	unregisterClient(s.client)
+	s.client.finish()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Makes the hub maps this instance's connections and rooms are registered in
+func startTestHub(t *testing.T) {
+	t.Helper()
+	connsMu.Lock()
+	wsconns = make(map[int]*wsClient)
+	connsMu.Unlock()
+	roomsMu.Lock()
+	activeRooms = make(map[int][]string)
+	roomsMu.Unlock()
+}
+
+// Polls with the given query and returns the status and the decoded response
+func poll(t *testing.T, method, query string) (int, PollResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, "/chat/events/poll?"+query, nil)
+	if method == http.MethodDelete {
+		closePollHandler(w, r)
+	} else {
+		pollHandler(w, r)
+	}
+	var res PollResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, res
+}
+
+// Checks a poll returned the texts with the cursor
+func expectPoll(t *testing.T, what string, code int, res PollResponse, cursor int64, texts ...string) {
+	t.Helper()
+	if code != http.StatusOK {
+		t.Fatalf("%s: status %d", what, code)
+	}
+	got := make([]string, 0, len(res.Messages))
+	for _, msg := range res.Messages {
+		got = append(got, *msg.MessageText)
+	}
+	if res.Cursor != cursor || len(got) != len(texts) {
+		t.Fatalf("%s: cursor %d messages %q, want cursor %d messages %q", what, res.Cursor, got, cursor, texts)
+	}
+	for i := range texts {
+		if got[i] != texts[i] {
+			t.Fatalf("%s: messages %q, want %q", what, got, texts)
+		}
+	}
+}
+
+func sendText(c *wsClient, text string) {
+	sender, room := c.userName, "lobby"
+	sendHandler(c, Message{Sender: &sender, RoomName: &room, MessageText: &text})
+}
+
+func TestPollAck(t *testing.T) {
+	openTestDatabase(t)
+	startTestHub(t)
+	userID, err := newUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := "user-id=" + strconv.Itoa(userID)
+
+	code, res := poll(t, http.MethodGet, user)
+	expectPoll(t, "open", code, res, 0)
+	session := user + "&wait=0&session=" + res.Session
+	c := wsconns[userID]
+
+	sendText(c, "one")
+	sendText(c, "two")
+	code, res = poll(t, http.MethodGet, session+"&ack=0")
+	expectPoll(t, "first batch", code, res, 1, "one", "two")
+
+	// The response was lost, so the client polls again without acknowledging it
+	sendText(c, "three")
+	code, res = poll(t, http.MethodGet, session+"&ack=0")
+	expectPoll(t, "resent batch", code, res, 1, "one", "two")
+
+	code, res = poll(t, http.MethodGet, session+"&ack=1")
+	expectPoll(t, "next batch", code, res, 2, "three")
+	code, res = poll(t, http.MethodGet, session+"&ack=2")
+	expectPoll(t, "empty poll", code, res, 2)
+
+	for _, ack := range []string{"1", "3", "x"} {
+		if code, _ := poll(t, http.MethodGet, session+"&ack="+ack); code != http.StatusBadRequest {
+			t.Errorf("ack=%s: status %d, want %d", ack, code, http.StatusBadRequest)
+		}
+	}
+
+	// Polls without ack acknowledge each batch as it is sent
+	sendText(c, "four")
+	code, res = poll(t, http.MethodGet, session)
+	expectPoll(t, "poll without ack", code, res, 3, "four")
+	sendText(c, "five")
+	code, res = poll(t, http.MethodGet, session)
+	expectPoll(t, "second poll without ack", code, res, 4, "five")
+
+	// The last batch of a closed session can be fetched again until the session ends
+	sendText(c, "six")
+	c.close(websocket.ClosePolicyViolation, "Replaced by a new connection")
+	for i, ack := range []string{"4", "4", "5"} {
+		code, res = poll(t, http.MethodGet, session+"&ack="+ack)
+		want := []string{"six"}
+		if ack == "5" {
+			want = nil
+		}
+		expectPoll(t, "closing batch "+strconv.Itoa(i), code, res, 5, want...)
+		if res.Close == nil || res.Close.Code != websocket.ClosePolicyViolation {
+			t.Fatalf("closing batch %d: close = %+v, want code %d", i, res.Close, websocket.ClosePolicyViolation)
+		}
+	}
+	if _, ok := wsconns[userID]; ok {
+		t.Error("closed session is still registered")
+	}
+
+	if code, _ := poll(t, http.MethodDelete, session); code != http.StatusNoContent {
+		t.Fatalf("closing the session: status %d", code)
+	}
+	if code, _ := poll(t, http.MethodGet, session+"&ack=5"); code != http.StatusNotFound {
+		t.Errorf("poll after the session ended: status %d, want %d", code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A generated certificate with its key, PEM encoded
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// Generates a certificate for the name, signed by parent or self-signed when parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// Writes the certificate and key to the files, dated mtime
+func (c *testCert) write(t *testing.T, certFile, keyFile string, mtime time.Time) {
+	t.Helper()
+	for name, data := range map[string][]byte{certFile: c.certPEM, keyFile: c.keyPEM} {
+		if err := os.WriteFile(name, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// Returns the serial of the certificate the reloader hands out
+func servedSerial(t *testing.T, r *certReloader) *big.Int {
+	t.Helper()
+	cert, err := r.getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	first := newTestCert(t, "localhost", nil, false)
+	first.write(t, certFile, keyFile, time.Now().Add(-time.Minute))
+
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedSerial(t, r); got.Cmp(first.cert.SerialNumber) != 0 {
+		t.Fatalf("serving certificate %v, want %v", got, first.cert.SerialNumber)
+	}
+
+	// A renewed certificate is noticed by its files' modification time and swapped in
+	renewed := newTestCert(t, "localhost", nil, false)
+	renewed.write(t, certFile, keyFile, time.Now())
+	modTime, err := r.latestModTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modTime.After(r.modTime) {
+		t.Fatalf("modification time %v isn't after %v, so the change wouldn't be noticed", modTime, r.modTime)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedSerial(t, r); got.Cmp(renewed.cert.SerialNumber) != 0 {
+		t.Fatalf("serving certificate %v after reloading, want %v", got, renewed.cert.SerialNumber)
+	}
+
+	// A broken certificate is rejected and the current one stays in use
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reload(); err == nil {
+		t.Fatal("reloading a broken certificate succeeded")
+	}
+	if got := servedSerial(t, r); got.Cmp(renewed.cert.SerialNumber) != 0 {
+		t.Fatalf("serving certificate %v after a failed reload, want %v", got, renewed.cert.SerialNumber)
+	}
+}
+
+func TestServerTLSClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "GoChat test CA", nil, true)
+	server := newTestCert(t, "localhost", ca, false)
+	trusted := newTestCert(t, "alice", ca, false)
+	untrusted := newTestCert(t, "mallory", nil, false)
+
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	server.write(t, certFile, keyFile, time.Now())
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, ca.certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, tc := range []struct {
+		name    string
+		require bool
+		client  *testCert
+		ok      bool
+	}{
+		{"required, trusted", true, trusted, true},
+		{"required, none", true, nil, false},
+		{"required, untrusted", true, untrusted, false},
+		{"optional, trusted", false, trusted, true},
+		{"optional, none", false, nil, true},
+		{"optional, untrusted", false, untrusted, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsConfig, err := serverTLSConfig(TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, RequireClientCert: tc.require}, reloader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			srv.TLS = tlsConfig
+			srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+			srv.StartTLS()
+			defer srv.Close()
+
+			clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if tc.client != nil {
+				// Always present it, since Go clients otherwise only send certificates from the CAs the server asks for
+				cert := tc.client.tlsCertificate(t)
+				clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return &cert, nil
+				}
+			}
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			resp, err := c.Get(srv.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tc.ok && err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("request succeeded, want the handshake to fail")
+			}
+		})
+	}
+
+	if _, err := serverTLSConfig(TLSConfig{ClientCAFile: certFile + ".missing"}, reloader); err == nil {
+		t.Error("a missing client CA file was accepted")
+	}
+	if _, err := serverTLSConfig(TLSConfig{ClientCAFile: keyFile}, reloader); err == nil {
+		t.Error("a client CA file without certificates was accepted")
+	}
+}
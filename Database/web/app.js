@@ -0,0 +1,397 @@
+// Browser client for GoChat. Uses the same REST and websocket API as the Go client.
+(function () {
+  "use strict";
+
+  // Number of messages loaded per page of history
+  const PAGE_SIZE = 50;
+
+  const state = {
+    user: null,       // {name, userID}
+    socket: null,
+    current: null,    // name of the room being shown
+    joined: [],       // names of joined rooms
+    messages: {},     // room name -> messages, oldest first
+    unread: {},       // room name -> unread count
+    hasOlder: {},     // room name -> whether older history may exist
+    reconnectDelay: 1000,
+    useStream: false, // whether to connect with an event stream instead of a websocket
+  };
+
+  const $ = (id) => document.getElementById(id);
+
+  // Calls the REST API and throws the server's error message on failure
+  async function api(method, path, { body, headers } = {}) {
+    const opts = { method, headers: Object.assign({}, headers) };
+    if (body !== undefined) {
+      opts.body = JSON.stringify(body);
+      opts.headers["Content-Type"] = "application/json";
+    }
+    const resp = await fetch(path, opts);
+    const text = await resp.text();
+    let data = null;
+    if (text) {
+      try {
+        data = JSON.parse(text);
+      } catch (e) {
+        data = text;
+      }
+    }
+    if (!resp.ok) {
+      const err = new Error(data && data.error ? data.error.message : resp.statusText);
+      err.code = data && data.error ? data.error.code : "http_error";
+      throw err;
+    }
+    return data;
+  }
+
+  // Logs in as an existing user, or creates the user if the name is new
+  async function login(name) {
+    try {
+      return await api("GET", "/chat/user/" + encodeURIComponent(name));
+    } catch (err) {
+      if (err.code !== "user_not_found") {
+        throw err;
+      }
+    }
+    return api("POST", "/chat/user/new", { body: { name } });
+  }
+
+  function roomHeaders(room) {
+    return { "User-Name": state.user.name, "Room-Name": room };
+  }
+
+  function showError(message) {
+    $("chat-error").textContent = message || "";
+  }
+
+  // Opens the websocket, or an event stream when the last websocket never opened because something
+  // blocks it, and reconnects with backoff when it drops
+  function connect() {
+    if (state.useStream) {
+      connectStream();
+      return;
+    }
+    const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+    const socket = new WebSocket(`${scheme}//${location.host}/chat/sockets/connect?user-id=${state.user.userID}`);
+    state.socket = socket;
+    let opened = false;
+
+    socket.onopen = () => {
+      opened = true;
+      state.reconnectDelay = 1000;
+      setConnected(true);
+    };
+    socket.onmessage = (event) => handleData(event.data);
+    socket.onclose = () => {
+      setConnected(false);
+      if (state.socket === socket) {
+        state.useStream = !opened;
+        reconnect();
+      }
+    };
+  }
+
+  // Receives the same messages as server-sent events. EventSource would reconnect on its own, but
+  // going through connect keeps the backoff and lets a websocket be tried again.
+  function connectStream() {
+    const source = new EventSource(`/chat/events/stream?user-id=${state.user.userID}`);
+    state.socket = source;
+    let opened = false;
+
+    source.onopen = () => {
+      opened = true;
+      state.reconnectDelay = 1000;
+      setConnected(true);
+    };
+    source.addEventListener("message", (event) => handleData(event.data));
+    const drop = () => {
+      source.close();
+      setConnected(false);
+      if (state.socket === source) {
+        state.useStream = opened;
+        reconnect();
+      }
+    };
+    // The server sends a close event before ending the stream
+    source.addEventListener("close", drop);
+    source.onerror = drop;
+  }
+
+  function reconnect() {
+    setTimeout(connect, state.reconnectDelay);
+    state.reconnectDelay = Math.min(state.reconnectDelay * 2, 30000);
+  }
+
+  function handleData(data) {
+    let msg;
+    try {
+      msg = JSON.parse(data);
+    } catch (e) {
+      return;
+    }
+    if (msg && msg.roomName && msg.sender) {
+      receive(msg);
+    }
+  }
+
+  function setConnected(online) {
+    const el = $("connection");
+    el.textContent = online ? "online" : "offline";
+    el.classList.toggle("online", online);
+  }
+
+  // Handles a live message from the websocket or event stream
+  function receive(msg) {
+    const room = msg.roomName;
+    if (!state.joined.includes(room)) {
+      return;
+    }
+    (state.messages[room] = state.messages[room] || []).push(msg);
+    if (room === state.current) {
+      appendMessage(msg, true);
+    } else {
+      state.unread[room] = (state.unread[room] || 0) + 1;
+      renderRooms();
+    }
+  }
+
+  async function joinRoom(room) {
+    await api("POST", "/chat/room/join", { headers: roomHeaders(room) });
+    if (!state.joined.includes(room)) {
+      state.joined.push(room);
+      saveRooms();
+    }
+    await selectRoom(room);
+    refreshAllRooms();
+  }
+
+  async function leaveRoom(room) {
+    await api("DELETE", "/chat/room/leave", { headers: roomHeaders(room) });
+    state.joined = state.joined.filter((r) => r !== room);
+    delete state.messages[room];
+    delete state.unread[room];
+    saveRooms();
+    if (state.current === room) {
+      state.current = null;
+      if (state.joined.length > 0) {
+        await selectRoom(state.joined[0]);
+        return;
+      }
+      renderRoom();
+    }
+    renderRooms();
+  }
+
+  async function selectRoom(room) {
+    state.current = room;
+    state.unread[room] = 0;
+    if (!state.messages[room]) {
+      state.messages[room] = [];
+      state.hasOlder[room] = true;
+      await loadOlder(room);
+    }
+    renderRooms();
+    renderRoom();
+    refreshMembers();
+  }
+
+  // Loads the page of history before the oldest message we have
+  async function loadOlder(room) {
+    const messages = state.messages[room];
+    let path = `/chat/room/${encodeURIComponent(room)}?limit=${PAGE_SIZE}`;
+    if (messages.length > 0) {
+      path += `&before=${messages[0].epoch}`;
+    }
+    const data = await api("GET", path);
+    const page = (data && data.messages) || [];
+    state.messages[room] = page.concat(messages);
+    state.hasOlder[room] = page.length === PAGE_SIZE;
+  }
+
+  async function sendMessage(text) {
+    const msg = { sender: state.user.name, roomName: state.current, messageText: text };
+    if (state.socket instanceof WebSocket && state.socket.readyState === WebSocket.OPEN) {
+      state.socket.send(JSON.stringify(msg));
+      return;
+    }
+    await api("POST", "/chat/postmsg", { body: msg });
+  }
+
+  async function refreshMembers() {
+    const list = $("member-list");
+    if (!state.current) {
+      list.replaceChildren();
+      return;
+    }
+    const room = state.current;
+    try {
+      const data = await api("GET", `/chat/room/${encodeURIComponent(room)}/members`);
+      if (room !== state.current) {
+        return;
+      }
+      list.replaceChildren(...data.members.map((name) => li(name)));
+    } catch (err) {
+      list.replaceChildren();
+    }
+  }
+
+  async function refreshAllRooms() {
+    try {
+      const data = await api("GET", "/chat/rooms");
+      $("all-rooms").replaceChildren(...data.rooms.map((room) => {
+        const item = li(room);
+        item.onclick = () => joinRoom(room).catch((err) => showError(err.message));
+        return item;
+      }));
+    } catch (err) {
+      showError(err.message);
+    }
+  }
+
+  function li(text) {
+    const item = document.createElement("li");
+    item.textContent = text;
+    return item;
+  }
+
+  function renderRooms() {
+    $("joined-rooms").replaceChildren(...state.joined.map((room) => {
+      const item = li(room);
+      item.classList.toggle("active", room === state.current);
+      const unread = state.unread[room] || 0;
+      if (unread > 0) {
+        const badge = document.createElement("span");
+        badge.className = "badge";
+        badge.textContent = unread;
+        item.appendChild(badge);
+      }
+      item.onclick = () => selectRoom(room).catch((err) => showError(err.message));
+      return item;
+    }));
+  }
+
+  function renderRoom() {
+    const room = state.current;
+    $("room-title").textContent = room || "No room selected";
+    $("leave").hidden = !room;
+    $("load-older").hidden = !room || !state.hasOlder[room];
+    $("composer-text").disabled = !room;
+    $("composer").querySelector("button").disabled = !room;
+    $("message-list").replaceChildren();
+    if (room) {
+      state.messages[room].forEach((msg) => appendMessage(msg, false));
+      scrollToBottom();
+    }
+  }
+
+  function appendMessage(msg, scroll) {
+    const box = $("messages");
+    const atBottom = box.scrollHeight - box.scrollTop - box.clientHeight < 40;
+
+    const item = document.createElement("li");
+    const time = document.createElement("span");
+    time.className = "time";
+    const sent = msg.epoch ? new Date(msg.epoch * 1000) : new Date();
+    time.textContent = sent.toLocaleString();
+    const sender = document.createElement("span");
+    sender.className = "sender";
+    sender.textContent = msg.sender;
+    const text = document.createElement("span");
+    text.textContent = msg.messageText;
+    item.append(time, sender, text);
+    $("message-list").appendChild(item);
+
+    if (scroll && atBottom) {
+      scrollToBottom();
+    }
+  }
+
+  function scrollToBottom() {
+    const box = $("messages");
+    box.scrollTop = box.scrollHeight;
+  }
+
+  // Joined rooms are remembered per user between visits
+  function saveRooms() {
+    localStorage.setItem("gochat.rooms." + state.user.name, JSON.stringify(state.joined));
+  }
+
+  function savedRooms() {
+    try {
+      return JSON.parse(localStorage.getItem("gochat.rooms." + state.user.name)) || [];
+    } catch (e) {
+      return [];
+    }
+  }
+
+  $("login-form").onsubmit = async (event) => {
+    event.preventDefault();
+    const name = $("login-name").value.trim();
+    if (!name) {
+      return;
+    }
+    try {
+      state.user = await login(name);
+    } catch (err) {
+      $("login-error").textContent = err.message;
+      return;
+    }
+    localStorage.setItem("gochat.user", state.user.name);
+    $("login").hidden = true;
+    $("chat").hidden = false;
+    $("user-name").textContent = state.user.name;
+    connect();
+    refreshAllRooms();
+    for (const room of savedRooms()) {
+      try {
+        await joinRoom(room);
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+    setInterval(refreshMembers, 5000);
+  };
+
+  $("join-form").onsubmit = (event) => {
+    event.preventDefault();
+    const room = $("join-name").value.trim();
+    if (!room) {
+      return;
+    }
+    $("join-name").value = "";
+    joinRoom(room).then(() => showError(""), (err) => showError(err.message));
+  };
+
+  $("leave").onclick = () => {
+    leaveRoom(state.current).catch((err) => showError(err.message));
+  };
+
+  $("load-older").onclick = async () => {
+    const room = state.current;
+    const box = $("messages");
+    const fromBottom = box.scrollHeight - box.scrollTop;
+    try {
+      await loadOlder(room);
+    } catch (err) {
+      showError(err.message);
+      return;
+    }
+    if (room === state.current) {
+      renderRoom();
+      box.scrollTop = box.scrollHeight - fromBottom;
+    }
+  };
+
+  $("composer").onsubmit = (event) => {
+    event.preventDefault();
+    const input = $("composer-text");
+    const text = input.value.trim();
+    if (!text || !state.current) {
+      return;
+    }
+    input.value = "";
+    sendMessage(text).then(() => showError(""), (err) => showError(err.message));
+  };
+
+  $("login-name").value = localStorage.getItem("gochat.user") || "";
+})();
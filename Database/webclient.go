@@ -0,0 +1,26 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Static files for the browser client
+//
+//go:embed web
+var webFiles embed.FS
+
+// Serves the browser client's index page at / and its assets under /static/
+func registerWebClient(router *mux.Router) {
+	static, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(static))
+
+	router.Handle("/", fileServer).Methods("GET")
+	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", fileServer)).Methods("GET")
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Room events a webhook can subscribe to
+const (
+	EventMessage = "message"
+	EventJoin    = "join"
+	EventLeave   = "leave"
+)
+
+var webhookEvents = []string{EventMessage, EventJoin, EventLeave}
+
+// Headers sent with every delivery. The signature is "sha256=" followed by the hex HMAC-SHA256
+// of the timestamp, a dot and the body, keyed with the webhook's secret.
+const (
+	headerWebhookEvent     = "X-GoChat-Event"
+	headerWebhookDelivery  = "X-GoChat-Delivery"
+	headerWebhookTimestamp = "X-GoChat-Timestamp"
+	headerWebhookSignature = "X-GoChat-Signature"
+)
+
+// An HTTP endpoint that receives a room's events. The secret is only returned when it is created.
+type Webhook struct {
+	ID        int      `json:"id"`
+	Room      string   `json:"room"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedBy string   `json:"createdBy"`
+	Created   int64    `json:"created"`
+}
+
+// Request body for registering a webhook. Events defaults to all events.
+type NewWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// JSON body posted to a webhook
+type WebhookPayload struct {
+	DeliveryID string   `json:"deliveryID"`
+	Event      string   `json:"event"`
+	Room       string   `json:"room"`
+	User       string   `json:"user"`
+	Epoch      int64    `json:"epoch"`
+	Message    *Message `json:"message,omitempty"`
+}
+
+// A single attempt to deliver an event
+type WebhookDelivery struct {
+	DeliveryID string `json:"deliveryID"`
+	Event      string `json:"event"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"statusCode"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"durationMs"`
+	Epoch      int64  `json:"epoch"`
+}
+
+// An event that was given up on after every attempt failed
+type DeadLetter struct {
+	DeliveryID string          `json:"deliveryID"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	Error      string          `json:"error"`
+	Epoch      int64           `json:"epoch"`
+}
+
+type WebhooksResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+type DeliveriesResponse struct {
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+type DeadLettersResponse struct {
+	DeadLetters []DeadLetter `json:"deadLetters"`
+}
+
+// A payload waiting to be delivered to one webhook
+type webhookJob struct {
+	webhookID  int
+	url        string
+	secret     string
+	deliveryID string
+	event      string
+	payload    []byte
+	attempt    int
+}
+
+var (
+	webhookQueue   chan webhookJob
+	webhookQuit    chan struct{}
+	webhookWorkers sync.WaitGroup
+	webhookClient  *http.Client
+)
+
+// A failed delivery waiting out its backoff before the next attempt
+type webhookRetry struct {
+	job     webhookJob
+	errText string
+	timer   *time.Timer
+}
+
+var (
+	// Retries waiting for their timer, by delivery ID. Removed when the timer fires, or when the
+	// workers stop and the retry is dead-lettered instead.
+	webhookRetries   = make(map[string]*webhookRetry)
+	webhookRetriesMu sync.Mutex
+)
+
+// Starts the workers that deliver webhook payloads
+func startWebhooks() {
+	webhookQueue = make(chan webhookJob, config.Webhooks.QueueSize)
+	webhookQuit = make(chan struct{})
+	webhookClient = &http.Client{Timeout: config.Webhooks.Timeout}
+	for i := 0; i < config.Webhooks.Workers; i++ {
+		webhookWorkers.Add(1)
+		go webhookWorker()
+	}
+}
+
+// Stops the workers, waiting for deliveries in progress until ctx is done. Queued deliveries and
+// pending retries are dead-lettered, so every event ends up either delivered or dead-lettered.
+func stopWebhooks(ctx context.Context) {
+	webhookRetriesMu.Lock()
+	close(webhookQuit)
+	retries := webhookRetries
+	webhookRetries = make(map[string]*webhookRetry)
+	webhookRetriesMu.Unlock()
+	for _, retry := range retries {
+		retry.timer.Stop()
+		deadLetterWebhook(retry.job, retry.job.attempt, "server stopped before retrying: "+retry.errText)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		webhookWorkers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Timed out waiting for webhook deliveries to finish")
+	}
+	for {
+		select {
+		case job := <-webhookQueue:
+			deadLetterWebhook(job, job.attempt-1, "server stopped before delivering")
+		default:
+			return
+		}
+	}
+}
+
+func webhookWorker() {
+	trackWebhookWorker(1)
+	defer trackWebhookWorker(-1)
+	defer webhookWorkers.Done()
+	for {
+		select {
+		case <-webhookQuit:
+			return
+		case job := <-webhookQueue:
+			deliverWebhook(job)
+		}
+	}
+}
+
+// Queues a job without blocking the caller. A full queue counts as a failed attempt.
+func enqueueWebhook(job webhookJob) {
+	select {
+	case <-webhookQuit:
+		deadLetterWebhook(job, job.attempt-1, "server stopped before delivering")
+		return
+	default:
+	}
+	select {
+	case webhookQueue <- job:
+	default:
+		recordDelivery(job, 0, "delivery queue is full", 0)
+		retryWebhook(job, "delivery queue is full")
+	}
+}
+
+// Sends the event to every webhook in the room subscribed to it
+func emitRoomEvent(roomID int, room, event, user string, msg *Message) {
+	rows, err := db.Query("SELECT WebhookID, URL, Secret, Events FROM Webhooks WHERE RoomID = ?", roomID)
+	if err != nil {
+		slog.Error("Error loading webhooks", "room", room, "err", err)
+		return
+	}
+	defer rows.Close()
+
+	epoch := time.Now().Unix()
+	if msg != nil && msg.Epoch != nil {
+		epoch = *msg.Epoch
+	}
+	for rows.Next() {
+		var job webhookJob
+		var events string
+		if err := rows.Scan(&job.webhookID, &job.url, &job.secret, &events); err != nil {
+			slog.Error("Error loading webhooks", "room", room, "err", err)
+			return
+		}
+		if !containsString(strings.Split(events, ","), event) {
+			continue
+		}
+		job.deliveryID = randomHex(16)
+		job.event = event
+		job.attempt = 1
+		job.payload, err = json.Marshal(WebhookPayload{
+			DeliveryID: job.deliveryID,
+			Event:      event,
+			Room:       room,
+			User:       user,
+			Epoch:      epoch,
+			Message:    msg,
+		})
+		if err != nil {
+			slog.Error("Error encoding webhook payload", "webhook_id", job.webhookID, "err", err)
+			continue
+		}
+		enqueueWebhook(job)
+	}
+}
+
+// Posts the payload and records the attempt, scheduling a retry if it failed. Jobs for a webhook
+// deleted since they were queued are dropped.
+func deliverWebhook(job webhookJob) {
+	if !webhookExists(job.webhookID) {
+		slog.Info("Dropping delivery for deleted webhook", "webhook_id", job.webhookID, "delivery_id", job.deliveryID)
+		return
+	}
+	start := time.Now()
+	status, err := postWebhook(job)
+	duration := time.Since(start)
+
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+	} else if status < 200 || status > 299 {
+		errText = fmt.Sprintf("unexpected status %d", status)
+	}
+	recordDelivery(job, status, errText, duration)
+	if errText != "" {
+		retryWebhook(job, errText)
+	}
+}
+
+func postWebhook(job webhookJob) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, job.url, bytes.NewReader(job.payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoChat-Webhook")
+	req.Header.Set(headerWebhookEvent, job.event)
+	req.Header.Set(headerWebhookDelivery, job.deliveryID)
+	req.Header.Set(headerWebhookTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(headerWebhookSignature, signWebhook(job.secret, timestamp, job.payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	return resp.StatusCode, nil
+}
+
+// Returns the signature header value for a payload
+func signWebhook(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Schedules the next attempt with exponential backoff, or dead-letters the job once it has used
+// all its attempts
+func retryWebhook(job webhookJob, errText string) {
+	if job.attempt >= config.Webhooks.MaxAttempts {
+		deadLetterWebhook(job, job.attempt, errText)
+		return
+	}
+	webhookRetriesMu.Lock()
+	defer webhookRetriesMu.Unlock()
+	select {
+	case <-webhookQuit:
+		deadLetterWebhook(job, job.attempt, "server stopped before retrying: "+errText)
+		return
+	default:
+	}
+	delay := config.Webhooks.Backoff << (job.attempt - 1)
+	webhookRetries[job.deliveryID] = &webhookRetry{job: job, errText: errText, timer: time.AfterFunc(delay, func() {
+		webhookRetriesMu.Lock()
+		_, pending := webhookRetries[job.deliveryID]
+		delete(webhookRetries, job.deliveryID)
+		webhookRetriesMu.Unlock()
+		// Stopping the workers dead-letters the retry if it gets there first
+		if pending {
+			job.attempt++
+			enqueueWebhook(job)
+		}
+	})}
+}
+
+// Records that the job won't be delivered, after the given number of attempts. Nothing is
+// recorded for a webhook that has been deleted.
+func deadLetterWebhook(job webhookJob, attempts int, errText string) {
+	if !webhookExists(job.webhookID) {
+		return
+	}
+	_, err := db.Exec("INSERT INTO WebhookDeadLetters (DeliveryID, WebhookID, Event, Payload, Attempts, Error, Epoch) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		job.deliveryID, job.webhookID, job.event, string(job.payload), attempts, errText, time.Now().Unix())
+	if err != nil {
+		slog.Error("Error saving dead letter", "webhook_id", job.webhookID, "delivery_id", job.deliveryID, "err", err)
+	}
+	slog.Warn("Giving up on webhook delivery", "webhook_id", job.webhookID, "delivery_id", job.deliveryID, "attempts", attempts, "err", errText)
+}
+
+// Reports whether the webhook is still registered. Errors count as registered, so a failing
+// database doesn't silently drop deliveries.
+func webhookExists(webhookID int) bool {
+	err := db.QueryRow("SELECT WebhookID FROM Webhooks WHERE WebhookID = ?", webhookID).Scan(&webhookID)
+	if err != nil && err != sql.ErrNoRows {
+		slog.Error("Error loading webhook", "webhook_id", webhookID, "err", err)
+	}
+	return err != sql.ErrNoRows
+}
+
+func recordDelivery(job webhookJob, status int, errText string, duration time.Duration) {
+	_, err := db.Exec("INSERT INTO WebhookDeliveries (DeliveryID, WebhookID, Event, Attempt, StatusCode, Error, Duration, Epoch) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		job.deliveryID, job.webhookID, job.event, job.attempt, status, errText, duration.Milliseconds(), time.Now().Unix())
+	if err != nil {
+		slog.Error("Error recording webhook delivery", "webhook_id", job.webhookID, "delivery_id", job.deliveryID, "err", err)
+	}
+}
+
+// Checks that the User-Name header names the owner of the room. Rooms without an owner, e.g. ones
+// created before owners existed or whose owner was deleted, can't be managed until an administrator
+// assigns one. Writes an error response and returns false if not.
+func requireRoomOwner(w http.ResponseWriter, r *http.Request, room string) (int, string, bool) {
+	user := r.Header.Get("User-Name")
+	if !userExists(user) {
+		writeError(w, http.StatusBadRequest, ErrCodeUserNotFound, "Invalid user name supplied \"%s\": A user with this name does not exist", user)
+		return 0, "", false
+	}
+	roomID, err := getRoomID(room)
+	if err != nil {
+		writeError(w, http.StatusNotFound, ErrCodeRoomNotFound, "Invalid room name supplied \"%s\": A room with this name does not exist", room)
+		return 0, "", false
+	}
+	var owner sql.NullString
+	if err := db.QueryRow("SELECT Owner FROM Rooms WHERE RoomID = ?", roomID).Scan(&owner); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return 0, "", false
+	}
+	if !owner.Valid {
+		writeError(w, http.StatusForbidden, ErrCodeForbidden, "Room \"%s\" has no owner: an administrator must assign one before its settings can be changed", room)
+		return 0, "", false
+	}
+	if owner.String != user {
+		writeError(w, http.StatusForbidden, ErrCodeForbidden, "Only the owner of room \"%s\" can change its settings", room)
+		return 0, "", false
+	}
+	return roomID, user, true
+}
+
+// Handles registering a webhook for a room
+func newWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	roomID, user, ok := requireRoomOwner(w, r, room)
+	if !ok {
+		return
+	}
+
+	var req NewWebhookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid request body: %v", err)
+		return
+	}
+	u, err := neturl.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid url supplied \"%s\": must be an absolute http or https URL", req.URL)
+		return
+	}
+	if len(req.Events) == 0 {
+		req.Events = webhookEvents
+	}
+	for _, event := range req.Events {
+		if !containsString(webhookEvents, event) {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid event supplied \"%s\": must be one of %s", event, strings.Join(webhookEvents, ", "))
+			return
+		}
+	}
+
+	hook := Webhook{
+		Room:      room,
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    randomHex(32),
+		CreatedBy: user,
+		Created:   time.Now().Unix(),
+	}
+	err = db.QueryRow("INSERT INTO Webhooks (RoomID, URL, Secret, Events, CreatedBy, Created) VALUES (?, ?, ?, ?, ?, ?) RETURNING WebhookID",
+		roomID, hook.URL, hook.Secret, strings.Join(hook.Events, ","), hook.CreatedBy, hook.Created).Scan(&hook.ID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// Handles listing a room's webhooks
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	room := mux.Vars(r)["room"]
+	roomID, _, ok := requireRoomOwner(w, r, room)
+	if !ok {
+		return
+	}
+	rows, err := db.Query("SELECT WebhookID, URL, Events, CreatedBy, Created FROM Webhooks WHERE RoomID = ? ORDER BY WebhookID", roomID)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	hooks := make([]Webhook, 0)
+	for rows.Next() {
+		hook := Webhook{Room: room}
+		var events string
+		if err := rows.Scan(&hook.ID, &hook.URL, &events, &hook.CreatedBy, &hook.Created); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		hook.Events = strings.Split(events, ",")
+		hooks = append(hooks, hook)
+	}
+	if err := rows.Err(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, WebhooksResponse{Webhooks: hooks})
+}
+
+// Handles removing a webhook
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	roomID, hookID, ok := requireWebhook(w, r)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM Webhooks WHERE WebhookID = ? AND RoomID = ?", hookID, roomID); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles the delivery log for a webhook, newest first. ?limit= caps the number of entries.
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	_, hookID, ok := requireWebhook(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	rows, err := db.Query("SELECT DeliveryID, Event, Attempt, StatusCode, Error, Duration, Epoch FROM WebhookDeliveries WHERE WebhookID = ? ORDER BY Epoch DESC, rowid DESC LIMIT ?", hookID, limit)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	deliveries := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.DeliveryID, &d.Event, &d.Attempt, &d.StatusCode, &d.Error, &d.DurationMS, &d.Epoch); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, DeliveriesResponse{Deliveries: deliveries})
+}
+
+// Handles listing the events a webhook gave up on, newest first
+func webhookDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	_, hookID, ok := requireWebhook(w, r)
+	if !ok {
+		return
+	}
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	rows, err := db.Query("SELECT DeliveryID, Event, Payload, Attempts, Error, Epoch FROM WebhookDeadLetters WHERE WebhookID = ? ORDER BY Epoch DESC, rowid DESC LIMIT ?", hookID, limit)
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+	letters := make([]DeadLetter, 0)
+	for rows.Next() {
+		var d DeadLetter
+		var payload string
+		if err := rows.Scan(&d.DeliveryID, &d.Event, &payload, &d.Attempts, &d.Error, &d.Epoch); err != nil {
+			writeErr(w, http.StatusInternalServerError, err)
+			return
+		}
+		d.Payload = json.RawMessage(payload)
+		letters = append(letters, d)
+	}
+	if err := rows.Err(); err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, DeadLettersResponse{DeadLetters: letters})
+}
+
+// Checks the caller owns the room and the webhook in the URL belongs to it
+func requireWebhook(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	vars := mux.Vars(r)
+	roomID, _, ok := requireRoomOwner(w, r, vars["room"])
+	if !ok {
+		return 0, 0, false
+	}
+	hookID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid webhook id supplied \"%s\": must be an integer", vars["id"])
+		return 0, 0, false
+	}
+	var found int
+	err = db.QueryRow("SELECT WebhookID FROM Webhooks WHERE WebhookID = ? AND RoomID = ?", hookID, roomID).Scan(&found)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, ErrCodeNotFound, "Webhook %d does not exist in room \"%s\"", hookID, vars["room"])
+		return 0, 0, false
+	}
+	if err != nil {
+		writeErr(w, http.StatusInternalServerError, err)
+		return 0, 0, false
+	}
+	return roomID, hookID, true
+}
+
+// Reads the optional ?limit= query parameter, defaulting to 50
+func limitParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidParam, "Invalid limit supplied \"%s\": must be a positive integer", v)
+			return 0, false
+		}
+		limit = n
+	}
+	return limit, true
+}
+
+// Returns n random bytes as a hex string
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
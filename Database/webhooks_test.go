@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Registers a webhook for the room posting to url and returns its ID
+func createTestWebhook(t *testing.T, roomID int, url string) int {
+	t.Helper()
+	var hookID int
+	err := db.QueryRow("INSERT INTO Webhooks (RoomID, URL, Secret, Events, CreatedBy, Created) VALUES (?, ?, ?, ?, ?, ?) RETURNING WebhookID",
+		roomID, url, "secret", strings.Join(webhookEvents, ","), "alice", time.Now().Unix()).Scan(&hookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hookID
+}
+
+// Returns the number of rows in table for the webhook
+func countWebhookRows(t *testing.T, table string, hookID int) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE WebhookID = ?", hookID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Retries still waiting when the workers stop are dead-lettered, unless their webhook is gone
+func TestWebhookRetriesDeadLetteredOnStop(t *testing.T) {
+	openTestDatabase(t, "-webhooks-backoff", "1h")
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer endpoint.Close()
+	roomID := createTestRoom(t, "lobby")
+	kept := createTestWebhook(t, roomID, endpoint.URL)
+	deleted := createTestWebhook(t, roomID, endpoint.URL)
+
+	startWebhooks()
+	emitRoomEvent(roomID, "lobby", EventJoin, "alice", nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for countWebhookRows(t, "WebhookDeliveries", kept)+countWebhookRows(t, "WebhookDeliveries", deleted) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first attempts weren't recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The delivery is recorded before its retry is scheduled
+	for {
+		webhookRetriesMu.Lock()
+		n := len(webhookRetries)
+		webhookRetriesMu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d retries pending, want 2", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := db.Exec("DELETE FROM Webhooks WHERE WebhookID = ?", deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	stopWebhooks(context.Background())
+	var attempts int
+	var errText string
+	if err := db.QueryRow("SELECT Attempts, Error FROM WebhookDeadLetters WHERE WebhookID = ?", kept).Scan(&attempts, &errText); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 || !strings.HasPrefix(errText, "server stopped before retrying") {
+		t.Errorf("dead letter has %d attempts and error %q, want 1 attempt and the server stopping", attempts, errText)
+	}
+	if n := countWebhookRows(t, "WebhookDeadLetters", deleted); n != 0 {
+		t.Errorf("%d dead letters for the deleted webhook, want none", n)
+	}
+	if len(webhookRetries) != 0 {
+		t.Errorf("%d retries still pending after stopping", len(webhookRetries))
+	}
+}
+
+// A retry for a webhook deleted since the last attempt isn't delivered
+func TestWebhookDeletedBeforeRetry(t *testing.T) {
+	openTestDatabase(t)
+	var requests atomic.Int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer endpoint.Close()
+	roomID := createTestRoom(t, "lobby")
+	hookID := createTestWebhook(t, roomID, endpoint.URL)
+	if _, err := db.Exec("DELETE FROM Webhooks WHERE WebhookID = ?", hookID); err != nil {
+		t.Fatal(err)
+	}
+
+	startWebhooks()
+	defer stopWebhooks(context.Background())
+	deliverWebhook(webhookJob{webhookID: hookID, url: endpoint.URL, secret: "secret", deliveryID: "d", event: EventJoin, payload: []byte("{}"), attempt: 2})
+	if n := requests.Load(); n != 0 {
+		t.Errorf("deleted webhook got %d requests", n)
+	}
+	if n := countWebhookRows(t, "WebhookDeliveries", hookID); n != 0 {
+		t.Errorf("%d deliveries recorded for the deleted webhook", n)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Websocket subprotocols selecting a binary encoding. A client that asks for neither gets JSON
+// text frames holding bare messages. The binary encodings wrap each message in an envelope naming
+// the type of event, and clients post messages in the same envelope. wire.proto has the protobuf
+// schema. MessagePack encodes the same structures as arrays, with the fields in the order of
+// their numbers in wire.proto, so any change to them needs a new subprotocol.
+const (
+	subprotocolMsgpack  = "gochat.v1.msgpack"
+	subprotocolProtobuf = "gochat.v1.protobuf"
+)
+
+// Envelope type of a message posted to a room, the only type so far
+const envelopeMessage = "message"
+
+// Encodes the events written to a websocket and decodes the messages read from it
+type wireCodec interface {
+	// Name shown in /admin/connections
+	name() string
+	// websocket.TextMessage or websocket.BinaryMessage
+	frameType() int
+	encode(msg Message) ([]byte, error)
+	decode(data []byte) (Message, error)
+}
+
+// Codecs by the subprotocol that selects them
+var wireCodecs = map[string]wireCodec{
+	"":                  jsonCodec{},
+	subprotocolMsgpack:  msgpackCodec{},
+	subprotocolProtobuf: protobufCodec{},
+}
+
+// Subprotocols offered to clients, preferred first
+var wireSubprotocols = []string{subprotocolProtobuf, subprotocolMsgpack}
+
+// Returned for a binary frame on a connection using JSON
+var errFrameType = errors.New("unexpected binary frame")
+
+type jsonCodec struct{}
+
+func (jsonCodec) name() string {
+	return "json"
+}
+
+func (jsonCodec) frameType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) encode(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) decode(data []byte) (Message, error) {
+	var msg Message
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+type msgpackEnvelope struct {
+	Type    string   `json:"type"`
+	Message *Message `json:"message"`
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) frameType() int {
+	return websocket.BinaryMessage
+}
+
+// Fields without a json tag, or with "-", are left out of the arrays as they are from the JSON
+func (msgpackCodec) encode(msg Message) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseArrayEncodedStructs(true)
+	enc.UseCompactInts(true)
+	if err := enc.Encode(msgpackEnvelope{Type: envelopeMessage, Message: &msg}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) decode(data []byte) (Message, error) {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	var env msgpackEnvelope
+	if err := dec.Decode(&env); err != nil {
+		return Message{}, err
+	}
+	if env.Type != envelopeMessage || env.Message == nil {
+		return Message{}, fmt.Errorf("unsupported envelope type %q", env.Type)
+	}
+	return *env.Message, nil
+}
+
+// Field numbers from wire.proto
+const (
+	envelopeTypeField    protowire.Number = 1
+	envelopeMessageField protowire.Number = 2
+
+	messageSenderField     protowire.Number = 1
+	messageEpochField      protowire.Number = 2
+	messageTextField       protowire.Number = 3
+	messageRoomNameField   protowire.Number = 4
+	messageAttachmentField protowire.Number = 5
+
+	attachmentIDField          protowire.Number = 1
+	attachmentNameField        protowire.Number = 2
+	attachmentContentTypeField protowire.Number = 3
+	attachmentSizeField        protowire.Number = 4
+	attachmentWidthField       protowire.Number = 5
+	attachmentHeightField      protowire.Number = 6
+	attachmentThumbnailField   protowire.Number = 7
+)
+
+type protobufCodec struct{}
+
+func (protobufCodec) name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) frameType() int {
+	return websocket.BinaryMessage
+}
+
+func (protobufCodec) encode(msg Message) ([]byte, error) {
+	b := protowire.AppendTag(nil, envelopeTypeField, protowire.BytesType)
+	b = protowire.AppendString(b, envelopeMessage)
+	b = protowire.AppendTag(b, envelopeMessageField, protowire.BytesType)
+	return protowire.AppendBytes(b, appendProtoMessage(nil, msg)), nil
+}
+
+func appendProtoMessage(b []byte, msg Message) []byte {
+	b = appendProtoString(b, messageSenderField, msg.Sender)
+	if msg.Epoch != nil {
+		b = protowire.AppendTag(b, messageEpochField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*msg.Epoch))
+	}
+	b = appendProtoString(b, messageTextField, msg.MessageText)
+	b = appendProtoString(b, messageRoomNameField, msg.RoomName)
+	if att := msg.Attachment; att != nil {
+		var a []byte
+		if att.ID != "" {
+			a = appendProtoString(a, attachmentIDField, &att.ID)
+		}
+		if att.Name != "" {
+			a = appendProtoString(a, attachmentNameField, &att.Name)
+		}
+		if att.ContentType != "" {
+			a = appendProtoString(a, attachmentContentTypeField, &att.ContentType)
+		}
+		a = appendProtoVarint(a, attachmentSizeField, uint64(att.Size))
+		a = appendProtoVarint(a, attachmentWidthField, uint64(att.Width))
+		a = appendProtoVarint(a, attachmentHeightField, uint64(att.Height))
+		a = appendProtoVarint(a, attachmentThumbnailField, protowire.EncodeBool(att.Thumbnail))
+		b = protowire.AppendTag(b, messageAttachmentField, protowire.BytesType)
+		b = protowire.AppendBytes(b, a)
+	}
+	return b
+}
+
+// Appends a string field if s is set, even to "", so the decoder can tell it was set
+func appendProtoString(b []byte, num protowire.Number, s *string) []byte {
+	if s == nil {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, *s)
+}
+
+// Appends a varint field unless it is zero, which proto3 leaves out
+func appendProtoVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func (protobufCodec) decode(data []byte) (Message, error) {
+	var eventType string
+	var msg *Message
+	err := consumeProto(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == envelopeTypeField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			eventType = v
+			return n, nil
+		case num == envelopeMessageField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			m, err := decodeProtoMessage(v)
+			msg = &m
+			return n, err
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	if eventType != envelopeMessage || msg == nil {
+		return Message{}, fmt.Errorf("unsupported envelope type %q", eventType)
+	}
+	return *msg, nil
+}
+
+func decodeProtoMessage(data []byte) (Message, error) {
+	var msg Message
+	err := consumeProto(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == messageSenderField && typ == protowire.BytesType:
+			return consumeProtoString(b, &msg.Sender)
+		case num == messageEpochField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			epoch := int64(v)
+			msg.Epoch = &epoch
+			return n, nil
+		case num == messageTextField && typ == protowire.BytesType:
+			return consumeProtoString(b, &msg.MessageText)
+		case num == messageRoomNameField && typ == protowire.BytesType:
+			return consumeProtoString(b, &msg.RoomName)
+		case num == messageAttachmentField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			att, err := decodeProtoAttachment(v)
+			msg.Attachment = &att
+			return n, err
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return msg, err
+}
+
+func decodeProtoAttachment(data []byte) (Attachment, error) {
+	var att Attachment
+	err := consumeProto(data, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ == protowire.BytesType {
+			v, n := protowire.ConsumeString(b)
+			switch num {
+			case attachmentIDField:
+				att.ID = v
+			case attachmentNameField:
+				att.Name = v
+			case attachmentContentTypeField:
+				att.ContentType = v
+			}
+			return n, nil
+		}
+		if typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			switch num {
+			case attachmentSizeField:
+				att.Size = int64(v)
+			case attachmentWidthField:
+				att.Width = int(int32(v))
+			case attachmentHeightField:
+				att.Height = int(int32(v))
+			case attachmentThumbnailField:
+				att.Thumbnail = protowire.DecodeBool(v)
+			}
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return att, err
+}
+
+func consumeProtoString(b []byte, s **string) (int, error) {
+	v, n := protowire.ConsumeString(b)
+	*s = &v
+	return n, nil
+}
+
+// Calls field with the number, type and remaining bytes of each field in data. field returns how
+// many bytes the value took, negative for a protowire error, and skips fields it doesn't know.
+func consumeProto(data []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		n, err := field(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
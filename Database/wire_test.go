@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Frames of each fixture in each encoding. The client's tests check its codecs against the same
+// files, so the two stay able to read each other's frames.
+const wireGoldenDir = "testdata/wire"
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func int64Ptr(n int64) *int64 {
+	return &n
+}
+
+// Messages covering every field, set, unset and empty
+var wireFixtures = []struct {
+	name string
+	msg  Message
+}{
+	{"text", Message{Sender: strPtr("alice"), Epoch: int64Ptr(1704067200), MessageText: strPtr("hello, world"), RoomName: strPtr("lobby")}},
+	{"attachment", Message{Sender: strPtr("bob"), Epoch: int64Ptr(1704067201), MessageText: strPtr("see attached"), RoomName: strPtr("ops"),
+		Attachment: &Attachment{
+			ID:   "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			Name: "screenshot.png", ContentType: "image/png", Size: 123456, Width: 1280, Height: 720, Thumbnail: true,
+		}}},
+	// A message as a client posts it, without an epoch, and with text set but empty
+	{"posted", Message{Sender: strPtr("carol"), MessageText: strPtr(""), RoomName: strPtr("lobby")}},
+	{"unset", Message{}},
+	{"unicode", Message{Sender: strPtr("dörte"), Epoch: int64Ptr(1), MessageText: strPtr("héllo 👋 <b>\u2028\"quoted\"</b>"), RoomName: strPtr("café")}},
+}
+
+// Returns the codecs, JSON first
+func testCodecs() []wireCodec {
+	return []wireCodec{jsonCodec{}, msgpackCodec{}, protobufCodec{}}
+}
+
+func TestWireGolden(t *testing.T) {
+	for _, codec := range testCodecs() {
+		for _, fx := range wireFixtures {
+			path := filepath.Join(wireGoldenDir, fx.name+"."+codec.name())
+			data, err := codec.encode(fx.msg)
+			if err != nil {
+				t.Fatalf("%s: encoding %s: %v", codec.name(), fx.name, err)
+			}
+			if *update {
+				if err := os.MkdirAll(wireGoldenDir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(data, golden) {
+				t.Errorf("%s: encoded %s = %x, want %x from %s", codec.name(), fx.name, data, golden, path)
+			}
+			got, err := codec.decode(golden)
+			if err != nil {
+				t.Fatalf("%s: decoding %s: %v", codec.name(), path, err)
+			}
+			if !reflect.DeepEqual(got, fx.msg) {
+				t.Errorf("%s: decoded %s = %s, want %s", codec.name(), path, describe(got), describe(fx.msg))
+			}
+		}
+	}
+}
+
+// Formats a message with its pointers followed, for failures
+func describe(msg Message) string {
+	s := func(p *string) string {
+		if p == nil {
+			return "nil"
+		}
+		return fmt.Sprintf("%q", *p)
+	}
+	epoch := "nil"
+	if msg.Epoch != nil {
+		epoch = fmt.Sprint(*msg.Epoch)
+	}
+	return fmt.Sprintf("{sender %s epoch %s text %s room %s attachment %+v}", s(msg.Sender), epoch, s(msg.MessageText), s(msg.RoomName), msg.Attachment)
+}
+
+func TestWireDecodeErrors(t *testing.T) {
+	text := wireFixtures[0].msg
+	protoFrame, _ := protobufCodec{}.encode(text)
+	msgpackFrame, _ := msgpackCodec{}.encode(text)
+
+	for _, tc := range []struct {
+		name  string
+		codec wireCodec
+		data  []byte
+	}{
+		{"json truncated", jsonCodec{}, []byte(`{"sender":"alice"`)},
+		{"msgpack truncated", msgpackCodec{}, msgpackFrame[:len(msgpackFrame)-1]},
+		{"msgpack other type", msgpackCodec{}, bytes.Replace(msgpackFrame, []byte(envelopeMessage), []byte("receipt"), 1)},
+		{"protobuf truncated", protobufCodec{}, protoFrame[:len(protoFrame)-1]},
+		{"protobuf other type", protobufCodec{}, bytes.Replace(protoFrame, []byte(envelopeMessage), []byte("receipt"), 1)},
+		{"protobuf no message", protobufCodec{}, protowire.AppendString(protowire.AppendTag(nil, envelopeTypeField, protowire.BytesType), envelopeMessage)},
+	} {
+		if _, err := tc.codec.decode(tc.data); err == nil {
+			t.Errorf("%s: decode succeeded, want an error", tc.name)
+		}
+	}
+}
+
+// Fields added to wire.proto later are skipped by decoders that don't know them
+func TestWireProtobufUnknownFields(t *testing.T) {
+	msg := wireFixtures[1].msg
+	inner := appendProtoMessage(nil, msg)
+	inner = protowire.AppendTag(inner, 15, protowire.VarintType)
+	inner = protowire.AppendVarint(inner, 42)
+	inner = protowire.AppendTag(inner, 16, protowire.BytesType)
+	inner = protowire.AppendString(inner, "later")
+	data := protowire.AppendTag(nil, envelopeTypeField, protowire.BytesType)
+	data = protowire.AppendString(data, envelopeMessage)
+	data = protowire.AppendTag(data, 3, protowire.Fixed64Type)
+	data = protowire.AppendFixed64(data, 7)
+	data = protowire.AppendTag(data, envelopeMessageField, protowire.BytesType)
+	data = protowire.AppendBytes(data, inner)
+
+	got, err := protobufCodec{}.decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("decoded %s, want %s", describe(got), describe(msg))
+	}
+}
+
+// Returns n messages like those in a busy chat: short lines of text from a handful of senders
+// across many rooms, one in ten with an attachment
+func sampleMessages(n int) []Message {
+	words := strings.Fields("the quick brown fox jumps over lazy dog deploy failed again build green " +
+		"review merged ticket lunch meeting tomorrow thanks sounds good see you there ok")
+	rng := rand.New(rand.NewSource(1))
+	msgs := make([]Message, n)
+	for i := range msgs {
+		text := make([]string, 3+rng.Intn(20))
+		for j := range text {
+			text[j] = words[rng.Intn(len(words))]
+		}
+		msgs[i] = Message{
+			Sender:      strPtr(fmt.Sprintf("user-%d", rng.Intn(50))),
+			Epoch:       int64Ptr(1704067200 + int64(i)),
+			MessageText: strPtr(strings.Join(text, " ")),
+			RoomName:    strPtr(fmt.Sprintf("room-%d", rng.Intn(200))),
+		}
+		if i%10 == 0 {
+			id := make([]byte, 32)
+			rng.Read(id)
+			msgs[i].Attachment = &Attachment{
+				ID: hex.EncodeToString(id), Name: "screenshot.png", ContentType: "image/png",
+				Size: int64(20000 + rng.Intn(500000)), Width: 1280, Height: 720,
+			}
+		}
+	}
+	return msgs
+}
+
+func BenchmarkWireEncode(b *testing.B) {
+	sample := sampleMessages(1000)
+	for _, codec := range testCodecs() {
+		b.Run(codec.name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.encode(sample[i%len(sample)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWireDecode(b *testing.B) {
+	sample := sampleMessages(1000)
+	for _, codec := range testCodecs() {
+		frames := make([][]byte, len(sample))
+		for i, msg := range sample {
+			var err error
+			if frames[i], err = codec.encode(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(codec.name(), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.decode(frames[i%len(frames)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+#!/usr/bin/env bash
+# Runs the cluster conformance test (Client/conformance), which starts two servers sharing one SQLite
+# database and a NATS broker and checks that room events posted to one reach members connected to
+# the other.
+#
+# NATS is taken from the first of:
+#   - GOCHAT_TEST_NATS_URL, a NATS server the checks may publish to
+#   - nats-server on the PATH (go install github.com/nats-io/nats-server/v2@latest)
+#   - a nats container, when docker is available
+set -euo pipefail
+
+root=$(cd "$(dirname "$0")/.." && pwd)
+work=$(mktemp -d)
+pids=()
+container=""
+
+cleanup() {
+	for pid in "${pids[@]}"; do
+		kill "$pid" 2>/dev/null || true
+		wait "$pid" 2>/dev/null || true
+	done
+	if [ -n "$container" ]; then
+		docker rm -f "$container" >/dev/null 2>&1 || true
+	fi
+	rm -rf "$work"
+}
+trap cleanup EXIT
+
+natsurl=${GOCHAT_TEST_NATS_URL:-}
+if [ -z "$natsurl" ] && command -v nats-server >/dev/null; then
+	nats-server -a 127.0.0.1 -p 14222 >"$work/nats.log" 2>&1 &
+	pids+=("$!")
+	natsurl=nats://127.0.0.1:14222
+elif [ -z "$natsurl" ] && command -v docker >/dev/null; then
+	container=$(docker run -d --rm -p 127.0.0.1:14222:4222 nats:2)
+	natsurl=nats://127.0.0.1:14222
+fi
+if [ -z "$natsurl" ]; then
+	echo "no NATS server: set GOCHAT_TEST_NATS_URL, or install nats-server or docker" >&2
+	exit 1
+fi
+if [ -z "${GOCHAT_TEST_NATS_URL:-}" ]; then
+	# The servers fail to start if NATS isn't listening yet
+	for _ in $(seq 100); do
+		(echo >/dev/tcp/127.0.0.1/14222) 2>/dev/null && break
+		sleep 0.1
+	done
+fi
+
+cd "$root/Client"
+GOCHAT_TEST_NATS_URL=$natsurl go test -count=1 -v -run TestCluster ./conformance